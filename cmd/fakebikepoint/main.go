@@ -0,0 +1,81 @@
+// Command fakebikepoint serves a simulated TfL /BikePoint API, for running the
+// exporter offline, and load testing it against misbehaving upstreams.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint/bikepointtest"
+)
+
+func main() {
+	if err := app(context.Background()); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func app(ctx context.Context) error {
+	listenAddr := flag.String("listen", ":9723", "the address and port to bind the web server to")
+	stations := flag.Int("stations", 800, "the number of stations to simulate")
+	seed := flag.Uint64("seed", 1, "seed for the random number generator, for reproducible runs")
+	latency := flag.Duration("latency", 0, "the minimum time to wait before responding")
+	jitter := flag.Duration("jitter", 0, "the maximum additional, random time to wait before responding")
+	churn := flag.Float64("churn", 0.05, "the probability of each station's availability changing between requests")
+	serverErrorRate := flag.Float64("server-error-rate", 0, "the probability of a burst of 503 responses starting")
+	burstLength := flag.Int("burst-length", 3, "the number of consecutive 503 responses in a burst")
+	rateLimitRate := flag.Float64("rate-limit-rate", 0, "the probability of a 429 response")
+	truncateRate := flag.Float64("truncate-rate", 0, "the probability of a response body being cut off")
+	dripRate := flag.Float64("drip-rate", 0, "the probability of a response body being sent slowly")
+	dripInterval := flag.Duration("drip-interval", 50*time.Millisecond, "the pause between each 4KiB of a slowly sent body")
+	flag.Parse()
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	handler := bikepointtest.NewHandler(
+		bikepointtest.WithStations(*stations),
+		bikepointtest.WithSeed(*seed),
+		bikepointtest.WithLatency(*latency, *jitter),
+		bikepointtest.WithChurn(*churn),
+		bikepointtest.WithFaultRate(bikepointtest.FaultServerError, *serverErrorRate),
+		bikepointtest.WithBurstLength(*burstLength),
+		bikepointtest.WithFaultRate(bikepointtest.FaultRateLimited, *rateLimitRate),
+		bikepointtest.WithFaultRate(bikepointtest.FaultTruncated, *truncateRate),
+		bikepointtest.WithFaultRate(bikepointtest.FaultSlowDrip, *dripRate),
+		bikepointtest.WithDripInterval(*dripInterval),
+	)
+	http.Handle("/BikePoint", handler)
+
+	listenConfig := net.ListenConfig{}
+	listener, err := listenConfig.Listen(ctx, "tcp", *listenAddr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	logger.InfoContext(ctx, "listening",
+		slog.String("endpoint", fmt.Sprintf("http://%v/BikePoint", listener.Addr())))
+
+	server := http.Server{
+		ReadHeaderTimeout: time.Second,
+	}
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		server.Close()
+	}()
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("web server terminated incorrectly: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/config"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/validate"
+)
+
+// maxViolationsShown bounds the number of validation warnings printed, as a
+// broken response could violate a rule at every station.
+const maxViolationsShown = 10
+
+// check implements the `check` subcommand, which validates the configuration
+// and makes one request to TfL, so a new app key or config can be tested
+// before it is deployed. A report is written to w. An error is returned if
+// any step fails.
+func check(ctx context.Context, w io.Writer, args []string) error {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	configFile := fs.String("config", "", "path to an optional YAML configuration file to validate")
+	endpoint := fs.String("endpoint", bikepoint.DefaultEndpoint, "the URL of the /BikePoint resource")
+	timeout := fs.Duration("timeout", 5*time.Second, "how long to spend fetching stations, including retries")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	cfg := config.Default()
+	if *configFile != "" {
+		loaded, err := config.Load(*configFile, tflSystemName)
+		if err != nil {
+			fmt.Fprintf(w, "config: FAILED: %v\n", err)
+			return errors.New("check failed")
+		}
+		cfg = loaded
+		fmt.Fprintf(w, "config: ok, %v probe modules\n", len(cfg.Modules))
+	} else {
+		fmt.Fprintln(w, "config: ok, using defaults")
+	}
+
+	// The report includes any failure, so retries would only be noise.
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelError,
+	}))
+	appKey := os.Getenv("APP_KEY")
+	client := bikepoint.NewClient(logger, http.DefaultClient,
+		bikepoint.WithAppKey(appKey),
+		bikepoint.WithEndpoint(*endpoint),
+		bikepoint.WithRetryPolicy(cfg.Retry))
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+	start := time.Now()
+	stationAvailabilities, err := client.FetchStationAvailabilities(ctx)
+	latency := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		fmt.Fprintf(w, "fetch: FAILED after %v: %v (%v)\n", latency, err, bikepoint.ClassOf(err))
+	} else {
+		fmt.Fprintf(w, "fetch: ok, %v stations in %v\n", len(stationAvailabilities), latency)
+	}
+	fmt.Fprintf(w, "auth: %v\n", authStatus(appKey, err))
+	if err != nil {
+		return errors.New("check failed")
+	}
+
+	violations := cfg.Validation.Check(stationAvailabilities)
+	_, _, err = validate.New(cfg.Validation).Validate(tflSystemName, stationAvailabilities)
+	switch {
+	case err != nil:
+		fmt.Fprintf(w, "validation: FAILED: %v\n", err)
+	case len(violations) > 0:
+		fmt.Fprintf(w, "validation: ok, %v warnings\n", len(violations))
+	default:
+		fmt.Fprintln(w, "validation: ok")
+	}
+	for i, violation := range violations {
+		if i == maxViolationsShown {
+			fmt.Fprintf(w, "  and %v more\n", len(violations)-i)
+			break
+		}
+		fmt.Fprintf(w, "  %v\n", violation)
+	}
+	if err != nil {
+		return errors.New("check failed")
+	}
+	return nil
+}
+
+// authStatus describes what the result of a fetch says about the app key.
+func authStatus(appKey string, err error) string {
+	var statusErr *bikepoint.StatusError
+	switch {
+	case err == nil && appKey == "":
+		return "no app key, so anonymous rate limits apply"
+	case err == nil:
+		return "app key accepted"
+	case errors.As(err, &statusErr) &&
+		(statusErr.StatusCode == http.StatusUnauthorized || statusErr.StatusCode == http.StatusForbidden):
+		if appKey == "" {
+			return fmt.Sprintf("FAILED: anonymous access rejected with HTTP %v", statusErr.StatusCode)
+		}
+		return fmt.Sprintf("FAILED: app key rejected with HTTP %v", statusErr.StatusCode)
+	}
+	return "unknown, as the request failed"
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint/bikepointtest"
+)
+
+func TestCheck(t *testing.T) {
+	t.Parallel()
+
+	fake := bikepointtest.NewServer(bikepointtest.WithStations(50))
+	defer fake.Close()
+	forbidden := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid app_key", http.StatusForbidden)
+	}))
+	defer forbidden.Close()
+
+	dir := t.TempDir()
+	writeConfig := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	invalid := writeConfig("invalid.yml", "modules:\n  tfl:\n    provider: citybikes\n")
+	strict := writeConfig("strict.yml", "validation:\n  min_stations: 100\n  policies:\n    min_stations: fail\n")
+	valid := writeConfig("valid.yml", "modules:\n  london: {}\n")
+
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+		want    []string
+	}{
+		{
+			name: "healthy",
+			args: []string{"-endpoint", fake.URL, "-config", valid},
+			want: []string{"config: ok, 1 probe modules", "fetch: ok, 50 stations", "validation: ok"},
+		},
+		{
+			name:    "invalid config",
+			args:    []string{"-endpoint", fake.URL, "-config", invalid},
+			wantErr: true,
+			want:    []string{"config: FAILED"},
+		},
+		{
+			name:    "rejected",
+			args:    []string{"-endpoint", forbidden.URL},
+			wantErr: true,
+			want:    []string{"fetch: FAILED", "http_4xx", "rejected with HTTP 403"},
+		},
+		{
+			name:    "validation",
+			args:    []string{"-endpoint", fake.URL, "-config", strict},
+			wantErr: true,
+			want:    []string{"validation: FAILED", "min_stations (fail): got 50 stations"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			err := check(context.Background(), buf, test.args)
+			if (err != nil) != test.wantErr {
+				t.Errorf("wanted error %v, got %v", test.wantErr, err)
+			}
+			for _, want := range test.want {
+				if !strings.Contains(buf.String(), want) {
+					t.Errorf("report does not contain %q:\n%v", want, buf)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthStatus(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		appKey string
+		err    error
+		want   string
+	}{
+		{"anonymous", "", nil, "no app key, so anonymous rate limits apply"},
+		{"accepted", "key", nil, "app key accepted"},
+		{"rejected", "key", bikepoint.NewStatusError(http.StatusUnauthorized, ""), "FAILED: app key rejected with HTTP 401"},
+		{"anonymous rejected", "", bikepoint.NewStatusError(http.StatusForbidden, ""), "FAILED: anonymous access rejected with HTTP 403"},
+		{"server error", "key", bikepoint.NewStatusError(http.StatusBadGateway, ""), "unknown, as the request failed"},
+		{"network", "key", errors.New("connection refused"), "unknown, as the request failed"},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			if got := authStatus(test.appKey, test.err); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -6,24 +6,53 @@ import (
 	"flag"
 	"fmt"
 	"log/slog"
+	"maps"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/gebn/tflcycles_exporter/internal/pkg/audit"
 	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/config"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/events"
 	"github.com/gebn/tflcycles_exporter/internal/pkg/exporter"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/gbfs"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/graphite"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/history"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/influx"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/notify"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/otlp"
 	"github.com/gebn/tflcycles_exporter/internal/pkg/promutil"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/recording"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/remotewrite"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/requestid"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/validate"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/watch"
 
 	"github.com/gebn/go-stamp/v2"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
+// tflSystemName is the value of the `system` label for TfL's stations.
+const tflSystemName = "tfl"
+
+// notifyShutdownTimeout bounds how long shutdown waits for notifications to
+// be delivered, including retries.
+const notifyShutdownTimeout = 30 * time.Second
+
 var (
 	buildInfo = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -35,7 +64,23 @@ var (
 )
 
 func main() {
-	if err := app(context.Background()); err != nil {
+	ctx := context.Background()
+	run := app
+	if len(os.Args) > 1 {
+		// Subcommands have their own flags, so are dispatched before the
+		// exporter's are parsed.
+		switch os.Args[1] {
+		case "check":
+			run = func(ctx context.Context) error {
+				return check(ctx, os.Stdout, os.Args[2:])
+			}
+		case "stations":
+			run = func(ctx context.Context) error {
+				return stations(ctx, os.Stdout, os.Args[2:])
+			}
+		}
+	}
+	if err := run(ctx); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
@@ -47,6 +92,50 @@ func app(ctx context.Context) error {
 	showVersion := flag.Bool("version", false, "print the exporter version and exit")
 	isDebug := flag.Bool("debug", false, "enable verbose, human-readable logging")
 	listenAddr := flag.String("listen", ":9722", "the address and port to bind the web server to")
+	configFile := flag.String("config", "", "path to an optional YAML configuration file defining /probe modules")
+	scrapeTimeoutMargin := flag.Duration("scrape-timeout-margin", 500*time.Millisecond, "how long before Prometheus's scrape timeout to stop retrying, to leave time to respond")
+	timestamps := flag.Bool("timestamps", false, "attach each station's last-modified time to its samples")
+	nativeHistograms := flag.Bool("native-histograms", false, "expose the exporter's latency histograms as native histograms as well as classic buckets")
+	systemLabel := flag.Bool("system-label", false, "add the system label to /stations series even if TfL is the only system exported; always added with -gbfs")
+	recordDir := flag.String("record", "", "directory in which to save every /BikePoint response, for later replay")
+	recordMaxExchanges := flag.Int("record-max-exchanges", 0, "number of responses to keep in -record, deleting the oldest; unlimited if 0")
+	recordMaxBytes := flag.Int64("record-max-bytes", 1<<30, "total size of responses to keep in -record, deleting the oldest; unlimited if 0")
+	replayDir := flag.String("replay", "", "directory of recorded /BikePoint responses to serve instead of calling TfL")
+	pollInterval := flag.Duration("poll-interval", time.Minute, "how often to fetch every system's availability in the background, for history, notifications, events, remote-write, OTLP and Graphite")
+	historyDir := flag.String("history-dir", "", "directory in which to store TfL's availability over time, served by /api/v1/stations/{id}/history; disabled if empty")
+	historyRetention := flag.Duration("history-retention", 7*24*time.Hour, "how long to keep history for")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "URL of an OpenTelemetry collector to push metrics to, e.g. http://localhost:4318; disabled if empty")
+	otlpProtocol := flag.String("otlp-protocol", otlp.ProtocolHTTP, "protocol for -otlp-endpoint: http/protobuf or grpc")
+	otlpInterval := flag.Duration("otlp-interval", time.Minute, "how often to push metrics to -otlp-endpoint")
+	auditLogPath := flag.String("audit-log", "", "file to append a JSON record of every fetch to, giving its request ID, attempts and outcome; disabled if empty")
+	auditLogMaxSize := flag.Int64("audit-log-max-size", 100, "size in MiB at which to rotate -audit-log; at least 1")
+	auditLogMaxBackups := flag.Int("audit-log-max-backups", 5, "number of rotated -audit-log files to keep")
+	traceExporter := flag.String("trace-exporter", "", "where to send trace spans of scrapes and requests to TfL: otlp, to -otlp-endpoint, or stdout; disabled if empty")
+	enableEvents := flag.Bool("events", false, "stream changes to TfL's stations as Server-Sent Events at /api/v1/events")
+	remoteWriteURL := flag.String("remote-write-url", "", "Prometheus remote-write endpoint to push /stations series to every -poll-interval; disabled if empty")
+	graphiteAddr := flag.String("graphite-address", "", "host:port of a Graphite plaintext listener to push stations to every -poll-interval, e.g. localhost:2003; disabled if empty")
+	graphitePrefix := flag.String("graphite-prefix", "tflcycles", "path under which to push to -graphite-address")
+	remoteWriteLabels := map[string]string{}
+	flag.Func("remote-write-label", "a label to add to remote-written series, as name=value, e.g. instance=pi; can be repeated", func(s string) error {
+		name, value, ok := strings.Cut(s, "=")
+		if !ok || name == "" {
+			return errors.New("must be of the form name=value")
+		}
+		remoteWriteLabels[name] = value
+		return nil
+	})
+	gbfsSystems := map[string]string{}
+	flag.Func("gbfs", "a GBFS system to export alongside TfL, as name=url of its gbfs.json; can be repeated", func(s string) error {
+		name, url, ok := strings.Cut(s, "=")
+		if !ok || name == "" || url == "" {
+			return errors.New("must be of the form name=url")
+		}
+		if _, ok := gbfsSystems[name]; ok || name == tflSystemName {
+			return fmt.Errorf("duplicate system name %q", name)
+		}
+		gbfsSystems[name] = url
+		return nil
+	})
 	flag.Parse()
 
 	if *showVersion {
@@ -57,49 +146,312 @@ func app(ctx context.Context) error {
 	logger := buildLogger(*isDebug)
 	slog.SetDefault(logger)
 
+	bikePointHTTPClient, err := buildBikePointHTTPClient(logger, *recordDir, *replayDir,
+		recording.WithMaxExchanges(*recordMaxExchanges),
+		recording.WithMaxBytes(*recordMaxBytes))
+	if err != nil {
+		return err
+	}
+
+	cfg := config.Default()
+	if *configFile != "" {
+		// Modules must not share state with the systems of /stations.
+		reserved := append([]string{tflSystemName}, slices.Collect(maps.Keys(gbfsSystems))...)
+		loaded, err := config.Load(*configFile, reserved...)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		cfg = loaded
+	}
+
 	indexHandler, err := buildIndexHandler(logger)
 	if err != nil {
 		return err
 	}
 	http.Handle("/{$}", indexHandler)
 
+	// The exporter's own metrics, exposed on /metrics and pushed over OTLP.
+	gatherer := prometheus.DefaultGatherer
+	if !*nativeHistograms {
+		gatherer = promutil.WithoutNativeHistograms(gatherer)
+	}
 	metricsHandler := promhttp.HandlerFor(
-		prometheus.DefaultGatherer,
+		gatherer,
 		promutil.HandlerOptsWithLogger(logger),
 	)
 	http.Handle("/metrics", metricsHandler)
 
-	stationsHandler := exporter.NewExporter(
-		logger,
-		bikepoint.NewClient(
-			logger,
-			http.DefaultClient,
-			bikepoint.WithAppKey(os.Getenv("APP_KEY")),
-		),
+	exporterOpts := []exporter.ExporterOption{
+		exporter.WithScrapeTimeoutMargin(*scrapeTimeoutMargin),
+		exporter.WithValidator(validate.New(cfg.Validation)),
+	}
+	if *timestamps {
+		exporterOpts = append(exporterOpts, exporter.WithTimestamps())
+	}
+	if *systemLabel {
+		exporterOpts = append(exporterOpts, exporter.WithSystemLabel())
+	}
+	if *auditLogPath != "" {
+		// Smaller sizes would rotate on almost every write.
+		if *auditLogMaxSize < 1 {
+			return fmt.Errorf("-audit-log-max-size must be at least 1 MiB, got %v", *auditLogMaxSize)
+		}
+		auditLog, err := audit.OpenLog(*auditLogPath,
+			audit.WithMaxSize(*auditLogMaxSize<<20),
+			audit.WithMaxBackups(*auditLogMaxBackups))
+		if err != nil {
+			return fmt.Errorf("failed to open audit log: %w", err)
+		}
+		defer auditLog.Close()
+		exporterOpts = append(exporterOpts, exporter.WithAuditLog(auditLog))
+	}
+	systems := []exporter.System{
+		{
+			Name: tflSystemName,
+			Provider: bikepoint.NewClient(
+				logger,
+				bikePointHTTPClient,
+				bikepoint.WithAppKey(os.Getenv("APP_KEY")),
+				bikepoint.WithRetryPolicy(cfg.Retry),
+				bikepoint.WithCircuitBreaker(cfg.CircuitBreaker),
+			),
+		},
+	}
+	for name, url := range gbfsSystems {
+		systems = append(systems, exporter.System{
+			Name:     name,
+			Provider: gbfs.NewClient(logger, http.DefaultClient, url),
+		})
+	}
+	stationsHandler := exporter.NewExporter(logger, systems, exporterOpts...)
+	http.Handle("/stations", requestid.Wrap(stationsHandler))
+	http.Handle("/stations.influx", requestid.Wrap(influx.NewHandler(logger, stationsHandler.Fetch)))
+
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.Debug("opentelemetry error", slog.String("error", err.Error()))
+	}))
+	if *traceExporter != "" {
+		tracerProvider, err := buildTracerProvider(ctx, *traceExporter, *otlpEndpoint, *otlpProtocol)
+		if err != nil {
+			return fmt.Errorf("failed to start tracing: %w", err)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+			if err := tracerProvider.Shutdown(ctx); err != nil {
+				logger.Error("failed to flush spans", slog.String("error", err.Error()))
+			}
+		}()
+		otel.SetTracerProvider(tracerProvider)
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	}
+
+	// Observers of the stations of every system, polled in the background.
+	var observers []watch.SystemsObserver
+
+	if *otlpEndpoint != "" {
+		// Pushes send the latest poll, rather than fetching stations again.
+		var polled atomic.Pointer[prometheus.Registry]
+		observers = append(observers, watch.SystemsObserverFunc(
+			func(_ context.Context, _ time.Time, systems map[string][]bikepoint.StationAvailability) {
+				polled.Store(stationsHandler.Registry(systems))
+			}))
+		pusher, err := otlp.NewPusher(ctx, logger, *otlpEndpoint,
+			func(context.Context) prometheus.Gatherer {
+				gatherers := prometheus.Gatherers{gatherer}
+				if reg := polled.Load(); reg != nil {
+					gatherers = append(gatherers, reg)
+				}
+				return gatherers
+			},
+			otlp.WithProtocol(*otlpProtocol),
+			otlp.WithInterval(*otlpInterval))
+		if err != nil {
+			return fmt.Errorf("failed to start OTLP pusher: %w", err)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(ctx, *otlpInterval)
+			defer cancel()
+			if err := pusher.Shutdown(ctx); err != nil {
+				logger.Error("failed to stop OTLP pusher", slog.String("error", err.Error()))
+			}
+		}()
+	}
+
+	if *remoteWriteURL != "" {
+		writer := remotewrite.NewWriter(logger, http.DefaultClient, *remoteWriteURL,
+			remotewrite.WithTimeout(*pollInterval),
+			remotewrite.WithExternalLabels(remoteWriteLabels))
+		observers = append(observers, watch.SystemsObserverFunc(
+			func(ctx context.Context, t time.Time, systems map[string][]bikepoint.StationAvailability) {
+				writer.Enqueue(ctx, stationsHandler.Registry(systems), t)
+			}))
+		writeCtx, cancel := context.WithCancel(ctx)
+		written := make(chan struct{})
+		go func() {
+			defer close(written)
+			writer.Run(writeCtx)
+		}()
+		defer func() {
+			cancel()
+			<-written
+		}()
+	}
+
+	if *graphiteAddr != "" {
+		pusher := graphite.NewPusher(logger, *graphiteAddr,
+			graphite.WithPrefix(*graphitePrefix))
+		observers = append(observers, pusher)
+		pushCtx, cancel := context.WithCancel(ctx)
+		pushed := make(chan struct{})
+		go func() {
+			defer close(pushed)
+			pusher.Run(pushCtx)
+		}()
+		defer func() {
+			cancel()
+			<-pushed
+		}()
+	}
+
+	probeHandler := exporter.NewProber(
+		stationsHandler,
+		cfg.ProbeModules(logger, http.DefaultClient),
 	)
-	http.Handle("/stations", stationsHandler)
+	http.Handle("/probe", requestid.Wrap(probeHandler))
 
-	return listenAndServe(ctx, logger, *listenAddr)
+	if *historyDir != "" {
+		store, err := history.Open(logger, *historyDir,
+			history.WithRetention(*historyRetention))
+		if err != nil {
+			return fmt.Errorf("failed to open history: %w", err)
+		}
+		// Deferred first, so the store is closed after the poller stops.
+		defer func() {
+			if err := store.Close(); err != nil {
+				logger.Error("failed to close history", slog.String("error", err.Error()))
+			}
+		}()
+		http.Handle("/api/v1/stations/{id}/history", history.NewHandler(logger, store))
+		observers = append(observers, watch.ForSystem(tflSystemName, store))
+	}
+	if len(cfg.Notifications.Rules) > 0 {
+		notifier := notify.New(logger, http.DefaultClient, cfg.Notifications)
+		// Deferred first, so deliveries are drained after the poller stops.
+		defer func() {
+			ctx, cancel := context.WithTimeout(ctx, notifyShutdownTimeout)
+			defer cancel()
+			if err := notifier.Shutdown(ctx); err != nil {
+				logger.Error("abandoned undelivered notifications", slog.String("error", err.Error()))
+			}
+		}()
+		observers = append(observers, watch.ForSystem(tflSystemName, notifier))
+	}
+	var onShutdown []func()
+	if *enableEvents {
+		broker := events.NewBroker(logger)
+		// Streams never become idle, so must be ended for shutdown to finish.
+		onShutdown = append(onShutdown, broker.Close)
+		http.Handle("/api/v1/events", events.NewHandler(logger, broker))
+		observers = append(observers, watch.ForSystem(tflSystemName, broker))
+	}
+	if len(observers) > 0 {
+		pollCtx, cancel := context.WithCancel(ctx)
+		polled := make(chan struct{})
+		go func() {
+			defer close(polled)
+			watch.Poll(pollCtx, logger, stationsHandler.Fetch, *pollInterval, observers...)
+		}()
+		defer func() {
+			cancel()
+			<-polled
+		}()
+	}
+
+	return listenAndServe(ctx, logger, *listenAddr, onShutdown...)
+}
+
+// buildBikePointHTTPClient returns the client to use for TfL's API, which
+// records or replays responses if a directory is provided.
+func buildBikePointHTTPClient(logger *slog.Logger, recordDir, replayDir string, recordOpts ...recording.RecorderOption) (*http.Client, error) {
+	switch {
+	case recordDir != "" && replayDir != "":
+		return nil, errors.New("-record and -replay are mutually exclusive")
+	case recordDir != "":
+		if err := os.MkdirAll(recordDir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create recording directory: %w", err)
+		}
+		return &http.Client{
+			Transport: recording.NewRecorder(logger, http.DefaultTransport, recordDir, recordOpts...),
+		}, nil
+	case replayDir != "":
+		replayer, err := recording.NewReplayer(replayDir, recording.WithDelay())
+		if err != nil {
+			return nil, fmt.Errorf("failed to load recordings: %w", err)
+		}
+		return &http.Client{
+			Transport: replayer,
+		}, nil
+	}
+	return http.DefaultClient, nil
+}
+
+// buildTracerProvider returns a provider sending spans to the named exporter:
+// "otlp", which sends to the collector at otlpEndpoint, or "stdout", which
+// writes them as JSON. The OTEL_TRACES_SAMPLER environment variable can be
+// used to sample a subset of traces.
+func buildTracerProvider(ctx context.Context, exporter, otlpEndpoint, otlpProtocol string) (*sdktrace.TracerProvider, error) {
+	var spanExporter sdktrace.SpanExporter
+	switch exporter {
+	case "otlp":
+		if otlpEndpoint == "" {
+			return nil, errors.New("-trace-exporter otlp requires -otlp-endpoint")
+		}
+		otlpExporter, err := otlp.NewTraceExporter(ctx, otlpEndpoint, otlpProtocol)
+		if err != nil {
+			return nil, err
+		}
+		spanExporter = otlpExporter
+	case "stdout":
+		stdoutExporter, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return nil, err
+		}
+		spanExporter = stdoutExporter
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+	res, err := otlp.NewResource(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(res),
+	), nil
 }
 
 // buildLogger creates a suitable logger for the provided mode. If debugging is
 // disabled, which will typically be the case, the logger is suitable for
 // production: JSON format, info level. If debugging is enabled, we instead log
-// for direct human interpretation, at debug level.
+// for direct human interpretation, at debug level. Either way, records logged
+// while handling a request include its ID.
 //
 // Note the parameter to this function is not simply a log level, as it also
 // influences the format.
 func buildLogger(isDebug bool) *slog.Logger {
 	if isDebug {
 		// Uses the logfmt standard.
-		return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		return slog.New(requestid.NewLogHandler(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
 			Level: slog.LevelDebug,
-		}))
+		})))
 	}
-	return slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	return slog.New(requestid.NewLogHandler(slog.NewJSONHandler(os.Stderr, nil)))
 }
 
-func listenAndServe(ctx context.Context, logger *slog.Logger, addr string) error {
+// listenAndServe serves the default mux until SIGINT or SIGTERM, calling
+// onShutdown when shutdown begins.
+func listenAndServe(ctx context.Context, logger *slog.Logger, addr string, onShutdown ...func()) error {
 	listenConfig := net.ListenConfig{}
 	listener, err := listenConfig.Listen(ctx, "tcp", addr)
 	if err != nil {
@@ -113,6 +465,9 @@ func listenAndServe(ctx context.Context, logger *slog.Logger, addr string) error
 		// This is above the max recommended scrape interval of 2m.
 		IdleTimeout: 3 * time.Minute,
 	}
+	for _, f := range onShutdown {
+		server.RegisterOnShutdown(f)
+	}
 
 	shutdown := make(chan error)
 	go func() {
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+)
+
+// earthRadiusMetres is the mean radius of the Earth.
+const earthRadiusMetres = 6371008.8
+
+const stationsUsage = `usage: tflcycles_exporter stations <command> [flags] [args]
+
+Commands:
+  list                      print every station
+  get <id|name>             print the station with an ID, or whose name contains the argument
+  nearest -lat -lon [-n 5]  print the closest stations to a point
+
+Run a command with -help for its flags.`
+
+// stationRow is a station to print, with its distance from the point of
+// interest if relevant.
+type stationRow struct {
+	bikepoint.StationAvailability
+	distance float64
+}
+
+// stationJSON is the JSON representation of a station.
+type stationJSON struct {
+	ID                string   `json:"id"`
+	Name              string   `json:"name"`
+	Docks             int      `json:"docks"`
+	DocksAvailable    int      `json:"docks_available"`
+	BicyclesAvailable int      `json:"bicycles_available"`
+	EBikesAvailable   int      `json:"ebikes_available"`
+	Lat               float64  `json:"lat"`
+	Lon               float64  `json:"lon"`
+	Modified          string   `json:"modified,omitempty"`
+	DistanceMetres    *float64 `json:"distance_metres,omitempty"`
+}
+
+// stations implements the `stations` subcommand, for ad-hoc queries of TfL's
+// current availability from the terminal. Output is written to w.
+func stations(ctx context.Context, w io.Writer, args []string) error {
+	if len(args) == 0 {
+		return errors.New(stationsUsage)
+	}
+	command, args := args[0], args[1:]
+
+	fs := flag.NewFlagSet("stations "+command, flag.ContinueOnError)
+	format := fs.String("format", "table", "output format: table, json or csv")
+	endpoint := fs.String("endpoint", bikepoint.DefaultEndpoint, "the URL of the /BikePoint resource")
+	timeout := fs.Duration("timeout", 10*time.Second, "how long to spend fetching stations, including retries")
+	var lat, lon *float64
+	var n *int
+	switch command {
+	case "list", "get":
+	case "nearest":
+		lat = fs.Float64("lat", math.NaN(), "the latitude of the point, in degrees")
+		lon = fs.Float64("lon", math.NaN(), "the longitude of the point, in degrees")
+		n = fs.Int("n", 5, "the number of stations to print")
+	default:
+		return fmt.Errorf("unknown command %q\n\n%v", command, stationsUsage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	switch *format {
+	case "table", "json", "csv":
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	var query string
+	switch command {
+	case "get":
+		if fs.NArg() != 1 {
+			return errors.New("usage: tflcycles_exporter stations get [flags] <id|name>")
+		}
+		query = fs.Arg(0)
+	case "nearest":
+		if math.IsNaN(*lat) || math.IsNaN(*lon) {
+			return errors.New("-lat and -lon are required")
+		}
+		if *n < 1 {
+			return errors.New("-n must be at least 1")
+		}
+		fallthrough
+	default:
+		if fs.NArg() != 0 {
+			return fmt.Errorf("unexpected arguments: %v", fs.Args())
+		}
+	}
+
+	// Retries are logged at warn level, which would be noise here; the
+	// returned error explains any failure.
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelError,
+	}))
+	client := bikepoint.NewClient(logger, http.DefaultClient,
+		bikepoint.WithAppKey(os.Getenv("APP_KEY")),
+		bikepoint.WithEndpoint(*endpoint))
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+	stationAvailabilities, err := client.FetchStationAvailabilities(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch stations: %w", err)
+	}
+
+	var rows []stationRow
+	switch command {
+	case "list":
+		rows = listStations(stationAvailabilities)
+	case "get":
+		rows = getStations(stationAvailabilities, query)
+		if len(rows) == 0 {
+			return fmt.Errorf("no station has ID %q or a name containing it", query)
+		}
+	case "nearest":
+		rows = nearestStations(stationAvailabilities, *lat, *lon, *n)
+	}
+	withDistance := command == "nearest"
+
+	switch *format {
+	case "json":
+		return writeStationsJSON(w, rows, withDistance)
+	case "csv":
+		return writeStationsCSV(w, rows, withDistance)
+	}
+	return writeStationsTable(w, rows, withDistance)
+}
+
+func listStations(stationAvailabilities []bikepoint.StationAvailability) []stationRow {
+	rows := make([]stationRow, 0, len(stationAvailabilities))
+	for _, sa := range stationAvailabilities {
+		rows = append(rows, stationRow{StationAvailability: sa})
+	}
+	return rows
+}
+
+// getStations returns the station with the provided ID if there is one, or
+// otherwise those whose name contains the query. Matching is
+// case-insensitive.
+func getStations(stationAvailabilities []bikepoint.StationAvailability, query string) []stationRow {
+	for _, sa := range stationAvailabilities {
+		if strings.EqualFold(sa.Station.ID, query) {
+			return []stationRow{{StationAvailability: sa}}
+		}
+	}
+	query = strings.ToLower(query)
+	var rows []stationRow
+	for _, sa := range stationAvailabilities {
+		if strings.Contains(strings.ToLower(sa.Station.Name), query) {
+			rows = append(rows, stationRow{StationAvailability: sa})
+		}
+	}
+	return rows
+}
+
+// nearestStations returns up to n stations closest to the point, nearest
+// first.
+func nearestStations(stationAvailabilities []bikepoint.StationAvailability, lat, lon float64, n int) []stationRow {
+	rows := make([]stationRow, 0, len(stationAvailabilities))
+	for _, sa := range stationAvailabilities {
+		rows = append(rows, stationRow{
+			StationAvailability: sa,
+			distance:            distanceMetres(lat, lon, sa.Station.Lat, sa.Station.Lon),
+		})
+	}
+	slices.SortStableFunc(rows, func(a, b stationRow) int {
+		switch {
+		case a.distance < b.distance:
+			return -1
+		case a.distance > b.distance:
+			return 1
+		}
+		return 0
+	})
+	return rows[:min(n, len(rows))]
+}
+
+// distanceMetres returns the great-circle distance between two points using
+// the haversine formula. This is accurate to within 0.5% at London's scale.
+func distanceMetres(lat1, lon1, lat2, lon2 float64) float64 {
+	radians := func(degrees float64) float64 {
+		return degrees * math.Pi / 180
+	}
+	dLat := radians(lat2 - lat1)
+	dLon := radians(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(radians(lat1))*math.Cos(radians(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusMetres * math.Asin(math.Sqrt(a))
+}
+
+func writeStationsTable(w io.Writer, rows []stationRow, withDistance bool) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	header := "ID\tNAME\tDOCKS\tEMPTY\tBIKES\tE-BIKES"
+	if withDistance {
+		header += "\tDISTANCE"
+	}
+	fmt.Fprintln(tw, header)
+	for _, row := range rows {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v",
+			row.Station.ID, row.Station.Name, row.Station.Docks,
+			row.Availability.Docks, row.Availability.Bicycles, row.Availability.EBikes)
+		if withDistance {
+			fmt.Fprintf(tw, "\t%.0fm", row.distance)
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
+
+func writeStationsJSON(w io.Writer, rows []stationRow, withDistance bool) error {
+	out := make([]stationJSON, 0, len(rows))
+	for _, row := range rows {
+		station := stationJSON{
+			ID:                row.Station.ID,
+			Name:              row.Station.Name,
+			Docks:             row.Station.Docks,
+			DocksAvailable:    row.Availability.Docks,
+			BicyclesAvailable: row.Availability.Bicycles,
+			EBikesAvailable:   row.Availability.EBikes,
+			Lat:               row.Station.Lat,
+			Lon:               row.Station.Lon,
+			Modified:          formatModified(row.Modified),
+		}
+		if withDistance {
+			station.DistanceMetres = &row.distance
+		}
+		out = append(out, station)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+func writeStationsCSV(w io.Writer, rows []stationRow, withDistance bool) error {
+	cw := csv.NewWriter(w)
+	header := []string{"id", "name", "docks", "docks_available", "bicycles_available",
+		"ebikes_available", "lat", "lon", "modified"}
+	if withDistance {
+		header = append(header, "distance_metres")
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		record := []string{
+			row.Station.ID,
+			row.Station.Name,
+			strconv.Itoa(row.Station.Docks),
+			strconv.Itoa(row.Availability.Docks),
+			strconv.Itoa(row.Availability.Bicycles),
+			strconv.Itoa(row.Availability.EBikes),
+			strconv.FormatFloat(row.Station.Lat, 'f', -1, 64),
+			strconv.FormatFloat(row.Station.Lon, 'f', -1, 64),
+			formatModified(row.Modified),
+		}
+		if withDistance {
+			record = append(record, strconv.FormatFloat(row.distance, 'f', 0, 64))
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// formatModified returns t in RFC 3339 format, or an empty string if it is
+// zero, as the modification time was unknown.
+func formatModified(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint/bikepointtest"
+)
+
+func TestStations(t *testing.T) {
+	t.Parallel()
+
+	server := bikepointtest.NewServer(bikepointtest.WithStations(50))
+	defer server.Close()
+	want := server.StationAvailabilities()
+
+	run := func(t *testing.T, args ...string) []stationJSON {
+		t.Helper()
+		args = append(args[:1:1], append([]string{"-endpoint", server.URL, "-format", "json"}, args[1:]...)...)
+		buf := &bytes.Buffer{}
+		if err := stations(context.Background(), buf, args); err != nil {
+			t.Fatal(err)
+		}
+		var got []stationJSON
+		if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+			t.Fatalf("failed to decode %s: %v", buf.Bytes(), err)
+		}
+		return got
+	}
+
+	t.Run("list", func(t *testing.T) {
+		got := run(t, "list")
+		if len(got) != len(want) {
+			t.Fatalf("got %v stations, want %v", len(got), len(want))
+		}
+		for i := range got {
+			if got[i].ID != want[i].Station.ID || got[i].BicyclesAvailable != want[i].Availability.Bicycles ||
+				got[i].DistanceMetres != nil {
+				t.Errorf("station %v: got %+v, want %+v", i, got[i], want[i])
+			}
+		}
+	})
+	t.Run("get id", func(t *testing.T) {
+		got := run(t, "get", strings.ToLower(want[3].Station.ID))
+		if len(got) != 1 || got[0].ID != want[3].Station.ID {
+			t.Errorf("got %+v, want only %v", got, want[3].Station.ID)
+		}
+	})
+	t.Run("get name", func(t *testing.T) {
+		got := run(t, "get", strings.ToUpper(want[3].Station.Name))
+		if len(got) == 0 {
+			t.Fatal("no stations returned")
+		}
+		for _, station := range got {
+			if !strings.Contains(station.Name, want[3].Station.Name) {
+				t.Errorf("%q does not contain %q", station.Name, want[3].Station.Name)
+			}
+		}
+	})
+	t.Run("nearest", func(t *testing.T) {
+		target := want[7].Station
+		got := run(t, "nearest", "-lat", "51.5", "-lon", "-0.1", "-n", "3")
+		if len(got) != 3 {
+			t.Fatalf("got %v stations, want 3", len(got))
+		}
+		for i := 1; i < len(got); i++ {
+			if *got[i].DistanceMetres < *got[i-1].DistanceMetres {
+				t.Errorf("stations not in order of distance: %+v", got)
+			}
+		}
+		got = run(t, "nearest", "-n", "1",
+			"-lat", strconv.FormatFloat(target.Lat, 'f', -1, 64),
+			"-lon", strconv.FormatFloat(target.Lon, 'f', -1, 64))
+		if *got[0].DistanceMetres != 0 {
+			t.Errorf("nearest station to %v is %v away", target.ID, *got[0].DistanceMetres)
+		}
+	})
+	t.Run("get no match", func(t *testing.T) {
+		err := stations(context.Background(), &bytes.Buffer{},
+			[]string{"get", "-endpoint", server.URL, "Nowhere In Particular"})
+		if err == nil || !strings.Contains(err.Error(), "no station") {
+			t.Errorf("wanted no station error, got %v", err)
+		}
+	})
+	t.Run("csv", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		if err := stations(context.Background(), buf, []string{"nearest", "-endpoint", server.URL,
+			"-format", "csv", "-lat", "51.5", "-lon", "-0.1", "-n", "2"}); err != nil {
+			t.Fatal(err)
+		}
+		records, err := csv.NewReader(buf).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 3 || records[0][len(records[0])-1] != "distance_metres" {
+			t.Errorf("got %v, want header and 2 stations with distances", records)
+		}
+	})
+	t.Run("table", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		if err := stations(context.Background(), buf, []string{"list", "-endpoint", server.URL}); err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Count(buf.String(), "\n"); lines != len(want)+1 {
+			t.Errorf("got %v lines, want %v", lines, len(want)+1)
+		}
+	})
+}
+
+func TestWriteStationsJSON_Modified(t *testing.T) {
+	t.Parallel()
+
+	modified := bikepoint.StationAvailability{}
+	modified.Modified = time.Date(2024, time.March, 4, 8, 0, 0, 500, time.UTC)
+	buf := &bytes.Buffer{}
+	if err := writeStationsJSON(buf, []stationRow{
+		{StationAvailability: modified},
+		{},
+	}, false); err != nil {
+		t.Fatal(err)
+	}
+	var got []map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got[0]["modified"] != "2024-03-04T08:00:00.0000005Z" {
+		t.Errorf("got modified %v", got[0]["modified"])
+	}
+	if _, ok := got[1]["modified"]; ok {
+		t.Errorf("wanted unknown modified time omitted, got %v", got[1]["modified"])
+	}
+}
+
+func TestStations_Errors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"no command", nil},
+		{"unknown command", []string{"delete"}},
+		{"unknown format", []string{"list", "-format", "xml"}},
+		{"get without argument", []string{"get"}},
+		{"nearest without point", []string{"nearest", "-lat", "51.5"}},
+		{"nearest zero", []string{"nearest", "-lat", "51.5", "-lon", "0", "-n", "0"}},
+		{"list with argument", []string{"list", "extra"}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			if err := stations(context.Background(), &bytes.Buffer{}, test.args); err == nil {
+				t.Error("wanted error")
+			}
+		})
+	}
+}
+
+func TestDistanceMetres(t *testing.T) {
+	t.Parallel()
+
+	// Trafalgar Square to St Paul's Cathedral is about 2.2km.
+	got := distanceMetres(51.5080, -0.1281, 51.5138, -0.0984)
+	if math.Abs(got-2160) > 50 {
+		t.Errorf("got %v, want about 2160", got)
+	}
+}
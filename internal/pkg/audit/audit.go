@@ -0,0 +1,83 @@
+// Package audit records the outcome of each fetch as a line of JSON, giving
+// the attempts made, their responses and the result. Unlike logs, a record is
+// written for every fetch, including those that succeed first time.
+package audit
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Attempt describes a single request to an upstream API.
+type Attempt struct {
+	URL string `json:"url"`
+
+	// Status is the HTTP status code of the response, or 0 if none was
+	// received.
+	Status int `json:"status,omitempty"`
+
+	// Bytes is the size of the response body read, which is less than its
+	// full size if reading failed.
+	Bytes    int64   `json:"bytes"`
+	Duration float64 `json:"duration_seconds"`
+	Error    string  `json:"error,omitempty"`
+	Class    string  `json:"class,omitempty"`
+}
+
+// Record describes a fetch of a system's stations, including any retries.
+type Record struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	TraceID   string    `json:"trace_id,omitempty"`
+	System    string    `json:"system"`
+	Duration  float64   `json:"duration_seconds"`
+	Attempts  []Attempt `json:"attempts"`
+	Stations  int       `json:"stations"`
+	Error     string    `json:"error,omitempty"`
+	Class     string    `json:"class,omitempty"`
+
+	// mu guards Attempts, which may be added to concurrently if a provider
+	// makes several requests at once.
+	mu sync.Mutex
+}
+
+// AddAttempt appends an attempt to the record. It does nothing if r is nil,
+// so providers can call it regardless of whether the fetch is being audited.
+func (r *Record) AddAttempt(a Attempt) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Attempts = append(r.Attempts, a)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying r, to which providers add their
+// attempts.
+func NewContext(ctx context.Context, r *Record) context.Context {
+	return context.WithValue(ctx, contextKey{}, r)
+}
+
+// FromContext returns the record carried by ctx, or nil if the fetch is not
+// being audited.
+func FromContext(ctx context.Context) *Record {
+	r, _ := ctx.Value(contextKey{}).(*Record)
+	return r
+}
+
+// CountingReader counts the bytes read from the underlying reader, for
+// Attempt.Bytes.
+type CountingReader struct {
+	io.Reader
+	N int64
+}
+
+func (r *CountingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.N += int64(n)
+	return n, err
+}
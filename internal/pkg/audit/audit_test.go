@@ -0,0 +1,188 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecord_AddAttempt(t *testing.T) {
+	t.Parallel()
+
+	// Fetches that are not audited have no record.
+	FromContext(context.Background()).AddAttempt(Attempt{Status: 200})
+
+	r := &Record{}
+	ctx := NewContext(context.Background(), r)
+	FromContext(ctx).AddAttempt(Attempt{Status: 503})
+	FromContext(ctx).AddAttempt(Attempt{Status: 200})
+	if len(r.Attempts) != 2 || r.Attempts[0].Status != 503 || r.Attempts[1].Status != 200 {
+		t.Errorf("unexpected attempts: %+v", r.Attempts)
+	}
+}
+
+// readRecords decodes every record in the file at path.
+func readRecords(t *testing.T, path string) []*Record {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []*Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		r := &Record{}
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			t.Fatalf("invalid line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestLog_Write(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := OpenLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Record{
+		Time:      time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		RequestID: "abc",
+		System:    "tfl",
+		Duration:  1.5,
+		Attempts: []Attempt{
+			{Status: 503, Bytes: 10, Duration: .5, Error: "got HTTP 503", Class: "http_5xx"},
+			{Status: 200, Bytes: 1000, Duration: .25},
+		},
+		Stations: 800,
+	}
+	if err := l.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Write(want); err == nil {
+		t.Error("wanted error writing to closed log")
+	}
+
+	// Reopening appends.
+	l, err = OpenLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := l.Write(&Record{System: "other"}); err != nil {
+		t.Fatal(err)
+	}
+
+	records := readRecords(t, path)
+	if len(records) != 2 {
+		t.Fatalf("wanted 2 records, got %v", len(records))
+	}
+	got := records[0]
+	if !got.Time.Equal(want.Time) || got.RequestID != want.RequestID || got.Stations != want.Stations ||
+		len(got.Attempts) != 2 || got.Attempts[0] != want.Attempts[0] || got.Attempts[1] != want.Attempts[1] {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if records[1].System != "other" {
+		t.Errorf("wanted appended record, got %+v", records[1])
+	}
+}
+
+func TestLog_Rotate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		maxBackups  int
+		wantBackups []int // number of records in path.1, path.2, ...
+	}{
+		{
+			name:        "backups",
+			maxBackups:  2,
+			wantBackups: []int{1, 1},
+		},
+		{
+			name:       "no backups",
+			maxBackups: 0,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(t.TempDir(), "audit.log")
+			// Each record is larger than this, so every write after the
+			// first rotates.
+			l, err := OpenLog(path, WithMaxSize(10), WithMaxBackups(test.maxBackups))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			for _, system := range []string{"a", "b", "c", "d"} {
+				if err := l.Write(&Record{System: system}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if records := readRecords(t, path); len(records) != 1 || records[0].System != "d" {
+				t.Errorf("wanted only the newest record in current file, got %+v", records)
+			}
+			for i, want := range test.wantBackups {
+				records := readRecords(t, l.backup(i+1))
+				// Backups are newest first: c, then b.
+				if len(records) != want || records[0].System != string(rune('c'-i)) {
+					t.Errorf("unexpected records in backup %v: %+v", i+1, records)
+				}
+			}
+			if _, err := os.Stat(l.backup(len(test.wantBackups) + 1)); !os.IsNotExist(err) {
+				t.Errorf("wanted at most %v backups, got %v", len(test.wantBackups), err)
+			}
+		})
+	}
+}
+
+func TestLog_RotateFailed(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := OpenLog(path, WithMaxSize(10), WithMaxBackups(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// The current file cannot be moved onto a non-empty directory.
+	if err := os.MkdirAll(filepath.Join(l.backup(1), "blocker"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Write(&Record{System: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Write(&Record{System: "b"}); err == nil {
+		t.Fatal("wanted rotation error")
+	}
+
+	// The log remains open, and rotates once the obstruction is removed.
+	if err := os.RemoveAll(l.backup(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Write(&Record{System: "c"}); err != nil {
+		t.Fatalf("wanted write after failed rotation to succeed, got %v", err)
+	}
+	if records := readRecords(t, l.backup(1)); len(records) != 2 || records[1].System != "b" {
+		t.Errorf("wanted record written despite failed rotation, got %+v", records)
+	}
+	if records := readRecords(t, path); len(records) != 1 || records[0].System != "c" {
+		t.Errorf("wanted only the newest record in current file, got %+v", records)
+	}
+}
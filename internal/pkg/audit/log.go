@@ -0,0 +1,160 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// LogOption customises a Log.
+type LogOption func(*Log)
+
+// WithMaxSize sets the size in bytes the file can reach before it is rotated.
+// It must be positive, and defaults to 100 MiB.
+func WithMaxSize(bytes int64) LogOption {
+	return func(l *Log) {
+		l.MaxSize = bytes
+	}
+}
+
+// WithMaxBackups sets how many rotated files are kept, named path.1 (the
+// newest) to path.n. It defaults to 5. If 0, the file is truncated instead.
+func WithMaxBackups(n int) LogOption {
+	return func(l *Log) {
+		l.MaxBackups = n
+	}
+}
+
+// Log appends records to a file as JSON lines, rotating it when it reaches a
+// maximum size. It is safe for concurrent use. Create instances with
+// OpenLog().
+type Log struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// OpenLog opens the file at path for appending, creating it if it does not
+// exist. Call Close() when done.
+func OpenLog(path string, opts ...LogOption) (*Log, error) {
+	l := &Log{
+		Path:       path,
+		MaxSize:    100 << 20,
+		MaxBackups: 5,
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the current file, recording its size.
+func (l *Log) open() error {
+	file, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// Write appends a record to the file, first rotating it if the record would
+// take it over the maximum size.
+func (l *Log) Write(r *Record) error {
+	r.mu.Lock()
+	b, err := json.Marshal(r)
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return errors.New("audit log is closed")
+	}
+	// A record larger than the limit is still written, to an empty file.
+	var rotateErr error
+	if l.size > 0 && l.size+int64(len(b)) > l.MaxSize {
+		if err := l.rotate(); err != nil {
+			rotateErr = fmt.Errorf("failed to rotate audit log: %w", err)
+			if l.file == nil {
+				return rotateErr
+			}
+			// The record is appended to the current file, and rotation
+			// retried by the next write.
+		}
+	}
+	n, err := l.file.Write(b)
+	l.size += int64(n)
+	return errors.Join(rotateErr, err)
+}
+
+// rotate shifts each backup up a number, dropping the oldest, then moves the
+// current file to path.1 and opens a new one. The file at path is reopened
+// even if shifting fails, so the log is only left closed if that fails too.
+func (l *Log) rotate() error {
+	err := l.shift()
+	if openErr := l.open(); openErr != nil {
+		return errors.Join(err, openErr)
+	}
+	return err
+}
+
+// shift closes the current file, then moves it and the backups out of the
+// way.
+func (l *Log) shift() error {
+	err := l.file.Close()
+	l.file = nil
+	if err != nil {
+		return err
+	}
+	if l.MaxBackups > 0 {
+		for i := l.MaxBackups - 1; i >= 1; i-- {
+			err := os.Rename(l.backup(i), l.backup(i+1))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+		if err := os.Rename(l.Path, l.backup(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(l.Path); err != nil {
+		return err
+	}
+	return nil
+}
+
+// backup returns the path of the nth newest rotated file.
+func (l *Log) backup(n int) string {
+	return fmt.Sprintf("%v.%v", l.Path, n)
+}
+
+// Close closes the file. Subsequent writes fail.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
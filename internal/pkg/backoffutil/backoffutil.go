@@ -0,0 +1,40 @@
+// Package backoffutil contains helpers for retrying with the backoff library.
+package backoffutil
+
+import (
+	"context"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+// deadlineBackOff stops retrying once waiting would take it past a deadline.
+type deadlineBackOff struct {
+	backoff.BackOff
+	deadline time.Time
+	now      func() time.Time
+}
+
+func (b deadlineBackOff) NextBackOff() time.Duration {
+	next := b.BackOff.NextBackOff()
+	if next == backoff.Stop || !b.now().Add(next).Before(b.deadline) {
+		return backoff.Stop
+	}
+	return next
+}
+
+// WithContext returns a policy that stops when the context is cancelled, and,
+// if the context has a deadline, will not wait beyond it. Without the latter,
+// the final wait can outlive the context, so the caller only notices it has
+// run out of time once the wait ends, rather than returning the last error
+// immediately.
+func WithContext(b backoff.BackOff, ctx context.Context) backoff.BackOffContext {
+	if deadline, ok := ctx.Deadline(); ok {
+		b = deadlineBackOff{
+			BackOff:  b,
+			deadline: deadline,
+			now:      time.Now,
+		}
+	}
+	return backoff.WithContext(b, ctx)
+}
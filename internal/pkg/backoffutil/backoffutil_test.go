@@ -0,0 +1,94 @@
+package backoffutil
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+func TestDeadlineBackOff_NextBackOff(t *testing.T) {
+	now := time.Date(2024, 10, 18, 10, 5, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		interval time.Duration
+		deadline time.Time
+		want     time.Duration
+	}{
+		{
+			name:     "well before deadline",
+			interval: time.Second,
+			deadline: now.Add(time.Minute),
+			want:     time.Second,
+		},
+		{
+			name:     "ends at deadline",
+			interval: time.Second,
+			deadline: now.Add(time.Second),
+			want:     backoff.Stop,
+		},
+		{
+			name:     "ends after deadline",
+			interval: 2 * time.Second,
+			deadline: now.Add(time.Second),
+			want:     backoff.Stop,
+		},
+		{
+			name:     "deadline passed",
+			interval: 0,
+			deadline: now.Add(-time.Second),
+			want:     backoff.Stop,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			b := deadlineBackOff{
+				BackOff:  backoff.NewConstantBackOff(test.interval),
+				deadline: test.deadline,
+				now: func() time.Time {
+					return now
+				},
+			}
+			if got := b.NextBackOff(); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWithContext(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	attempts := 0
+	start := time.Now()
+	err := backoff.Retry(
+		func() error {
+			attempts++
+			return errTest
+		},
+		WithContext(backoff.NewConstantBackOff(60*time.Millisecond), ctx),
+	)
+	if err != errTest {
+		t.Errorf("wanted last operation error, got %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("wanted 2 attempts, got %v", attempts)
+	}
+	if elapsed := time.Since(start); elapsed >= 100*time.Millisecond {
+		t.Errorf("returned after %v, beyond the deadline", elapsed)
+	}
+}
+
+type testError struct{}
+
+func (testError) Error() string {
+	return "test"
+}
+
+var errTest = testError{}
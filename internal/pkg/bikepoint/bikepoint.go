@@ -5,11 +5,14 @@
 package bikepoint
 
 import (
-	"encoding/json"
+	"fmt"
 	"regexp"
-	"strconv"
+	"time"
 )
 
+// lockedProperty is the additionalProperty indicating a station is closed.
+const lockedProperty = "Locked"
+
 var (
 	// propertyMappings provides an efficient way to take a given
 	// additionalProperty in the response and find the corresponding field on a
@@ -33,6 +36,10 @@ var (
 // Station contains relatively-stable metadata about a docking point.
 type Station struct {
 
+	// ID uniquely identifies the docking point within its system, e.g.
+	// "BikePoints_1". It is taken from the `id` field of the JSON.
+	ID string
+
 	// Name is the human-readable location of the docking point, e.g.
 	// "Stonecutter Street, Holborn". It is taken from the `commonName` field
 	// of the JSON.
@@ -42,6 +49,10 @@ type Station struct {
 	// including those out of service. It is taken from the `NbDocks` property
 	// of the JSON.
 	Docks int
+
+	// Lat and Lon are the WGS 84 coordinates of the docking point, in
+	// degrees. They are taken from the `lat` and `lon` fields of the JSON.
+	Lat, Lon float64
 }
 
 // Availability represents the hire and drop-off services available at a
@@ -62,6 +73,11 @@ type Availability struct {
 	// EBikes is the number of in-service, electric bikes available for hire.
 	// It is taken from the `NbEBikes` property.
 	EBikes int
+
+	// Locked indicates bikes can neither be hired from nor returned to the
+	// station, e.g. during maintenance. It is taken from the `Locked`
+	// property.
+	Locked bool
 }
 
 // StationAvailability represents the occupancy of bikes at a particular
@@ -70,23 +86,14 @@ type Availability struct {
 type StationAvailability struct {
 	Station
 	Availability
-}
-
-type (
-	place struct {
-		CommonName           string               `json:"commonName"`
-		AdditionalProperties []additionalProperty `json:"additionalProperties"`
-	}
 
-	additionalProperty struct {
-		Key   string `json:"key"`
-		Value string `json:"value"`
-
-		// We do not interpret `modified` as it is too fraught - the Unified
-		// API may miss if a bike was rented and returned within the same time
-		// interval and not update the timestamp.
-	}
-)
+	// Modified is the latest `modified` time of the properties used to
+	// populate the struct. It is the zero value if none were provided, or any
+	// could not be parsed. Note the Unified API may not advance this if a bike
+	// was rented and returned between its polls of the docking point, so it
+	// should not be relied upon to detect changes.
+	Modified time.Time
+}
 
 var (
 	whitespaceBeforeComma = regexp.MustCompile(`\s+,`)
@@ -99,26 +106,47 @@ func normaliseCommonName(commonName string) string {
 	return whitespaceBeforeComma.ReplaceAllString(commonName, ",")
 }
 
-func (sa *StationAvailability) UnmarshalJSON(b []byte) error {
-	p := place{}
-	if err := json.Unmarshal(b, &p); err != nil {
-		return err
-	}
+// PropertyError indicates a station could not be decoded due to an invalid
+// value. It is returned wrapped in an *Error of class ClassValidation. The rest
+// of the response may still be usable.
+type PropertyError struct {
+
+	// ID is the ID of the station, if it could be decoded.
+	ID string
 
-	sa.Station.Name = normaliseCommonName(p.CommonName)
+	// Key is the additionalProperty key, or name of the JSON field, with the
+	// invalid value.
+	Key string
+
+	Err error
+}
 
-	for _, ap := range p.AdditionalProperties {
-		mapping, ok := propertyMappings[ap.Key]
-		if !ok {
-			continue
-		}
-		field := mapping(sa)
+func (e *PropertyError) Error() string {
+	return fmt.Sprintf("%v of station %v: %v", e.Key, e.ID, e.Err)
+}
+
+func (e *PropertyError) Unwrap() error {
+	return e.Err
+}
 
-		value, err := strconv.Atoi(ap.Value)
-		if err != nil {
-			return err
-		}
-		*field = value
+func newPropertyError(id, key string, err error) error {
+	return &Error{
+		Class: ClassValidation,
+		Err: &PropertyError{
+			ID:  id,
+			Key: key,
+			Err: err,
+		},
+	}
+}
+
+// UnmarshalJSON decodes a single station, as returned by `/BikePoint/{id}`. If
+// a value cannot be interpreted, the returned error wraps a *PropertyError.
+func (sa *StationAvailability) UnmarshalJSON(b []byte) error {
+	d := decoder{}
+	d.reset(b)
+	if err := d.decodeStation(sa); err != nil {
+		return err
 	}
-	return nil
+	return d.end()
 }
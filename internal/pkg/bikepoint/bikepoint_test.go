@@ -0,0 +1,164 @@
+package bikepoint
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+var whitespaceBeforeCommaAnywhere = regexp.MustCompile(`\s,`)
+
+func TestNormaliseCommonName(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"Stonecutter Street, Holborn", "Stonecutter Street, Holborn"},
+		{"River Street , Clerkenwell", "River Street, Clerkenwell"},
+		{"Kennington Road  , Vauxhall", "Kennington Road, Vauxhall"},
+		{"Tab\t, Newline\n, Both", "Tab, Newline, Both"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.input, func(t *testing.T) {
+			t.Parallel()
+			if got := normaliseCommonName(test.input); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func FuzzNormaliseCommonName(f *testing.F) {
+	for _, seed := range []string{
+		"Stonecutter Street, Holborn",
+		"Kennington Road  , Vauxhall",
+		" , ,, \t,",
+		" ,",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, name string) {
+		normalised := normaliseCommonName(name)
+		if whitespaceBeforeCommaAnywhere.MatchString(normalised) {
+			t.Errorf("%q normalised to %q, which has whitespace before a comma", name, normalised)
+		}
+		if again := normaliseCommonName(normalised); again != normalised {
+			t.Errorf("not idempotent: %q normalised to %q, then %q", name, normalised, again)
+		}
+		if stripSpace(normalised) != stripSpace(name) {
+			t.Errorf("%q normalised to %q, which differs by more than whitespace", name, normalised)
+		}
+	})
+}
+
+// stripSpace removes the characters matched by \s.
+func stripSpace(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\n', '\f', '\r':
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// marshalPlace encodes a station in the Unified API's format.
+func marshalPlace(sa StationAvailability) ([]byte, error) {
+	type additionalProperty struct {
+		Key      string `json:"key"`
+		Value    string `json:"value"`
+		Modified string `json:"modified,omitempty"`
+	}
+	var modified string
+	if !sa.Modified.IsZero() {
+		modified = sa.Modified.Format(time.RFC3339Nano)
+	}
+	property := func(key string, value int) additionalProperty {
+		return additionalProperty{
+			Key:      key,
+			Value:    strconv.Itoa(value),
+			Modified: modified,
+		}
+	}
+	properties := []additionalProperty{
+		property("NbDocks", sa.Station.Docks),
+		property("NbEmptyDocks", sa.Availability.Docks),
+		property("NbStandardBikes", sa.Availability.Bicycles),
+		property("NbEBikes", sa.Availability.EBikes),
+		{
+			Key:   lockedProperty,
+			Value: strconv.FormatBool(sa.Availability.Locked),
+		},
+	}
+	return json.Marshal(struct {
+		ID                   string               `json:"id"`
+		CommonName           string               `json:"commonName"`
+		Lat                  float64              `json:"lat"`
+		Lon                  float64              `json:"lon"`
+		AdditionalProperties []additionalProperty `json:"additionalProperties"`
+	}{
+		ID:                   sa.Station.ID,
+		CommonName:           sa.Station.Name,
+		Lat:                  sa.Station.Lat,
+		Lon:                  sa.Station.Lon,
+		AdditionalProperties: properties,
+	})
+}
+
+func FuzzStationAvailability_UnmarshalJSON(f *testing.F) {
+	// Real stations, to give the fuzzer the structure of the payload.
+	var places []json.RawMessage
+	if err := json.Unmarshal(loadFixture(f), &places); err != nil {
+		f.Fatal(err)
+	}
+	for _, place := range places[:20] {
+		f.Add([]byte(place))
+	}
+	for _, seed := range []string{
+		`{}`,
+		`{"id": null, "commonName": "A , B", "additionalProperties": null}`,
+		`{"id": "BikePoints_1", "additionalProperties": [{"key": "NbDocks", "value": "-1", "modified": "2024-01-02T03:04:05+01:00"}]}`,
+		`{"id": "BikePoints_1", "additionalProperties": [{"key": "NbDocks", "value": 1}]}`,
+		`{"commonName": "é🚲 ,\tx"}`,
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		sa := StationAvailability{}
+		err := json.Unmarshal(b, &sa)
+		if err != nil {
+			var propertyErr *PropertyError
+			if errors.As(err, &propertyErr) && ClassOf(err) != ClassValidation {
+				t.Errorf("property error not classed as %v: %v", ClassValidation, err)
+			}
+			return
+		}
+		if whitespaceBeforeCommaAnywhere.MatchString(sa.Station.Name) {
+			t.Errorf("name %q has whitespace before a comma", sa.Station.Name)
+		}
+		// Prometheus rejects label values that are not valid UTF-8.
+		if !utf8.ValidString(sa.Station.ID) || !utf8.ValidString(sa.Station.Name) {
+			t.Errorf("invalid UTF-8 in ID %q or name %q", sa.Station.ID, sa.Station.Name)
+		}
+
+		encoded, err := marshalPlace(sa)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTripped := StationAvailability{}
+		if err := json.Unmarshal(encoded, &roundTripped); err != nil {
+			t.Fatalf("failed to decode %s: %v", encoded, err)
+		}
+		if roundTripped.Station != sa.Station || roundTripped.Availability != sa.Availability ||
+			!roundTripped.Modified.Equal(sa.Modified) {
+			t.Errorf("round trip via %s changed %+v to %+v", encoded, sa, roundTripped)
+		}
+	})
+}
@@ -0,0 +1,493 @@
+// Package bikepointtest provides a fake TfL /BikePoint API for integration and
+// load testing. It serves simulated stations in the Unified API's format, and
+// can reproduce the failure modes we have seen in production: latency, bursts
+// of 5xx errors, rate limiting, truncated bodies and slow drips.
+package bikepointtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+)
+
+// Fault is a way in which a response can fail.
+type Fault int
+
+const (
+	// FaultNone is a successful response.
+	FaultNone Fault = iota
+
+	// FaultServerError responds with 503 Service Unavailable.
+	FaultServerError
+
+	// FaultRateLimited responds with 429 Too Many Requests, as TfL does when
+	// an application exceeds its quota.
+	FaultRateLimited
+
+	// FaultTruncated sends half of the body, then closes the connection.
+	FaultTruncated
+
+	// FaultSlowDrip sends the body in small chunks, pausing between each.
+	FaultSlowDrip
+)
+
+func (f Fault) String() string {
+	switch f {
+	case FaultNone:
+		return "none"
+	case FaultServerError:
+		return "server_error"
+	case FaultRateLimited:
+		return "rate_limited"
+	case FaultTruncated:
+		return "truncated"
+	case FaultSlowDrip:
+		return "slow_drip"
+	}
+	return "Fault(" + strconv.Itoa(int(f)) + ")"
+}
+
+// dripChunkSize is the number of bytes sent at a time by FaultSlowDrip.
+const dripChunkSize = 4096
+
+// Handler is an http.Handler serving a fake /BikePoint response. It is safe for
+// concurrent use. Create instances with NewHandler().
+type Handler struct {
+	stations     int
+	seed         uint64
+	latency      time.Duration
+	jitter       time.Duration
+	churn        float64
+	faultRates   map[Fault]float64
+	burstLength  int
+	dripInterval time.Duration
+
+	mu       sync.Mutex
+	rand     *rand.Rand
+	state    []station
+	nextID   int
+	queued   []Fault
+	burst    int
+	requests int
+}
+
+// station is the simulated state of a docking point.
+type station struct {
+	id         int
+	name       string
+	docks      int
+	emptyDocks int
+	bikes      int
+	eBikes     int
+	modified   time.Time
+}
+
+// Option allows customising the handler's behaviour during construction with
+// NewHandler().
+type Option func(*Handler)
+
+// WithStations sets the number of stations. This is 800 by default, similar
+// to TfL's network.
+func WithStations(n int) Option {
+	return func(h *Handler) {
+		h.stations = n
+	}
+}
+
+// WithSeed sets the seed of the random number generator, making the stations,
+// their churn and random faults reproducible. This is 1 by default.
+func WithSeed(seed uint64) Option {
+	return func(h *Handler) {
+		h.seed = seed
+	}
+}
+
+// WithLatency delays every response by base, plus a uniformly distributed
+// random duration up to jitter.
+func WithLatency(base, jitter time.Duration) Option {
+	return func(h *Handler) {
+		h.latency = base
+		h.jitter = jitter
+	}
+}
+
+// WithChurn sets the probability of each station's availability changing
+// between requests. A tenth of this is the probability of the station being
+// removed, and a new one installed in its place. This is 0 by default, so
+// every response is the same.
+func WithChurn(p float64) Option {
+	return func(h *Handler) {
+		h.churn = p
+	}
+}
+
+// WithFaultRate sets the probability of a response failing in the provided
+// way. A FaultServerError starts a burst of consecutive failures, the length
+// of which can be set with WithBurstLength(). Faults can also be injected
+// deterministically with Handler.Inject().
+func WithFaultRate(fault Fault, p float64) Option {
+	return func(h *Handler) {
+		h.faultRates[fault] = p
+	}
+}
+
+// WithBurstLength sets how many consecutive responses fail once a random
+// FaultServerError occurs. This is 3 by default.
+func WithBurstLength(n int) Option {
+	return func(h *Handler) {
+		h.burstLength = n
+	}
+}
+
+// WithDripInterval sets the pause between each 4KiB chunk of a
+// FaultSlowDrip response. This is 50ms by default, so a response with 800
+// stations takes around 30s.
+func WithDripInterval(d time.Duration) Option {
+	return func(h *Handler) {
+		h.dripInterval = d
+	}
+}
+
+// NewHandler creates a fake /BikePoint API.
+func NewHandler(opts ...Option) *Handler {
+	h := &Handler{
+		stations:     800,
+		seed:         1,
+		faultRates:   make(map[Fault]float64),
+		burstLength:  3,
+		dripInterval: 50 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	h.rand = rand.New(rand.NewPCG(h.seed, h.seed))
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	for i := 0; i < h.stations; i++ {
+		h.state = append(h.state, h.newStation(now))
+	}
+	return h
+}
+
+// newStation installs a station with random availability. The caller must
+// hold mu, or have exclusive access.
+func (h *Handler) newStation(now time.Time) station {
+	h.nextID++
+	// TfL names sometimes contain spurious whitespace before the comma.
+	separator := ","
+	if h.nextID%20 == 0 {
+		separator = " ,"
+	}
+	s := station{
+		id:    h.nextID,
+		name:  fmt.Sprintf("Street %v%v Area %v", h.nextID, separator, h.nextID%37),
+		docks: 10 + h.rand.IntN(40),
+	}
+	h.randomiseAvailability(&s, now)
+	return s
+}
+
+// randomiseAvailability assigns new, consistent availability to a station.
+func (h *Handler) randomiseAvailability(s *station, now time.Time) {
+	broken := h.rand.IntN(3)
+	s.bikes = h.rand.IntN(s.docks - broken + 1)
+	s.eBikes = h.rand.IntN(s.docks - broken - s.bikes + 1)
+	s.emptyDocks = s.docks - broken - s.bikes - s.eBikes
+	s.modified = now
+}
+
+// Inject queues faults for the next responses, in order. Queued faults take
+// precedence over random ones.
+func (h *Handler) Inject(faults ...Fault) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.queued = append(h.queued, faults...)
+}
+
+// Requests returns the number of requests received.
+func (h *Handler) Requests() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.requests
+}
+
+// StationAvailabilities returns what a client should decode from the latest
+// response containing stations, or the initial state if there has not been
+// one, sorted by ID.
+func (h *Handler) StationAvailabilities() []bikepoint.StationAvailability {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stationAvailabilities := make([]bikepoint.StationAvailability, 0, len(h.state))
+	for _, s := range h.sorted() {
+		stationAvailabilities = append(stationAvailabilities, bikepoint.StationAvailability{
+			Station: bikepoint.Station{
+				ID:    stationID(s.id),
+				Name:  strings.ReplaceAll(s.name, " ,", ","),
+				Docks: s.docks,
+				Lat:   s.lat(),
+				Lon:   s.lon(),
+			},
+			Availability: bikepoint.Availability{
+				Docks:    s.emptyDocks,
+				Bicycles: s.bikes,
+				EBikes:   s.eBikes,
+			},
+			Modified: s.modified,
+		})
+	}
+	return stationAvailabilities
+}
+
+// sorted returns the stations ordered by ID string, as TfL does. The caller
+// must hold mu.
+func (h *Handler) sorted() []station {
+	sorted := make([]station, len(h.state))
+	copy(sorted, h.state)
+	slices.SortFunc(sorted, func(a, b station) int {
+		return strings.Compare(stationID(a.id), stationID(b.id))
+	})
+	return sorted
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fault, body, delay := h.next()
+	if err := sleep(r.Context(), delay); err != nil {
+		return
+	}
+
+	switch fault {
+	case FaultServerError:
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("<html><body><h1>503 Service Unavailable</h1></body></html>"))
+		return
+	case FaultRateLimited:
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{ "statusCode": 429, "message": "Rate limit is exceeded. Try again in 30 seconds." }`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	switch fault {
+	case FaultTruncated:
+		// The server closes the connection when the handler returns without
+		// sending the promised length.
+		w.Write(body[:len(body)/2])
+	case FaultSlowDrip:
+		flusher, _ := w.(http.Flusher)
+		for len(body) > 0 {
+			n := min(dripChunkSize, len(body))
+			if _, err := w.Write(body[:n]); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			body = body[n:]
+			if err := sleep(r.Context(), h.dripInterval); err != nil {
+				return
+			}
+		}
+	default:
+		w.Write(body)
+	}
+}
+
+// next advances the simulation for a request, returning how to respond.
+func (h *Handler) next() (Fault, []byte, time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.requests++
+	delay := h.latency
+	if h.jitter > 0 {
+		delay += time.Duration(h.rand.Int64N(int64(h.jitter)))
+	}
+
+	fault := h.nextFault()
+	if fault == FaultServerError || fault == FaultRateLimited {
+		// The body is not needed, and the data does not change.
+		return fault, nil, delay
+	}
+	h.applyChurn()
+	body, err := json.Marshal(h.places())
+	if err != nil {
+		// Our own types always marshal.
+		panic(err)
+	}
+	return fault, body, delay
+}
+
+// nextFault chooses the fault of the next response. The caller must hold mu.
+func (h *Handler) nextFault() Fault {
+	if len(h.queued) > 0 {
+		fault := h.queued[0]
+		h.queued = h.queued[1:]
+		return fault
+	}
+	if h.burst > 0 {
+		h.burst--
+		return FaultServerError
+	}
+	// Iterate in a fixed order, so runs are reproducible.
+	for _, fault := range []Fault{FaultServerError, FaultRateLimited, FaultTruncated, FaultSlowDrip} {
+		if p := h.faultRates[fault]; p > 0 && h.rand.Float64() < p {
+			if fault == FaultServerError {
+				h.burst = h.burstLength - 1
+			}
+			return fault
+		}
+	}
+	return FaultNone
+}
+
+// applyChurn changes the availability of random stations, and replaces some.
+// The caller must hold mu.
+func (h *Handler) applyChurn() {
+	if h.churn <= 0 {
+		return
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	for i := range h.state {
+		switch p := h.rand.Float64(); {
+		case p < h.churn/10:
+			h.state[i] = h.newStation(now)
+		case p < h.churn:
+			h.randomiseAvailability(&h.state[i], now)
+		}
+	}
+}
+
+type (
+	place struct {
+		Type                 string               `json:"$type"`
+		ID                   string               `json:"id"`
+		URL                  string               `json:"url"`
+		CommonName           string               `json:"commonName"`
+		PlaceType            string               `json:"placeType"`
+		AdditionalProperties []additionalProperty `json:"additionalProperties"`
+		Children             []any                `json:"children"`
+		ChildrenURLs         []any                `json:"childrenUrls"`
+		Lat                  float64              `json:"lat"`
+		Lon                  float64              `json:"lon"`
+	}
+
+	additionalProperty struct {
+		Type            string `json:"$type"`
+		Category        string `json:"category"`
+		Key             string `json:"key"`
+		SourceSystemKey string `json:"sourceSystemKey"`
+		Value           string `json:"value"`
+		Modified        string `json:"modified"`
+	}
+)
+
+// places renders the stations in the Unified API's format. The caller must
+// hold mu.
+func (h *Handler) places() []place {
+	places := make([]place, 0, len(h.state))
+	for _, s := range h.sorted() {
+		modified := s.modified.Format("2006-01-02T15:04:05.999Z07:00")
+		property := func(key string, value string) additionalProperty {
+			return additionalProperty{
+				Type:            "Tfl.Api.Presentation.Entities.AdditionalProperties, Tfl.Api.Presentation.Entities",
+				Category:        "Description",
+				Key:             key,
+				SourceSystemKey: "BikePoints",
+				Value:           value,
+				Modified:        modified,
+			}
+		}
+		places = append(places, place{
+			Type:       "Tfl.Api.Presentation.Entities.Place, Tfl.Api.Presentation.Entities",
+			ID:         stationID(s.id),
+			URL:        "/Place/" + stationID(s.id),
+			CommonName: s.name,
+			PlaceType:  "BikePoint",
+			AdditionalProperties: []additionalProperty{
+				property("TerminalName", strconv.Itoa(1000+s.id)),
+				property("Installed", "true"),
+				property("Locked", "false"),
+				property("InstallDate", ""),
+				property("RemovalDate", ""),
+				property("Temporary", "false"),
+				property("NbBikes", strconv.Itoa(s.bikes+s.eBikes)),
+				property("NbEmptyDocks", strconv.Itoa(s.emptyDocks)),
+				property("NbDocks", strconv.Itoa(s.docks)),
+				property("NbStandardBikes", strconv.Itoa(s.bikes)),
+				property("NbEBikes", strconv.Itoa(s.eBikes)),
+			},
+			Children:     []any{},
+			ChildrenURLs: []any{},
+			Lat:          s.lat(),
+			Lon:          s.lon(),
+		})
+	}
+	return places
+}
+
+// lat and lon place stations in a grid around central London.
+func (s station) lat() float64 {
+	return 51.5 + float64(s.id%100)/1000
+}
+
+func (s station) lon() float64 {
+	return -0.1 + float64(s.id%73)/1000
+}
+
+func stationID(id int) string {
+	return "BikePoints_" + strconv.Itoa(id)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Server is a Handler listening on a local port, for use in tests.
+type Server struct {
+	*Handler
+	*httptest.Server
+}
+
+// NewServer starts a fake /BikePoint API. The caller should call Close() when
+// finished, to shut it down. The Server's URL can be passed to
+// bikepoint.WithEndpoint().
+func NewServer(opts ...Option) *Server {
+	handler := NewHandler(opts...)
+	return &Server{
+		Handler: handler,
+		Server:  httptest.NewServer(handler),
+	}
+}
+
+// NewClient returns a bikepoint.Client fetching from the server.
+func (s *Server) NewClient(logger *slog.Logger, opts ...bikepoint.ClientOption) *bikepoint.Client {
+	return bikepoint.NewClient(logger, s.Server.Client(),
+		append([]bikepoint.ClientOption{bikepoint.WithEndpoint(s.URL)}, opts...)...)
+}
@@ -0,0 +1,113 @@
+package bikepointtest
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestServer_FetchStationAvailabilities(t *testing.T) {
+	t.Parallel()
+
+	server := NewServer(WithStations(50), WithChurn(0.5))
+	defer server.Close()
+	client := server.NewClient(slog.Default())
+
+	var previous any
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		got, err := client.FetchStationAvailabilities(ctx)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := server.StationAvailabilities()
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("fetch %v: got %+v, want %+v", i, got, want)
+		}
+		if len(got) != 50 {
+			t.Errorf("fetch %v: wanted 50 stations, got %v", i, len(got))
+		}
+		if reflect.DeepEqual(got, previous) {
+			t.Errorf("fetch %v: stations did not churn", i)
+		}
+		previous = got
+	}
+}
+
+func TestServer_Inject(t *testing.T) {
+	tests := []struct {
+		fault      Fault
+		wantStatus int
+		wantErr    bool
+	}{
+		{
+			fault:      FaultNone,
+			wantStatus: http.StatusOK,
+		},
+		{
+			fault:      FaultServerError,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			fault:      FaultRateLimited,
+			wantStatus: http.StatusTooManyRequests,
+		},
+		{
+			fault:      FaultTruncated,
+			wantStatus: http.StatusOK,
+			wantErr:    true,
+		},
+		{
+			fault:      FaultSlowDrip,
+			wantStatus: http.StatusOK,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.fault.String(), func(t *testing.T) {
+			t.Parallel()
+
+			server := NewServer(WithStations(10), WithDripInterval(time.Millisecond))
+			defer server.Close()
+			server.Inject(test.fault)
+
+			resp, err := server.Server.Client().Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != test.wantStatus {
+				t.Errorf("wanted status %v, got %v", test.wantStatus, resp.StatusCode)
+			}
+			if _, err := io.ReadAll(resp.Body); (err != nil) != test.wantErr {
+				t.Errorf("wanted body error %v, got %v", test.wantErr, err)
+			}
+			if requests := server.Requests(); requests != 1 {
+				t.Errorf("wanted 1 request, got %v", requests)
+			}
+		})
+	}
+}
+
+func TestHandler_FaultRate(t *testing.T) {
+	t.Parallel()
+
+	h := NewHandler(
+		WithStations(1),
+		WithFaultRate(FaultServerError, 1),
+		WithBurstLength(2),
+		WithFaultRate(FaultRateLimited, 1),
+	)
+	// A burst of 2, then the next burst starts immediately.
+	want := []Fault{FaultServerError, FaultServerError, FaultServerError}
+	for i, want := range want {
+		if got, _, _ := h.next(); got != want {
+			t.Errorf("response %v: got %v, want %v", i, got, want)
+		}
+	}
+}
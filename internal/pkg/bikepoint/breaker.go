@@ -0,0 +1,309 @@
+package bikepoint
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ErrCircuitOpen is returned, classified as ClassCircuitOpen, by fetches
+// rejected by an open circuit breaker.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+var (
+	breakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tflcycles_bikepoint_circuit_breaker_state",
+		Help: "The state of the circuit breaker for each /BikePoint endpoint and app key. 1 for the current state, 0 otherwise.",
+	}, []string{"endpoint", "app_key", "state"})
+	breakerTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tflcycles_bikepoint_circuit_breaker_transitions_total",
+		Help: "The number of times the circuit breaker for each /BikePoint endpoint and app key entered each state.",
+	}, []string{"endpoint", "app_key", "state"})
+	breakerRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tflcycles_bikepoint_circuit_breaker_rejections_total",
+		Help: "The number of /BikePoint requests not made because the circuit breaker was open.",
+	}, []string{"endpoint", "app_key"})
+	breakerStaleServed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tflcycles_bikepoint_circuit_breaker_stale_served_total",
+		Help: "The number of fetches that returned the last successful fetch's stations because the circuit breaker was open.",
+	}, []string{"endpoint", "app_key"})
+)
+
+// breakerKey identifies the clients sharing a breaker. Clients with different
+// app keys have their own, as one key being rejected or rate limited says
+// nothing about another.
+type breakerKey struct {
+	endpoint string
+	appKey   string
+}
+
+// breakers holds the breaker of each endpoint and app key, so clients making
+// the same requests share one, as they share the endpoint's health.
+var breakers = struct {
+	sync.Mutex
+	byKey map[breakerKey]*breaker
+}{
+	byKey: make(map[breakerKey]*breaker),
+}
+
+// appKeyID returns the value of the app_key label for an app key: the start
+// of its SHA-256 hash, so keys can be told apart without being exposed, or
+// empty for anonymous access.
+func appKeyID(appKey string) string {
+	if appKey == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(appKey))
+	return hex.EncodeToString(sum[:4])
+}
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState string
+
+const (
+	// BreakerClosed allows every request.
+	BreakerClosed BreakerState = "closed"
+
+	// BreakerOpen rejects every request, until the open duration elapses.
+	BreakerOpen BreakerState = "open"
+
+	// BreakerHalfOpen allows a single probe request, whose result closes or
+	// re-opens the breaker. Others are rejected in the meantime.
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+var breakerStates = []BreakerState{BreakerClosed, BreakerOpen, BreakerHalfOpen}
+
+// BreakerPolicy configures a client's circuit breaker, which stops requests
+// to an API that is consistently failing, rather than every fetch retrying
+// against it.
+type BreakerPolicy struct {
+
+	// FailureThreshold is the number of consecutive failed requests after
+	// which the breaker opens. If 0, the breaker is disabled.
+	FailureThreshold int `yaml:"failure_threshold"`
+
+	// OpenDuration is how long the breaker rejects requests before allowing
+	// a probe.
+	OpenDuration time.Duration `yaml:"open_duration"`
+
+	// ServeStale returns the stations from the last successful fetch while
+	// the breaker is open, rather than failing. Their availability could be
+	// arbitrarily out of date.
+	ServeStale bool `yaml:"serve_stale"`
+}
+
+// DefaultBreakerPolicy returns the policy used unless configured otherwise,
+// in which the breaker is disabled.
+func DefaultBreakerPolicy() BreakerPolicy {
+	return BreakerPolicy{
+		OpenDuration: 30 * time.Second,
+	}
+}
+
+// Validate returns an error if the policy is invalid.
+func (p BreakerPolicy) Validate() error {
+	if p.FailureThreshold < 0 {
+		return errors.New("failure_threshold must not be negative")
+	}
+	if p.OpenDuration <= 0 {
+		return errors.New("open_duration must be positive")
+	}
+	return nil
+}
+
+// breaker is a circuit breaker guarding requests to an endpoint. A nil
+// breaker allows every request.
+type breaker struct {
+	policy BreakerPolicy
+	now    func() time.Time
+
+	// labels are the endpoint and app key ID of the breaker's series.
+	labels []string
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int       // consecutive, while closed
+	openedAt time.Time // when last opened
+	probing  bool      // whether a half-open probe is in flight
+
+	// stale is the last successful fetch's stations, if the policy serves
+	// them while open.
+	stale []StationAvailability
+}
+
+// newBreaker returns the breaker of the endpoint and app key, or nil if the
+// policy disables it. If another client with the same endpoint and app key
+// created a breaker, that one is returned, retaining its policy; a warning is
+// logged if it differs.
+func newBreaker(logger *slog.Logger, policy BreakerPolicy, endpoint, appKey string) *breaker {
+	if policy.FailureThreshold == 0 {
+		return nil
+	}
+	key := breakerKey{
+		endpoint: endpoint,
+		appKey:   appKey,
+	}
+	breakers.Lock()
+	defer breakers.Unlock()
+	if b, ok := breakers.byKey[key]; ok {
+		if b.policy != policy {
+			logger.Warn("ignoring circuit breaker policy, as another client of the endpoint with the same app key has a different one",
+				slog.String("endpoint", endpoint))
+		}
+		return b
+	}
+	b := &breaker{
+		policy: policy,
+		now:    time.Now,
+		labels: []string{endpoint, appKeyID(appKey)},
+		state:  BreakerClosed,
+	}
+	for _, state := range breakerStates {
+		breakerTransitions.WithLabelValues(append(b.labels, string(state))...)
+	}
+	breakerRejections.WithLabelValues(b.labels...)
+	if policy.ServeStale {
+		breakerStaleServed.WithLabelValues(b.labels...)
+	}
+	b.setGauge()
+	breakers.byKey[key] = b
+	return b
+}
+
+// allow returns whether a request can be made. If it returns true, the
+// outcome must be passed to record().
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) < b.policy.OpenDuration {
+			break
+		}
+		b.transition(BreakerHalfOpen)
+		fallthrough
+	case BreakerHalfOpen:
+		if b.probing {
+			break
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+	breakerRejections.WithLabelValues(b.labels...).Inc()
+	return false
+}
+
+// record updates the breaker with the outcome of an allowed request. Failures
+// due to ctx, the fetch's context, ending are not the endpoint's fault, so do
+// not count. Neither do errors such as 4xx responses, which show the endpoint
+// is answering, but not the client's requests, so count as successes.
+func (b *breaker) record(ctx context.Context, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	wasProbe := b.probing
+	b.probing = false
+	switch {
+	case err == nil, ctx.Err() == nil && !isEndpointFailure(err):
+		b.failures = 0
+		if b.state != BreakerClosed {
+			b.transition(BreakerClosed)
+		}
+	case ctx.Err() != nil:
+		// Abandoned; a half-open breaker allows another probe.
+	case b.state == BreakerClosed:
+		b.failures++
+		if b.failures >= b.policy.FailureThreshold {
+			b.open()
+		}
+	case wasProbe:
+		b.open()
+	}
+}
+
+// isEndpointFailure returns whether err indicates the endpoint is unhealthy:
+// a 5xx or 429 response, a network error or timeout, or an undecodable body.
+func isEndpointFailure(err error) bool {
+	switch ClassOf(err) {
+	case ClassHTTP5xx, ClassRateLimited, ClassNetwork, ClassTimeout, ClassDecode:
+		return true
+	}
+	return false
+}
+
+// open opens the breaker, starting the open duration.
+func (b *breaker) open() {
+	b.failures = 0
+	b.openedAt = b.now()
+	b.transition(BreakerOpen)
+}
+
+// transition changes the breaker's state. The caller must hold mu.
+func (b *breaker) transition(state BreakerState) {
+	b.state = state
+	breakerTransitions.WithLabelValues(append(b.labels, string(state))...).Inc()
+	b.setGauge()
+}
+
+func (b *breaker) setGauge() {
+	for _, state := range breakerStates {
+		value := 0.
+		if state == b.state {
+			value = 1
+		}
+		breakerState.WithLabelValues(append(b.labels, string(state))...).Set(value)
+	}
+}
+
+// current returns the breaker's state. A nil breaker is always closed.
+func (b *breaker) current() BreakerState {
+	if b == nil {
+		return BreakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// setStale saves a copy of the stations of a successful fetch, if the policy
+// serves them while open. The caller may go on to modify its slice.
+func (b *breaker) setStale(stationAvailabilities []StationAvailability) {
+	if b == nil || !b.policy.ServeStale {
+		return
+	}
+	stale := slices.Clone(stationAvailabilities)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stale = stale
+}
+
+// getStale returns a copy of the saved stations, or nil if there are none. A
+// non-nil result is counted as served.
+func (b *breaker) getStale() []StationAvailability {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stale == nil {
+		return nil
+	}
+	breakerStaleServed.WithLabelValues(b.labels...).Inc()
+	return append([]StationAvailability(nil), b.stale...)
+}
@@ -0,0 +1,300 @@
+package bikepoint
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBreakerPolicy_Validate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		modify  func(*BreakerPolicy)
+		wantErr bool
+	}{
+		{
+			name:   "default",
+			modify: func(*BreakerPolicy) {},
+		},
+		{
+			name: "enabled",
+			modify: func(p *BreakerPolicy) {
+				p.FailureThreshold = 5
+				p.ServeStale = true
+			},
+		},
+		{
+			name:    "negative threshold",
+			modify:  func(p *BreakerPolicy) { p.FailureThreshold = -1 },
+			wantErr: true,
+		},
+		{
+			name:    "zero open duration",
+			modify:  func(p *BreakerPolicy) { p.OpenDuration = 0 },
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			policy := DefaultBreakerPolicy()
+			test.modify(&policy)
+			if err := policy.Validate(); (err != nil) != test.wantErr {
+				t.Errorf("wanted error %v, got %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(0, 0)
+	b := newBreaker(slog.Default(), BreakerPolicy{
+		FailureThreshold: 2,
+		OpenDuration:     10 * time.Second,
+	}, "TestBreaker", "")
+	b.now = func() time.Time {
+		return now
+	}
+	ctx := context.Background()
+	failure := NewStatusError(http.StatusServiceUnavailable, "")
+	rejected := NewStatusError(http.StatusForbidden, "")
+
+	steps := []struct {
+		name      string
+		advance   time.Duration
+		wantAllow bool
+		err       error
+		wantState BreakerState
+	}{
+		{name: "first failure", wantAllow: true, err: failure, wantState: BreakerClosed},
+		{name: "success resets", wantAllow: true, wantState: BreakerClosed},
+		{name: "failure after reset", wantAllow: true, err: failure, wantState: BreakerClosed},
+		{name: "rejection resets", wantAllow: true, err: rejected, wantState: BreakerClosed},
+		{name: "failure after rejection", wantAllow: true, err: failure, wantState: BreakerClosed},
+		{name: "threshold", wantAllow: true, err: failure, wantState: BreakerOpen},
+		{name: "open", advance: 9 * time.Second, wantState: BreakerOpen},
+		{name: "failed probe", advance: time.Second, wantAllow: true, err: failure, wantState: BreakerOpen},
+		{name: "reopened", advance: 5 * time.Second, wantState: BreakerOpen},
+		{name: "successful probe", advance: 5 * time.Second, wantAllow: true, wantState: BreakerClosed},
+	}
+	for _, step := range steps {
+		now = now.Add(step.advance)
+		allowed := b.allow()
+		if allowed != step.wantAllow {
+			t.Fatalf("%v: wanted allow %v, got %v", step.name, step.wantAllow, allowed)
+		}
+		if allowed {
+			b.record(ctx, step.err)
+		}
+		if got := b.current(); got != step.wantState {
+			t.Fatalf("%v: wanted state %v, got %v", step.name, step.wantState, got)
+		}
+	}
+
+	for state, want := range map[BreakerState]float64{
+		BreakerClosed:   1,
+		BreakerOpen:     2,
+		BreakerHalfOpen: 2,
+	} {
+		if got := testutil.ToFloat64(breakerTransitions.WithLabelValues("TestBreaker", "", string(state))); got != want {
+			t.Errorf("wanted %v transitions to %v, got %v", want, state, got)
+		}
+	}
+	if got := testutil.ToFloat64(breakerRejections.WithLabelValues("TestBreaker", "")); got != 2 {
+		t.Errorf("wanted 2 rejections, got %v", got)
+	}
+}
+
+func TestBreaker_halfOpenSingleProbe(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(0, 0)
+	b := newBreaker(slog.Default(), BreakerPolicy{
+		FailureThreshold: 1,
+		OpenDuration:     time.Second,
+	}, "TestBreaker_halfOpenSingleProbe", "")
+	b.now = func() time.Time {
+		return now
+	}
+	b.allow()
+	b.record(context.Background(), NewStatusError(http.StatusBadGateway, ""))
+
+	now = now.Add(time.Second)
+	if !b.allow() {
+		t.Fatal("wanted probe to be allowed")
+	}
+	if b.allow() {
+		t.Error("wanted second request rejected while probing")
+	}
+
+	// An abandoned probe is not held against the endpoint.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b.record(ctx, ctx.Err())
+	if got := b.current(); got != BreakerHalfOpen {
+		t.Errorf("wanted %v, got %v", BreakerHalfOpen, got)
+	}
+	if !b.allow() {
+		t.Error("wanted another probe to be allowed")
+	}
+}
+
+func TestNewBreaker_shared(t *testing.T) {
+	t.Parallel()
+
+	policy := BreakerPolicy{
+		FailureThreshold: 1,
+		OpenDuration:     time.Minute,
+	}
+	b := newBreaker(slog.Default(), policy, "TestNewBreaker_shared", "key")
+	if other := newBreaker(slog.Default(), policy, "TestNewBreaker_shared", "key"); other != b {
+		t.Error("wanted clients of the same endpoint and app key to share a breaker")
+	}
+	lenient := policy
+	lenient.FailureThreshold = 10
+	if other := newBreaker(slog.Default(), lenient, "TestNewBreaker_shared", "key"); other != b || other.policy != policy {
+		t.Error("wanted the first client's policy to be kept")
+	}
+	if other := newBreaker(slog.Default(), policy, "TestNewBreaker_shared", "other"); other == b {
+		t.Error("wanted clients with different app keys to have their own breaker")
+	}
+	if other := newBreaker(slog.Default(), policy, "TestNewBreaker_shared/other", "key"); other == b {
+		t.Error("wanted clients of different endpoints to have their own breaker")
+	}
+}
+
+func TestBreaker_staleCopied(t *testing.T) {
+	t.Parallel()
+
+	b := newBreaker(slog.Default(), BreakerPolicy{
+		FailureThreshold: 1,
+		OpenDuration:     time.Minute,
+		ServeStale:       true,
+	}, "TestBreaker_staleCopied", "")
+	stationAvailabilities := []StationAvailability{{Station: Station{ID: "1"}}}
+	b.setStale(stationAvailabilities)
+	// The caller's slice may be sorted or filtered after the fetch.
+	stationAvailabilities[0].Station.ID = "2"
+	if got := b.getStale(); got[0].Station.ID != "1" {
+		t.Errorf("wanted saved stations unaffected, got %v", got[0].Station.ID)
+	}
+}
+
+func TestClient_FetchStationAvailabilitiesCircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		serveStale bool
+	}{
+		{
+			name: "fail fast",
+		},
+		{
+			name:       "serve stale",
+			serveStale: true,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			requests := atomic.Int32{}
+			failing := atomic.Bool{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				if failing.Load() {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.Write([]byte(`[
+					{
+						"id": "BikePoints_1",
+						"commonName": "River Street , Clerkenwell",
+						"additionalProperties": [
+							{"key": "NbDocks", "value": "19"},
+							{"key": "NbEmptyDocks", "value": "8"}
+						]
+					}
+				]`))
+			}))
+			defer server.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			client := NewClient(slog.Default(), server.Client(),
+				WithEndpoint(server.URL),
+				WithInitialInterval(time.Millisecond),
+				WithMaxInterval(time.Millisecond),
+				WithMaxAttempts(3),
+				WithCircuitBreaker(BreakerPolicy{
+					FailureThreshold: 2,
+					OpenDuration:     time.Minute,
+					ServeStale:       test.serveStale,
+				}))
+			now := time.Now()
+			client.breaker.now = func() time.Time {
+				return now
+			}
+
+			if _, err := client.FetchStationAvailabilities(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			// The breaker opens during the fetch's retries, whose cause is
+			// returned.
+			failing.Store(true)
+			_, err := client.FetchStationAvailabilities(ctx)
+			if class := ClassOf(err); class != ClassHTTP5xx {
+				t.Errorf("wanted %v error, got %v: %v", ClassHTTP5xx, class, err)
+			}
+			if got := requests.Load(); got != 3 {
+				t.Errorf("wanted 3 requests, got %v", got)
+			}
+			if got := testutil.ToFloat64(breakerState.WithLabelValues(server.URL, "", string(BreakerOpen))); got != 1 {
+				t.Errorf("wanted open gauge to be 1, got %v", got)
+			}
+
+			got, err := client.FetchStationAvailabilities(ctx)
+			if requests.Load() != 3 {
+				t.Error("wanted no request while open")
+			}
+			if test.serveStale {
+				if err != nil || len(got) != 1 {
+					t.Errorf("wanted stale station, got %v, %v", got, err)
+				}
+				if got := testutil.ToFloat64(breakerStaleServed.WithLabelValues(server.URL, "")); got != 1 {
+					t.Errorf("wanted 1 stale fetch served, got %v", got)
+				}
+			} else if !errors.Is(err, ErrCircuitOpen) || ClassOf(err) != ClassCircuitOpen {
+				t.Errorf("wanted %v error, got %v", ClassCircuitOpen, err)
+			}
+
+			// The probe succeeds, closing the breaker.
+			failing.Store(false)
+			now = now.Add(time.Minute)
+			if _, err := client.FetchStationAvailabilities(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if got := requests.Load(); got != 4 {
+				t.Errorf("wanted 4 requests, got %v", got)
+			}
+			if got := testutil.ToFloat64(breakerState.WithLabelValues(server.URL, "", string(BreakerClosed))); got != 1 {
+				t.Errorf("wanted closed gauge to be 1, got %v", got)
+			}
+		})
+	}
+}
@@ -2,29 +2,41 @@ package bikepoint
 
 import (
 	"context"
-	"encoding/json"
-	"errors"
-	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"net/http/httptrace"
 	"time"
 
+	"github.com/gebn/tflcycles_exporter/internal/pkg/audit"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/backoffutil"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/promutil"
+
 	"github.com/cenkalti/backoff/v4"
 	"github.com/gebn/go-stamp/v2"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/httptrace/otelhttptrace"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// tracer creates spans for fetches. It uses the global provider, so is a
+// no-op unless tracing is enabled.
+var tracer = otel.Tracer("github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint")
+
 var (
 	// This will observe a shorter value if a given request is terminated early
 	// due to timeout.
-	httpRequestDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	httpRequestDuration = promauto.NewHistogram(promutil.WithNativeHistogram(prometheus.HistogramOpts{
 		Name: "tflcycles_bikepoint_http_request_duration_seconds",
 		Help: "Observes the duration of all requests to /BikePoint, including response parsing.",
 		// The last bucket should be just above our timeout.
 		Buckets: prometheus.ExponentialBuckets(.2, 1.355, 10), // 3.08
-	})
+	}))
 	// This is arguably redundant given the existence of retries, which
 	// provides an indication of failures. This metric also does not correspond
 	// to a single line of code.
@@ -34,10 +46,32 @@ var (
 	})
 	httpRequestRetries = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "tflcycles_bikepoint_http_request_retries_total",
-		Help: "The number of times we timed-out or received a 5xx error from /BikePoint, and retried.",
+		Help: "The number of times we timed-out or received a retryable error from /BikePoint, and retried.",
 	})
+	httpRequestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tflcycles_bikepoint_http_request_errors_total",
+		Help: "The number of failed /BikePoint requests, by class of error.",
+	}, []string{"class"})
+	attemptsPerFetch = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tflcycles_bikepoint_attempts_per_fetch",
+		Help:    "Observes the number of /BikePoint requests made by each fetch, including the first.",
+		Buckets: prometheus.LinearBuckets(1, 1, 8),
+	})
+	stationsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tflcycles_bikepoint_stations_rejected_total",
+		Help: "The number of stations skipped due to an invalid value, by the property containing it.",
+	}, []string{"property"})
 )
 
+func init() {
+	for _, class := range ErrorClasses {
+		httpRequestErrors.WithLabelValues(string(class))
+	}
+}
+
+// DefaultEndpoint is the URL of TfL's production /BikePoint resource.
+const DefaultEndpoint = "https://api.tfl.gov.uk/BikePoint"
+
 // Client is used to interact with the BikePoint API. Create instances with
 // NewClient().
 //
@@ -53,6 +87,10 @@ type Client struct {
 	// provided when calling NewClient().
 	HTTPClient *http.Client
 
+	// Endpoint is the URL of the /BikePoint resource. This can be configured
+	// using WithEndpoint().
+	Endpoint string
+
 	// Timeout is the per-attempt request timeout. This can be configured using
 	// WithTimeout().
 	Timeout time.Duration
@@ -62,7 +100,19 @@ type Client struct {
 	// be configured using WithAppKey().
 	AppKey string
 
-	req *http.Request
+	// Retry determines how failed requests are retried. This can be
+	// configured using WithRetryPolicy(), or field-by-field with options
+	// such as WithMaxAttempts().
+	Retry RetryPolicy
+
+	// CircuitBreaker determines when the client stops making requests after
+	// repeated failures. It is disabled by default, and can be configured
+	// using WithCircuitBreaker(). Clients with the same endpoint and app key
+	// share a breaker, whose policy is that of the first created.
+	CircuitBreaker BreakerPolicy
+
+	req     *http.Request
+	breaker *breaker
 }
 
 // ClientOption allows customising the client's behaviour during construction
@@ -78,6 +128,15 @@ func WithAppKey(key string) ClientOption {
 	}
 }
 
+// WithEndpoint overrides the URL requested, which is
+// https://api.tfl.gov.uk/BikePoint by default. This is useful for pointing the
+// client at a proxy or test server.
+func WithEndpoint(endpoint string) ClientOption {
+	return func(c *Client) {
+		c.Endpoint = endpoint
+	}
+}
+
 // WithTimeout sets the per-attempt request timeout. This is 3s by default. The
 // lower of this and the HTTPClient's request timeout will be effective.
 func WithTimeout(timeout time.Duration) ClientOption {
@@ -86,25 +145,92 @@ func WithTimeout(timeout time.Duration) ClientOption {
 	}
 }
 
+// WithRetryPolicy replaces the retry policy, which is DefaultRetryPolicy() by
+// default. The policy must be valid.
+func WithRetryPolicy(policy RetryPolicy) ClientOption {
+	return func(c *Client) {
+		c.Retry = policy
+	}
+}
+
+// WithInitialInterval sets the wait before the first retry. This is 500ms by
+// default.
+func WithInitialInterval(interval time.Duration) ClientOption {
+	return func(c *Client) {
+		c.Retry.InitialInterval = interval
+	}
+}
+
+// WithMultiplier sets the factor by which the wait grows after each retry.
+// This is 1.5 by default.
+func WithMultiplier(multiplier float64) ClientOption {
+	return func(c *Client) {
+		c.Retry.Multiplier = multiplier
+	}
+}
+
+// WithMaxInterval caps the wait between attempts. This is 1m by default.
+func WithMaxInterval(interval time.Duration) ClientOption {
+	return func(c *Client) {
+		c.Retry.MaxInterval = interval
+	}
+}
+
+// WithMaxAttempts limits the requests made by each fetch, including the
+// first. By default, attempts are only limited by the context.
+func WithMaxAttempts(attempts int) ClientOption {
+	return func(c *Client) {
+		c.Retry.MaxAttempts = attempts
+	}
+}
+
+// WithJitter sets the fraction by which each wait is randomised either way.
+// This is 0.5 by default. 0 disables jitter.
+func WithJitter(jitter float64) ClientOption {
+	return func(c *Client) {
+		c.Retry.Jitter = jitter
+	}
+}
+
+// WithRetryableStatusCodes sets the HTTP statuses to retry after, failing the
+// fetch immediately on any other. By default, every 5xx status is retried.
+func WithRetryableStatusCodes(codes ...int) ClientOption {
+	return func(c *Client) {
+		c.Retry.RetryableStatusCodes = codes
+	}
+}
+
+// WithCircuitBreaker configures the client's circuit breaker, which is
+// disabled by default.
+func WithCircuitBreaker(policy BreakerPolicy) ClientOption {
+	return func(c *Client) {
+		c.CircuitBreaker = policy
+	}
+}
+
 // NewClient initialises a client to retrieve data from the BikePoint API.
 func NewClient(logger *slog.Logger, httpClient *http.Client, opts ...ClientOption) *Client {
 	c := &Client{
-		Logger:     logger,
-		HTTPClient: httpClient,
-		Timeout:    3 * time.Second,
+		Logger:         logger,
+		HTTPClient:     httpClient,
+		Endpoint:       DefaultEndpoint,
+		Timeout:        3 * time.Second,
+		Retry:          DefaultRetryPolicy(),
+		CircuitBreaker: DefaultBreakerPolicy(),
 	}
 	for _, opt := range opts {
 		opt(c)
 	}
 	c.req = c.buildRequest()
+	c.breaker = newBreaker(logger, c.CircuitBreaker, c.Endpoint, c.AppKey)
 	return c
 }
 
 func (c Client) buildRequest() *http.Request {
-	req, err := http.NewRequest(http.MethodGet, "https://api.tfl.gov.uk/BikePoint", nil)
+	req, err := http.NewRequest(http.MethodGet, c.Endpoint, nil)
 	if err != nil {
-		// We're fully in control of this part; the tests will fail if this
-		// returns an error.
+		// The default endpoint is valid, and the config package validates
+		// any override, so this is a programming error.
 		panic(err)
 	}
 
@@ -121,54 +247,58 @@ func (c Client) buildRequest() *http.Request {
 }
 
 // FetchStationAvailabilities retrieves the latest cycle and dock availability.
-// It will back-off exponentially until the passed context expires. The
-// returned list can be assumed to be sorted by station ID.
+// It will back-off exponentially according to the client's retry policy until
+// the passed context expires or attempts are exhausted, and will not start
+// waiting for a retry that could not begin before its deadline. If the
+// client's circuit breaker is open, it fails immediately with a
+// ClassCircuitOpen error, or returns the last successful fetch's stations if
+// the breaker's policy serves stale data. The returned list can be assumed
+// to be sorted by station ID.
 func (c *Client) FetchStationAvailabilities(ctx context.Context) ([]StationAvailability, error) {
+	ctx, span := tracer.Start(ctx, "bikepoint.FetchStationAvailabilities")
+	defer span.End()
+
 	// Can still grow if needed; this saves the first handful of reallocs.
 	stationAvailabilities := make([]StationAvailability, 0, 1024)
+	attempt := 0
+	var lastErr error
 	err := backoff.RetryNotify(
 		func() error {
-			ctx, cancel := context.WithTimeout(ctx, c.Timeout)
-			defer cancel()
-
-			timer := prometheus.NewTimer(httpRequestDuration)
-			defer timer.ObserveDuration()
-
-			resp, err := c.HTTPClient.Do(c.req.WithContext(ctx))
-			if err != nil {
-				httpRequestFailures.Inc()
-				return err
-			}
-			defer resp.Body.Close()
-
-			if resp.StatusCode != http.StatusOK {
-				httpRequestFailures.Inc()
-				msg := fmt.Sprintf("got HTTP %v", resp.StatusCode)
-				var fault error
-				b, err := io.ReadAll(resp.Body)
-				if err != nil {
-					fault = errors.New(msg)
-				} else {
-					fault = fmt.Errorf("%v: %v", msg, string(b))
-				}
-				if resp.StatusCode < http.StatusInternalServerError {
-					return backoff.Permanent(fault)
+			if !c.breaker.allow() {
+				if lastErr != nil {
+					// The breaker opened during this fetch; its cause is
+					// more useful.
+					return backoff.Permanent(lastErr)
 				}
-				return fault
+				return backoff.Permanent(&Error{
+					Class: ClassCircuitOpen,
+					Err:   ErrCircuitOpen,
+				})
 			}
+			attempt++
+			ctx, span := tracer.Start(ctx, "bikepoint.attempt",
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(attribute.Int("tflcycles.attempt", attempt)))
+			defer span.End()
 
-			dec := json.NewDecoder(resp.Body)
-			if err := dec.Decode(&stationAvailabilities); err != nil {
-				httpRequestFailures.Inc()
-				// In case we partially decoded the response.
-				stationAvailabilities = stationAvailabilities[:0]
-				return err
+			err := c.attempt(ctx, &stationAvailabilities)
+			c.breaker.record(ctx, err)
+			lastErr = err
+			if err != nil {
+				span.SetAttributes(semconv.ErrorTypeKey.String(string(ClassOf(err))))
+				span.SetStatus(codes.Error, err.Error())
 			}
-			return nil
+			return err
 		},
-		// No need to use backoff.WithContext() here as well.
-		backoff.NewExponentialBackOff(),
+		// This stops waiting if the next attempt would start after the
+		// deadline, so we return the last error rather than a less useful
+		// context error.
+		backoffutil.WithContext(c.Retry.newBackOff(), ctx),
 		func(err error, wait time.Duration) {
+			span.AddEvent("retry", trace.WithAttributes(
+				attribute.Int("tflcycles.attempt", attempt),
+				attribute.String("error.type", string(ClassOf(err))),
+				attribute.Float64("tflcycles.backoff.wait", wait.Seconds())))
 			c.Logger.WarnContext(ctx, "failed attempt",
 				slog.String("error", err.Error()),
 				// This may not be relevant to the error above, but typically
@@ -178,5 +308,125 @@ func (c *Client) FetchStationAvailabilities(ctx context.Context) ([]StationAvail
 			httpRequestRetries.Inc()
 		},
 	)
+	attemptsPerFetch.Observe(float64(attempt))
+	switch {
+	case err == nil:
+		c.breaker.setStale(stationAvailabilities)
+	case ClassOf(err) == ClassCircuitOpen:
+		if stale := c.breaker.getStale(); stale != nil {
+			c.Logger.WarnContext(ctx, "circuit breaker open; serving stale stations",
+				slog.Int("stations", len(stale)))
+			span.SetAttributes(attribute.Bool("tflcycles.stale", true))
+			stationAvailabilities, err = stale, nil
+		}
+	}
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.SetAttributes(
+		attribute.Int("tflcycles.attempts", attempt),
+		attribute.Int("tflcycles.stations", len(stationAvailabilities)))
+	return stationAvailabilities, err
+}
+
+// attempt makes a single request, replacing the contents of
+// stationAvailabilities with the response's stations if it succeeds. Errors
+// are classified, and permanent if retrying would not help.
+func (c *Client) attempt(ctx context.Context, stationAvailabilities *[]StationAvailability) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	timer := prometheus.NewTimer(httpRequestDuration)
+	defer timer.ObserveDurationWithExemplar(promutil.TraceExemplar(ctx))
+
+	attempt := audit.Attempt{
+		URL: c.Endpoint,
+	}
+	body := &audit.CountingReader{}
+	start := time.Now()
+	defer func() {
+		attempt.Bytes = body.N
+		attempt.Duration = time.Since(start).Seconds()
+		if err != nil {
+			attempt.Error = err.Error()
+			attempt.Class = string(ClassOf(err))
+		}
+		audit.FromContext(ctx).AddAttempt(attempt)
+	}()
+
+	// Records DNS, connection, TLS and time-to-first-byte as child spans.
+	// Request headers are omitted, as they include the app key.
+	ctx = httptrace.WithClientTrace(ctx, otelhttptrace.NewClientTrace(ctx,
+		otelhttptrace.WithoutHeaders()))
+	resp, err := c.HTTPClient.Do(c.req.WithContext(ctx))
+	if err != nil {
+		return failed(ClassifyTransportError(err))
+	}
+	defer resp.Body.Close()
+	body.Reader = resp.Body
+	attempt.Status = resp.StatusCode
+	trace.SpanFromContext(ctx).SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+
+	if resp.StatusCode != http.StatusOK {
+		// If we fail to read the body, we still have the status.
+		b, _ := io.ReadAll(body)
+		fault := failed(NewStatusError(resp.StatusCode, string(b)))
+		if !c.Retry.retryable(resp.StatusCode) {
+			return backoff.Permanent(fault)
+		}
+		return fault
+	}
+
+	*stationAvailabilities, err = c.decode(ctx, body, *stationAvailabilities)
+	if err != nil {
+		// In case we partially decoded the response.
+		*stationAvailabilities = (*stationAvailabilities)[:0]
+		return failed(ClassifyDecodeError(err))
+	}
+	return nil
+}
+
+// decode appends the stations in a /BikePoint response to the provided slice.
+// Stations that are valid JSON but contain a value we cannot interpret are
+// logged and skipped, so one bad station does not prevent the others being
+// exported.
+func (c *Client) decode(ctx context.Context, r io.Reader, stationAvailabilities []StationAvailability) ([]StationAvailability, error) {
+	// This includes reading the body, which is usually the bulk of it.
+	ctx, span := tracer.Start(ctx, "bikepoint.decode")
+	defer span.End()
+
+	d := decoders.Get().(*decoder)
+	defer decoders.Put(d)
+
+	d.readFrom(r)
+	rejected := 0
+	stationAvailabilities, err := d.decodeStations(stationAvailabilities, func(propertyErr *PropertyError) {
+		rejected++
+		c.Logger.WarnContext(ctx, "skipping malformed station",
+			slog.String("id", propertyErr.ID),
+			slog.String("property", propertyErr.Key),
+			slog.String("error", propertyErr.Err.Error()))
+		stationsRejected.WithLabelValues(propertyErr.Key).Inc()
+	})
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	if d.invalidModified > 0 {
+		c.Logger.WarnContext(ctx, "ignoring malformed modified times",
+			slog.Int("stations", d.invalidModified))
+	}
+	span.SetAttributes(
+		attribute.Int("tflcycles.response.bytes", d.read),
+		attribute.Int("tflcycles.stations", len(stationAvailabilities)),
+		attribute.Int("tflcycles.stations.rejected", rejected),
+		attribute.Int("tflcycles.stations.invalid_modified", d.invalidModified))
 	return stationAvailabilities, err
 }
+
+// failed records a failed attempt, returning the error for convenience. The
+// error must have been classified.
+func failed(err error) error {
+	httpRequestFailures.Inc()
+	httpRequestErrors.WithLabelValues(string(ClassOf(err))).Inc()
+	return err
+}
@@ -0,0 +1,325 @@
+package bikepoint
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/audit"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/recording"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestClient_FetchStationAvailabilitiesSkipsMalformed(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+			{
+				"id": "BikePoints_1",
+				"commonName": "River Street , Clerkenwell",
+				"additionalProperties": [
+					{"key": "NbDocks", "value": "19"},
+					{"key": "NbEmptyDocks", "value": "8"}
+				]
+			},
+			{
+				"id": "BikePoints_2",
+				"commonName": "Phillimore Gardens, Kensington",
+				"additionalProperties": [
+					{"key": "NbDocks", "value": "37"},
+					{"key": "NbEmptyDocks", "value": "unknown"}
+				]
+			},
+			{
+				"id": "BikePoints_3",
+				"commonName": 3,
+				"additionalProperties": []
+			},
+			{
+				"id": "BikePoints_4",
+				"commonName": "Christopher Street, Liverpool Street",
+				"additionalProperties": [
+					{"key": "NbDocks", "value": "23"},
+					{"key": "NbEmptyDocks", "value": "2"}
+				]
+			}
+		]`))
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	emptyDocksBefore := testutil.ToFloat64(stationsRejected.WithLabelValues("NbEmptyDocks"))
+	commonNameBefore := testutil.ToFloat64(stationsRejected.WithLabelValues("commonName"))
+
+	client := NewClient(slog.Default(), server.Client(), WithEndpoint(server.URL))
+	got, err := client.FetchStationAvailabilities(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []StationAvailability{
+		{
+			Station: Station{
+				ID:    "BikePoints_1",
+				Name:  "River Street, Clerkenwell",
+				Docks: 19,
+			},
+			Availability: Availability{
+				Docks: 8,
+			},
+		},
+		{
+			Station: Station{
+				ID:    "BikePoints_4",
+				Name:  "Christopher Street, Liverpool Street",
+				Docks: 23,
+			},
+			Availability: Availability{
+				Docks: 2,
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if delta := testutil.ToFloat64(stationsRejected.WithLabelValues("NbEmptyDocks")) - emptyDocksBefore; delta != 1 {
+		t.Errorf("wanted 1 station rejected due to NbEmptyDocks, got %v", delta)
+	}
+	if delta := testutil.ToFloat64(stationsRejected.WithLabelValues("commonName")) - commonNameBefore; delta != 1 {
+		t.Errorf("wanted 1 station rejected due to commonName, got %v", delta)
+	}
+}
+
+func TestClient_FetchStationAvailabilitiesMalformedResponse(t *testing.T) {
+	bodies := []string{
+		``,
+		`{}`,
+		`[{"id": "BikePoints_1", "commonName": "River Street , Clerkenwell"}`,
+		`[{"id": "BikePoints_1", "commonName": "River Street , Clerkenwell"},]`,
+	}
+	for _, body := range bodies {
+		body := body
+		t.Run(body, func(t *testing.T) {
+			t.Parallel()
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(body))
+			}))
+			defer server.Close()
+
+			// Decode errors are retried, so this bounds the test.
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			client := NewClient(slog.Default(), server.Client(), WithEndpoint(server.URL))
+			got, err := client.FetchStationAvailabilities(ctx)
+			if err == nil {
+				t.Fatalf("wanted error, got %v", got)
+			}
+			if class := ClassOf(err); class != ClassDecode {
+				t.Errorf("wanted %v error, got %v: %v", ClassDecode, class, err)
+			}
+		})
+	}
+}
+
+func TestClient_FetchStationAvailabilitiesRecorded(t *testing.T) {
+	tests := []struct {
+		recording string
+		want      ErrorClass
+	}{
+		{
+			recording: "rate-limited",
+			want:      ClassRateLimited,
+		},
+		{
+			recording: "truncated",
+			want:      ClassDecode,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.recording, func(t *testing.T) {
+			t.Parallel()
+
+			replayer, err := recording.NewReplayer(filepath.Join("testdata", "recordings", test.recording))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Decode errors are retried, so this bounds the test.
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			client := NewClient(slog.Default(), &http.Client{Transport: replayer})
+			got, err := client.FetchStationAvailabilities(ctx)
+			if err == nil {
+				t.Fatalf("wanted error, got %v", got)
+			}
+			if class := ClassOf(err); class != test.want {
+				t.Errorf("wanted %v error, got %v: %v", test.want, class, err)
+			}
+		})
+	}
+}
+
+func TestClient_FetchStationAvailabilitiesAudited(t *testing.T) {
+	t.Parallel()
+
+	requests := atomic.Int32{}
+	body := `[{
+		"id": "BikePoints_1",
+		"commonName": "River Street , Clerkenwell",
+		"additionalProperties": [
+			{"key": "NbDocks", "value": "19"}
+		]
+	}]`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	record := &audit.Record{}
+	client := NewClient(slog.Default(), server.Client(), WithEndpoint(server.URL))
+	if _, err := client.FetchStationAvailabilities(audit.NewContext(ctx, record)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(record.Attempts) != 2 {
+		t.Fatalf("wanted 2 attempts, got %+v", record.Attempts)
+	}
+	failed, succeeded := record.Attempts[0], record.Attempts[1]
+	if failed.URL != server.URL || failed.Status != http.StatusServiceUnavailable || failed.Class != string(ClassHTTP5xx) ||
+		failed.Bytes != int64(len("unavailable\n")) || failed.Error == "" {
+		t.Errorf("unexpected failed attempt: %+v", failed)
+	}
+	if succeeded.Status != http.StatusOK || succeeded.Class != "" || succeeded.Error != "" ||
+		succeeded.Bytes != int64(len(body)) || succeeded.Duration <= 0 {
+		t.Errorf("unexpected successful attempt: %+v", succeeded)
+	}
+}
+
+func TestClient_FetchStationAvailabilitiesTraced(t *testing.T) {
+	// Not parallel, as this sets the global provider.
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	requests := atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`[{
+			"id": "BikePoints_1",
+			"commonName": "River Street , Clerkenwell",
+			"additionalProperties": [
+				{"key": "NbDocks", "value": "19"}
+			]
+		}]`))
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// Other tests' spans are recorded too, so ours are identified by trace.
+	ctx, root := otel.Tracer("test").Start(ctx, "test")
+	const appKey = "s3cret-app-key"
+	client := NewClient(slog.Default(), server.Client(),
+		WithEndpoint(server.URL),
+		WithAppKey(appKey))
+	if _, err := client.FetchStationAvailabilities(ctx); err != nil {
+		t.Fatal(err)
+	}
+	root.End()
+
+	spans := map[string][]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID() == root.SpanContext().TraceID() {
+			spans[span.Name()] = append(spans[span.Name()], span)
+		}
+	}
+	for name, want := range map[string]int{
+		"bikepoint.FetchStationAvailabilities": 1,
+		"bikepoint.attempt":                    2,
+		"bikepoint.decode":                     1,
+		"http.getconn":                         2,
+	} {
+		if got := len(spans[name]); got != want {
+			t.Errorf("wanted %v %v spans, got %v", want, name, got)
+		}
+	}
+	if t.Failed() {
+		return
+	}
+	for name, spans := range spans {
+		for _, span := range spans {
+			kvs := span.Attributes()
+			for _, event := range span.Events() {
+				kvs = append(kvs, event.Attributes...)
+			}
+			for _, kv := range kvs {
+				if strings.Contains(kv.Value.Emit(), appKey) {
+					t.Errorf("%v span exposes app key in %v", name, kv.Key)
+				}
+			}
+		}
+	}
+
+	// Attempts are sequential, so end in the order they started.
+	for i, want := range []struct {
+		attempt int64
+		status  int64
+	}{
+		{1, http.StatusServiceUnavailable},
+		{2, http.StatusOK},
+	} {
+		attrs := attributes(spans["bikepoint.attempt"][i].Attributes())
+		if attrs["tflcycles.attempt"].AsInt64() != want.attempt {
+			t.Errorf("attempt %v: got attempt number %v", i, attrs["tflcycles.attempt"].AsInt64())
+		}
+		if attrs["http.response.status_code"].AsInt64() != want.status {
+			t.Errorf("attempt %v: wanted status %v, got %v", i, want.status, attrs["http.response.status_code"].AsInt64())
+		}
+	}
+	fetch := spans["bikepoint.FetchStationAvailabilities"][0]
+	if attrs := attributes(fetch.Attributes()); attrs["tflcycles.stations"].AsInt64() != 1 {
+		t.Errorf("wanted 1 station, got %v", attrs["tflcycles.stations"].AsInt64())
+	}
+	events := fetch.Events()
+	if len(events) != 1 || events[0].Name != "retry" {
+		t.Fatalf("wanted a single retry event, got %v", events)
+	}
+	if attrs := attributes(events[0].Attributes); attrs["error.type"].AsString() != string(ClassHTTP5xx) ||
+		attrs["tflcycles.backoff.wait"].AsFloat64() <= 0 {
+		t.Errorf("unexpected retry event attributes: %v", events[0].Attributes)
+	}
+}
+
+// attributes indexes attributes by key.
+func attributes(kvs []attribute.KeyValue) map[attribute.Key]attribute.Value {
+	m := make(map[attribute.Key]attribute.Value, len(kvs))
+	for _, kv := range kvs {
+		m[kv.Key] = kv.Value
+	}
+	return m
+}
@@ -0,0 +1,811 @@
+package bikepoint
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// minRead is the smallest read from the body into the buffer.
+const minRead = 4096
+
+// maxDepth bounds the nesting of values we are willing to skip, to avoid
+// unbounded recursion on hostile input. encoding/json uses 10000.
+const maxDepth = 10000
+
+var (
+	// decoders allows buffers and interned strings to be reused across
+	// fetches, including concurrent ones.
+	decoders = sync.Pool{
+		New: func() any {
+			return &decoder{
+				ids:   make(map[string]string),
+				names: make(map[string]string),
+			}
+		},
+	}
+
+	errInvalidValue = errors.New("invalid value")
+)
+
+// SyntaxError indicates a /BikePoint response was not valid JSON.
+type SyntaxError struct {
+	Offset int
+	msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%v at offset %v", e.msg, e.Offset)
+}
+
+// decoder is a purpose-built JSON decoder for /BikePoint responses. Compared to
+// encoding/json, it avoids reflection, fills StationAvailability directly
+// without an intermediate representation, skips properties we do not use
+// without allocating, and reuses its buffer and the strings it has produced
+// across decodes.
+//
+// The body is read incrementally, and the buffer only holds the unconsumed
+// part of it, so is bounded by the size of a station rather than the
+// response. Strings are returned as sub-slices of the buffer where possible,
+// so are only valid until the next station is decoded.
+type decoder struct {
+	buf []byte
+	pos int
+
+	// r is the body being read, or nil if buf holds the whole input.
+	r io.Reader
+
+	// err is the error returned by the last read of r, including io.EOF.
+	err error
+
+	// offset is the number of bytes of the body discarded before buf, and
+	// read is the number of bytes read in total.
+	offset int
+	read   int
+
+	// scratch is the decoder's own buffer, reused across bodies. buf may
+	// instead be a caller's slice passed to reset().
+	scratch []byte
+
+	// ids and names map raw values to strings from previous decodes, so
+	// unchanged stations do not cause allocations. They are pruned if they
+	// grow beyond twice the number of strings used in a single decode.
+	ids   map[string]string
+	names map[string]string
+	used  int
+
+	// lastModifiedRaw caches the most recent `modified` value parsed. TfL
+	// updates stations in batches, so consecutive values tend to be
+	// identical.
+	lastModifiedRaw []byte
+	lastModified    time.Time
+
+	// invalidModified is the number of stations decoded whose `modified`
+	// values could not all be parsed. Their Modified field is left as the
+	// zero value, as the timestamp is optional and the counts are still
+	// usable.
+	invalidModified int
+
+	// modifiedInvalid is whether a `modified` value of the current station
+	// could not be parsed.
+	modifiedInvalid bool
+}
+
+// reset prepares the decoder to decode b. It does not take ownership of b.
+func (d *decoder) reset(b []byte) {
+	d.buf = b
+	d.pos = 0
+	d.r = nil
+	d.err = io.EOF
+	d.offset = 0
+	d.read = len(b)
+	d.used = 0
+	d.invalidModified = 0
+}
+
+// readFrom prepares the decoder to decode r as it is read, reusing the
+// decoder's buffer.
+func (d *decoder) readFrom(r io.Reader) {
+	d.reset(d.scratch[:0])
+	d.r = r
+	d.err = nil
+}
+
+// available returns whether at least n bytes remain to be consumed, reading
+// more of the body if necessary.
+func (d *decoder) available(n int) bool {
+	return len(d.buf)-d.pos >= n || d.fill(n)
+}
+
+// fill reads the body until at least n bytes remain to be consumed, returning
+// false if it ends first. The buffer may be reallocated, but existing bytes
+// are never overwritten, so sub-slices of it remain valid; see discard().
+func (d *decoder) fill(n int) bool {
+	for len(d.buf)-d.pos < n {
+		if d.err != nil {
+			return false
+		}
+		if cap(d.buf)-len(d.buf) < minRead {
+			buf := make([]byte, len(d.buf), 2*cap(d.buf)+minRead)
+			copy(buf, d.buf)
+			d.buf = buf
+			d.scratch = buf
+		}
+		read, err := d.r.Read(d.buf[len(d.buf):cap(d.buf)])
+		d.buf = d.buf[:len(d.buf)+read]
+		d.read += read
+		d.err = err
+	}
+	return true
+}
+
+// discard drops the consumed part of the buffer if it is running out of
+// space, so the buffer does not grow with the body. As this overwrites the
+// buffer, it must only be called between stations.
+func (d *decoder) discard() {
+	if d.r == nil || cap(d.buf)-len(d.buf) >= minRead {
+		return
+	}
+	n := copy(d.buf, d.buf[d.pos:])
+	d.buf = d.buf[:n]
+	d.offset += d.pos
+	d.pos = 0
+}
+
+// decodeStations decodes the array of stations in the buffer, appending them
+// to dst. If a station contains an invalid value, skip is called and the
+// station is omitted. Any other error is returned immediately.
+func (d *decoder) decodeStations(dst []StationAvailability, skip func(*PropertyError)) ([]StationAvailability, error) {
+	if err := d.expect('['); err != nil {
+		return dst, err
+	}
+	if d.consume(']') {
+		return dst, d.end()
+	}
+	for {
+		d.discard()
+		// Decoding in place avoids sa escaping to the heap.
+		dst = append(dst, StationAvailability{})
+		if err := d.decodeStation(&dst[len(dst)-1]); err != nil {
+			dst = dst[:len(dst)-1]
+			var propertyErr *PropertyError
+			if !errors.As(err, &propertyErr) {
+				return dst, err
+			}
+			skip(propertyErr)
+		}
+		if d.consume(']') {
+			break
+		}
+		if err := d.expect(','); err != nil {
+			return dst, err
+		}
+	}
+	d.pruneInterned()
+	return dst, d.end()
+}
+
+// decodeStation decodes a single station object. If a value cannot be
+// interpreted, the rest of the object is still consumed, and an error
+// wrapping a *PropertyError is returned.
+func (d *decoder) decodeStation(sa *StationAvailability) error {
+	// The first invalid value encountered. Syntax errors are returned
+	// immediately.
+	var invalid error
+	var id string
+	d.modifiedInvalid = false
+	if err := d.expect('{'); err != nil {
+		return err
+	}
+	if !d.consume('}') {
+		for {
+			key, err := d.readKey()
+			if err != nil {
+				return err
+			}
+			switch string(key) {
+			case "id":
+				id, err = d.readInternedString(d.ids, false)
+				if errors.Is(err, errInvalidValue) {
+					invalid = firstError(invalid, newPropertyError(id, "id",
+						errors.New("not a string")))
+				} else if err != nil {
+					return err
+				}
+				sa.Station.ID = id
+			case "commonName":
+				name, err := d.readInternedString(d.names, true)
+				if errors.Is(err, errInvalidValue) {
+					invalid = firstError(invalid, newPropertyError(id, "commonName",
+						errors.New("not a string")))
+				} else if err != nil {
+					return err
+				}
+				sa.Station.Name = name
+			case "lat", "lon":
+				dst := &sa.Station.Lat
+				if string(key) == "lon" {
+					dst = &sa.Station.Lon
+				}
+				if err := d.readFloat(dst); errors.Is(err, errInvalidValue) {
+					invalid = firstError(invalid, newPropertyError(id, string(key),
+						errors.New("not a number")))
+				} else if err != nil {
+					return err
+				}
+			case "additionalProperties":
+				if err := d.decodeAdditionalProperties(sa); err != nil {
+					var propertyErr *PropertyError
+					if !errors.As(err, &propertyErr) {
+						return err
+					}
+					invalid = firstError(invalid, err)
+				}
+			default:
+				if err := d.skipValue(0); err != nil {
+					return err
+				}
+			}
+			if d.consume('}') {
+				break
+			}
+			if err := d.expect(','); err != nil {
+				return err
+			}
+		}
+	}
+	if invalid != nil {
+		// The ID may have appeared after the invalid value.
+		var propertyErr *PropertyError
+		if errors.As(invalid, &propertyErr) && propertyErr.ID == "" {
+			propertyErr.ID = id
+		}
+		return invalid
+	}
+	if d.modifiedInvalid {
+		d.invalidModified++
+		sa.Modified = time.Time{}
+	}
+	return nil
+}
+
+// decodeAdditionalProperties decodes the additionalProperties array into sa.
+// Like decodeStation(), it consumes the whole array even if a value is
+// invalid.
+func (d *decoder) decodeAdditionalProperties(sa *StationAvailability) error {
+	if d.consumeLiteral("null") {
+		return nil
+	}
+	if d.peek() != '[' {
+		if err := d.skipValue(0); err != nil {
+			return err
+		}
+		return newPropertyError("", "additionalProperties", errors.New("not an array"))
+	}
+	d.pos++
+	if d.consume(']') {
+		return nil
+	}
+	var invalid error
+	for {
+		if err := d.decodeAdditionalProperty(sa); err != nil {
+			var propertyErr *PropertyError
+			if !errors.As(err, &propertyErr) {
+				return err
+			}
+			invalid = firstError(invalid, err)
+		}
+		if d.consume(']') {
+			return invalid
+		}
+		if err := d.expect(','); err != nil {
+			return err
+		}
+	}
+}
+
+// decodeAdditionalProperty decodes a single key/value pair, setting the
+// corresponding field of sa if it is one we use.
+func (d *decoder) decodeAdditionalProperty(sa *StationAvailability) error {
+	d.skipWhitespace()
+	if d.peek() != '{' {
+		if err := d.skipValue(0); err != nil {
+			return err
+		}
+		return newPropertyError("", "additionalProperties", errors.New("not an object"))
+	}
+	d.pos++
+
+	// Fields may appear in any order, so we gather them before interpreting.
+	var key, value, modified []byte
+	var invalid error
+	// modified is only needed for timestamps, so is not worth rejecting the
+	// station over.
+	modifiedInvalid := false
+	if !d.consume('}') {
+		for {
+			field, err := d.readKey()
+			if err != nil {
+				return err
+			}
+			var dst *[]byte
+			switch string(field) {
+			case "key":
+				dst = &key
+			case "value":
+				dst = &value
+			case "modified":
+				dst = &modified
+			default:
+				if err := d.skipValue(0); err != nil {
+					return err
+				}
+			}
+			if dst != nil {
+				*dst, err = d.readString()
+				if errors.Is(err, errInvalidValue) && dst == &modified {
+					modifiedInvalid = true
+				} else if errors.Is(err, errInvalidValue) {
+					invalid = firstError(invalid, newPropertyError("",
+						"additionalProperties."+string(field), errors.New("not a string")))
+				} else if err != nil {
+					return err
+				}
+			}
+			if d.consume('}') {
+				break
+			}
+			if err := d.expect(','); err != nil {
+				return err
+			}
+		}
+	}
+	if invalid != nil {
+		return invalid
+	}
+
+	if string(key) == lockedProperty {
+		locked, err := parseBool(value)
+		if err != nil {
+			return newPropertyError("", string(key), err)
+		}
+		sa.Availability.Locked = locked
+		return nil
+	}
+	mapping, ok := propertyMappings[string(key)]
+	if !ok {
+		return nil
+	}
+	number, err := parseInt(value)
+	if err != nil {
+		return newPropertyError("", string(key), err)
+	}
+	*mapping(sa) = number
+
+	if modifiedInvalid {
+		d.modifiedInvalid = true
+		return nil
+	}
+	if len(modified) == 0 {
+		return nil
+	}
+	t, err := d.parseModified(modified)
+	if err != nil {
+		d.modifiedInvalid = true
+		return nil
+	}
+	if t.After(sa.Modified) {
+		sa.Modified = t
+	}
+	return nil
+}
+
+// parseModified parses an RFC 3339 timestamp, reusing the previous result if
+// it is the same.
+func (d *decoder) parseModified(raw []byte) (time.Time, error) {
+	if d.lastModifiedRaw != nil && bytes.Equal(raw, d.lastModifiedRaw) {
+		return d.lastModified, nil
+	}
+	t, err := time.Parse(time.RFC3339, string(raw))
+	if err != nil {
+		return time.Time{}, err
+	}
+	d.lastModifiedRaw = append(d.lastModifiedRaw[:0], raw...)
+	d.lastModified = t
+	return t, nil
+}
+
+// parseBool parses the values TfL uses for boolean properties.
+func parseBool(b []byte) (bool, error) {
+	switch string(b) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean %q", b)
+}
+
+// parseInt is equivalent to strconv.Atoi(), without converting to a string in
+// the common case.
+func parseInt(b []byte) (int, error) {
+	s := b
+	negative := false
+	if len(s) > 0 && (s[0] == '-' || s[0] == '+') {
+		negative = s[0] == '-'
+		s = s[1:]
+	}
+	// Anything longer could overflow; leave it to strconv.
+	if len(s) == 0 || len(s) > 18 {
+		return strconv.Atoi(string(b))
+	}
+	n := 0
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			// Produces an identical error.
+			return strconv.Atoi(string(b))
+		}
+		n = n*10 + int(c-'0')
+	}
+	if negative {
+		n = -n
+	}
+	return n, nil
+}
+
+// readFloat reads a number into dst. Like encoding/json, null leaves dst
+// unchanged. If the value is valid JSON but not a number, it is skipped and
+// errInvalidValue is returned.
+func (d *decoder) readFloat(dst *float64) error {
+	if d.consumeLiteral("null") {
+		return nil
+	}
+	if c := d.peek(); c != '-' && (c < '0' || c > '9') {
+		if err := d.skipValue(0); err != nil {
+			return err
+		}
+		return errInvalidValue
+	}
+	start := d.pos
+	if err := d.skipNumber(); err != nil {
+		return err
+	}
+	f, err := strconv.ParseFloat(string(d.buf[start:d.pos]), 64)
+	if err != nil {
+		// Out of range; the syntax has been validated.
+		return errInvalidValue
+	}
+	*dst = f
+	return nil
+}
+
+// readInternedString reads a string value, returning a previously allocated
+// copy if we have seen it before. If normalise is true, the string is passed
+// through normaliseCommonName(); the raw value is used as the key. Strings are
+// not interned if the decoder has no map, e.g. in UnmarshalJSON().
+func (d *decoder) readInternedString(interned map[string]string, normalise bool) (string, error) {
+	raw, err := d.readString()
+	if err != nil {
+		return "", err
+	}
+	d.used++
+	if s, ok := interned[string(raw)]; ok {
+		return s, nil
+	}
+	key := string(raw)
+	s := key
+	if !utf8.ValidString(s) {
+		// Prometheus label values must be valid UTF-8. This matches
+		// encoding/json's behaviour.
+		s = toValidUTF8(s)
+	}
+	if normalise {
+		s = normaliseCommonName(s)
+	}
+	if interned != nil {
+		interned[key] = s
+	}
+	return s, nil
+}
+
+// toValidUTF8 replaces each byte of s that is not part of a valid UTF-8
+// sequence with U+FFFD.
+func toValidUTF8(s string) string {
+	b := strings.Builder{}
+	b.Grow(len(s))
+	for _, r := range s {
+		// Ranging over a string yields RuneError for each invalid byte.
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// pruneInterned discards interned strings if they are likely stale, e.g. due
+// to stations being renamed, so the map does not grow without bound.
+func (d *decoder) pruneInterned() {
+	if len(d.ids)+len(d.names) > 2*d.used+64 {
+		clear(d.ids)
+		clear(d.names)
+	}
+}
+
+// readKey reads an object key and the following colon.
+func (d *decoder) readKey() ([]byte, error) {
+	d.skipWhitespace()
+	if d.peek() != '"' {
+		return nil, d.syntaxError("expected object key")
+	}
+	key, err := d.readString()
+	if err != nil {
+		return nil, err
+	}
+	return key, d.expect(':')
+}
+
+// readString reads a string value, returning its unescaped contents. This is a
+// sub-slice of the buffer unless the string contains escape sequences. Like
+// encoding/json, null is treated as the empty string. If the value is valid
+// JSON but not a string, it is skipped and errInvalidValue is returned.
+func (d *decoder) readString() ([]byte, error) {
+	if d.consumeLiteral("null") {
+		return nil, nil
+	}
+	if d.peek() != '"' {
+		if err := d.skipValue(0); err != nil {
+			return nil, err
+		}
+		return nil, errInvalidValue
+	}
+	start := d.pos
+	escaped, err := d.skipString()
+	if err != nil {
+		return nil, err
+	}
+	if !escaped {
+		return d.buf[start+1 : d.pos-1], nil
+	}
+	// Rare enough that we can afford encoding/json.
+	var s string
+	if err := json.Unmarshal(d.buf[start:d.pos], &s); err != nil {
+		return nil, d.syntaxError(err.Error())
+	}
+	return []byte(s), nil
+}
+
+// skipValue consumes any JSON value.
+func (d *decoder) skipValue(depth int) error {
+	if depth > maxDepth {
+		return d.syntaxError("exceeded max depth")
+	}
+	d.skipWhitespace()
+	switch c := d.peek(); {
+	case c == '"':
+		_, err := d.skipString()
+		return err
+	case c == '{':
+		d.pos++
+		if d.consume('}') {
+			return nil
+		}
+		for {
+			if _, err := d.readKey(); err != nil {
+				return err
+			}
+			if err := d.skipValue(depth + 1); err != nil {
+				return err
+			}
+			if d.consume('}') {
+				return nil
+			}
+			if err := d.expect(','); err != nil {
+				return err
+			}
+		}
+	case c == '[':
+		d.pos++
+		if d.consume(']') {
+			return nil
+		}
+		for {
+			if err := d.skipValue(depth + 1); err != nil {
+				return err
+			}
+			if d.consume(']') {
+				return nil
+			}
+			if err := d.expect(','); err != nil {
+				return err
+			}
+		}
+	case c == '-' || (c >= '0' && c <= '9'):
+		return d.skipNumber()
+	case d.consumeLiteral("true"), d.consumeLiteral("false"), d.consumeLiteral("null"):
+		return nil
+	}
+	return d.syntaxError("expected value")
+}
+
+// skipString consumes a string, including its quotes, returning whether it
+// contains escape sequences.
+func (d *decoder) skipString() (escaped bool, err error) {
+	d.pos++ // opening quote
+
+	// Fast path for the common case of a string without escapes.
+	if end := bytes.IndexByte(d.buf[d.pos:], '"'); end >= 0 {
+		contents := d.buf[d.pos : d.pos+end]
+		if bytes.IndexByte(contents, '\\') < 0 {
+			for i, c := range contents {
+				if c < 0x20 {
+					d.pos += i
+					return false, d.syntaxError("control character in string")
+				}
+			}
+			d.pos += end + 1
+			return false, nil
+		}
+	}
+
+	for d.available(1) {
+		c := d.buf[d.pos]
+		switch {
+		case c == '"':
+			d.pos++
+			return escaped, nil
+		case c == '\\':
+			escaped = true
+			d.pos++
+			if !d.available(1) {
+				return false, d.syntaxError("unterminated string")
+			}
+			switch d.buf[d.pos] {
+			case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+				d.pos++
+			case 'u':
+				d.pos++
+				for i := 0; i < 4; i++ {
+					if !d.available(1) || !isHex(d.buf[d.pos]) {
+						return false, d.syntaxError("invalid unicode escape")
+					}
+					d.pos++
+				}
+			default:
+				return false, d.syntaxError("invalid escape")
+			}
+		case c < 0x20:
+			return false, d.syntaxError("control character in string")
+		default:
+			d.pos++
+		}
+	}
+	return false, d.syntaxError("unterminated string")
+}
+
+// skipNumber consumes a number, following the grammar in RFC 8259.
+func (d *decoder) skipNumber() error {
+	d.consume('-')
+	switch {
+	case d.available(1) && d.buf[d.pos] == '0':
+		d.pos++
+	case d.skipDigits() == 0:
+		return d.syntaxError("invalid number")
+	}
+	if d.available(1) && d.buf[d.pos] == '.' {
+		d.pos++
+		if d.skipDigits() == 0 {
+			return d.syntaxError("invalid number")
+		}
+	}
+	if d.available(1) && (d.buf[d.pos] == 'e' || d.buf[d.pos] == 'E') {
+		d.pos++
+		if d.available(1) && (d.buf[d.pos] == '+' || d.buf[d.pos] == '-') {
+			d.pos++
+		}
+		if d.skipDigits() == 0 {
+			return d.syntaxError("invalid number")
+		}
+	}
+	return nil
+}
+
+func (d *decoder) skipDigits() int {
+	start := d.pos
+	for d.available(1) && d.buf[d.pos] >= '0' && d.buf[d.pos] <= '9' {
+		d.pos++
+	}
+	return d.pos - start
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func (d *decoder) skipWhitespace() {
+	for d.available(1) {
+		switch d.buf[d.pos] {
+		case ' ', '\t', '\n', '\r':
+			d.pos++
+		default:
+			return
+		}
+	}
+}
+
+// peek returns the next byte without consuming it, or 0 at the end of the
+// body. The caller must have skipped whitespace.
+func (d *decoder) peek() byte {
+	if !d.available(1) {
+		return 0
+	}
+	return d.buf[d.pos]
+}
+
+// consume skips whitespace, then consumes c if it is next, returning whether
+// it did so.
+func (d *decoder) consume(c byte) bool {
+	d.skipWhitespace()
+	if d.peek() == c {
+		d.pos++
+		return true
+	}
+	return false
+}
+
+// consumeLiteral is like consume(), for a sequence of bytes.
+func (d *decoder) consumeLiteral(literal string) bool {
+	d.skipWhitespace()
+	if d.available(len(literal)) && string(d.buf[d.pos:d.pos+len(literal)]) == literal {
+		d.pos += len(literal)
+		return true
+	}
+	return false
+}
+
+// expect consumes c, returning a syntax error if it is not next.
+func (d *decoder) expect(c byte) error {
+	if !d.consume(c) {
+		return d.syntaxError(fmt.Sprintf("expected %q", c))
+	}
+	return nil
+}
+
+// end returns an error if anything other than whitespace remains.
+func (d *decoder) end() error {
+	d.skipWhitespace()
+	if d.available(1) {
+		return d.syntaxError("unexpected data after top-level value")
+	}
+	if d.err != io.EOF {
+		return d.err
+	}
+	return nil
+}
+
+// syntaxError returns an error at the current position. If the body ended
+// early, the error reading it is returned instead, or io.ErrUnexpectedEOF if
+// it was cut short.
+func (d *decoder) syntaxError(msg string) error {
+	if !d.available(1) {
+		if d.err != io.EOF {
+			return d.err
+		}
+		return io.ErrUnexpectedEOF
+	}
+	return &SyntaxError{
+		Offset: d.offset + d.pos,
+		msg:    msg,
+	}
+}
+
+func firstError(existing, err error) error {
+	if existing != nil {
+		return existing
+	}
+	return err
+}
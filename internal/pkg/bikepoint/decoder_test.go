@@ -0,0 +1,415 @@
+package bikepoint
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// loadFixture returns a synthetic /BikePoint response of 800 stations. It has
+// the structure, property set and size of a real response, however station
+// names and counts are generated, so must not be relied upon. A recording
+// made with -record can be substituted.
+func loadFixture(tb testing.TB) []byte {
+	tb.Helper()
+	f, err := os.Open("testdata/bikepoint.json.gz")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return b
+}
+
+type (
+	// legacyStationAvailability decodes a station the way the client did
+	// before the decoder was introduced: each element is unmarshalled into a
+	// place, which is then copied field by field. Lat, Lon and Locked were
+	// added afterwards, and are included so results are comparable.
+	legacyStationAvailability struct {
+		StationAvailability
+	}
+
+	legacyPlace struct {
+		ID                   string                     `json:"id"`
+		CommonName           string                     `json:"commonName"`
+		Lat                  float64                    `json:"lat"`
+		Lon                  float64                    `json:"lon"`
+		AdditionalProperties []legacyAdditionalProperty `json:"additionalProperties"`
+	}
+
+	legacyAdditionalProperty struct {
+		Key      string `json:"key"`
+		Value    string `json:"value"`
+		Modified string `json:"modified"`
+	}
+)
+
+func (lsa *legacyStationAvailability) UnmarshalJSON(b []byte) error {
+	p := legacyPlace{}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	sa := &lsa.StationAvailability
+	sa.Station.ID = p.ID
+	sa.Station.Name = normaliseCommonName(p.CommonName)
+	sa.Station.Lat = p.Lat
+	sa.Station.Lon = p.Lon
+	for _, ap := range p.AdditionalProperties {
+		if ap.Key == lockedProperty {
+			locked, err := parseBool([]byte(ap.Value))
+			if err != nil {
+				return err
+			}
+			sa.Availability.Locked = locked
+			continue
+		}
+		mapping, ok := propertyMappings[ap.Key]
+		if !ok {
+			continue
+		}
+		value, err := strconv.Atoi(ap.Value)
+		if err != nil {
+			return err
+		}
+		*mapping(sa) = value
+		if ap.Modified == "" {
+			continue
+		}
+		modified, err := time.Parse(time.RFC3339, ap.Modified)
+		if err != nil {
+			return err
+		}
+		if modified.After(sa.Modified) {
+			sa.Modified = modified
+		}
+	}
+	return nil
+}
+
+// legacyDecode is the json.Decoder-based implementation the decoder replaced.
+// It is retained as a reference for equivalence tests and benchmarks.
+func legacyDecode(r io.Reader) ([]StationAvailability, error) {
+	stationAvailabilities := make([]StationAvailability, 0, 1024)
+	dec := json.NewDecoder(r)
+	if token, err := dec.Token(); err != nil || token != json.Delim('[') {
+		return nil, fmt.Errorf("expected array, got %v: %w", token, err)
+	}
+	for dec.More() {
+		lsa := legacyStationAvailability{}
+		if err := dec.Decode(&lsa); err != nil {
+			return nil, err
+		}
+		stationAvailabilities = append(stationAvailabilities, lsa.StationAvailability)
+	}
+	if token, err := dec.Token(); err != nil || token != json.Delim(']') {
+		return nil, fmt.Errorf("expected end of array, got %v: %w", token, err)
+	}
+	return stationAvailabilities, nil
+}
+
+func decodeAll(b []byte) ([]StationAvailability, error) {
+	d := decoders.Get().(*decoder)
+	defer decoders.Put(d)
+	d.reset(b)
+	return d.decodeStations([]StationAvailability{}, func(*PropertyError) {})
+}
+
+func TestDecoder_Fixture(t *testing.T) {
+	t.Parallel()
+
+	b := loadFixture(t)
+	want, err := legacyDecode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Decode twice to exercise interned strings.
+	for i := 0; i < 2; i++ {
+		got, err := decodeAll(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("decode %v: result differs from encoding/json", i)
+		}
+	}
+}
+
+func TestDecoder_Equivalence(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+	}{
+		{
+			name: "empty",
+			json: `[]`,
+		},
+		{
+			name: "escapes",
+			json: `[{"id": "BikePoints_1", "commonName": "Kennington Road  , Vauxhall \"Oval\"\n"}]`,
+		},
+		{
+			name: "nulls",
+			json: `[{"id": null, "commonName": null, "additionalProperties": null}]`,
+		},
+		{
+			name: "field order",
+			json: `[{"additionalProperties": [{"modified": "2024-01-02T03:04:05.67Z", "value": "+3", "key": "NbDocks"}], "id": "BikePoints_2"}]`,
+		},
+		{
+			name: "ignored values",
+			json: `[{"lat": -0.5e-3, "lon": 51, "children": [[], {}, true, false, null], "placeType": {"a": ["b"]}, "id": "BikePoints_3",
+				"additionalProperties": [{"key": "NbBikes", "value": "x", "extra": 1}]}]`,
+		},
+		{
+			name: "invalid utf8",
+			json: "[{\"id\": \"BikePoints_\xff1\", \"commonName\": \"Street\xc3 , Area\"}]",
+		},
+		{
+			name: "locked",
+			json: `[{"id": "BikePoints_4", "additionalProperties": [{"key": "Locked", "value": "true"}, {"key": "NbDocks", "value": "4"}]}]`,
+		},
+		{
+			name: "long integer",
+			json: `[{"additionalProperties": [{"key": "NbDocks", "value": "0000000000000000000012"}]}]`,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			want, err := legacyDecode(strings.NewReader(test.json))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := decodeAll([]byte(test.json))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestDecoder_PropertyErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		wantID  string
+		wantKey string
+	}{
+		{
+			name:    "invalid integer",
+			json:    `{"id": "BikePoints_1", "additionalProperties": [{"key": "NbDocks", "value": "many"}]}`,
+			wantID:  "BikePoints_1",
+			wantKey: "NbDocks",
+		},
+		{
+			name:    "id after invalid value",
+			json:    `{"additionalProperties": [{"key": "NbEBikes", "value": "1.5"}], "id": "BikePoints_2"}`,
+			wantID:  "BikePoints_2",
+			wantKey: "NbEBikes",
+		},
+		{
+			name:    "non-string name",
+			json:    `{"id": "BikePoints_4", "commonName": ["Holborn"]}`,
+			wantID:  "BikePoints_4",
+			wantKey: "commonName",
+		},
+		{
+			name:    "invalid locked",
+			json:    `{"id": "BikePoints_6", "additionalProperties": [{"key": "Locked", "value": "maybe"}]}`,
+			wantID:  "BikePoints_6",
+			wantKey: "Locked",
+		},
+		{
+			name:    "non-string value",
+			json:    `{"id": "BikePoints_5", "additionalProperties": [{"key": "NbDocks", "value": 1}]}`,
+			wantID:  "BikePoints_5",
+			wantKey: "additionalProperties.value",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			sa := StationAvailability{}
+			err := json.Unmarshal([]byte(test.json), &sa)
+			var propertyErr *PropertyError
+			if !errors.As(err, &propertyErr) {
+				t.Fatalf("wanted *PropertyError, got %v", err)
+			}
+			if propertyErr.ID != test.wantID || propertyErr.Key != test.wantKey {
+				t.Errorf("got ID %q and key %q, want %q and %q", propertyErr.ID,
+					propertyErr.Key, test.wantID, test.wantKey)
+			}
+			if class := ClassOf(err); class != ClassValidation {
+				t.Errorf("wanted %v error, got %v", ClassValidation, class)
+			}
+		})
+	}
+}
+
+func TestDecoder_InvalidModified(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+	}{
+		{
+			name: "unparseable",
+			json: `[{"id": "BikePoints_3", "additionalProperties": [{"key": "NbDocks", "value": "1", "modified": "2024-03-04T00:00:00Z"}, {"key": "NbStandardBikes", "value": "1", "modified": "yesterday"}]}]`,
+		},
+		{
+			name: "non-string",
+			json: `[{"id": "BikePoints_3", "additionalProperties": [{"key": "NbDocks", "value": "1", "modified": 1709510400}, {"key": "NbStandardBikes", "value": "1"}]}]`,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			d := &decoder{}
+			d.reset([]byte(test.json))
+			got, err := d.decodeStations(nil, func(propertyErr *PropertyError) {
+				t.Errorf("station skipped: %v", propertyErr)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []StationAvailability{
+				{
+					Station: Station{
+						ID:    "BikePoints_3",
+						Docks: 1,
+					},
+					Availability: Availability{
+						Bicycles: 1,
+					},
+				},
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+			if d.invalidModified != 1 {
+				t.Errorf("wanted 1 station with invalid modified, got %v", d.invalidModified)
+			}
+		})
+	}
+}
+
+func TestDecoder_Streaming(t *testing.T) {
+	t.Parallel()
+
+	b := loadFixture(t)
+	want, err := decodeAll(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &decoder{}
+	d.readFrom(iotest.HalfReader(bytes.NewReader(b)))
+	got, err := d.decodeStations(nil, func(*PropertyError) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatal("result differs from decoding the whole body")
+	}
+	if d.read != len(b) {
+		t.Errorf("wanted %v bytes read, got %v", len(b), d.read)
+	}
+	// The buffer holds roughly a station, not the response.
+	if size := cap(d.buf); size > 64<<10 {
+		t.Errorf("buffer grew to %v bytes", size)
+	}
+}
+
+func TestDecoder_ReadError(t *testing.T) {
+	t.Parallel()
+
+	b := loadFixture(t)
+	d := &decoder{}
+	d.readFrom(io.MultiReader(bytes.NewReader(b[:len(b)/2]), iotest.ErrReader(context.DeadlineExceeded)))
+	_, err := d.decodeStations(nil, func(*PropertyError) {})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("wanted read error, got %v", err)
+	}
+	if class := ClassOf(ClassifyDecodeError(err)); class != ClassTimeout {
+		t.Errorf("wanted %v error, got %v", ClassTimeout, class)
+	}
+}
+
+func TestDecoder_SyntaxErrors(t *testing.T) {
+	bodies := []string{
+		``,
+		`[`,
+		`{}`,
+		`[{"id": "BikePoints_1"},]`,
+		`[{"id": "BikePoints_1"}] []`,
+		`[{"id": "BikePoints_1}]`,
+		`[{"id": "BikePoints_1", "lat": 01}]`,
+		`[{"id": "BikePoints_1", "lat": tru}]`,
+		`[{"id": "BikePoints_1\x"}]`,
+		`[{id: "BikePoints_1"}]`,
+	}
+	for _, body := range bodies {
+		body := body
+		t.Run(body, func(t *testing.T) {
+			t.Parallel()
+			got, err := decodeAll([]byte(body))
+			if err == nil {
+				t.Fatalf("wanted error, got %v", got)
+			}
+			if class := ClassOf(err); class != ClassDecode {
+				t.Errorf("wanted %v error, got %v: %v", ClassDecode, class, err)
+			}
+		})
+	}
+}
+
+// BenchmarkDecode compares decoding a response as it is read, as a fetch does,
+// including allocating the result.
+func BenchmarkDecode(b *testing.B) {
+	fixture := loadFixture(b)
+	b.Run("decoder", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(fixture)))
+		for i := 0; i < b.N; i++ {
+			d := decoders.Get().(*decoder)
+			d.readFrom(bytes.NewReader(fixture))
+			_, err := d.decodeStations(make([]StationAvailability, 0, 1024), func(*PropertyError) {})
+			decoders.Put(d)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("encoding_json", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(fixture)))
+		for i := 0; i < b.N; i++ {
+			if _, err := legacyDecode(bytes.NewReader(fixture)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,177 @@
+package bikepoint
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// ErrorClass is a coarse category of failure, suitable for use as a metric
+// label.
+type ErrorClass string
+
+const (
+	// ClassTimeout indicates an attempt did not complete in time, or the
+	// caller gave up waiting.
+	ClassTimeout ErrorClass = "timeout"
+
+	// ClassNetwork indicates a failure to connect or exchange data, e.g. DNS
+	// resolution, a refused connection or a TLS handshake error.
+	ClassNetwork ErrorClass = "network"
+
+	// ClassHTTP4xx indicates the API rejected the request, other than due to
+	// rate limiting.
+	ClassHTTP4xx ErrorClass = "http_4xx"
+
+	// ClassHTTP5xx indicates the API failed to handle the request.
+	ClassHTTP5xx ErrorClass = "http_5xx"
+
+	// ClassRateLimited indicates the API returned 429 Too Many Requests.
+	ClassRateLimited ErrorClass = "rate_limited"
+
+	// ClassDecode indicates the response was not valid JSON of the expected
+	// shape.
+	ClassDecode ErrorClass = "decode"
+
+	// ClassValidation indicates the response was well-formed, but contained
+	// values we could not interpret or did not trust.
+	ClassValidation ErrorClass = "validation"
+
+	// ClassCircuitOpen indicates no request was made, as the client's
+	// circuit breaker was open following repeated failures.
+	ClassCircuitOpen ErrorClass = "circuit_open"
+
+	// ClassUnknown is returned by ClassOf() for errors not otherwise
+	// classified.
+	ClassUnknown ErrorClass = "unknown"
+)
+
+// ErrorClasses lists every class, so metrics can be initialised for each.
+var ErrorClasses = []ErrorClass{
+	ClassTimeout,
+	ClassNetwork,
+	ClassHTTP4xx,
+	ClassHTTP5xx,
+	ClassRateLimited,
+	ClassDecode,
+	ClassValidation,
+	ClassCircuitOpen,
+	ClassUnknown,
+}
+
+// Error is returned by clients to indicate the class of a failure. Use
+// ClassOf() rather than asserting for this directly, as not every error is
+// wrapped.
+type Error struct {
+	Class ErrorClass
+	Err   error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ClassOf returns the class of an error returned by a client.
+func ClassOf(err error) ErrorClass {
+	var classified *Error
+	switch {
+	case errors.As(err, &classified):
+		return classified.Class
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return ClassTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return ClassTimeout
+		}
+		return ClassNetwork
+	}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var decoderErr *SyntaxError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) || errors.As(err, &decoderErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF) {
+		return ClassDecode
+	}
+	return ClassUnknown
+}
+
+// ClassifyTransportError wraps an error returned by http.Client.Do().
+func ClassifyTransportError(err error) error {
+	class := ClassOf(err)
+	if class == ClassUnknown {
+		// e.g. an unsupported protocol scheme, which is closest to being
+		// unable to connect.
+		class = ClassNetwork
+	}
+	return &Error{
+		Class: class,
+		Err:   err,
+	}
+}
+
+// ClassifyDecodeError wraps an error returned when decoding a response body.
+// Errors already classified, e.g. by an UnmarshalJSON() implementation, are
+// returned unchanged.
+func ClassifyDecodeError(err error) error {
+	var classified *Error
+	if errors.As(err, &classified) {
+		return err
+	}
+	class := ClassDecode
+	if ClassOf(err) == ClassTimeout {
+		// The body may be cut off by the attempt timing out.
+		class = ClassTimeout
+	}
+	return &Error{
+		Class: class,
+		Err:   err,
+	}
+}
+
+// StatusError is the underlying error of an unexpected HTTP response status.
+// It allows callers to distinguish statuses sharing a class, e.g. an app key
+// being rejected.
+type StatusError struct {
+	StatusCode int
+
+	// Message is the response body, which may be empty.
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("got HTTP %v", e.StatusCode)
+	}
+	return fmt.Sprintf("got HTTP %v: %v", e.StatusCode, e.Message)
+}
+
+// NewStatusError returns an error for an unexpected HTTP response status. The
+// message is included in the error if not empty. Statuses below 400 are
+// classed as http_4xx, as we similarly cannot do anything with them. The
+// status can be retrieved with errors.As() and a *StatusError.
+func NewStatusError(status int, msg string) error {
+	class := ClassHTTP4xx
+	switch {
+	case status == http.StatusTooManyRequests:
+		class = ClassRateLimited
+	case status >= http.StatusInternalServerError:
+		class = ClassHTTP5xx
+	}
+	return &Error{
+		Class: class,
+		Err: &StatusError{
+			StatusCode: status,
+			Message:    msg,
+		},
+	}
+}
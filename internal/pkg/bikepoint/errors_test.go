@@ -0,0 +1,147 @@
+package bikepoint
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestClassOf(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{
+			name: "classified",
+			err:  &Error{Class: ClassValidation, Err: errors.New("negative")},
+			want: ClassValidation,
+		},
+		{
+			name: "wrapped classified",
+			err:  fmt.Errorf("fetch: %w", &Error{Class: ClassHTTP5xx, Err: errors.New("503")}),
+			want: ClassHTTP5xx,
+		},
+		{
+			name: "deadline",
+			err:  &url.Error{Op: "Get", URL: DefaultEndpoint, Err: context.DeadlineExceeded},
+			want: ClassTimeout,
+		},
+		{
+			name: "cancelled",
+			err:  context.Canceled,
+			want: ClassTimeout,
+		},
+		{
+			name: "dns",
+			err: &url.Error{Op: "Get", URL: DefaultEndpoint, Err: &net.OpError{
+				Op:  "dial",
+				Err: &net.DNSError{Err: "no such host", Name: "api.tfl.gov.uk"},
+			}},
+			want: ClassNetwork,
+		},
+		{
+			name: "dns timeout",
+			err: &net.OpError{
+				Op:  "dial",
+				Err: &net.DNSError{Err: "i/o timeout", Name: "api.tfl.gov.uk", IsTimeout: true},
+			},
+			want: ClassTimeout,
+		},
+		{
+			name: "syntax",
+			err:  json.Unmarshal([]byte("[{"), &[]StationAvailability{}),
+			want: ClassDecode,
+		},
+		{
+			name: "truncated",
+			err:  io.ErrUnexpectedEOF,
+			want: ClassDecode,
+		},
+		{
+			name: "other",
+			err:  errors.New("something else"),
+			want: ClassUnknown,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			if got := ClassOf(test.err); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewStatusError(t *testing.T) {
+	tests := []struct {
+		status int
+		want   ErrorClass
+	}{
+		{http.StatusNoContent, ClassHTTP4xx},
+		{http.StatusForbidden, ClassHTTP4xx},
+		{http.StatusTooManyRequests, ClassRateLimited},
+		{http.StatusInternalServerError, ClassHTTP5xx},
+		{http.StatusServiceUnavailable, ClassHTTP5xx},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(http.StatusText(test.status), func(t *testing.T) {
+			t.Parallel()
+			err := NewStatusError(test.status, "")
+			if got := ClassOf(err); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+			var statusErr *StatusError
+			if !errors.As(err, &statusErr) || statusErr.StatusCode != test.status {
+				t.Errorf("wanted *StatusError with status %v, got %#v", test.status, err)
+			}
+		})
+	}
+}
+
+func TestClassifyDecodeError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{
+			name: "syntax",
+			err:  &json.SyntaxError{},
+			want: ClassDecode,
+		},
+		{
+			name: "unrecognised",
+			err:  errors.New("invalid character"),
+			want: ClassDecode,
+		},
+		{
+			name: "already classified",
+			err:  &Error{Class: ClassValidation, Err: errors.New("bad value")},
+			want: ClassValidation,
+		},
+		{
+			name: "timed out reading body",
+			err:  context.DeadlineExceeded,
+			want: ClassTimeout,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			if got := ClassOf(ClassifyDecodeError(test.err)); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
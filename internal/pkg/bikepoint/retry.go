@@ -0,0 +1,98 @@
+package bikepoint
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+// RetryPolicy determines how failed requests to /BikePoint are retried. Waits
+// grow exponentially from InitialInterval. Attempts continue until one
+// succeeds, fails permanently, MaxAttempts is reached, or the fetch's context
+// expires. Start from DefaultRetryPolicy(), as the zero value is not valid.
+type RetryPolicy struct {
+
+	// InitialInterval is the wait before the first retry.
+	InitialInterval time.Duration `yaml:"initial_interval"`
+
+	// Multiplier is the factor by which the wait grows after each retry.
+	Multiplier float64 `yaml:"multiplier"`
+
+	// MaxInterval caps the wait between attempts.
+	MaxInterval time.Duration `yaml:"max_interval"`
+
+	// MaxAttempts limits the requests made by a fetch, including the first.
+	// If 0, attempts are only limited by the context.
+	MaxAttempts int `yaml:"max_attempts"`
+
+	// Jitter randomises each wait by up to this fraction either way, so
+	// exporters that failed together do not retry together. 0 disables it.
+	Jitter float64 `yaml:"jitter"`
+
+	// RetryableStatusCodes are the HTTP statuses after which to retry. Any
+	// other non-200 status fails the fetch immediately. If empty, every 5xx
+	// status is retried.
+	RetryableStatusCodes []int `yaml:"retryable_status_codes"`
+}
+
+// DefaultRetryPolicy returns the policy used unless configured otherwise.
+// Waits start at 500ms, growing by 1.5x to at most 1m, with 50% jitter, and
+// 5xx statuses are retried.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		InitialInterval: backoff.DefaultInitialInterval,
+		Multiplier:      backoff.DefaultMultiplier,
+		MaxInterval:     backoff.DefaultMaxInterval,
+		Jitter:          backoff.DefaultRandomizationFactor,
+	}
+}
+
+// Validate returns an error if the policy is invalid.
+func (p RetryPolicy) Validate() error {
+	if p.InitialInterval <= 0 {
+		return errors.New("initial_interval must be positive")
+	}
+	if p.Multiplier < 1 {
+		return fmt.Errorf("multiplier must be at least 1, got %v", p.Multiplier)
+	}
+	if p.MaxInterval < p.InitialInterval {
+		return fmt.Errorf("max_interval must be at least initial_interval (%v), got %v", p.InitialInterval, p.MaxInterval)
+	}
+	if p.MaxAttempts < 0 {
+		return fmt.Errorf("max_attempts must not be negative, got %v", p.MaxAttempts)
+	}
+	if p.Jitter < 0 || p.Jitter >= 1 {
+		return fmt.Errorf("jitter must be in [0, 1), got %v", p.Jitter)
+	}
+	for _, code := range p.RetryableStatusCodes {
+		if code < 100 || code > 599 || code == http.StatusOK {
+			return fmt.Errorf("invalid retryable status code %v", code)
+		}
+	}
+	return nil
+}
+
+// retryable returns whether a response with the status should be retried.
+func (p RetryPolicy) retryable(status int) bool {
+	if len(p.RetryableStatusCodes) == 0 {
+		return status >= http.StatusInternalServerError
+	}
+	return slices.Contains(p.RetryableStatusCodes, status)
+}
+
+// newBackOff returns a fresh backoff implementing the policy, for one fetch.
+func (p RetryPolicy) newBackOff() backoff.BackOff {
+	b := backoff.NewExponentialBackOff(
+		backoff.WithInitialInterval(p.InitialInterval),
+		backoff.WithMultiplier(p.Multiplier),
+		backoff.WithMaxInterval(p.MaxInterval),
+		backoff.WithRandomizationFactor(p.Jitter))
+	if p.MaxAttempts > 0 {
+		return backoff.WithMaxRetries(b, uint64(p.MaxAttempts-1))
+	}
+	return b
+}
@@ -0,0 +1,184 @@
+package bikepoint
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestRetryPolicy_Validate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		modify  func(*RetryPolicy)
+		wantErr bool
+	}{
+		{
+			name:   "default",
+			modify: func(*RetryPolicy) {},
+		},
+		{
+			name: "custom",
+			modify: func(p *RetryPolicy) {
+				p.InitialInterval = time.Second
+				p.Multiplier = 1
+				p.MaxInterval = time.Second
+				p.MaxAttempts = 3
+				p.Jitter = 0
+				p.RetryableStatusCodes = []int{http.StatusTooManyRequests, http.StatusBadGateway}
+			},
+		},
+		{
+			name:    "zero initial interval",
+			modify:  func(p *RetryPolicy) { p.InitialInterval = 0 },
+			wantErr: true,
+		},
+		{
+			name:    "shrinking",
+			modify:  func(p *RetryPolicy) { p.Multiplier = .5 },
+			wantErr: true,
+		},
+		{
+			name:    "max below initial",
+			modify:  func(p *RetryPolicy) { p.MaxInterval = p.InitialInterval / 2 },
+			wantErr: true,
+		},
+		{
+			name:    "negative attempts",
+			modify:  func(p *RetryPolicy) { p.MaxAttempts = -1 },
+			wantErr: true,
+		},
+		{
+			name:    "jitter of 1",
+			modify:  func(p *RetryPolicy) { p.Jitter = 1 },
+			wantErr: true,
+		},
+		{
+			name:    "retrying success",
+			modify:  func(p *RetryPolicy) { p.RetryableStatusCodes = []int{http.StatusOK} },
+			wantErr: true,
+		},
+		{
+			name:    "invalid status",
+			modify:  func(p *RetryPolicy) { p.RetryableStatusCodes = []int{1000} },
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			policy := DefaultRetryPolicy()
+			test.modify(&policy)
+			if err := policy.Validate(); (err != nil) != test.wantErr {
+				t.Errorf("wanted error %v, got %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestRetryPolicy_newBackOff(t *testing.T) {
+	t.Parallel()
+
+	policy := RetryPolicy{
+		InitialInterval: time.Second,
+		Multiplier:      2,
+		MaxInterval:     3 * time.Second,
+		MaxAttempts:     4,
+	}
+	b := policy.newBackOff()
+	// No jitter, so waits are exact; 3 retries follow the first attempt.
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, backoff.Stop} {
+		if got := b.NextBackOff(); got != want {
+			t.Errorf("wait %v: got %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestClient_FetchStationAvailabilitiesRetryPolicy(t *testing.T) {
+	// Not parallel, so the attempts histogram only observes these fetches.
+	tests := []struct {
+		name         string
+		status       int
+		opts         []ClientOption
+		wantRequests int32
+	}{
+		{
+			name:         "5xx retried until max attempts",
+			status:       http.StatusServiceUnavailable,
+			opts:         []ClientOption{WithMaxAttempts(3)},
+			wantRequests: 3,
+		},
+		{
+			name:         "429 not retried by default",
+			status:       http.StatusTooManyRequests,
+			opts:         []ClientOption{WithMaxAttempts(3)},
+			wantRequests: 1,
+		},
+		{
+			name:   "429 retried if configured",
+			status: http.StatusTooManyRequests,
+			opts: []ClientOption{
+				WithMaxAttempts(2),
+				WithRetryableStatusCodes(http.StatusTooManyRequests),
+			},
+			wantRequests: 2,
+		},
+		{
+			name:   "5xx not retried if not configured",
+			status: http.StatusServiceUnavailable,
+			opts: []ClientOption{
+				WithMaxAttempts(3),
+				WithRetryableStatusCodes(http.StatusTooManyRequests),
+			},
+			wantRequests: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requests := atomic.Int32{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				w.WriteHeader(test.status)
+			}))
+			defer server.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			before := histogramSum(t)
+			opts := append([]ClientOption{
+				WithEndpoint(server.URL),
+				WithInitialInterval(time.Millisecond),
+				WithMaxInterval(time.Millisecond),
+			}, test.opts...)
+			client := NewClient(slog.Default(), server.Client(), opts...)
+			if _, err := client.FetchStationAvailabilities(ctx); err == nil {
+				t.Fatal("wanted error")
+			}
+			if got := requests.Load(); got != test.wantRequests {
+				t.Errorf("wanted %v requests, got %v", test.wantRequests, got)
+			}
+			if got := histogramSum(t) - before; got != float64(test.wantRequests) {
+				t.Errorf("wanted %v attempts observed, got %v", test.wantRequests, got)
+			}
+		})
+	}
+}
+
+// histogramSum returns the total of observations of attemptsPerFetch.
+func histogramSum(t *testing.T) float64 {
+	t.Helper()
+	metric := &dto.Metric{}
+	if err := attemptsPerFetch.Write(metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetHistogram().GetSampleSum()
+}
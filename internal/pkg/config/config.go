@@ -0,0 +1,250 @@
+// Package config implements parsing of the exporter's optional YAML
+// configuration file.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/exporter"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/gbfs"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/notify"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/validate"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Supported values of Module.Provider.
+const (
+	ProviderBikePoint = "bikepoint"
+	ProviderGBFS      = "gbfs"
+)
+
+// Config is the root of the configuration file.
+type Config struct {
+
+	// Modules are the named configurations available to /probe requests.
+	Modules map[string]Module `yaml:"modules"`
+
+	// Validation determines the checks applied to every snapshot before it
+	// is exported. Policies are merged with the defaults.
+	Validation validate.Config `yaml:"validation"`
+
+	// Notifications are the webhooks to call when TfL's stations start
+	// meeting a condition.
+	Notifications notify.Config `yaml:"notifications"`
+
+	// Retry determines how failed requests to /BikePoint are retried, by
+	// TfL's client and bikepoint modules. Fields are merged with the
+	// defaults.
+	Retry bikepoint.RetryPolicy `yaml:"retry"`
+
+	// CircuitBreaker determines when requests to /BikePoint stop after
+	// repeated failures, by TfL's client and bikepoint modules. Fields are
+	// merged with the defaults, which disable it.
+	CircuitBreaker bikepoint.BreakerPolicy `yaml:"circuit_breaker"`
+}
+
+// Module configures how to fetch a system's data for /probe. Unset fields
+// are given defaults by Parse().
+type Module struct {
+
+	// Provider is the API the system exposes: "bikepoint" (the default) or
+	// "gbfs".
+	Provider string `yaml:"provider"`
+
+	// Endpoint is the URL of the /BikePoint resource, or the gbfs.json
+	// discovery file. This is required for GBFS, and defaults to TfL's
+	// production API for BikePoint.
+	Endpoint string `yaml:"endpoint"`
+
+	// AppKey is the TfL Unified API application key. It only applies to
+	// BikePoint.
+	AppKey string `yaml:"app_key"`
+
+	// Language selects between translations of 2.x GBFS discovery files. It
+	// only applies to GBFS.
+	Language string `yaml:"language"`
+
+	// System is the value of the `system` label, and the probe target
+	// selecting all stations. It defaults to the module's name, and must be
+	// unique across modules, and differ from the systems of /stations.
+	System string `yaml:"system"`
+
+	// Timeout bounds the time spent on a probe, including retries. It
+	// defaults to 10s.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Filters are named groups of stations, each listed by ID or name, which
+	// can be passed as the probe target.
+	Filters map[string][]string `yaml:"filters"`
+
+	// retry is the config's retry policy, copied by Parse().
+	retry bikepoint.RetryPolicy
+
+	// breaker is the config's circuit breaker policy, copied by Parse().
+	breaker bikepoint.BreakerPolicy
+}
+
+// Default returns the configuration used if no file is provided.
+func Default() *Config {
+	c, err := Parse(nil)
+	if err != nil {
+		// The defaults are tested.
+		panic(err)
+	}
+	return c
+}
+
+// Load reads and parses the configuration file at path. See Parse() for
+// reservedSystems.
+func Load(path string, reservedSystems ...string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(b, reservedSystems...)
+}
+
+// Parse decodes a configuration file, applies defaults and validates the
+// result. Unknown fields are an error, to catch typos. Modules may not use
+// the names of reservedSystems, such as those exported by /stations.
+func Parse(b []byte, reservedSystems ...string) (*Config, error) {
+	c := &Config{
+		Validation:     validate.DefaultConfig(),
+		Retry:          bikepoint.DefaultRetryPolicy(),
+		CircuitBreaker: bikepoint.DefaultBreakerPolicy(),
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	// An empty file is a valid, empty config.
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if err := c.Retry.Validate(); err != nil {
+		return nil, fmt.Errorf("retry: %w", err)
+	}
+	if err := c.CircuitBreaker.Validate(); err != nil {
+		return nil, fmt.Errorf("circuit_breaker: %w", err)
+	}
+	// Modules are validated in order, so errors are deterministic.
+	names := slices.Sorted(maps.Keys(c.Modules))
+	systems := make(map[string]string, len(names))
+	for _, name := range names {
+		module := c.Modules[name]
+		if err := module.setDefaultsAndValidate(name); err != nil {
+			return nil, fmt.Errorf("module %q: %w", name, err)
+		}
+		// Validation and timestamp state is kept per system.
+		if slices.Contains(reservedSystems, module.System) {
+			return nil, fmt.Errorf("module %q: system %q is already used by /stations",
+				name, module.System)
+		}
+		if other, ok := systems[module.System]; ok {
+			return nil, fmt.Errorf("module %q: system %q is already used by module %q",
+				name, module.System, other)
+		}
+		systems[module.System] = name
+		module.retry = c.Retry
+		module.breaker = c.CircuitBreaker
+		c.Modules[name] = module
+	}
+	if err := c.Validation.Validate(); err != nil {
+		return nil, fmt.Errorf("validation: %w", err)
+	}
+	if err := c.Notifications.Validate(); err != nil {
+		return nil, fmt.Errorf("notifications: %w", err)
+	}
+	return c, nil
+}
+
+func (m *Module) setDefaultsAndValidate(name string) error {
+	if m.Provider == "" {
+		m.Provider = ProviderBikePoint
+	}
+	if m.System == "" {
+		m.System = name
+	}
+	if m.Timeout == 0 {
+		m.Timeout = 10 * time.Second
+	}
+
+	switch m.Provider {
+	case ProviderBikePoint:
+		if m.Endpoint == "" {
+			m.Endpoint = bikepoint.DefaultEndpoint
+		}
+		if m.Language != "" {
+			return errors.New("language is not supported by the bikepoint provider")
+		}
+	case ProviderGBFS:
+		if m.Endpoint == "" {
+			return errors.New("endpoint is required by the gbfs provider")
+		}
+		if m.AppKey != "" {
+			return errors.New("app_key is not supported by the gbfs provider")
+		}
+	default:
+		return fmt.Errorf("unknown provider %q", m.Provider)
+	}
+
+	if u, err := url.Parse(m.Endpoint); err != nil {
+		return fmt.Errorf("invalid endpoint: %w", err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("endpoint %q must be http or https", m.Endpoint)
+	}
+	if m.Timeout < 0 {
+		return errors.New("timeout must be positive")
+	}
+	for filter, stations := range m.Filters {
+		if filter == m.System {
+			return fmt.Errorf("filter %q has the same name as the system", filter)
+		}
+		if len(stations) == 0 {
+			return fmt.Errorf("filter %q has no stations", filter)
+		}
+	}
+	return nil
+}
+
+// ProbeModules builds the modules for exporter.NewProber().
+func (c Config) ProbeModules(logger *slog.Logger, httpClient *http.Client) map[string]exporter.Module {
+	modules := make(map[string]exporter.Module, len(c.Modules))
+	for name, module := range c.Modules {
+		modules[name] = exporter.Module{
+			System: exporter.System{
+				Name:     module.System,
+				Provider: module.NewProvider(logger, httpClient),
+			},
+			Timeout: module.Timeout,
+			Filters: module.Filters,
+		}
+	}
+	return modules
+}
+
+// NewProvider creates a client for the module's system. The module must have
+// been returned by Parse().
+func (m Module) NewProvider(logger *slog.Logger, httpClient *http.Client) exporter.Provider {
+	switch m.Provider {
+	case ProviderGBFS:
+		return gbfs.NewClient(logger, httpClient, m.Endpoint,
+			gbfs.WithLanguage(m.Language))
+	default:
+		return bikepoint.NewClient(logger, httpClient,
+			bikepoint.WithEndpoint(m.Endpoint),
+			bikepoint.WithAppKey(m.AppKey),
+			bikepoint.WithRetryPolicy(m.retry),
+			bikepoint.WithCircuitBreaker(m.breaker))
+	}
+}
@@ -0,0 +1,387 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/notify"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/validate"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		reserved []string
+		want     *Config
+		wantErr  bool
+	}{
+		{
+			name: "empty",
+			yaml: "",
+			want: &Config{
+				Validation:     validate.DefaultConfig(),
+				Retry:          bikepoint.DefaultRetryPolicy(),
+				CircuitBreaker: bikepoint.DefaultBreakerPolicy(),
+			},
+		},
+		{
+			name: "defaults",
+			yaml: `
+modules:
+  tfl: {}
+`,
+			want: &Config{
+				Modules: map[string]Module{
+					"tfl": {
+						Provider: ProviderBikePoint,
+						Endpoint: bikepoint.DefaultEndpoint,
+						System:   "tfl",
+						Timeout:  10 * time.Second,
+						retry:    bikepoint.DefaultRetryPolicy(),
+						breaker:  bikepoint.DefaultBreakerPolicy(),
+					},
+				},
+				Validation:     validate.DefaultConfig(),
+				Retry:          bikepoint.DefaultRetryPolicy(),
+				CircuitBreaker: bikepoint.DefaultBreakerPolicy(),
+			},
+		},
+		{
+			name: "full",
+			yaml: `
+modules:
+  office:
+    provider: bikepoint
+    endpoint: http://localhost:8080/BikePoint
+    app_key: secret
+    system: london
+    timeout: 5s
+    filters:
+      holborn:
+      - BikePoints_1
+      - Stonecutter Street, Holborn
+  cardiff:
+    provider: gbfs
+    endpoint: https://example.com/gbfs.json
+    language: en
+`,
+			want: &Config{
+				Modules: map[string]Module{
+					"office": {
+						Provider: ProviderBikePoint,
+						Endpoint: "http://localhost:8080/BikePoint",
+						AppKey:   "secret",
+						System:   "london",
+						Timeout:  5 * time.Second,
+						retry:    bikepoint.DefaultRetryPolicy(),
+						breaker:  bikepoint.DefaultBreakerPolicy(),
+						Filters: map[string][]string{
+							"holborn": {"BikePoints_1", "Stonecutter Street, Holborn"},
+						},
+					},
+					"cardiff": {
+						Provider: ProviderGBFS,
+						Endpoint: "https://example.com/gbfs.json",
+						Language: "en",
+						System:   "cardiff",
+						Timeout:  10 * time.Second,
+						retry:    bikepoint.DefaultRetryPolicy(),
+						breaker:  bikepoint.DefaultBreakerPolicy(),
+					},
+				},
+				Validation:     validate.DefaultConfig(),
+				Retry:          bikepoint.DefaultRetryPolicy(),
+				CircuitBreaker: bikepoint.DefaultBreakerPolicy(),
+			},
+		},
+		{
+			name: "validation",
+			yaml: `
+validation:
+  min_stations: 700
+  last_good_max_age: 5m
+  policies:
+    consistent: ignore
+    non_negative: fail
+    min_stations: last_good
+`,
+			want: &Config{
+				Validation: validate.Config{
+					MinStations:    700,
+					LastGoodMaxAge: 5 * time.Minute,
+					Policies: map[validate.Rule]validate.Policy{
+						validate.RuleNonNegative: validate.PolicyFail,
+						validate.RuleConsistent:  validate.PolicyIgnore,
+						validate.RuleMinStations: validate.PolicyLastGood,
+					},
+				},
+				Retry:          bikepoint.DefaultRetryPolicy(),
+				CircuitBreaker: bikepoint.DefaultBreakerPolicy(),
+			},
+		},
+		{
+			name: "notifications",
+			yaml: `
+notifications:
+  webhooks:
+  - name: office
+    url: https://example.com/hook
+    secret: s3cret
+  rules:
+  - name: holborn-empty
+    stations:
+    - BikePoints_1
+    condition: empty
+    cooldown: 30m
+`,
+			want: &Config{
+				Validation:     validate.DefaultConfig(),
+				Retry:          bikepoint.DefaultRetryPolicy(),
+				CircuitBreaker: bikepoint.DefaultBreakerPolicy(),
+				Notifications: notify.Config{
+					Webhooks: []notify.Webhook{
+						{Name: "office", URL: "https://example.com/hook", Secret: "s3cret"},
+					},
+					Rules: []notify.Rule{
+						{
+							Name:      "holborn-empty",
+							Stations:  []string{"BikePoints_1"},
+							Condition: notify.ConditionEmpty,
+							Cooldown:  30 * time.Minute,
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "invalid notification rule",
+			yaml: `
+notifications:
+  webhooks:
+  - name: office
+    url: https://example.com/hook
+  rules:
+  - name: few-ebikes
+    condition: ebikes_below
+`,
+			wantErr: true,
+		},
+		{
+			name: "invalid validation policy",
+			yaml: `
+validation:
+  policies:
+    min_stations: drop
+`,
+			wantErr: true,
+		},
+		{
+			name: "unknown field",
+			yaml: `
+modules:
+  tfl:
+    timeuot: 5s
+`,
+			wantErr: true,
+		},
+		{
+			name: "duplicate system",
+			yaml: `
+modules:
+  tfl:
+  tfl_staging:
+    endpoint: https://staging.example.com/BikePoint
+    system: tfl
+`,
+			wantErr: true,
+		},
+		{
+			name: "reserved system",
+			yaml: `
+modules:
+  tfl:
+`,
+			reserved: []string{"tfl"},
+			wantErr:  true,
+		},
+		{
+			name: "reserved gbfs system",
+			yaml: `
+modules:
+  cardiff_probe:
+    provider: gbfs
+    endpoint: https://example.com/gbfs.json
+    system: cardiff
+`,
+			reserved: []string{"tfl", "cardiff"},
+			wantErr:  true,
+		},
+		{
+			name: "unknown provider",
+			yaml: `
+modules:
+  tfl:
+    provider: citybikes
+`,
+			wantErr: true,
+		},
+		{
+			name: "gbfs without endpoint",
+			yaml: `
+modules:
+  cardiff:
+    provider: gbfs
+`,
+			wantErr: true,
+		},
+		{
+			name: "gbfs with app key",
+			yaml: `
+modules:
+  cardiff:
+    provider: gbfs
+    endpoint: https://example.com/gbfs.json
+    app_key: secret
+`,
+			wantErr: true,
+		},
+		{
+			name: "retry",
+			yaml: `
+retry:
+  max_attempts: 3
+  jitter: 0
+  retryable_status_codes: [429, 503]
+modules:
+  tfl: {}
+`,
+			want: &Config{
+				Modules: map[string]Module{
+					"tfl": {
+						Provider: ProviderBikePoint,
+						Endpoint: bikepoint.DefaultEndpoint,
+						System:   "tfl",
+						Timeout:  10 * time.Second,
+						retry: bikepoint.RetryPolicy{
+							InitialInterval:      500 * time.Millisecond,
+							Multiplier:           1.5,
+							MaxInterval:          time.Minute,
+							MaxAttempts:          3,
+							RetryableStatusCodes: []int{429, 503},
+						},
+						breaker: bikepoint.DefaultBreakerPolicy(),
+					},
+				},
+				Validation: validate.DefaultConfig(),
+				Retry: bikepoint.RetryPolicy{
+					InitialInterval:      500 * time.Millisecond,
+					Multiplier:           1.5,
+					MaxInterval:          time.Minute,
+					MaxAttempts:          3,
+					RetryableStatusCodes: []int{429, 503},
+				},
+				CircuitBreaker: bikepoint.DefaultBreakerPolicy(),
+			},
+		},
+		{
+			name: "invalid retry",
+			yaml: `
+retry:
+  multiplier: 0.5
+`,
+			wantErr: true,
+		},
+		{
+			name: "circuit breaker",
+			yaml: `
+circuit_breaker:
+  failure_threshold: 5
+  serve_stale: true
+modules:
+  tfl: {}
+`,
+			want: &Config{
+				Modules: map[string]Module{
+					"tfl": {
+						Provider: ProviderBikePoint,
+						Endpoint: bikepoint.DefaultEndpoint,
+						System:   "tfl",
+						Timeout:  10 * time.Second,
+						retry:    bikepoint.DefaultRetryPolicy(),
+						breaker: bikepoint.BreakerPolicy{
+							FailureThreshold: 5,
+							OpenDuration:     30 * time.Second,
+							ServeStale:       true,
+						},
+					},
+				},
+				Validation: validate.DefaultConfig(),
+				Retry:      bikepoint.DefaultRetryPolicy(),
+				CircuitBreaker: bikepoint.BreakerPolicy{
+					FailureThreshold: 5,
+					OpenDuration:     30 * time.Second,
+					ServeStale:       true,
+				},
+			},
+		},
+		{
+			name: "invalid circuit breaker",
+			yaml: `
+circuit_breaker:
+  failure_threshold: -1
+`,
+			wantErr: true,
+		},
+		{
+			name: "invalid endpoint scheme",
+			yaml: `
+modules:
+  tfl:
+    endpoint: ftp://example.com/BikePoint
+`,
+			wantErr: true,
+		},
+		{
+			name: "filter named after system",
+			yaml: `
+modules:
+  tfl:
+    filters:
+      tfl: [BikePoints_1]
+`,
+			wantErr: true,
+		},
+		{
+			name: "empty filter",
+			yaml: `
+modules:
+  tfl:
+    filters:
+      holborn: []
+`,
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := Parse([]byte(test.yaml), test.reserved...)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("wanted error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
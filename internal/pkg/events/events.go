@@ -0,0 +1,278 @@
+// Package events streams changes to stations' availability as Server-Sent
+// Events, so dashboards can be updated without polling /stations.
+//
+// Events are computed by diffing consecutive snapshots. Each has an ID, which
+// browsers send back in the Last-Event-ID header when reconnecting, allowing
+// the stream to resume from a buffer of recent events. If the ID is too old,
+// or from a previous run of the exporter, the client is sent the current state
+// of every station instead, as on its first connection.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/watch"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Types of event.
+const (
+	// TypeUpdate is sent with the state of a station that was added or
+	// changed.
+	TypeUpdate = "update"
+
+	// TypeRemove is sent with the last state of a station that disappeared
+	// from the API.
+	TypeRemove = "remove"
+)
+
+// subscriberBuffer is the number of snapshots' worth of events a subscriber
+// can fall behind by before being disconnected.
+const subscriberBuffer = 16
+
+// errClosed is returned when subscribing to a closed broker.
+var errClosed = errors.New("broker closed")
+
+var (
+	subscribers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tflcycles_exporter_events_subscribers",
+		Help: "The number of clients connected to the event stream.",
+	})
+	slowSubscribers = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tflcycles_exporter_events_slow_subscribers_total",
+		Help: "The number of clients disconnected from the event stream for falling behind.",
+	})
+)
+
+type stationJSON struct {
+	ID                string    `json:"id"`
+	Name              string    `json:"name"`
+	Docks             int       `json:"docks"`
+	DocksAvailable    int       `json:"docks_available"`
+	BicyclesAvailable int       `json:"bicycles_available"`
+	EBikesAvailable   int       `json:"ebikes_available"`
+	Locked            bool      `json:"locked"`
+	Lat               float64   `json:"lat"`
+	Lon               float64   `json:"lon"`
+	Time              time.Time `json:"time"`
+}
+
+// event is a change to a station, ready to be written to clients.
+type event struct {
+	seq         uint64
+	typ         string
+	stationID   string
+	stationName string
+	data        []byte
+}
+
+func newEvent(seq uint64, typ string, t time.Time, sa *bikepoint.StationAvailability) event {
+	data, err := json.Marshal(stationJSON{
+		ID:                sa.Station.ID,
+		Name:              sa.Station.Name,
+		Docks:             sa.Station.Docks,
+		DocksAvailable:    sa.Availability.Docks,
+		BicyclesAvailable: sa.Availability.Bicycles,
+		EBikesAvailable:   sa.Availability.EBikes,
+		Locked:            sa.Availability.Locked,
+		Lat:               sa.Station.Lat,
+		Lon:               sa.Station.Lon,
+		Time:              t.UTC(),
+	})
+	if err != nil {
+		// stationJSON contains only marshallable types.
+		panic(err)
+	}
+	return event{
+		seq:         seq,
+		typ:         typ,
+		stationID:   sa.Station.ID,
+		stationName: sa.Station.Name,
+		data:        data,
+	}
+}
+
+// subscriber receives batches of events, one per snapshot. The channel is
+// closed if the subscriber falls behind, or the broker is closed.
+type subscriber struct {
+	events chan []event
+}
+
+// BrokerOption customises a Broker.
+type BrokerOption func(*Broker)
+
+// WithBufferSize sets the number of events kept for clients resuming the
+// stream. It defaults to 5,000, which is several minutes of changes to TfL's
+// stations at busy times.
+func WithBufferSize(n int) BrokerOption {
+	return func(b *Broker) {
+		b.BufferSize = n
+	}
+}
+
+// Broker turns snapshots into events, and fans them out to subscribers. It
+// implements watch.Observer. Create instances with NewBroker().
+type Broker struct {
+	Logger     *slog.Logger
+	BufferSize int
+
+	// generation distinguishes event IDs from those of previous runs, which
+	// may have the same sequence numbers.
+	generation string
+
+	mu          sync.Mutex
+	closed      bool
+	seq         uint64 // of the last event
+	differ      watch.Differ
+	time        time.Time // of the differ's snapshot
+	buffer      []event   // contiguous, ending at seq
+	subscribers map[*subscriber]struct{}
+}
+
+// NewBroker creates a broker with no events.
+func NewBroker(logger *slog.Logger, opts ...BrokerOption) *Broker {
+	b := &Broker{
+		Logger:      logger,
+		BufferSize:  5000,
+		generation:  strconv.FormatInt(time.Now().UnixMilli(), 36),
+		subscribers: make(map[*subscriber]struct{}),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// Observe creates an event for each station that changed since the last
+// snapshot, and sends them to subscribers. Every station is sent as an update
+// after the first snapshot.
+func (b *Broker) Observe(ctx context.Context, t time.Time, stationAvailabilities []bikepoint.StationAvailability) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+
+	var batch []event
+	for _, change := range b.differ.Next(stationAvailabilities) {
+		b.seq++
+		if change.Current == nil {
+			batch = append(batch, newEvent(b.seq, TypeRemove, t, change.Previous))
+		} else {
+			batch = append(batch, newEvent(b.seq, TypeUpdate, t, change.Current))
+		}
+	}
+	b.time = t
+	if len(batch) == 0 {
+		return
+	}
+
+	b.buffer = append(b.buffer, batch...)
+	if excess := len(b.buffer) - b.BufferSize; excess > 0 {
+		b.buffer = b.buffer[excess:]
+	}
+	for sub := range b.subscribers {
+		select {
+		case sub.events <- batch:
+		default:
+			// The client can reconnect and resume from the buffer, rather
+			// than us blocking the poller.
+			slowSubscribers.Inc()
+			b.Logger.WarnContext(ctx, "disconnecting slow event subscriber")
+			b.remove(sub)
+		}
+	}
+}
+
+// subscribe registers a subscriber, returning the events it should be sent
+// first: those after lastEventID if they are buffered, otherwise the current
+// state of every station.
+func (b *Broker) subscribe(lastEventID string) (*subscriber, []event, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, nil, errClosed
+	}
+	sub := &subscriber{
+		events: make(chan []event, subscriberBuffer),
+	}
+	b.subscribers[sub] = struct{}{}
+	subscribers.Inc()
+	if replay, ok := b.since(lastEventID); ok {
+		return sub, replay, nil
+	}
+	return sub, b.snapshot(), nil
+}
+
+// since returns the buffered events after id, and whether they are complete.
+func (b *Broker) since(id string) ([]event, bool) {
+	generation, seqStr, ok := strings.Cut(id, "-")
+	if !ok || generation != b.generation {
+		return nil, false
+	}
+	seq, err := strconv.ParseUint(seqStr, 10, 64)
+	if err != nil || seq > b.seq {
+		return nil, false
+	}
+	oldest := b.seq + 1 - uint64(len(b.buffer))
+	if seq+1 < oldest {
+		return nil, false
+	}
+	return slices.Clone(b.buffer[seq+1-oldest:]), true
+}
+
+// snapshot returns an update for every current station, all with the ID of
+// the latest event.
+func (b *Broker) snapshot() []event {
+	current := b.differ.Snapshot()
+	events := make([]event, len(current))
+	for i := range current {
+		events[i] = newEvent(b.seq, TypeUpdate, b.time, &current[i])
+	}
+	return events
+}
+
+// unsubscribe stops sending events to a subscriber. It is a no-op if the
+// subscriber was already removed.
+func (b *Broker) unsubscribe(sub *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subscribers[sub]; ok {
+		b.remove(sub)
+	}
+}
+
+// remove must be called with mu held.
+func (b *Broker) remove(sub *subscriber) {
+	delete(b.subscribers, sub)
+	close(sub.events)
+	subscribers.Dec()
+}
+
+// Close disconnects every subscriber, and rejects new ones. It should be
+// called when the server is shutting down, as streams otherwise never become
+// idle.
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for sub := range b.subscribers {
+		b.remove(sub)
+	}
+}
+
+// id returns the SSE ID of an event.
+func (b *Broker) id(e event) string {
+	return b.generation + "-" + strconv.FormatUint(e.seq, 10)
+}
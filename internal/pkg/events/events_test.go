@@ -0,0 +1,270 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+)
+
+var epoch = time.Date(2024, time.March, 4, 8, 0, 0, 0, time.UTC)
+
+func station(id string, bicycles int) bikepoint.StationAvailability {
+	return bikepoint.StationAvailability{
+		Station: bikepoint.Station{
+			ID:    id,
+			Name:  "Station " + id,
+			Docks: 10,
+		},
+		Availability: bikepoint.Availability{
+			Docks:    10 - bicycles,
+			Bicycles: bicycles,
+		},
+	}
+}
+
+// received is an event as parsed by a client.
+type received struct {
+	id       string
+	typ      string
+	station  string
+	bicycles int
+}
+
+// stream is a client connected to the event stream.
+type stream struct {
+	t       *testing.T
+	resp    *http.Response
+	scanner *bufio.Scanner
+}
+
+func connect(t *testing.T, server *httptest.Server, query url.Values, lastEventID string) *stream {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, server.URL+"?"+query.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		resp.Body.Close()
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got HTTP %v", resp.StatusCode)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("got Content-Type %v", contentType)
+	}
+	return &stream{
+		t:       t,
+		resp:    resp,
+		scanner: bufio.NewScanner(resp.Body),
+	}
+}
+
+// next returns the next event, or whether a heartbeat was received instead.
+// It fails the test if the stream ends.
+func (s *stream) next() (received, bool) {
+	s.t.Helper()
+	e := received{}
+	for s.scanner.Scan() {
+		line := s.scanner.Text()
+		switch {
+		case line == "":
+			return e, false
+		case strings.HasPrefix(line, ": heartbeat"):
+			// Consume the blank line terminating the comment.
+			s.scanner.Scan()
+			return e, true
+		case strings.HasPrefix(line, "id: "):
+			e.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			e.typ = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data := stationJSON{}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &data); err != nil {
+				s.t.Fatal(err)
+			}
+			e.station = data.ID
+			e.bicycles = data.BicyclesAvailable
+		}
+	}
+	s.t.Fatalf("stream ended: %v", s.scanner.Err())
+	return e, false
+}
+
+// events reads n events, ignoring heartbeats.
+func (s *stream) events(n int) []received {
+	s.t.Helper()
+	var events []received
+	for len(events) < n {
+		if e, heartbeat := s.next(); !heartbeat {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// ended returns whether the server closed the stream.
+func (s *stream) ended() bool {
+	for s.scanner.Scan() {
+	}
+	return s.scanner.Err() == nil
+}
+
+func assertEvents(t *testing.T, got []received, want []received) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range got {
+		// IDs are opaque, so are compared separately.
+		got, want := got[i], want[i]
+		got.id, want.id = "", ""
+		if got != want {
+			t.Errorf("event %v: got %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+func newServer(t *testing.T, broker *Broker, opts ...HandlerOption) *httptest.Server {
+	server := httptest.NewServer(NewHandler(slog.Default(), broker, opts...))
+	t.Cleanup(server.Close)
+	// Streams must be ended before the server can close.
+	t.Cleanup(broker.Close)
+	return server
+}
+
+func TestHandler(t *testing.T) {
+	t.Parallel()
+
+	broker := NewBroker(slog.Default())
+	server := newServer(t, broker)
+	broker.Observe(context.Background(), epoch, []bikepoint.StationAvailability{
+		station("1", 1), station("2", 2), station("3", 3),
+	})
+
+	s := connect(t, server, url.Values{"station": {"1", "Station 2"}}, "")
+	assertEvents(t, s.events(2), []received{
+		{typ: TypeUpdate, station: "1", bicycles: 1},
+		{typ: TypeUpdate, station: "2", bicycles: 2},
+	})
+
+	broker.Observe(context.Background(), epoch.Add(time.Minute), []bikepoint.StationAvailability{
+		station("2", 4), station("3", 5),
+	})
+	assertEvents(t, s.events(2), []received{
+		{typ: TypeUpdate, station: "2", bicycles: 4},
+		{typ: TypeRemove, station: "1", bicycles: 1},
+	})
+}
+
+func TestHandler_Resume(t *testing.T) {
+	t.Parallel()
+
+	broker := NewBroker(slog.Default(), WithBufferSize(3))
+	server := newServer(t, broker)
+	broker.Observe(context.Background(), epoch, []bikepoint.StationAvailability{
+		station("1", 1), station("2", 2),
+	})
+	initial := connect(t, server, nil, "").events(2)
+	last := initial[len(initial)-1].id
+
+	broker.Observe(context.Background(), epoch.Add(time.Minute), []bikepoint.StationAvailability{
+		station("1", 3), station("2", 2),
+	})
+	assertEvents(t, connect(t, server, nil, last).events(1), []received{
+		{typ: TypeUpdate, station: "1", bicycles: 3},
+	})
+
+	// Nothing is sent until the next change.
+	upToDate := connect(t, server, nil, broker.id(event{seq: 3}))
+	broker.Observe(context.Background(), epoch.Add(2*time.Minute), []bikepoint.StationAvailability{
+		station("1", 3), station("2", 4),
+	})
+	assertEvents(t, upToDate.events(1), []received{
+		{typ: TypeUpdate, station: "2", bicycles: 4},
+	})
+
+	// The event after last has been evicted.
+	broker.Observe(context.Background(), epoch.Add(3*time.Minute), []bikepoint.StationAvailability{
+		station("1", 5), station("2", 6),
+	})
+	for _, id := range []string{last, "0-1", "invalid", broker.id(event{seq: 7})} {
+		assertEvents(t, connect(t, server, nil, id).events(2), []received{
+			{typ: TypeUpdate, station: "1", bicycles: 5},
+			{typ: TypeUpdate, station: "2", bicycles: 6},
+		})
+	}
+}
+
+func TestHandler_Heartbeat(t *testing.T) {
+	t.Parallel()
+
+	broker := NewBroker(slog.Default())
+	server := newServer(t, broker, WithHeartbeat(time.Millisecond))
+	s := connect(t, server, nil, "")
+	if _, heartbeat := s.next(); !heartbeat {
+		t.Error("wanted heartbeat")
+	}
+}
+
+func TestHandler_Close(t *testing.T) {
+	t.Parallel()
+
+	broker := NewBroker(slog.Default())
+	server := newServer(t, broker, WithHeartbeat(time.Millisecond))
+	s := connect(t, server, nil, "")
+	// Ensure the handler has subscribed.
+	s.next()
+	broker.Close()
+	if !s.ended() {
+		t.Error("wanted stream to end")
+	}
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("wanted HTTP 503, got %v", resp.StatusCode)
+	}
+}
+
+func TestBroker_SlowSubscriber(t *testing.T) {
+	t.Parallel()
+
+	broker := NewBroker(slog.Default())
+	sub, _, err := broker.subscribe("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range subscriberBuffer + 1 {
+		broker.Observe(context.Background(), epoch.Add(time.Duration(i)*time.Minute),
+			[]bikepoint.StationAvailability{station("1", i)})
+	}
+	for range subscriberBuffer {
+		if _, ok := <-sub.events; !ok {
+			t.Fatal("buffered events were lost")
+		}
+	}
+	if _, ok := <-sub.events; ok {
+		t.Error("wanted slow subscriber to be disconnected")
+	}
+	// The handler unsubscribes when the channel is closed.
+	broker.unsubscribe(sub)
+}
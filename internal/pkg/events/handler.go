@@ -0,0 +1,104 @@
+package events
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// HandlerOption customises a Handler.
+type HandlerOption func(*Handler)
+
+// WithHeartbeat sets how often a comment is sent when there are no events,
+// to stop proxies closing the connection, and detect clients that have gone
+// away. It defaults to 15s.
+func WithHeartbeat(interval time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.Heartbeat = interval
+	}
+}
+
+// Handler serves a broker's events as a text/event-stream. Create instances
+// with NewHandler().
+type Handler struct {
+	Logger    *slog.Logger
+	Broker    *Broker
+	Heartbeat time.Duration
+}
+
+// NewHandler creates a handler streaming events from broker.
+func NewHandler(logger *slog.Logger, broker *Broker, opts ...HandlerOption) *Handler {
+	h := &Handler{
+		Logger:    logger,
+		Broker:    broker,
+		Heartbeat: 15 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// ServeHTTP streams events until the client disconnects. The station query
+// parameter, which can be repeated, limits events to stations with a given
+// ID or name.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	filter := r.URL.Query()["station"]
+	sub, replay, err := h.Broker.subscribe(r.Header.Get("Last-Event-ID"))
+	if err != nil {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer h.Broker.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stops nginx buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	bw := bufio.NewWriter(w)
+	send := func(events []event) error {
+		for _, e := range events {
+			if len(filter) > 0 && !slices.Contains(filter, e.stationID) && !slices.Contains(filter, e.stationName) {
+				continue
+			}
+			// JSON cannot contain a raw newline, so fits in one data field.
+			fmt.Fprintf(bw, "id: %v\nevent: %v\ndata: %s\n\n", h.Broker.id(e), e.typ, e.data)
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	if err := send(replay); err != nil {
+		h.Logger.DebugContext(r.Context(), "failed to write events", slog.String("error", err.Error()))
+		return
+	}
+
+	heartbeat := time.NewTicker(h.Heartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case events, ok := <-sub.events:
+			if !ok {
+				// Closed by the broker.
+				return
+			}
+			err = send(events)
+		case <-heartbeat.C:
+			fmt.Fprint(bw, ": heartbeat\n\n")
+			err = send(nil)
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			h.Logger.DebugContext(r.Context(), "failed to write events", slog.String("error", err.Error()))
+			return
+		}
+	}
+}
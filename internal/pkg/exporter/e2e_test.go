@@ -0,0 +1,114 @@
+package exporter
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint/bikepointtest"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/validate"
+)
+
+// TestExporter_EndToEnd scrapes an exporter backed by a real bikepoint.Client
+// fetching from a fake /BikePoint API.
+func TestExporter_EndToEnd(t *testing.T) {
+	tests := []struct {
+		name          string
+		faults        []bikepointtest.Fault
+		scrapeTimeout string
+		wantUp        bool
+		wantClass     string
+		wantRequests  int
+	}{
+		{
+			name:         "healthy",
+			wantUp:       true,
+			wantRequests: 1,
+		},
+		{
+			name: "server error burst",
+			faults: []bikepointtest.Fault{
+				bikepointtest.FaultServerError,
+				bikepointtest.FaultServerError,
+			},
+			wantUp:       true,
+			wantRequests: 3,
+		},
+		{
+			name:      "rate limited",
+			faults:    []bikepointtest.Fault{bikepointtest.FaultRateLimited},
+			wantClass: "rate_limited",
+			// 4xx errors are not retried.
+			wantRequests: 1,
+		},
+		{
+			name:         "truncated",
+			faults:       []bikepointtest.Fault{bikepointtest.FaultTruncated},
+			wantUp:       true,
+			wantRequests: 2,
+		},
+		{
+			name:          "slow drip",
+			faults:        []bikepointtest.Fault{bikepointtest.FaultSlowDrip},
+			scrapeTimeout: "1",
+			wantClass:     "timeout",
+			wantRequests:  1,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			server := bikepointtest.NewServer(
+				bikepointtest.WithStations(50),
+				bikepointtest.WithDripInterval(time.Second),
+			)
+			defer server.Close()
+			server.Inject(test.faults...)
+
+			e := NewExporter(slog.Default(), []System{
+				{
+					Name:     "tfl",
+					Provider: server.NewClient(slog.Default()),
+				},
+			},
+				WithScrapeTimeoutMargin(200*time.Millisecond),
+				WithValidator(validate.New(validate.DefaultConfig())),
+			)
+			req := httptest.NewRequest(http.MethodGet, "/stations", nil)
+			if test.scrapeTimeout != "" {
+				req.Header.Set(scrapeTimeoutHeader, test.scrapeTimeout)
+			}
+			rr := httptest.NewRecorder()
+			e.ServeHTTP(rr, req)
+
+			body := rr.Body.String()
+			want := []string{
+				fmt.Sprintf(`tflcycles_up %v`, boolToFloat64(test.wantUp)),
+			}
+			if test.wantUp {
+				// Every station should be exported.
+				for _, sa := range server.StationAvailabilities() {
+					want = append(want, fmt.Sprintf(`tflcycles_docks{station=%q} %v`,
+						sa.Station.Name, sa.Station.Docks))
+				}
+			} else {
+				want = append(want, fmt.Sprintf(`tflcycles_last_error_info{class=%q} 1`,
+					test.wantClass))
+			}
+			for _, want := range want {
+				if !strings.Contains(body, want) {
+					t.Errorf("response did not contain %q:\n%v", want, body)
+				}
+			}
+			if requests := server.Requests(); requests != test.wantRequests {
+				t.Errorf("wanted %v requests, got %v", test.wantRequests, requests)
+			}
+		})
+	}
+}
@@ -3,74 +3,438 @@
 package exporter
 
 import (
+	"context"
 	"log/slog"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/gebn/tflcycles_exporter/internal/pkg/audit"
 	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
 	"github.com/gebn/tflcycles_exporter/internal/pkg/promutil"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/requestid"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/validate"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// tracer creates spans for scrapes and fetches. It uses the global provider,
+// so is a no-op unless tracing is enabled.
+var tracer = otel.Tracer("github.com/gebn/tflcycles_exporter/internal/pkg/exporter")
+
+// scrapeTimeoutHeader is set by Prometheus to the scrape_timeout of the job.
+const scrapeTimeoutHeader = "X-Prometheus-Scrape-Timeout-Seconds"
+
 var (
-	fetchDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	fetchDuration = promauto.NewHistogramVec(promutil.WithNativeHistogram(prometheus.HistogramOpts{
 		Name: "tflcycles_exporter_fetch_duration_seconds",
-		Help: "The end-to-end duration of BikePoint interactions, including any retries.",
+		Help: "The end-to-end duration of station availability fetches, including any retries.",
 		// These are copied from the tflcycles client histogram, because in
 		// practice, that's the latency of the end-to-end scrape.
 		Buckets: prometheus.ExponentialBuckets(.5, 1.223, 10), // 3.06
-	})
-	fetchFailures = promauto.NewCounter(prometheus.CounterOpts{
+	}), []string{"system"})
+	fetchFailures = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "tflcycles_exporter_fetch_failures_total",
-		Help: "The number of BikePoint interactions that failed, even after any retrying.",
-	})
+		Help: "The number of station availability fetches that failed, even after any retrying.",
+	}, []string{"system"})
+	fetchErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tflcycles_exporter_fetch_errors_total",
+		Help: "The number of station availability fetches that failed, by class of the final error.",
+	}, []string{"system", "class"})
 )
 
+// Provider retrieves the latest availability of a bike hire system's
+// stations. *bikepoint.Client and *gbfs.Client are implementations.
+type Provider interface {
+
+	// FetchStationAvailabilities returns the availability of every station
+	// in the system, retrying as appropriate until the context expires.
+	FetchStationAvailabilities(context.Context) ([]bikepoint.StationAvailability, error)
+}
+
+// System is a named bike hire scheme. The name is exposed in the `system`
+// label of every metric relating to it, unless it is the only system
+// exported, so should be short and stable, e.g. "tfl".
+type System struct {
+	Name     string
+	Provider Provider
+
+	// stations, if non-nil, are the IDs or names of the only stations to
+	// export. They are selected after validation, which applies to the whole
+	// system.
+	stations []string
+}
+
 // Exporter is an http.Handler that will respond to Prometheus scrape requests
 // with information about stations' dock and cycle availability. Create
 // instances with NewExporter().
 type Exporter struct {
-	Logger *slog.Logger
-	Client *bikepoint.Client
+	Logger  *slog.Logger
+	Systems []System
 
 	handlerOpts promhttp.HandlerOpts
+
+	// systemLabel is whether series carry a `system` label. It is always
+	// true when exporting more than one system, as their stations could
+	// otherwise collide.
+	systemLabel bool
+
+	// scrapeTimeoutMargin is subtracted from the scrape timeout Prometheus
+	// advertises, to leave time to render and send the response.
+	scrapeTimeoutMargin time.Duration
+
+	// timestamps is nil unless samples should carry upstream modification
+	// times.
+	timestamps *systemTimestamps
+
+	// validator is nil if snapshots should be exported as received.
+	validator *validate.Validator
+
+	// auditLog is nil if fetches should not be audited.
+	auditLog *audit.Log
+
+	// expositions holds the gathered station metrics of the latest
+	// snapshots. If nil, every response is gathered from scratch.
+	expositions *expositionCache
+
+	// fetched holds the outcome of each system's latest Fetch(), for
+	// Registry() to expose.
+	fetched *scrapeOutcomes
 }
 
-func NewExporter(logger *slog.Logger, client *bikepoint.Client) *Exporter {
-	return &Exporter{
+// ExporterOption allows customising the exporter's behaviour during
+// construction with NewExporter().
+type ExporterOption func(*Exporter)
+
+// WithTimestamps attaches each station's last-modified time to its samples,
+// rather than leaving Prometheus to use the time of the scrape. This is only
+// meaningful if Prometheus is configured to honour timestamps, which is the
+// default. Prometheus rejects samples older than its head block as out of
+// bounds, and does not mark series with explicit timestamps as stale, so
+// stations that have not been modified for a few hours will have gaps, and
+// removed stations will linger for 5 minutes.
+func WithTimestamps() ExporterOption {
+	return func(e *Exporter) {
+		e.timestamps = newSystemTimestamps()
+	}
+}
+
+// WithSystemLabel adds the `system` label to series even if only one system
+// is exported. Without it, a lone system's series are unlabelled, as they
+// were before other systems were supported, so existing queries continue to
+// work.
+func WithSystemLabel() ExporterOption {
+	return func(e *Exporter) {
+		e.systemLabel = true
+	}
+}
+
+// WithScrapeTimeoutMargin sets how long before Prometheus's scrape timeout the
+// exporter stops fetching data, in order to leave time to respond. This is
+// 500ms by default. If the scrape timeout is not longer than the margin, half
+// of it is used instead.
+func WithScrapeTimeoutMargin(margin time.Duration) ExporterOption {
+	return func(e *Exporter) {
+		e.scrapeTimeoutMargin = margin
+	}
+}
+
+// WithAuditLog writes a record of every fetch to log, describing its attempts
+// and outcome.
+func WithAuditLog(log *audit.Log) ExporterOption {
+	return func(e *Exporter) {
+		e.auditLog = log
+	}
+}
+
+// WithValidator checks each snapshot before it is exported. Stations may be
+// dropped, the last good snapshot substituted, or the fetch failed, according
+// to the validator's policies.
+func WithValidator(validator *validate.Validator) ExporterOption {
+	return func(e *Exporter) {
+		e.validator = validator
+	}
+}
+
+// NewExporter creates an exporter for the provided systems, which are fetched
+// concurrently on each scrape. Names must be unique.
+func NewExporter(logger *slog.Logger, systems []System, opts ...ExporterOption) *Exporter {
+	e := &Exporter{
 		Logger:      logger,
-		Client:      client,
+		Systems:     systems,
 		handlerOpts: promutil.HandlerOptsWithLogger(logger),
+
+		systemLabel:         len(systems) > 1,
+		scrapeTimeoutMargin: 500 * time.Millisecond,
+		expositions:         newExpositionCache(),
+		fetched:             newScrapeOutcomes(),
 	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
 }
 
 func (e Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Continues the caller's trace, if it sent a traceparent header.
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "Exporter.ServeHTTP",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			semconv.URLPath(r.URL.Path)))
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	ctx, cancel := e.scrapeContext(r)
+	defer cancel()
+
+	snapshots := e.fetchSystems(ctx)
+	if e.expositions == nil {
+		e.serveSnapshots(w, r, snapshots)
+		return
+	}
+	e.serveCached(w, r, snapshots)
+}
+
+// Registry returns a registry of the metrics /stations would expose for the
+// systems' stations, keyed by system name, such as from Fetch(). This allows
+// snapshots polled in the background to be pushed elsewhere. tflcycles_up is
+// 0 for systems missing from the map. The other scrape series, such as
+// tflcycles_scrape_duration_seconds, are those of the system's latest Fetch(),
+// and are omitted if it has not been fetched. Upstream timestamps are never
+// attached, so samples can be stamped with the time of the fetch: remote
+// storage rejects samples as old as upstream timestamps can be.
+func (e Exporter) Registry(systems map[string][]bikepoint.StationAvailability) *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	for _, system := range e.Systems {
+		stationAvailabilities, ok := systems[system.Name]
+		registerer := e.systemRegisterer(reg, system)
+		if scrape, fetched := e.fetched.get(system.Name); fetched {
+			scrape.Success = ok
+			registerer.MustRegister(scrape)
+		} else {
+			registerer.MustRegister(upCollector(ok))
+		}
+		if ok {
+			registerer.MustRegister(StationAvailabilitiesCollector{
+				StationAvailabilities: stationAvailabilities,
+			})
+		}
+	}
+	return reg
+}
+
+// Fetch fetches every system as a scrape would, returning the stations of
+// each that succeeded, keyed by system name. This allows them to be rendered
+// in other formats.
+func (e Exporter) Fetch(ctx context.Context) map[string][]bikepoint.StationAvailability {
+	systems := make(map[string][]bikepoint.StationAvailability, len(e.Systems))
+	for _, snapshot := range e.fetchSystems(ctx) {
+		e.fetched.set(snapshot.System.Name, snapshot.Scrape)
+		if snapshot.StationAvailabilities != nil {
+			systems[snapshot.System.Name] = snapshot.StationAvailabilities
+		}
+	}
+	return systems
+}
+
+// fetchSystems fetches every system concurrently.
+func (e Exporter) fetchSystems(ctx context.Context) []snapshot {
+	snapshots := make([]snapshot, len(e.Systems))
+	wg := sync.WaitGroup{}
+	for i, system := range e.Systems {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			snapshots[i] = e.fetchSystem(ctx, system)
+		}()
+	}
+	wg.Wait()
+	return snapshots
+}
+
+// serveSnapshots renders a response from scratch.
+func (e Exporter) serveSnapshots(w http.ResponseWriter, r *http.Request, snapshots []snapshot) {
+	promhttp.HandlerFor(e.registry(snapshots), e.handlerOpts).ServeHTTP(w, r)
+}
+
+// registry returns a registry exposing snapshots.
+func (e Exporter) registry(snapshots []snapshot) *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	for _, snapshot := range snapshots {
+		e.register(e.systemRegisterer(reg, snapshot.System), snapshot)
+	}
+	return reg
+}
+
+// systemRegisterer returns a registerer that labels metrics registered with it
+// by system, if the exporter labels series.
+func (e Exporter) systemRegisterer(reg prometheus.Registerer, system System) prometheus.Registerer {
+	if !e.systemLabel {
+		return reg
+	}
+	return prometheus.WrapRegistererWith(prometheus.Labels{"system": system.Name}, reg)
+}
+
+// scrapeContext returns the request's context, with a deadline if Prometheus
+// told us when it will give up on the scrape. The deadline is brought forward
+// by the configured margin, so we can still respond with `tflcycles_up 0` if
+// the upstream API is struggling, rather than being disconnected mid-retry.
+func (e Exporter) scrapeContext(r *http.Request) (context.Context, context.CancelFunc) {
 	ctx := r.Context()
+	header := r.Header.Get(scrapeTimeoutHeader)
+	if header == "" {
+		return context.WithCancel(ctx)
+	}
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil || seconds <= 0 {
+		e.Logger.WarnContext(ctx, "ignoring invalid scrape timeout",
+			slog.String("header", header))
+		return context.WithCancel(ctx)
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout > e.scrapeTimeoutMargin {
+		timeout -= e.scrapeTimeoutMargin
+	} else {
+		// The margin would leave no time to fetch, but using the full timeout
+		// would leave none to respond, so we split the difference.
+		timeout /= 2
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// snapshot is the outcome of fetching a system.
+type snapshot struct {
+	System System
+
+	// StationAvailabilities is nil if the fetch failed.
+	StationAvailabilities []bikepoint.StationAvailability
+
+	Scrape ScrapeCollector
+}
+
+// collectSystem fetches the latest data for a system, and registers collectors
+// exposing it.
+func (e Exporter) collectSystem(ctx context.Context, reg prometheus.Registerer, system System) {
+	e.register(reg, e.fetchSystem(ctx, system))
+}
+
+// fetchSystem fetches and validates the latest data for a system, recording
+// the outcome.
+func (e Exporter) fetchSystem(ctx context.Context, system System) snapshot {
+	ctx, span := tracer.Start(ctx, "Exporter.fetchSystem",
+		trace.WithAttributes(attribute.String("tflcycles.system", system.Name)))
+	defer span.End()
 
 	start := time.Now()
-	stationAvailabilities, err := e.Client.FetchStationAvailabilities(ctx)
+	var record *audit.Record
+	if e.auditLog != nil {
+		record = &audit.Record{
+			Time:   start,
+			System: system.Name,
+		}
+		record.RequestID, _ = requestid.FromContext(ctx)
+		if spanContext := span.SpanContext(); spanContext.IsSampled() {
+			record.TraceID = spanContext.TraceID().String()
+		}
+		ctx = audit.NewContext(ctx, record)
+	}
+	stationAvailabilities, err := system.Provider.FetchStationAvailabilities(ctx)
+	if err == nil && e.validator != nil {
+		var stale bool
+		stationAvailabilities, stale, err = e.validator.Validate(system.Name, stationAvailabilities)
+		if stale {
+			e.Logger.WarnContext(ctx, "serving last good snapshot",
+				slog.String("system", system.Name))
+		}
+	}
+	if err == nil && system.stations != nil {
+		stationAvailabilities = filterStations(stationAvailabilities, system.stations)
+	}
 	elapsed := time.Since(start)
-	fetchDuration.Observe(elapsed.Seconds())
+	promutil.ObserveWithTrace(ctx, fetchDuration.WithLabelValues(system.Name), elapsed.Seconds())
+	var errorClass bikepoint.ErrorClass
 	if err != nil {
-		fetchFailures.Inc()
-		e.Logger.ErrorContext(ctx, "failed to fetch station availabilities",
-			slog.String("error", err.Error()))
+		errorClass = bikepoint.ClassOf(err)
+		fetchFailures.WithLabelValues(system.Name).Inc()
+		fetchErrors.WithLabelValues(system.Name, string(errorClass)).Inc()
+		attrs := []any{
+			slog.String("system", system.Name),
+			slog.String("error", err.Error()),
+			slog.String("class", string(errorClass)),
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			// Distinguishes giving up due to the scrape timeout from
+			// permanent errors.
+			attrs = append(attrs, slog.Duration("budget", deadline.Sub(start)))
+		}
+		e.Logger.ErrorContext(ctx, "failed to fetch station availabilities", attrs...)
+		span.SetAttributes(semconv.ErrorTypeKey.String(string(errorClass)))
+		span.SetStatus(codes.Error, err.Error())
 		// Force to nil, even if we received a non-nil slice.
 		stationAvailabilities = nil
 	}
+	if record != nil {
+		e.audit(ctx, record, elapsed, stationAvailabilities, err)
+	}
 
-	reg := prometheus.NewRegistry()
-	reg.MustRegister(ScrapeCollector{
-		Success:  stationAvailabilities != nil,
-		Duration: elapsed,
-	})
-	if stationAvailabilities != nil {
-		reg.MustRegister(StationAvailabilitiesCollector{
-			StationAvailabilities: stationAvailabilities,
-		})
-	}
-	promhttp.HandlerFor(reg, e.handlerOpts).ServeHTTP(w, r)
+	return snapshot{
+		System:                system,
+		StationAvailabilities: stationAvailabilities,
+		Scrape: ScrapeCollector{
+			Success:    stationAvailabilities != nil,
+			Duration:   elapsed,
+			ErrorClass: errorClass,
+		},
+	}
+}
+
+// audit completes a fetch's record with its outcome, and writes it.
+func (e Exporter) audit(ctx context.Context, record *audit.Record, elapsed time.Duration, stationAvailabilities []bikepoint.StationAvailability, err error) {
+	record.Duration = elapsed.Seconds()
+	record.Stations = len(stationAvailabilities)
+	if err != nil {
+		record.Error = err.Error()
+		record.Class = string(bikepoint.ClassOf(err))
+	}
+	if err := e.auditLog.Write(record); err != nil {
+		e.Logger.ErrorContext(ctx, "failed to write audit record",
+			slog.String("system", record.System),
+			slog.String("error", err.Error()))
+	}
+}
+
+// register adds collectors exposing a snapshot to the registry.
+func (e Exporter) register(reg prometheus.Registerer, snapshot snapshot) {
+	reg.MustRegister(snapshot.Scrape)
+	if collector, ok := e.stationCollector(snapshot); ok {
+		reg.MustRegister(collector)
+	}
+}
+
+// stationCollector returns a collector for a snapshot's stations, or false if
+// the fetch failed.
+func (e Exporter) stationCollector(snapshot snapshot) (StationAvailabilitiesCollector, bool) {
+	if snapshot.StationAvailabilities == nil {
+		return StationAvailabilitiesCollector{}, false
+	}
+	collector := StationAvailabilitiesCollector{
+		StationAvailabilities: snapshot.StationAvailabilities,
+	}
+	if e.timestamps != nil {
+		timestamps := e.timestamps.For(snapshot.System.Name)
+		timestamps.Retain(snapshot.StationAvailabilities)
+		collector.Timestamp = timestamps.Timestamp
+	}
+	return collector, true
 }
@@ -0,0 +1,474 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/audit"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/requestid"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// staticProvider returns the same data on every fetch.
+type staticProvider struct {
+	stationAvailabilities []bikepoint.StationAvailability
+	err                   error
+}
+
+func (p staticProvider) FetchStationAvailabilities(context.Context) ([]bikepoint.StationAvailability, error) {
+	return p.stationAvailabilities, p.err
+}
+
+func TestExporter_ServeHTTP(t *testing.T) {
+	t.Parallel()
+
+	e := NewExporter(slog.Default(), []System{
+		{
+			Name: "tfl",
+			Provider: staticProvider{
+				stationAvailabilities: []bikepoint.StationAvailability{
+					{
+						Station: bikepoint.Station{
+							Name:  "Foo",
+							Docks: 5,
+						},
+						Availability: bikepoint.Availability{
+							Docks:    1,
+							Bicycles: 2,
+							EBikes:   1,
+						},
+					},
+				},
+			},
+		},
+		{
+			Name: "other",
+			Provider: staticProvider{
+				err: errors.New("unavailable"),
+			},
+		},
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/stations", nil)
+	rr := httptest.NewRecorder()
+	e.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wanted %v, got %v", http.StatusOK, rr.Code)
+	}
+	body := rr.Body.String()
+	for _, want := range []string{
+		`tflcycles_up{system="tfl"} 1`,
+		`tflcycles_up{system="other"} 0`,
+		`tflcycles_last_error_info{class="unknown",system="other"} 1`,
+		`tflcycles_docks{station="Foo",system="tfl"} 5`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("response did not contain %q:\n%v", want, body)
+		}
+	}
+	if strings.Contains(body, `tflcycles_docks{station="Foo",system="other"}`) {
+		t.Errorf("response contained stations for failed system:\n%v", body)
+	}
+}
+
+func TestExporter_Registry(t *testing.T) {
+	snapshots := map[string][]bikepoint.StationAvailability{
+		"tfl": {
+			{
+				Station: bikepoint.Station{
+					Name:  "Foo",
+					Docks: 5,
+				},
+				Availability: bikepoint.Availability{
+					Docks:    1,
+					Bicycles: 2,
+					EBikes:   1,
+				},
+				Modified: time.Unix(1709510400, 0),
+			},
+		},
+	}
+	tests := []struct {
+		name    string
+		systems []System
+		opts    []ExporterOption
+		want    string
+	}{
+		{
+			name:    "single system",
+			systems: []System{{Name: "tfl"}},
+			// Upstream timestamps are not attached, even if enabled.
+			opts: []ExporterOption{WithTimestamps()},
+			want: `
+# HELP tflcycles_bicycles_available The number of in-service, conventional bikes available for hire.
+# TYPE tflcycles_bicycles_available gauge
+tflcycles_bicycles_available{station="Foo"} 2
+# HELP tflcycles_up Whether fetching the system's station availabilities succeeded.
+# TYPE tflcycles_up untyped
+tflcycles_up 1
+`,
+		},
+		{
+			name: "failed system",
+			// The system label is implied.
+			systems: []System{{Name: "tfl"}, {Name: "other"}},
+			want: `
+# HELP tflcycles_bicycles_available The number of in-service, conventional bikes available for hire.
+# TYPE tflcycles_bicycles_available gauge
+tflcycles_bicycles_available{station="Foo",system="tfl"} 2
+# HELP tflcycles_up Whether fetching the system's station availabilities succeeded.
+# TYPE tflcycles_up untyped
+tflcycles_up{system="other"} 0
+tflcycles_up{system="tfl"} 1
+`,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			e := NewExporter(slog.Default(), test.systems, test.opts...)
+			if err := testutil.GatherAndCompare(e.Registry(snapshots), strings.NewReader(test.want),
+				"tflcycles_bicycles_available", "tflcycles_up"); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestExporter_Fetch(t *testing.T) {
+	t.Parallel()
+
+	stationAvailabilities := []bikepoint.StationAvailability{
+		{
+			Station: bikepoint.Station{
+				Name:  "Foo",
+				Docks: 5,
+			},
+		},
+	}
+	e := NewExporter(slog.Default(), []System{
+		{
+			Name: "tfl",
+			Provider: staticProvider{
+				stationAvailabilities: stationAvailabilities,
+			},
+		},
+		{
+			Name: "other",
+			Provider: staticProvider{
+				err: errors.New("unavailable"),
+			},
+		},
+	})
+
+	got := e.Fetch(context.Background())
+	want := map[string][]bikepoint.StationAvailability{
+		"tfl": stationAvailabilities,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestExporter_RegistryFetched(t *testing.T) {
+	t.Parallel()
+
+	e := NewExporter(slog.Default(), []System{
+		{
+			Name: "tfl",
+			Provider: staticProvider{
+				stationAvailabilities: []bikepoint.StationAvailability{
+					{
+						Station: bikepoint.Station{
+							Name:  "Foo",
+							Docks: 5,
+						},
+					},
+				},
+			},
+		},
+		{
+			Name: "other",
+			Provider: staticProvider{
+				err: errors.New("unavailable"),
+			},
+		},
+	})
+
+	reg := e.Registry(e.Fetch(context.Background()))
+	want := `
+# HELP tflcycles_last_error_info The class of error that caused the fetch for this scrape to fail. Only present if tflcycles_up is 0. Always 1.
+# TYPE tflcycles_last_error_info gauge
+tflcycles_last_error_info{class="unknown",system="other"} 1
+# HELP tflcycles_up Whether fetching the system's station availabilities succeeded.
+# TYPE tflcycles_up untyped
+tflcycles_up{system="other"} 0
+tflcycles_up{system="tfl"} 1
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want),
+		"tflcycles_last_error_info", "tflcycles_up"); err != nil {
+		t.Error(err)
+	}
+	if count, err := testutil.GatherAndCount(reg, "tflcycles_scrape_duration_seconds"); err != nil {
+		t.Error(err)
+	} else if count != 2 {
+		t.Errorf("got %v scrape durations, want 2", count)
+	}
+}
+
+// blockingProvider waits for the context to expire.
+func TestExporter_ServeHTTPTraced(t *testing.T) {
+	// Not parallel, as this sets the global provider and propagator.
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	e := NewExporter(slog.Default(), []System{
+		{
+			Name:     "tfl",
+			Provider: staticProvider{},
+		},
+		{
+			Name: "other",
+			Provider: staticProvider{
+				err: bikepoint.NewStatusError(http.StatusBadGateway, ""),
+			},
+		},
+	})
+	parent := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{2},
+		TraceFlags: trace.FlagsSampled,
+	})
+	req := httptest.NewRequest(http.MethodGet, "/stations", nil)
+	otel.GetTextMapPropagator().Inject(trace.ContextWithSpanContext(context.Background(), parent),
+		propagation.HeaderCarrier(req.Header))
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	var serve sdktrace.ReadOnlySpan
+	fetches := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID() != parent.TraceID() {
+			continue
+		}
+		switch span.Name() {
+		case "Exporter.ServeHTTP":
+			serve = span
+		case "Exporter.fetchSystem":
+			for _, attr := range span.Attributes() {
+				if attr.Key == "tflcycles.system" {
+					fetches[attr.Value.AsString()] = span
+				}
+			}
+		}
+	}
+	if serve == nil {
+		t.Fatal("no Exporter.ServeHTTP span in the caller's trace")
+	}
+	if serve.Parent().SpanID() != parent.SpanID() {
+		t.Errorf("wanted parent %v, got %v", parent.SpanID(), serve.Parent().SpanID())
+	}
+	if len(fetches) != 2 {
+		t.Fatalf("wanted a fetch span per system, got %v", fetches)
+	}
+	for system, span := range fetches {
+		if span.Parent().SpanID() != serve.SpanContext().SpanID() {
+			t.Errorf("%v fetch is not a child of the scrape", system)
+		}
+	}
+	if code := fetches["tfl"].Status().Code; code != codes.Unset {
+		t.Errorf("wanted tfl fetch status %v, got %v", codes.Unset, code)
+	}
+	if code := fetches["other"].Status().Code; code != codes.Error {
+		t.Errorf("wanted other fetch status %v, got %v", codes.Error, code)
+	}
+}
+
+func TestExporter_ServeHTTPAudited(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := audit.OpenLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auditLog.Close()
+	e := NewExporter(slog.Default(), []System{
+		{
+			Name: "tfl",
+			Provider: staticProvider{
+				stationAvailabilities: []bikepoint.StationAvailability{{}, {}},
+			},
+		},
+		{
+			Name: "other",
+			Provider: staticProvider{
+				err: bikepoint.NewStatusError(http.StatusBadGateway, ""),
+			},
+		},
+	}, WithAuditLog(auditLog))
+	req := httptest.NewRequest(http.MethodGet, "/stations", nil)
+	req.Header.Set(requestid.Header, "abc")
+	requestid.Wrap(e).ServeHTTP(httptest.NewRecorder(), req)
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := map[string]map[string]any{}
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		record := map[string]any{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		records[record["system"].(string)] = record
+	}
+	if len(records) != 2 {
+		t.Fatalf("wanted a record per system, got %v", records)
+	}
+	for system, record := range records {
+		if record["request_id"] != "abc" {
+			t.Errorf("%v: wanted request ID abc, got %v", system, record["request_id"])
+		}
+	}
+	if tfl := records["tfl"]; tfl["stations"] != 2. || tfl["error"] != nil {
+		t.Errorf("unexpected tfl record: %v", tfl)
+	}
+	if other := records["other"]; other["stations"] != 0. || other["class"] != string(bikepoint.ClassHTTP5xx) {
+		t.Errorf("unexpected other record: %v", other)
+	}
+}
+
+func TestExporter_FetchAudited(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := audit.OpenLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auditLog.Close()
+	e := NewExporter(slog.Default(), []System{
+		{
+			Name: "tfl",
+			Provider: staticProvider{
+				stationAvailabilities: []bikepoint.StationAvailability{{}},
+			},
+		},
+	}, WithAuditLog(auditLog))
+	// As the background poll does.
+	e.Fetch(context.Background())
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := map[string]any{}
+	if err := json.Unmarshal(b, &record); err != nil {
+		t.Fatalf("wanted a single record, got %q: %v", b, err)
+	}
+	if record["system"] != "tfl" || record["stations"] != 1. || record["request_id"] != nil {
+		t.Errorf("unexpected record: %v", record)
+	}
+}
+
+type blockingProvider struct{}
+
+func (blockingProvider) FetchStationAvailabilities(ctx context.Context) ([]bikepoint.StationAvailability, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestExporter_ServeHTTPScrapeTimeout(t *testing.T) {
+	t.Parallel()
+
+	e := NewExporter(slog.Default(), []System{
+		{
+			Name:     "tfl",
+			Provider: blockingProvider{},
+		},
+	}, WithScrapeTimeoutMargin(200*time.Millisecond))
+
+	req := httptest.NewRequest(http.MethodGet, "/stations", nil)
+	req.Header.Set(scrapeTimeoutHeader, "0.3")
+	rr := httptest.NewRecorder()
+	start := time.Now()
+	e.ServeHTTP(rr, req)
+	elapsed := time.Since(start)
+
+	if elapsed >= 300*time.Millisecond {
+		t.Errorf("responded after %v, beyond the scrape timeout", elapsed)
+	}
+	body := rr.Body.String()
+	for _, want := range []string{
+		`tflcycles_up 0`,
+		`tflcycles_last_error_info{class="timeout"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("response did not contain %q:\n%v", want, body)
+		}
+	}
+}
+
+func TestExporter_scrapeContext(t *testing.T) {
+	e := NewExporter(slog.Default(), nil, WithScrapeTimeoutMargin(time.Second))
+	tests := []struct {
+		header       string
+		wantDeadline bool
+		wantTimeout  time.Duration
+	}{
+		{"", false, 0},
+		{"invalid", false, 0},
+		{"-1", false, 0},
+		{"10", true, 9 * time.Second},
+		{"2.5", true, 1500 * time.Millisecond},
+		// The margin is too large to apply, so half the timeout is used.
+		{"0.5", true, 250 * time.Millisecond},
+		{"1", true, 500 * time.Millisecond},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.header, func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodGet, "/stations", nil)
+			if test.header != "" {
+				req.Header.Set(scrapeTimeoutHeader, test.header)
+			}
+			start := time.Now()
+			ctx, cancel := e.scrapeContext(req)
+			defer cancel()
+			deadline, ok := ctx.Deadline()
+			if ok != test.wantDeadline {
+				t.Fatalf("wanted deadline %v, got %v", test.wantDeadline, ok)
+			}
+			if !ok {
+				return
+			}
+			// Allow for time passing between start and creating the context.
+			if timeout := deadline.Sub(start); timeout < test.wantTimeout ||
+				timeout > test.wantTimeout+100*time.Millisecond {
+				t.Errorf("wanted timeout of %v, got %v", test.wantTimeout, timeout)
+			}
+		})
+	}
+}
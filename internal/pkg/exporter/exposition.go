@@ -0,0 +1,154 @@
+package exporter
+
+import (
+	"encoding/binary"
+	"hash/maphash"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	expositionCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tflcycles_exporter_exposition_cache_requests_total",
+		Help: "The number of scrapes, by whether station metrics were served from previously gathered metrics.",
+	}, []string{"result"})
+)
+
+func init() {
+	expositionCacheRequests.WithLabelValues("hit")
+	expositionCacheRequests.WithLabelValues("miss")
+}
+
+// exposition is the gathered station metrics of a version of the snapshots.
+type exposition struct {
+	version uint64
+	mfs     []*dto.MetricFamily
+}
+
+// expositionCache holds the station metrics of the latest snapshots, gathered
+// ready to encode. Station metrics are ~99% of a response, and building,
+// gathering and sorting them dominates the CPU time of a scrape; the data only
+// changes every few minutes. The per-scrape metrics from ScrapeCollector are
+// always gathered afresh. It is safe for concurrent use.
+type expositionCache struct {
+	seed maphash.Seed
+
+	mu     sync.Mutex
+	latest exposition
+}
+
+func newExpositionCache() *expositionCache {
+	return &expositionCache{
+		seed: maphash.MakeSeed(),
+	}
+}
+
+// version returns a hash of everything affecting the gathered station
+// metrics. Timestamps are derived from the snapshots, and do not change if the
+// snapshots do not.
+func (c *expositionCache) version(snapshots []snapshot) uint64 {
+	h := maphash.Hash{}
+	h.SetSeed(c.seed)
+	var buf []byte
+	for _, snapshot := range snapshots {
+		buf = append(buf[:0], snapshot.System.Name...)
+		buf = append(buf, 0)
+		if snapshot.StationAvailabilities == nil {
+			buf = append(buf, 0)
+			h.Write(buf)
+			continue
+		}
+		buf = append(buf, 1)
+		for _, sa := range snapshot.StationAvailabilities {
+			buf = append(buf, sa.Station.ID...)
+			buf = append(buf, 0)
+			buf = append(buf, sa.Station.Name...)
+			buf = append(buf, 0)
+			buf = binary.AppendVarint(buf, int64(sa.Station.Docks))
+			buf = binary.AppendVarint(buf, int64(sa.Availability.Docks))
+			buf = binary.AppendVarint(buf, int64(sa.Availability.Bicycles))
+			buf = binary.AppendVarint(buf, int64(sa.Availability.EBikes))
+			buf = binary.AppendVarint(buf, sa.Modified.UnixNano())
+			h.Write(buf)
+			buf = buf[:0]
+		}
+	}
+	return h.Sum64()
+}
+
+// get returns the gathered station metrics, if they are of the provided
+// version.
+func (c *expositionCache) get(version uint64) ([]*dto.MetricFamily, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.latest.mfs == nil || c.latest.version != version {
+		return nil, false
+	}
+	return c.latest.mfs, true
+}
+
+// put stores gathered station metrics, replacing those of other versions, as
+// they are unlikely to be requested again.
+func (c *expositionCache) put(version uint64, mfs []*dto.MetricFamily) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.latest = exposition{
+		version: version,
+		mfs:     mfs,
+	}
+}
+
+// serveCached responds with the station metrics of the snapshots, reusing
+// those previously gathered if they have not changed, followed by freshly
+// gathered scrape metrics. Metric families are disjoint between the two parts,
+// and station metric names sort before scrape metric names, so the output is
+// identical to serveSnapshots(). The response is encoded and compressed by
+// promhttp as usual, so content negotiation is unaffected.
+func (e Exporter) serveCached(w http.ResponseWriter, r *http.Request, snapshots []snapshot) {
+	version := e.expositions.version(snapshots)
+	stations, ok := e.expositions.get(version)
+	if ok {
+		expositionCacheRequests.WithLabelValues("hit").Inc()
+	} else {
+		expositionCacheRequests.WithLabelValues("miss").Inc()
+		reg := prometheus.NewRegistry()
+		for _, snapshot := range snapshots {
+			if collector, ok := e.stationCollector(snapshot); ok {
+				e.systemRegisterer(reg, snapshot.System).MustRegister(collector)
+			}
+		}
+		var err error
+		stations, err = reg.Gather()
+		if err != nil {
+			e.Logger.ErrorContext(r.Context(), "failed to gather station metrics",
+				slog.String("error", err.Error()))
+			e.serveSnapshots(w, r, snapshots)
+			return
+		}
+		e.expositions.put(version, stations)
+	}
+
+	reg := prometheus.NewRegistry()
+	for _, snapshot := range snapshots {
+		e.systemRegisterer(reg, snapshot.System).MustRegister(snapshot.Scrape)
+	}
+	gatherer := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		scrape, err := reg.Gather()
+		if err != nil {
+			return nil, err
+		}
+		// Cached families are shared between responses, so the slice is
+		// copied rather than appended to.
+		return append(slices.Clip(stations), scrape...), nil
+	})
+	promhttp.HandlerFor(gatherer, e.handlerOpts).ServeHTTP(w, r)
+}
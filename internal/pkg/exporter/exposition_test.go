@@ -0,0 +1,193 @@
+package exporter
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+)
+
+// manyStations returns a snapshot the size of TfL's.
+func manyStations() []bikepoint.StationAvailability {
+	stationAvailabilities := make([]bikepoint.StationAvailability, 800)
+	for i := range stationAvailabilities {
+		stationAvailabilities[i] = bikepoint.StationAvailability{
+			Station: bikepoint.Station{
+				ID:    fmt.Sprintf("BikePoints_%v", i+1),
+				Name:  fmt.Sprintf("Station %v, Holborn", i+1),
+				Docks: 20 + i%30,
+			},
+			Availability: bikepoint.Availability{
+				Docks:    i % 20,
+				Bicycles: i % 7,
+				EBikes:   i % 3,
+			},
+			Modified: time.Date(2024, 1, 2, 3, 4, 5, i*int(time.Millisecond), time.UTC),
+		}
+	}
+	return stationAvailabilities
+}
+
+// scrape requests metrics, returning the decompressed body without the scrape
+// duration, which varies between requests.
+func scrape(t testing.TB, handler http.Handler, accept, acceptEncoding string) string {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/stations", nil)
+	req.Header.Set("Accept", accept)
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wanted %v, got %v", http.StatusOK, rr.Code)
+	}
+
+	var body io.Reader = rr.Body
+	if rr.Header().Get("Content-Encoding") == "gzip" {
+		r, err := gzip.NewReader(rr.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Some clients cannot decode more than one gzip member.
+		r.Multistream(false)
+		body = r
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := []string{rr.Header().Get("Content-Type")}
+	for _, line := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(line, "tflcycles_scrape_duration_seconds{") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestExporter_ServeHTTPCached(t *testing.T) {
+	provider := &staticProvider{
+		stationAvailabilities: manyStations()[:3],
+	}
+	systems := []System{
+		{
+			Name:     "tfl",
+			Provider: provider,
+		},
+		{
+			Name: "other",
+			Provider: staticProvider{
+				err: bikepoint.NewStatusError(http.StatusServiceUnavailable, ""),
+			},
+		},
+	}
+	cached := NewExporter(slog.Default(), systems, WithTimestamps())
+	uncached := NewExporter(slog.Default(), systems, WithTimestamps())
+	uncached.expositions = nil
+
+	tests := []struct {
+		name           string
+		accept         string
+		acceptEncoding string
+	}{
+		{
+			name: "text",
+		},
+		{
+			name:           "text gzip",
+			acceptEncoding: "gzip",
+		},
+		{
+			name:   "openmetrics",
+			accept: "application/openmetrics-text;version=1.0.0",
+		},
+		{
+			name:           "openmetrics gzip",
+			accept:         "application/openmetrics-text;version=1.0.0",
+			acceptEncoding: "gzip, deflate",
+		},
+	}
+	// Not parallel, as the provider is modified.
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			want := scrape(t, uncached, test.accept, test.acceptEncoding)
+			for i := 0; i < 2; i++ {
+				if got := scrape(t, cached, test.accept, test.acceptEncoding); got != want {
+					t.Fatalf("scrape %v: got\n%v\nwant\n%v", i, got, want)
+				}
+			}
+
+			provider.stationAvailabilities = manyStations()[:4]
+			want = scrape(t, uncached, test.accept, test.acceptEncoding)
+			if got := scrape(t, cached, test.accept, test.acceptEncoding); got != want {
+				t.Fatalf("after change: got\n%v\nwant\n%v", got, want)
+			}
+			provider.stationAvailabilities = manyStations()[:3]
+		})
+	}
+}
+
+func BenchmarkExporter_ServeHTTP(b *testing.B) {
+	systems := []System{
+		{
+			Name: "tfl",
+			Provider: staticProvider{
+				stationAvailabilities: manyStations(),
+			},
+		},
+	}
+	exporters := []struct {
+		name     string
+		exporter *Exporter
+	}{
+		{
+			name:     "cached",
+			exporter: NewExporter(slog.Default(), systems),
+		},
+		{
+			name: "uncached",
+			exporter: func() *Exporter {
+				e := NewExporter(slog.Default(), systems)
+				e.expositions = nil
+				return e
+			}(),
+		},
+	}
+	formats := []struct {
+		name           string
+		accept         string
+		acceptEncoding string
+	}{
+		{
+			name: "text",
+		},
+		{
+			name:           "openmetrics_gzip",
+			accept:         "application/openmetrics-text;version=1.0.0",
+			acceptEncoding: "gzip",
+		},
+	}
+	for _, exporter := range exporters {
+		for _, format := range formats {
+			b.Run(exporter.name+"/"+format.name, func(b *testing.B) {
+				b.ReportAllocs()
+				req := httptest.NewRequest(http.MethodGet, "/stations", nil)
+				req.Header.Set("Accept", format.accept)
+				req.Header.Set("Accept-Encoding", format.acceptEncoding)
+				for i := 0; i < b.N; i++ {
+					rr := httptest.NewRecorder()
+					exporter.exporter.ServeHTTP(rr, req)
+					if rr.Code != http.StatusOK {
+						b.Fatalf("wanted %v, got %v", http.StatusOK, rr.Code)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Module describes how to fetch a system's data for a /probe request. The
+// target of the probe selects either the whole system, by its name, or one of
+// the filters.
+type Module struct {
+	System System
+
+	// Timeout bounds the time spent fetching data, including retries. If
+	// Prometheus's scrape timeout, less the exporter's margin, is lower, that
+	// will apply instead.
+	Timeout time.Duration
+
+	// Filters are named groups of stations, each identified by ID or name.
+	Filters map[string][]string
+}
+
+// Prober is an http.Handler responding to multi-target scrape requests of the
+// form /probe?module=<name>&target=<system-or-filter>, in the style of the
+// blackbox exporter. This allows Prometheus relabelling to fan out to many
+// logical targets from one exporter process. Create instances with
+// NewProber().
+type Prober struct {
+	Exporter *Exporter
+	Modules  map[string]Module
+}
+
+// NewProber creates a Prober for the provided modules. The exporter's options,
+// e.g. timestamps, apply to probes; its systems are not used.
+func NewProber(exporter *Exporter, modules map[string]Module) *Prober {
+	return &Prober{
+		Exporter: exporter,
+		Modules:  modules,
+	}
+}
+
+func (p Prober) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := p.Exporter.scrapeContext(r)
+	defer cancel()
+	params := r.URL.Query()
+
+	moduleName := params.Get("module")
+	module, ok := p.Modules[moduleName]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown module %q", moduleName), http.StatusBadRequest)
+		return
+	}
+
+	target := params.Get("target")
+	system := module.System
+	if target != system.Name {
+		stations, ok := module.Filters[target]
+		if !ok {
+			http.Error(w, fmt.Sprintf("target %q is neither system %q nor a filter of module %q",
+				target, system.Name, moduleName), http.StatusBadRequest)
+			return
+		}
+		system.stations = stations
+	}
+
+	// The earlier of this and the scrape deadline will take effect.
+	ctx, cancel = context.WithTimeout(ctx, module.Timeout)
+	defer cancel()
+
+	reg := prometheus.NewRegistry()
+	p.Exporter.collectSystem(ctx, prometheus.WrapRegistererWith(
+		prometheus.Labels{"system": system.Name},
+		reg,
+	), system)
+	promhttp.HandlerFor(reg, p.Exporter.handlerOpts).ServeHTTP(w, r)
+}
+
+// filterStations returns only the stations whose ID or name is listed. The
+// input is not modified.
+func filterStations(stationAvailabilities []bikepoint.StationAvailability, stations []string) []bikepoint.StationAvailability {
+	filtered := []bikepoint.StationAvailability{}
+	for _, sa := range stationAvailabilities {
+		if slices.Contains(stations, sa.Station.ID) ||
+			slices.Contains(stations, sa.Station.Name) {
+			filtered = append(filtered, sa)
+		}
+	}
+	return filtered
+}
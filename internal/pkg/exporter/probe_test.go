@@ -0,0 +1,176 @@
+package exporter
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/validate"
+)
+
+func TestProber_ServeHTTP(t *testing.T) {
+	prober := NewProber(NewExporter(slog.Default(), nil), map[string]Module{
+		"tfl": {
+			System: System{
+				Name: "tfl",
+				Provider: staticProvider{
+					stationAvailabilities: []bikepoint.StationAvailability{
+						{
+							Station: bikepoint.Station{
+								ID:    "BikePoints_1",
+								Name:  "Foo",
+								Docks: 5,
+							},
+						},
+						{
+							Station: bikepoint.Station{
+								ID:    "BikePoints_2",
+								Name:  "Bar",
+								Docks: 10,
+							},
+						},
+						{
+							Station: bikepoint.Station{
+								ID:    "BikePoints_3",
+								Name:  "Baz",
+								Docks: 15,
+							},
+						},
+					},
+				},
+			},
+			Timeout: time.Second,
+			Filters: map[string][]string{
+				"office": {"BikePoints_1", "Baz"},
+			},
+		},
+	})
+	tests := []struct {
+		name     string
+		query    string
+		wantCode int
+		want     []string
+		dontWant []string
+	}{
+		{
+			name:     "system",
+			query:    "module=tfl&target=tfl",
+			wantCode: http.StatusOK,
+			want: []string{
+				`tflcycles_up{system="tfl"} 1`,
+				`tflcycles_docks{station="Foo",system="tfl"} 5`,
+				`tflcycles_docks{station="Bar",system="tfl"} 10`,
+				`tflcycles_docks{station="Baz",system="tfl"} 15`,
+			},
+		},
+		{
+			name:     "filter",
+			query:    "module=tfl&target=office",
+			wantCode: http.StatusOK,
+			want: []string{
+				`tflcycles_up{system="tfl"} 1`,
+				`tflcycles_docks{station="Foo",system="tfl"} 5`,
+				`tflcycles_docks{station="Baz",system="tfl"} 15`,
+			},
+			dontWant: []string{
+				`station="Bar"`,
+			},
+		},
+		{
+			name:     "unknown module",
+			query:    "module=gbfs&target=tfl",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "missing module",
+			query:    "target=tfl",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "unknown target",
+			query:    "module=tfl&target=home",
+			wantCode: http.StatusBadRequest,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodGet, "/probe?"+test.query, nil)
+			rr := httptest.NewRecorder()
+			prober.ServeHTTP(rr, req)
+
+			if rr.Code != test.wantCode {
+				t.Fatalf("wanted %v, got %v: %v", test.wantCode, rr.Code, rr.Body)
+			}
+			body := rr.Body.String()
+			for _, want := range test.want {
+				if !strings.Contains(body, want) {
+					t.Errorf("response did not contain %q:\n%v", want, body)
+				}
+			}
+			for _, dontWant := range test.dontWant {
+				if strings.Contains(body, dontWant) {
+					t.Errorf("response contained %q:\n%v", dontWant, body)
+				}
+			}
+		})
+	}
+}
+
+func TestProber_ServeHTTPValidatesWholeSystem(t *testing.T) {
+	t.Parallel()
+
+	stationAvailabilities := []bikepoint.StationAvailability{
+		{Station: bikepoint.Station{ID: "BikePoints_1", Name: "Foo", Docks: 5}},
+		{Station: bikepoint.Station{ID: "BikePoints_2", Name: "Bar", Docks: 10}},
+		{Station: bikepoint.Station{ID: "BikePoints_3", Name: "Baz", Docks: 15}},
+	}
+	provider := &staticProvider{
+		stationAvailabilities: stationAvailabilities,
+	}
+	config := validate.DefaultConfig()
+	config.MinStations = 3
+	config.Policies = map[validate.Rule]validate.Policy{
+		validate.RuleMinStations: validate.PolicyLastGood,
+	}
+	prober := NewProber(NewExporter(slog.Default(), nil, WithValidator(validate.New(config))), map[string]Module{
+		"tfl": {
+			System: System{
+				Name:     "probe-validation",
+				Provider: provider,
+			},
+			Timeout: time.Second,
+			Filters: map[string][]string{
+				"office": {"BikePoints_1"},
+			},
+		},
+	})
+	probe := func(target string) string {
+		rr := httptest.NewRecorder()
+		prober.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/probe?module=tfl&target="+target, nil))
+		return rr.Body.String()
+	}
+
+	// The filtered snapshot is smaller than min_stations, but the system's
+	// is not.
+	if body := probe("office"); !strings.Contains(body, `tflcycles_up{system="probe-validation"} 1`) ||
+		!strings.Contains(body, `station="Foo"`) || strings.Contains(body, `station="Bar"`) {
+		t.Errorf("unexpected filtered probe response:\n%v", body)
+	}
+
+	// The last good snapshot is the whole system, not the filtered one.
+	provider.stationAvailabilities = stationAvailabilities[:1]
+	body := probe("probe-validation")
+	for _, name := range []string{"Foo", "Bar", "Baz"} {
+		if !strings.Contains(body, fmt.Sprintf(`station=%q`, name)) {
+			t.Errorf("last good snapshot missing %v:\n%v", name, body)
+		}
+	}
+}
@@ -1,15 +1,18 @@
 package exporter
 
 import (
+	"sync"
 	"time"
 
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 var (
 	up = prometheus.NewDesc(
 		"tflcycles_up",
-		"Whether the request to TfL's /BikePoint API succeeded.",
+		"Whether fetching the system's station availabilities succeeded.",
 		nil, nil,
 	)
 	scrapeDurationSeconds = prometheus.NewDesc(
@@ -17,6 +20,11 @@ var (
 		"The amount of time it took to retrieve and parse the data for the scrape.",
 		nil, nil,
 	)
+	lastErrorInfo = prometheus.NewDesc(
+		"tflcycles_last_error_info",
+		"The class of error that caused the fetch for this scrape to fail. Only present if tflcycles_up is 0. Always 1.",
+		[]string{"class"}, nil,
+	)
 )
 
 // ScrapeCollector is a prometheus.Collector yielding metrics about the
@@ -24,11 +32,16 @@ var (
 type ScrapeCollector struct {
 	Success bool
 	time.Duration
+
+	// ErrorClass is the class of the error that caused the fetch to fail. It
+	// is ignored if Success is true.
+	ErrorClass bikepoint.ErrorClass
 }
 
 func (ScrapeCollector) Describe(d chan<- *prometheus.Desc) {
 	d <- up
 	d <- scrapeDurationSeconds
+	d <- lastErrorInfo
 }
 
 func (c ScrapeCollector) Collect(m chan<- prometheus.Metric) {
@@ -44,6 +57,58 @@ func (c ScrapeCollector) Collect(m chan<- prometheus.Metric) {
 		prometheus.GaugeValue,
 		c.Duration.Seconds(),
 	)
+	if !c.Success {
+		errorClass := c.ErrorClass
+		if errorClass == "" {
+			errorClass = bikepoint.ClassUnknown
+		}
+		m <- prometheus.MustNewConstMetric(
+			lastErrorInfo,
+			prometheus.GaugeValue,
+			1,
+			string(errorClass),
+		)
+	}
+}
+
+// scrapeOutcomes holds the latest ScrapeCollector of each system, keyed by
+// name. It is safe for concurrent use.
+type scrapeOutcomes struct {
+	mu      sync.Mutex
+	systems map[string]ScrapeCollector
+}
+
+func newScrapeOutcomes() *scrapeOutcomes {
+	return &scrapeOutcomes{
+		systems: make(map[string]ScrapeCollector),
+	}
+}
+
+func (o *scrapeOutcomes) set(system string, scrape ScrapeCollector) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.systems[system] = scrape
+}
+
+// get returns the system's latest outcome, or false if it has not been
+// fetched.
+func (o *scrapeOutcomes) get(system string) (ScrapeCollector, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	scrape, ok := o.systems[system]
+	return scrape, ok
+}
+
+// upCollector yields only tflcycles_up, for when the rest of a scrape's
+// metrics are not known.
+type upCollector bool
+
+func (upCollector) Describe(d chan<- *prometheus.Desc) {
+	d <- up
+}
+
+func (c upCollector) Collect(m chan<- prometheus.Metric) {
+	m <- prometheus.MustNewConstMetric(up, prometheus.UntypedValue, boolToFloat64(bool(c)))
 }
 
 func boolToFloat64(b bool) float64 {
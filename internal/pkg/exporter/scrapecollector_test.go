@@ -6,6 +6,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+
 	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
@@ -15,23 +17,33 @@ func TestScrapeCollector_Collect(t *testing.T) {
 		want string
 	}{
 		{
-			ScrapeCollector{true, 2 * time.Second},
+			ScrapeCollector{
+				Success:  true,
+				Duration: 2 * time.Second,
+			},
 			`
             # HELP tflcycles_scrape_duration_seconds The amount of time it took to retrieve and parse the data for the scrape.
             # TYPE tflcycles_scrape_duration_seconds gauge
             tflcycles_scrape_duration_seconds 2
-            # HELP tflcycles_up Whether the request to TfL's /BikePoint API succeeded.
+            # HELP tflcycles_up Whether fetching the system's station availabilities succeeded.
             # TYPE tflcyles_up untyped
             tflcycles_up 1
             `,
 		},
 		{
-			ScrapeCollector{false, time.Second},
+			ScrapeCollector{
+				Success:    false,
+				Duration:   time.Second,
+				ErrorClass: bikepoint.ClassRateLimited,
+			},
 			`
+            # HELP tflcycles_last_error_info The class of error that caused the fetch for this scrape to fail. Only present if tflcycles_up is 0. Always 1.
+            # TYPE tflcycles_last_error_info gauge
+            tflcycles_last_error_info{class="rate_limited"} 1
             # HELP tflcycles_scrape_duration_seconds The amount of time it took to retrieve and parse the data for the scrape.
             # TYPE tflcycles_scrape_duration_seconds gauge
             tflcycles_scrape_duration_seconds 1
-            # HELP tflcycles_up Whether the request to TfL's /BikePoint API succeeded.
+            # HELP tflcycles_up Whether fetching the system's station availabilities succeeded.
             # TYPE tflcyles_up untyped
             tflcycles_up 0
             `,
@@ -1,6 +1,8 @@
 package exporter
 
 import (
+	"time"
+
 	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -37,6 +39,11 @@ var (
 // about retrieved dock and bike availability data.
 type StationAvailabilitiesCollector struct {
 	StationAvailabilities []bikepoint.StationAvailability
+
+	// Timestamp optionally returns the time to attach to a station's samples.
+	// If nil, or if it returns the zero time, samples are left without a
+	// timestamp, so will be stamped with the scrape time by Prometheus.
+	Timestamp func(bikepoint.StationAvailability) time.Time
 }
 
 func (StationAvailabilitiesCollector) Describe(d chan<- *prometheus.Desc) {
@@ -48,29 +55,25 @@ func (StationAvailabilitiesCollector) Describe(d chan<- *prometheus.Desc) {
 
 func (c StationAvailabilitiesCollector) Collect(m chan<- prometheus.Metric) {
 	for _, stationAvailability := range c.StationAvailabilities {
-		m <- prometheus.MustNewConstMetric(
-			docks,
-			prometheus.GaugeValue,
-			float64(stationAvailability.Station.Docks),
-			stationAvailability.Station.Name,
-		)
-		m <- prometheus.MustNewConstMetric(
-			docksAvailable,
-			prometheus.GaugeValue,
-			float64(stationAvailability.Availability.Docks),
-			stationAvailability.Station.Name,
-		)
-		m <- prometheus.MustNewConstMetric(
-			bicyclesAvailable,
-			prometheus.GaugeValue,
-			float64(stationAvailability.Availability.Bicycles),
-			stationAvailability.Station.Name,
-		)
-		m <- prometheus.MustNewConstMetric(
-			eBikesAvailable,
-			prometheus.GaugeValue,
-			float64(stationAvailability.Availability.EBikes),
-			stationAvailability.Station.Name,
-		)
+		var timestamp time.Time
+		if c.Timestamp != nil {
+			timestamp = c.Timestamp(stationAvailability)
+		}
+		gauge := func(desc *prometheus.Desc, value int) prometheus.Metric {
+			metric := prometheus.MustNewConstMetric(
+				desc,
+				prometheus.GaugeValue,
+				float64(value),
+				stationAvailability.Station.Name,
+			)
+			if timestamp.IsZero() {
+				return metric
+			}
+			return prometheus.NewMetricWithTimestamp(timestamp, metric)
+		}
+		m <- gauge(docks, stationAvailability.Station.Docks)
+		m <- gauge(docksAvailable, stationAvailability.Availability.Docks)
+		m <- gauge(bicyclesAvailable, stationAvailability.Availability.Bicycles)
+		m <- gauge(eBikesAvailable, stationAvailability.Availability.EBikes)
 	}
 }
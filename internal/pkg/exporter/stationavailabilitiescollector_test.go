@@ -4,6 +4,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
 
@@ -17,7 +18,7 @@ func TestStationAvailabilitiesCollector_Collect(t *testing.T) {
 	}{
 		{
 			StationAvailabilitiesCollector{
-				[]bikepoint.StationAvailability{
+				StationAvailabilities: []bikepoint.StationAvailability{
 					{
 						Station: bikepoint.Station{
 							Name:  "Foo",
@@ -59,6 +60,56 @@ func TestStationAvailabilitiesCollector_Collect(t *testing.T) {
             # TYPE tflcycles_ebikes_available gauge
             tflcycles_ebikes_available{station="Bar"} 5
             tflcycles_ebikes_available{station="Foo"} 1
+            `,
+		},
+		{
+			StationAvailabilitiesCollector{
+				StationAvailabilities: []bikepoint.StationAvailability{
+					{
+						Station: bikepoint.Station{
+							Name:  "Foo",
+							Docks: 5,
+						},
+						Availability: bikepoint.Availability{
+							Docks:    1,
+							Bicycles: 2,
+							EBikes:   1,
+						},
+						Modified: time.UnixMilli(1729245941690),
+					},
+					{
+						Station: bikepoint.Station{
+							Name:  "Bar",
+							Docks: 22,
+						},
+						Availability: bikepoint.Availability{
+							Docks:    1,
+							Bicycles: 3,
+							EBikes:   5,
+						},
+					},
+				},
+				Timestamp: func(sa bikepoint.StationAvailability) time.Time {
+					return sa.Modified
+				},
+			},
+			`
+			# HELP tflcycles_bicycles_available The number of in-service, conventional bikes available for hire.
+            # TYPE tflcycles_bicycles_available gauge
+            tflcycles_bicycles_available{station="Bar"} 3
+            tflcycles_bicycles_available{station="Foo"} 2 1729245941690
+            # HELP tflcycles_docks The total number of docks at the station, including those that are out of service.
+            # TYPE tflcycles_docks gauge
+            tflcycles_docks{station="Bar"} 22
+            tflcycles_docks{station="Foo"} 5 1729245941690
+            # HELP tflcycles_docks_available The number of in-service, vacant docks to which a bike can be returned.
+            # TYPE tflcycles_docks_available gauge
+            tflcycles_docks_available{station="Bar"} 1
+            tflcycles_docks_available{station="Foo"} 1 1729245941690
+            # HELP tflcycles_ebikes_available The number of in-service e-bikes available for hire.
+            # TYPE tflcycles_ebikes_available gauge
+            tflcycles_ebikes_available{station="Bar"} 5
+            tflcycles_ebikes_available{station="Foo"} 1 1729245941690
             `,
 		},
 	}
@@ -0,0 +1,113 @@
+package exporter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+)
+
+// sampleTimestamps derives the timestamps to attach to each station's samples
+// from their upstream modification times. It remembers what it returned for
+// each station, so consecutive scrapes never produce samples Prometheus would
+// reject. It is safe for concurrent use.
+type sampleTimestamps struct {
+	mu   sync.Mutex
+	last map[string]stationSample
+}
+
+type stationSample struct {
+	timestamp    time.Time
+	availability bikepoint.Availability
+	docks        int
+}
+
+func newSampleTimestamps() *sampleTimestamps {
+	return &sampleTimestamps{
+		last: make(map[string]stationSample),
+	}
+}
+
+// systemTimestamps holds a sampleTimestamps for each system, creating them on
+// first use. It is safe for concurrent use.
+type systemTimestamps struct {
+	mu      sync.Mutex
+	systems map[string]*sampleTimestamps
+}
+
+func newSystemTimestamps() *systemTimestamps {
+	return &systemTimestamps{
+		systems: make(map[string]*sampleTimestamps),
+	}
+}
+
+// For returns the timestamps for the named system.
+func (s *systemTimestamps) For(system string) *sampleTimestamps {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	timestamps, ok := s.systems[system]
+	if !ok {
+		timestamps = newSampleTimestamps()
+		s.systems[system] = timestamps
+	}
+	return timestamps
+}
+
+// Timestamp returns the time to attach to the provided station's samples, or
+// the zero time if they should be left for Prometheus to timestamp on
+// ingestion.
+//
+// Prometheus stores timestamps with millisecond precision, and will drop a
+// sample older than the latest in its series (out of order), or with the same
+// timestamp but a different value (duplicate sample). The Unified API can
+// produce both: it is served from multiple backends which do not agree on
+// modification times, and a bike being hired and returned between polls of a
+// docking point may change the number of docks without advancing `modified`.
+// We therefore never go backwards, and nudge the timestamp forward by 1ms if
+// the values changed but the time did not.
+func (s *sampleTimestamps) Timestamp(sa bikepoint.StationAvailability) time.Time {
+	if sa.Modified.IsZero() {
+		return time.Time{}
+	}
+	timestamp := sa.Modified.Truncate(time.Millisecond)
+	current := stationSample{
+		timestamp:    timestamp,
+		availability: sa.Availability,
+		docks:        sa.Station.Docks,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if previous, ok := s.last[sa.Station.Name]; ok {
+		if current.timestamp.Before(previous.timestamp) {
+			current.timestamp = previous.timestamp
+		}
+		if current.timestamp.Equal(previous.timestamp) &&
+			(current.availability != previous.availability ||
+				current.docks != previous.docks) {
+			current.timestamp = previous.timestamp.Add(time.Millisecond)
+		}
+	}
+	s.last[sa.Station.Name] = current
+	return current.timestamp
+}
+
+// Retain forgets stations missing from the snapshot, so stations that are
+// removed from the system do not accumulate.
+func (s *sampleTimestamps) Retain(stationAvailabilities []bikepoint.StationAvailability) {
+	names := make(map[string]struct{}, len(stationAvailabilities))
+	for _, sa := range stationAvailabilities {
+		names[sa.Station.Name] = struct{}{}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name := range s.last {
+		if _, ok := names[name]; !ok {
+			delete(s.last, name)
+		}
+	}
+}
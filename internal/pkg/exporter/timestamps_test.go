@@ -0,0 +1,181 @@
+package exporter
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+)
+
+func TestSampleTimestamps_Timestamp(t *testing.T) {
+	t0 := time.Date(2024, 10, 18, 10, 5, 41, 690_000_000, time.UTC)
+	station := func(modified time.Time, bicycles int) bikepoint.StationAvailability {
+		return bikepoint.StationAvailability{
+			Station: bikepoint.Station{
+				Name:  "Foo",
+				Docks: 10,
+			},
+			Availability: bikepoint.Availability{
+				Docks:    10 - bicycles,
+				Bicycles: bicycles,
+			},
+			Modified: modified,
+		}
+	}
+	tests := []struct {
+		name string
+		// Scrapes are applied in order to the same instance. Only the final
+		// timestamp is checked.
+		scrapes []bikepoint.StationAvailability
+		want    time.Time
+	}{
+		{
+			"no modified time",
+			[]bikepoint.StationAvailability{
+				station(time.Time{}, 1),
+			},
+			time.Time{},
+		},
+		{
+			"first scrape",
+			[]bikepoint.StationAvailability{
+				station(t0, 1),
+			},
+			t0,
+		},
+		{
+			"truncated to milliseconds",
+			[]bikepoint.StationAvailability{
+				station(t0.Add(123*time.Microsecond), 1),
+			},
+			t0,
+		},
+		{
+			"advancing",
+			[]bikepoint.StationAvailability{
+				station(t0, 1),
+				station(t0.Add(time.Minute), 2),
+			},
+			t0.Add(time.Minute),
+		},
+		{
+			"identical",
+			[]bikepoint.StationAvailability{
+				station(t0, 1),
+				station(t0, 1),
+			},
+			t0,
+		},
+		{
+			"identical time with changed values",
+			[]bikepoint.StationAvailability{
+				station(t0, 1),
+				station(t0, 2),
+			},
+			t0.Add(time.Millisecond),
+		},
+		{
+			"identical time with changed values repeatedly",
+			[]bikepoint.StationAvailability{
+				station(t0, 1),
+				station(t0, 2),
+				station(t0, 3),
+			},
+			t0.Add(2 * time.Millisecond),
+		},
+		{
+			"identical time and values after nudge",
+			[]bikepoint.StationAvailability{
+				station(t0, 1),
+				station(t0, 2),
+				station(t0, 2),
+			},
+			t0.Add(time.Millisecond),
+		},
+		{
+			"out of order",
+			[]bikepoint.StationAvailability{
+				station(t0, 1),
+				station(t0.Add(-time.Minute), 1),
+			},
+			t0,
+		},
+		{
+			"out of order with changed values",
+			[]bikepoint.StationAvailability{
+				station(t0, 1),
+				station(t0.Add(-time.Minute), 2),
+			},
+			t0.Add(time.Millisecond),
+		},
+		{
+			"recovers after out of order",
+			[]bikepoint.StationAvailability{
+				station(t0, 1),
+				station(t0.Add(-time.Minute), 2),
+				station(t0.Add(time.Minute), 3),
+			},
+			t0.Add(time.Minute),
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			s := newSampleTimestamps()
+			var got time.Time
+			for _, scrape := range test.scrapes {
+				got = s.Timestamp(scrape)
+			}
+			if !got.Equal(test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSampleTimestamps_TimestampStationsIndependent(t *testing.T) {
+	t.Parallel()
+
+	t0 := time.Date(2024, 10, 18, 10, 5, 41, 0, time.UTC)
+	s := newSampleTimestamps()
+	for i, want := range []time.Time{t0, t0.Add(-time.Minute)} {
+		got := s.Timestamp(bikepoint.StationAvailability{
+			Station: bikepoint.Station{
+				Name: strconv.Itoa(i),
+			},
+			Modified: want,
+		})
+		if !got.Equal(want) {
+			t.Errorf("station %v: got %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestSampleTimestamps_Retain(t *testing.T) {
+	t.Parallel()
+
+	t0 := time.Date(2024, 10, 18, 10, 5, 41, 0, time.UTC)
+	station := func(name string, modified time.Time) bikepoint.StationAvailability {
+		return bikepoint.StationAvailability{
+			Station: bikepoint.Station{
+				Name: name,
+			},
+			Modified: modified,
+		}
+	}
+	s := newSampleTimestamps()
+	s.Timestamp(station("Foo", t0))
+	s.Timestamp(station("Bar", t0))
+
+	s.Retain([]bikepoint.StationAvailability{station("Foo", t0)})
+
+	if _, ok := s.last["Bar"]; ok {
+		t.Error("removed station was retained")
+	}
+	// Foo is still remembered, so cannot go backwards.
+	if got := s.Timestamp(station("Foo", t0.Add(-time.Minute))); !got.Equal(t0) {
+		t.Errorf("got %v, want %v", got, t0)
+	}
+}
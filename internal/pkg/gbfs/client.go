@@ -0,0 +1,286 @@
+package gbfs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/audit"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/backoffutil"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/promutil"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/gebn/go-stamp/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	httpRequestDuration = promauto.NewHistogramVec(promutil.WithNativeHistogram(prometheus.HistogramOpts{
+		Name:    "tflcycles_gbfs_http_request_duration_seconds",
+		Help:    "Observes the duration of all requests to GBFS feeds, including response parsing.",
+		Buckets: prometheus.ExponentialBuckets(.2, 1.355, 10), // 3.08
+	}), []string{"feed"})
+	httpRequestFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tflcycles_gbfs_http_request_failures_total",
+		Help: "The number of GBFS feed requests that timed out or returned an invalid response.",
+	}, []string{"feed"})
+	httpRequestRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tflcycles_gbfs_http_request_retries_total",
+		Help: "The number of times we timed-out or received a 5xx error from a GBFS feed, and retried.",
+	}, []string{"feed"})
+	httpRequestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tflcycles_gbfs_http_request_errors_total",
+		Help: "The number of failed GBFS feed requests, by class of error.",
+	}, []string{"feed", "class"})
+)
+
+// Client retrieves station availability from a GBFS system. Create instances
+// with NewClient().
+type Client struct {
+
+	// Logger will be used to record failed fetch attempts.
+	Logger *slog.Logger
+
+	// HTTPClient is the client used to make requests to the feeds. This must
+	// be provided when calling NewClient().
+	HTTPClient *http.Client
+
+	// URL is the location of the system's gbfs.json discovery file. This must
+	// be provided when calling NewClient().
+	URL string
+
+	// Language selects between translations of 2.x discovery files. If empty,
+	// the first language listed is used. This can be configured using
+	// WithLanguage().
+	Language string
+
+	// Timeout is the per-attempt request timeout. This can be configured using
+	// WithTimeout().
+	Timeout time.Duration
+}
+
+// ClientOption allows customising the client's behaviour during construction
+// with NewClient().
+type ClientOption func(*Client)
+
+// WithLanguage selects the language of feeds to use from a 2.x discovery file,
+// e.g. "en". It has no effect on 3.x systems.
+func WithLanguage(language string) ClientOption {
+	return func(c *Client) {
+		c.Language = language
+	}
+}
+
+// WithTimeout sets the per-attempt request timeout. This is 3s by default. The
+// lower of this and the HTTPClient's request timeout will be effective.
+func WithTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.Timeout = timeout
+	}
+}
+
+// NewClient initialises a client to retrieve data from the GBFS system whose
+// discovery file is at the provided URL.
+func NewClient(logger *slog.Logger, httpClient *http.Client, url string, opts ...ClientOption) *Client {
+	c := &Client{
+		Logger:     logger,
+		HTTPClient: httpClient,
+		URL:        url,
+		Timeout:    3 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// FetchStationAvailabilities retrieves the latest cycle and dock availability.
+// Each feed request will back-off exponentially until the passed context
+// expires, or a retry could not begin before its deadline. The returned list
+// is sorted by station ID. Stations with information but no status are
+// omitted.
+func (c *Client) FetchStationAvailabilities(ctx context.Context) ([]bikepoint.StationAvailability, error) {
+	d := discovery{}
+	if err := c.fetch(ctx, "gbfs", c.URL, &d); err != nil {
+		return nil, err
+	}
+	urls, err := d.findFeeds(c.Language)
+	if err != nil {
+		return nil, &bikepoint.Error{
+			Class: bikepoint.ClassValidation,
+			Err:   err,
+		}
+	}
+	for _, name := range []string{feedStationInformation, feedStationStatus} {
+		if urls[name] == "" {
+			return nil, &bikepoint.Error{
+				Class: bikepoint.ClassValidation,
+				Err:   fmt.Errorf("discovery file does not list %v feed", name),
+			}
+		}
+	}
+
+	information := stationInformation{}
+	if err := c.fetch(ctx, feedStationInformation, urls[feedStationInformation], &information); err != nil {
+		return nil, err
+	}
+	status := stationStatus{}
+	if err := c.fetch(ctx, feedStationStatus, urls[feedStationStatus], &status); err != nil {
+		return nil, err
+	}
+
+	// Vehicle types are optional, and only needed to tell e-bikes apart.
+	var electric map[string]bool
+	if url := urls[feedVehicleTypes]; url != "" {
+		types := vehicleTypes{}
+		if err := c.fetch(ctx, feedVehicleTypes, url, &types); err != nil {
+			return nil, err
+		}
+		electric = make(map[string]bool, len(types.Data.VehicleTypes))
+		for _, vt := range types.Data.VehicleTypes {
+			electric[vt.VehicleTypeID] = strings.HasPrefix(vt.PropulsionType, "electric")
+		}
+	}
+
+	statuses := make(map[string]stationStatusStation, len(status.Data.Stations))
+	for _, s := range status.Data.Stations {
+		statuses[s.StationID] = s
+	}
+	stationAvailabilities := make([]bikepoint.StationAvailability, 0, len(information.Data.Stations))
+	for _, info := range information.Data.Stations {
+		s, ok := statuses[info.StationID]
+		if !ok {
+			continue
+		}
+		stationAvailabilities = append(stationAvailabilities,
+			toStationAvailability(info, s, electric))
+	}
+	slices.SortFunc(stationAvailabilities, func(a, b bikepoint.StationAvailability) int {
+		return strings.Compare(a.Station.ID, b.Station.ID)
+	})
+	return stationAvailabilities, nil
+}
+
+// toStationAvailability combines a station's information and status. If
+// electric is nil, the system does not publish vehicle types, so we fall back
+// to the non-standard num_ebikes_available field.
+func toStationAvailability(info stationInformationStation, status stationStatusStation, electric map[string]bool) bikepoint.StationAvailability {
+	var vehicles, eBikes int
+	switch {
+	case status.NumVehiclesAvailable != nil:
+		vehicles = *status.NumVehiclesAvailable
+	case status.NumBikesAvailable != nil:
+		vehicles = *status.NumBikesAvailable
+	}
+	if electric != nil && status.VehicleTypesAvailable != nil {
+		for _, vta := range status.VehicleTypesAvailable {
+			if electric[vta.VehicleTypeID] {
+				eBikes += vta.Count
+			}
+		}
+	} else if status.NumEBikesAvailable != nil {
+		eBikes = *status.NumEBikesAvailable
+	}
+	return bikepoint.StationAvailability{
+		Station: bikepoint.Station{
+			ID:    info.StationID,
+			Name:  string(info.Name),
+			Docks: info.Capacity,
+			Lat:   info.Lat,
+			Lon:   info.Lon,
+		},
+		Availability: bikepoint.Availability{
+			Docks:    status.NumDocksAvailable,
+			Bicycles: vehicles - eBikes,
+			EBikes:   eBikes,
+			// Matches TfL's definition of a station being unusable.
+			Locked: status.IsRenting != nil && !*status.IsRenting &&
+				status.IsReturning != nil && !*status.IsReturning,
+		},
+		Modified: time.Time(status.LastReported),
+	}
+}
+
+// fetch retrieves the JSON document at url into v, retrying on timeouts and 5xx
+// responses. The name is used to label metrics.
+func (c *Client) fetch(ctx context.Context, name, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("user-agent", "tflcycles_exporter/"+stamp.Version)
+
+	return backoff.RetryNotify(
+		func() (err error) {
+			ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+			defer cancel()
+
+			timer := prometheus.NewTimer(httpRequestDuration.WithLabelValues(name))
+			defer timer.ObserveDurationWithExemplar(promutil.TraceExemplar(ctx))
+
+			attempt := audit.Attempt{
+				URL: url,
+			}
+			body := &audit.CountingReader{}
+			start := time.Now()
+			defer func() {
+				attempt.Bytes = body.N
+				attempt.Duration = time.Since(start).Seconds()
+				if err != nil {
+					attempt.Error = err.Error()
+					attempt.Class = string(bikepoint.ClassOf(err))
+				}
+				audit.FromContext(ctx).AddAttempt(attempt)
+			}()
+
+			resp, err := c.HTTPClient.Do(req.WithContext(ctx))
+			if err != nil {
+				return failed(name, bikepoint.ClassifyTransportError(err))
+			}
+			defer resp.Body.Close()
+			body.Reader = resp.Body
+			attempt.Status = resp.StatusCode
+
+			if resp.StatusCode != http.StatusOK {
+				// If we fail to read the body, we still have the status.
+				b, _ := io.ReadAll(body)
+				fault := failed(name, bikepoint.NewStatusError(resp.StatusCode,
+					fmt.Sprintf("%v: %v", url, string(b))))
+				if resp.StatusCode < http.StatusInternalServerError {
+					return backoff.Permanent(fault)
+				}
+				return fault
+			}
+
+			if err := json.NewDecoder(body).Decode(v); err != nil {
+				return failed(name, bikepoint.ClassifyDecodeError(err))
+			}
+			return nil
+		},
+		backoffutil.WithContext(backoff.NewExponentialBackOff(), ctx),
+		func(err error, wait time.Duration) {
+			c.Logger.WarnContext(ctx, "failed attempt",
+				slog.String("feed", name),
+				slog.String("error", err.Error()),
+				slog.Duration("timeout", c.Timeout),
+				slog.Duration("wait", wait))
+			httpRequestRetries.WithLabelValues(name).Inc()
+		},
+	)
+}
+
+// failed records a failed attempt to retrieve a feed, returning the error for
+// convenience. The error must have been classified.
+func failed(feed string, err error) error {
+	httpRequestFailures.WithLabelValues(feed).Inc()
+	httpRequestErrors.WithLabelValues(feed, string(bikepoint.ClassOf(err))).Inc()
+	return err
+}
@@ -0,0 +1,233 @@
+package gbfs
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+)
+
+// newFixtureServer serves the recorded feeds in testdata, replacing {{URL}} in
+// them with the server's URL so discovery files point back at it. If fail is
+// non-nil and returns true for a request, a 503 is returned instead.
+func newFixtureServer(t *testing.T, fail func(*http.Request) bool) *httptest.Server {
+	t.Helper()
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail != nil && fail(r) {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		b, err := os.ReadFile(filepath.Join("testdata", filepath.FromSlash(r.URL.Path)))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(bytes.ReplaceAll(b, []byte("{{URL}}"), []byte(server.URL)))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestClient_FetchStationAvailabilities(t *testing.T) {
+	server := newFixtureServer(t, nil)
+	tests := []struct {
+		name     string
+		path     string
+		language string
+		want     []bikepoint.StationAvailability
+		wantErr  bool
+	}{
+		{
+			name: "2.x with vehicle types",
+			path: "/v2/gbfs.json",
+			want: []bikepoint.StationAvailability{
+				{
+					Station: bikepoint.Station{
+						ID:    "1",
+						Name:  "Cardiff Central",
+						Docks: 20,
+						Lat:   51.4758,
+						Lon:   -3.1792,
+					},
+					Availability: bikepoint.Availability{
+						Docks:    12,
+						Bicycles: 5,
+						EBikes:   2,
+					},
+					Modified: time.Unix(1729245900, 0).UTC(),
+				},
+				{
+					Station: bikepoint.Station{
+						ID:    "2",
+						Name:  "Queen Street",
+						Docks: 12,
+						Lat:   51.4816,
+						Lon:   -3.1765,
+					},
+					Availability: bikepoint.Availability{
+						Docks: 12,
+					},
+					Modified: time.Unix(1729245800, 0).UTC(),
+				},
+			},
+		},
+		{
+			name:     "2.x with explicit language",
+			path:     "/v2/gbfs.json",
+			language: "cy",
+			// The Welsh feeds do not exist.
+			wantErr: true,
+		},
+		{
+			name:     "2.x with unknown language",
+			path:     "/v2/gbfs.json",
+			language: "fr",
+			wantErr:  true,
+		},
+		{
+			name: "3.x",
+			path: "/v3/gbfs.json",
+			want: []bikepoint.StationAvailability{
+				{
+					Station: bikepoint.Station{
+						ID:    "a",
+						Name:  "Broad Street",
+						Docks: 10,
+						Lat:   51.7543,
+						Lon:   -1.2582,
+					},
+					Availability: bikepoint.Availability{
+						Docks:    6,
+						Bicycles: 3,
+						EBikes:   1,
+					},
+					Modified: time.Date(2024, 10, 18, 10, 5, 0, 0, time.UTC),
+				},
+			},
+		},
+		{
+			name:    "missing discovery file",
+			path:    "/v4/gbfs.json",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			client := NewClient(slog.Default(), server.Client(), server.URL+test.path,
+				WithLanguage(test.language))
+			got, err := client.FetchStationAvailabilities(ctx)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("wanted error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestClient_FetchStationAvailabilitiesRetries(t *testing.T) {
+	t.Parallel()
+
+	failures := atomic.Int32{}
+	failures.Store(2)
+	server := newFixtureServer(t, func(r *http.Request) bool {
+		return r.URL.Path == "/v3/station_status.json" && failures.Add(-1) >= 0
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := NewClient(slog.Default(), server.Client(), server.URL+"/v3/gbfs.json")
+	got, err := client.FetchStationAvailabilities(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Errorf("wanted 1 station, got %v", len(got))
+	}
+	if remaining := failures.Load(); remaining >= 0 {
+		t.Errorf("wanted all failures to be retried, %v remaining", remaining+1)
+	}
+}
+
+func TestToStationAvailability_Locked(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name        string
+		isRenting   *bool
+		isReturning *bool
+		want        bool
+	}{
+		{"absent", nil, nil, false},
+		{"open", &yes, &yes, false},
+		{"not renting", &no, &yes, false},
+		{"not returning", &yes, &no, false},
+		{"closed", &no, &no, true},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			sa := toStationAvailability(stationInformationStation{}, stationStatusStation{
+				IsRenting:   test.isRenting,
+				IsReturning: test.isReturning,
+			}, nil)
+			if sa.Availability.Locked != test.want {
+				t.Errorf("got locked %v, want %v", sa.Availability.Locked, test.want)
+			}
+		})
+	}
+}
+
+func TestTimestamp_UnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		want    time.Time
+		wantErr bool
+	}{
+		{"integer", `1709510400`, time.Unix(1709510400, 0).UTC(), false},
+		{"float", `1709510400.5`, time.Unix(1709510400, 500_000_000).UTC(), false},
+		{"rfc 3339", `"2024-03-04T00:00:00Z"`, time.Unix(1709510400, 0).UTC(), false},
+		{"null", `null`, time.Time{}, false},
+		{"invalid", `"yesterday"`, time.Time{}, true},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			var got timestamp
+			err := got.UnmarshalJSON([]byte(test.json))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("wanted error %v, got %v", test.wantErr, err)
+			}
+			if !time.Time(got).Equal(test.want) {
+				t.Errorf("got %v, want %v", time.Time(got), test.want)
+			}
+		})
+	}
+}
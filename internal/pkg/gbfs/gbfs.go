@@ -0,0 +1,203 @@
+// Package gbfs implements a client for bike share systems publishing the
+// General Bikeshare Feed Specification, returning data in the same form as the
+// bikepoint package. Versions 2.x and 3.x are supported.
+//
+// Spec: https://github.com/MobilityData/gbfs/blob/master/gbfs.md
+package gbfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Feed names we consume from the discovery file.
+const (
+	feedStationInformation = "station_information"
+	feedStationStatus      = "station_status"
+	feedVehicleTypes       = "vehicle_types"
+)
+
+type (
+	// discovery is the gbfs.json file. In 2.x, feeds are keyed by language;
+	// in 3.x they are not.
+	discovery struct {
+		Data json.RawMessage `json:"data"`
+	}
+
+	feeds struct {
+		Feeds []feed `json:"feeds"`
+	}
+
+	feed struct {
+		Name string `json:"name"`
+		URL  string `json:"url"`
+	}
+
+	stationInformation struct {
+		Data struct {
+			Stations []stationInformationStation `json:"stations"`
+		} `json:"data"`
+	}
+
+	stationInformationStation struct {
+		StationID string        `json:"station_id"`
+		Name      localisedText `json:"name"`
+		Lat       float64       `json:"lat"`
+		Lon       float64       `json:"lon"`
+		Capacity  int           `json:"capacity"`
+	}
+
+	stationStatus struct {
+		Data struct {
+			Stations []stationStatusStation `json:"stations"`
+		} `json:"data"`
+	}
+
+	stationStatusStation struct {
+		StationID string `json:"station_id"`
+
+		// NumBikesAvailable was renamed to NumVehiclesAvailable in 3.0.
+		NumBikesAvailable    *int `json:"num_bikes_available"`
+		NumVehiclesAvailable *int `json:"num_vehicles_available"`
+
+		NumDocksAvailable int `json:"num_docks_available"`
+
+		// NumEBikesAvailable is not part of the spec, but is published by
+		// many systems that predate vehicle types.
+		NumEBikesAvailable *int `json:"num_ebikes_available"`
+
+		VehicleTypesAvailable []struct {
+			VehicleTypeID string `json:"vehicle_type_id"`
+			Count         int    `json:"count"`
+		} `json:"vehicle_types_available"`
+
+		// IsRenting and IsReturning are required by the spec, but treated as
+		// true if absent, as that is the common case.
+		IsRenting   *bool `json:"is_renting"`
+		IsReturning *bool `json:"is_returning"`
+
+		LastReported timestamp `json:"last_reported"`
+	}
+
+	vehicleTypes struct {
+		Data struct {
+			VehicleTypes []struct {
+				VehicleTypeID  string `json:"vehicle_type_id"`
+				PropulsionType string `json:"propulsion_type"`
+			} `json:"vehicle_types"`
+		} `json:"data"`
+	}
+)
+
+// findFeeds returns the URLs of the feeds in the discovery file, keyed by name.
+// If the file is in the 2.x format, the language is used to select between
+// translations; if empty, the first is chosen.
+func (d discovery) findFeeds(language string) (map[string]string, error) {
+	f := feeds{}
+	if err := json.Unmarshal(d.Data, &f); err != nil {
+		return nil, err
+	}
+	if f.Feeds == nil {
+		// 2.x: data is keyed by language. Go's map ordering is random, so we
+		// decode the keys in order to make "first" meaningful.
+		languages, err := orderedKeys(d.Data)
+		if err != nil {
+			return nil, err
+		}
+		if len(languages) == 0 {
+			return nil, errors.New("discovery file contains no feeds")
+		}
+		if language == "" {
+			language = languages[0]
+		}
+		byLanguage := map[string]feeds{}
+		if err := json.Unmarshal(d.Data, &byLanguage); err != nil {
+			return nil, err
+		}
+		var ok bool
+		if f, ok = byLanguage[language]; !ok {
+			return nil, fmt.Errorf("discovery file has no feeds for language %q", language)
+		}
+	}
+	urls := make(map[string]string, len(f.Feeds))
+	for _, feed := range f.Feeds {
+		urls[feed.Name] = feed.URL
+	}
+	return urls, nil
+}
+
+// orderedKeys returns the keys of a JSON object in the order they appear.
+func orderedKeys(b json.RawMessage) ([]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	var keys []string
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key.(string))
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// localisedText is a station name. It is a plain string in 2.x, and a list of
+// translations in 3.x, of which we take the first.
+type localisedText string
+
+func (t *localisedText) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*t = localisedText(s)
+		return nil
+	}
+	var translations []struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(b, &translations); err != nil {
+		return err
+	}
+	if len(translations) > 0 {
+		*t = localisedText(translations[0].Text)
+	}
+	return nil
+}
+
+// timestamp is a POSIX timestamp in 2.x, which may be an integer or float,
+// and an RFC 3339 string in 3.x.
+type timestamp time.Time
+
+func (t *timestamp) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		if s == "" {
+			// Includes null.
+			return nil
+		}
+		parsed, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return err
+		}
+		*t = timestamp(parsed)
+		return nil
+	}
+	// Some feeds include fractional seconds.
+	seconds, err := strconv.ParseFloat(string(b), 64)
+	if err != nil {
+		return err
+	}
+	whole, frac := math.Modf(seconds)
+	*t = timestamp(time.Unix(int64(whole), int64(frac*1e9)).UTC())
+	return nil
+}
@@ -0,0 +1,247 @@
+// Package graphite pushes station availability to Graphite over its plaintext
+// protocol.
+package graphite
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	pushes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tflcycles_exporter_graphite_pushes_total",
+		Help: "The number of polls of station availability to push to Graphite, by whether they were pushed, failed, or were dropped from a full queue.",
+	}, []string{"result"})
+)
+
+func init() {
+	for _, result := range []string{"success", "failure", "dropped"} {
+		pushes.WithLabelValues(result)
+	}
+}
+
+// AppendLines appends a line for each of the system's stations' metrics to b,
+// in the form "prefix.system.id.metric value timestamp". The prefix may
+// contain dots to span several nodes. Stations are identified by ID rather
+// than name, as names need not be unique, and a renamed station would
+// otherwise start a new series.
+func AppendLines(b []byte, prefix, system string, stationAvailabilities []bikepoint.StationAvailability, t time.Time) []byte {
+	timestamp := t.Unix()
+	var nodes []string
+	for _, node := range strings.Split(prefix, ".") {
+		if node = Sanitise(node); node != "" {
+			nodes = append(nodes, node)
+		}
+	}
+	nodes = append(nodes, Sanitise(system))
+	root := strings.Join(nodes, ".")
+	for _, sa := range stationAvailabilities {
+		station := Sanitise(sa.Station.ID)
+		for _, metric := range []struct {
+			name  string
+			value int
+		}{
+			{"docks", sa.Station.Docks},
+			{"docks_available", sa.Availability.Docks},
+			{"bicycles_available", sa.Availability.Bicycles},
+			{"ebikes_available", sa.Availability.EBikes},
+		} {
+			b = append(b, root...)
+			b = append(b, '.')
+			b = append(b, station...)
+			b = append(b, '.')
+			b = append(b, metric.name...)
+			b = append(b, ' ')
+			b = strconv.AppendInt(b, int64(metric.value), 10)
+			b = append(b, ' ')
+			b = strconv.AppendInt(b, timestamp, 10)
+			b = append(b, '\n')
+		}
+	}
+	return b
+}
+
+// Sanitise makes s usable as a single node of a metric path. Dots would
+// introduce a level, spaces would end the path, and most other punctuation
+// needs quoting in queries, so each run of characters other than ASCII
+// letters, digits, hyphens and underscores is replaced with an underscore.
+// Leading and trailing runs are removed, so "Stonecutter Street, Holborn"
+// becomes "Stonecutter_Street_Holborn".
+func Sanitise(s string) string {
+	b := make([]byte, 0, len(s))
+	replaced := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' {
+			if replaced && len(b) > 0 {
+				b = append(b, '_')
+			}
+			replaced = false
+			b = append(b, c)
+			continue
+		}
+		replaced = true
+	}
+	return string(b)
+}
+
+// PusherOption customises a Pusher.
+type PusherOption func(*Pusher)
+
+// WithPrefix sets the start of every metric path, e.g. "bikes.london". It
+// defaults to "tflcycles". An empty prefix places systems at the root.
+func WithPrefix(prefix string) PusherOption {
+	return func(p *Pusher) {
+		p.Prefix = prefix
+	}
+}
+
+// WithTimeout sets how long each push may take, including connecting. It
+// defaults to 10s.
+func WithTimeout(timeout time.Duration) PusherOption {
+	return func(p *Pusher) {
+		p.Timeout = timeout
+	}
+}
+
+// WithQueueSize sets how many polls can wait to be pushed while Graphite is
+// slow or unavailable, after which further polls are dropped. It defaults to
+// 10.
+func WithQueueSize(size int) PusherOption {
+	return func(p *Pusher) {
+		p.QueueSize = size
+	}
+}
+
+// Pusher writes every system's stations to a Graphite plaintext listener,
+// such as carbon-cache or carbon-relay, each time it observes a poll. Pushes
+// are made by Run(), so a slow listener does not hold up other observers.
+// Create instances with NewPusher().
+type Pusher struct {
+	Logger *slog.Logger
+
+	// Address is the host:port of the plaintext listener, usually on port
+	// 2003.
+	Address string
+
+	Prefix    string
+	Timeout   time.Duration
+	QueueSize int
+
+	// queue holds the rendered lines of each poll waiting to be pushed.
+	queue chan []byte
+}
+
+// NewPusher creates a pusher writing to address. Pass it to watch.Poll(), and
+// call Run() to start pushing.
+func NewPusher(logger *slog.Logger, address string, opts ...PusherOption) *Pusher {
+	p := &Pusher{
+		Logger:    logger,
+		Address:   address,
+		Prefix:    "tflcycles",
+		Timeout:   10 * time.Second,
+		QueueSize: 10,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	p.queue = make(chan []byte, p.QueueSize)
+	return p
+}
+
+// Run pushes queued polls until the context is cancelled. Polls still queued
+// are then discarded.
+func (p *Pusher) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case b := <-p.queue:
+			p.observe(ctx, p.write(ctx, b))
+		}
+	}
+}
+
+// ObserveSystems queues the systems' stations to be pushed, timestamped with
+// the time they were fetched. It does not block: if the queue is full, the
+// poll is dropped. A failed push is not retried, as the next poll will
+// supersede it.
+func (p *Pusher) ObserveSystems(ctx context.Context, t time.Time, systems map[string][]bikepoint.StationAvailability) {
+	b, err := p.render(t, systems)
+	if err != nil {
+		p.observe(ctx, err)
+		return
+	}
+	select {
+	case p.queue <- b:
+	default:
+		pushes.WithLabelValues("dropped").Inc()
+		p.Logger.WarnContext(ctx, "graphite queue full, dropped poll")
+	}
+}
+
+// observe records the outcome of a push.
+func (p *Pusher) observe(ctx context.Context, err error) {
+	if err != nil {
+		pushes.WithLabelValues("failure").Inc()
+		p.Logger.WarnContext(ctx, "failed to push to graphite",
+			slog.String("error", err.Error()))
+		return
+	}
+	pushes.WithLabelValues("success").Inc()
+}
+
+// Push writes the systems' stations over a new connection, failing if there
+// are none, as every system failed to fetch. The push is bounded by the
+// timeout.
+func (p *Pusher) Push(ctx context.Context, t time.Time, systems map[string][]bikepoint.StationAvailability) error {
+	b, err := p.render(t, systems)
+	if err != nil {
+		return err
+	}
+	return p.write(ctx, b)
+}
+
+// render returns the lines to push for the systems' stations.
+func (p *Pusher) render(t time.Time, systems map[string][]bikepoint.StationAvailability) ([]byte, error) {
+	if len(systems) == 0 {
+		return nil, errors.New("no station availabilities to push")
+	}
+	var b []byte
+	for system, stationAvailabilities := range systems {
+		b = AppendLines(b, p.Prefix, system, stationAvailabilities, t)
+	}
+	return b, nil
+}
+
+// write sends lines over a new connection, bounded by the timeout.
+func (p *Pusher) write(ctx context.Context, b []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", p.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetWriteDeadline(deadline); err != nil {
+			return err
+		}
+	}
+	if _, err := conn.Write(b); err != nil {
+		return err
+	}
+	return conn.Close()
+}
@@ -0,0 +1,213 @@
+package graphite
+
+import (
+	"bufio"
+	"context"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSanitise(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want string
+	}{
+		{
+			name: "plain",
+			s:    "BikePoints_1",
+			want: "BikePoints_1",
+		},
+		{
+			name: "comma and space",
+			s:    "Stonecutter Street, Holborn",
+			want: "Stonecutter_Street_Holborn",
+		},
+		{
+			name: "dots",
+			s:    "St. James's Square",
+			want: "St_James_s_Square",
+		},
+		{
+			name: "leading and trailing",
+			s:    " (Hyde Park) ",
+			want: "Hyde_Park",
+		},
+		{
+			name: "hyphen kept",
+			s:    "Ely Place-Holborn",
+			want: "Ely_Place-Holborn",
+		},
+		{
+			name: "non-ascii",
+			s:    "Café Nero",
+			want: "Caf_Nero",
+		},
+		{
+			name: "nothing usable",
+			s:    "., ",
+			want: "",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			if got := Sanitise(test.s); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+var stationAvailabilities = []bikepoint.StationAvailability{
+	{
+		Station: bikepoint.Station{
+			ID:    "BikePoints_1",
+			Name:  "River Street, Clerkenwell",
+			Docks: 19,
+		},
+		Availability: bikepoint.Availability{
+			Docks:    5,
+			Bicycles: 10,
+			EBikes:   2,
+		},
+	},
+	{
+		Station: bikepoint.Station{
+			ID:    "BikePoints_2",
+			Docks: 37,
+		},
+		Availability: bikepoint.Availability{
+			Docks:    30,
+			Bicycles: 7,
+		},
+	},
+}
+
+func TestAppendLines(t *testing.T) {
+	t.Parallel()
+
+	got := string(AppendLines(nil, "tflcycles", "tfl", stationAvailabilities, time.Unix(1700000000, 5)))
+	want := `tflcycles.tfl.BikePoints_1.docks 19 1700000000
+tflcycles.tfl.BikePoints_1.docks_available 5 1700000000
+tflcycles.tfl.BikePoints_1.bicycles_available 10 1700000000
+tflcycles.tfl.BikePoints_1.ebikes_available 2 1700000000
+tflcycles.tfl.BikePoints_2.docks 37 1700000000
+tflcycles.tfl.BikePoints_2.docks_available 30 1700000000
+tflcycles.tfl.BikePoints_2.bicycles_available 7 1700000000
+tflcycles.tfl.BikePoints_2.ebikes_available 0 1700000000
+`
+	if got != want {
+		t.Errorf("got:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestPusher_Push(t *testing.T) {
+	t.Parallel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var lines []string
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		received <- lines
+	}()
+
+	p := NewPusher(slog.Default(), listener.Addr().String(),
+		WithPrefix("bikes.london."),
+		WithTimeout(5*time.Second))
+	systems := map[string][]bikepoint.StationAvailability{
+		"tfl": stationAvailabilities[:1],
+	}
+	if err := p.Push(context.Background(), time.Unix(1700000000, 0), systems); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+	lines := <-received
+	if len(lines) != 4 {
+		t.Fatalf("wanted 4 lines, got %v: %v", len(lines), lines)
+	}
+	if want := "bikes.london.tfl.BikePoints_1.docks 19 1700000000"; lines[0] != want {
+		t.Errorf("got %v, want %v", lines[0], want)
+	}
+}
+
+func TestPusher_Push_Failed(t *testing.T) {
+	t.Parallel()
+
+	p := NewPusher(slog.Default(), "127.0.0.1:0")
+	if err := p.Push(context.Background(), time.Now(), nil); err == nil {
+		t.Error("expected error when no system could be fetched")
+	}
+}
+
+func TestPusher_Run(t *testing.T) {
+	t.Parallel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var lines []string
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		received <- lines
+	}()
+
+	p := NewPusher(slog.Default(), listener.Addr().String())
+	// Observing returns before the push is made.
+	p.ObserveSystems(context.Background(), time.Unix(1700000000, 0), map[string][]bikepoint.StationAvailability{
+		"tfl": stationAvailabilities[:1],
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx)
+
+	if lines := <-received; len(lines) != 4 {
+		t.Fatalf("wanted 4 lines, got %v: %v", len(lines), lines)
+	}
+}
+
+func TestPusher_ObserveSystems_QueueFull(t *testing.T) {
+	t.Parallel()
+
+	p := NewPusher(slog.Default(), "127.0.0.1:0", WithQueueSize(1))
+	systems := map[string][]bikepoint.StationAvailability{
+		"tfl": stationAvailabilities[:1],
+	}
+	before := testutil.ToFloat64(pushes.WithLabelValues("dropped"))
+	// Run() is not called, so the queue is never drained.
+	p.ObserveSystems(context.Background(), time.Now(), systems)
+	p.ObserveSystems(context.Background(), time.Now(), systems)
+	if dropped := testutil.ToFloat64(pushes.WithLabelValues("dropped")) - before; dropped != 1 {
+		t.Errorf("wanted 1 dropped poll, got %v", dropped)
+	}
+}
@@ -0,0 +1,139 @@
+package history
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultRange is the period queried if from is not specified.
+const defaultRange = time.Hour
+
+type pointJSON struct {
+	Time              time.Time `json:"time"`
+	Docks             int       `json:"docks"`
+	DocksAvailable    int       `json:"docks_available"`
+	BicyclesAvailable int       `json:"bicycles_available"`
+	EBikesAvailable   int       `json:"ebikes_available"`
+}
+
+type historyJSON struct {
+	ID     string      `json:"id"`
+	Name   string      `json:"name"`
+	Points []pointJSON `json:"points"`
+}
+
+// Handler serves a station's history as JSON. It must be registered with a
+// pattern containing an {id} wildcard. Create instances with NewHandler().
+type Handler struct {
+	Logger *slog.Logger
+	Store  *Store
+}
+
+// NewHandler creates a handler reading from store.
+func NewHandler(logger *slog.Logger, store *Store) *Handler {
+	return &Handler{
+		Logger: logger,
+		Store:  store,
+	}
+}
+
+// ServeHTTP responds with the history of the station in the path. The from
+// and to query parameters are RFC 3339 timestamps or Unix seconds, and
+// default to the last hour. The step parameter is a duration such as 5m, or
+// a number of seconds. If omitted, every snapshot in the range is returned.
+// Queries that would return more than 11,000 points are rejected, with or
+// without a step.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	query := r.URL.Query()
+	to, err := parseTime(query.Get("to"), time.Now())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid to: %v", err), http.StatusBadRequest)
+		return
+	}
+	from, err := parseTime(query.Get("from"), to.Add(-defaultRange))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid from: %v", err), http.StatusBadRequest)
+		return
+	}
+	if to.Before(from) {
+		http.Error(w, "to must not be before from", http.StatusBadRequest)
+		return
+	}
+	step, err := parseStep(query.Get("step"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid step: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	points, err := h.Store.Query(id, from, to, step)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, ErrTooManyPoints):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		h.Logger.ErrorContext(r.Context(), "failed to query history",
+			slog.String("id", id),
+			slog.String("error", err.Error()))
+		http.Error(w, "failed to query history", http.StatusInternalServerError)
+		return
+	}
+
+	history := historyJSON{
+		ID: id,
+		// The latest name is the most recognisable.
+		Name:   points[len(points)-1].Station.Name,
+		Points: make([]pointJSON, 0, len(points)),
+	}
+	for _, point := range points {
+		history.Points = append(history.Points, pointJSON{
+			Time:              point.Time.UTC(),
+			Docks:             point.Station.Docks,
+			DocksAvailable:    point.Availability.Docks,
+			BicyclesAvailable: point.Availability.Bicycles,
+			EBikesAvailable:   point.Availability.EBikes,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(history); err != nil {
+		h.Logger.DebugContext(r.Context(), "failed to write history",
+			slog.String("error", err.Error()))
+	}
+}
+
+// parseTime parses an RFC 3339 timestamp or Unix seconds, returning def if s
+// is empty.
+func parseTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.UnixMilli(int64(seconds * 1000)), nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// parseStep parses a duration or number of seconds. An empty string is 0.
+func parseStep(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	var step time.Duration
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		step = time.Duration(seconds * float64(time.Second))
+	} else if step, err = time.ParseDuration(s); err != nil {
+		return 0, err
+	}
+	if step <= 0 {
+		return 0, errors.New("must be positive")
+	}
+	return step, nil
+}
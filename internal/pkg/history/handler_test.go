@@ -0,0 +1,144 @@
+package history
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	t.Parallel()
+
+	s := open(t, t.TempDir())
+	appendMinutely(t, s, epoch, 30)
+	s.maxPoints = 20
+	mux := http.NewServeMux()
+	mux.Handle("/api/v1/stations/{id}/history", NewHandler(slog.Default(), s))
+
+	tests := []struct {
+		name       string
+		target     string
+		wantStatus int
+		wantPoints int
+	}{
+		{
+			name:       "raw",
+			target:     "/api/v1/stations/BikePoints_4/history?from=2024-03-04T00:00:00Z&to=2024-03-04T00:09:00Z",
+			wantStatus: http.StatusOK,
+			wantPoints: 10,
+		},
+		{
+			name:       "unix seconds and step",
+			target:     "/api/v1/stations/BikePoints_4/history?from=1709510400&to=1709512200&step=10m",
+			wantStatus: http.StatusOK,
+			wantPoints: 4,
+		},
+		{
+			name:       "step in seconds",
+			target:     "/api/v1/stations/BikePoints_4/history?from=1709510400&to=1709512200&step=600",
+			wantStatus: http.StatusOK,
+			wantPoints: 4,
+		},
+		{
+			name:       "no snapshot within lookback of a step",
+			target:     "/api/v1/stations/BikePoints_4/history?from=1709510160&to=1709511940&step=1h",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "default range",
+			target:     "/api/v1/stations/BikePoints_4/history",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "unknown station",
+			target:     "/api/v1/stations/BikePoints_404/history?from=1709510400&to=1709512200",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "invalid from",
+			target:     "/api/v1/stations/BikePoints_4/history?from=yesterday",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "reversed",
+			target:     "/api/v1/stations/BikePoints_4/history?from=1709512200&to=1709510400",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid step",
+			target:     "/api/v1/stations/BikePoints_4/history?step=-1m",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "too many points",
+			target:     "/api/v1/stations/BikePoints_4/history?from=1709510400&to=1709596800&step=1s",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "too many snapshots",
+			target:     "/api/v1/stations/BikePoints_4/history?from=1709510400&to=1709512200",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, test.target, nil))
+			if rr.Code != test.wantStatus {
+				t.Fatalf("wanted status %v, got %v: %v", test.wantStatus, rr.Code, rr.Body)
+			}
+			if test.wantStatus != http.StatusOK {
+				return
+			}
+			history := historyJSON{}
+			if err := json.Unmarshal(rr.Body.Bytes(), &history); err != nil {
+				t.Fatal(err)
+			}
+			if history.ID != "BikePoints_4" || history.Name != "Station 4" {
+				t.Errorf("got station %q %q", history.ID, history.Name)
+			}
+			if len(history.Points) != test.wantPoints {
+				t.Fatalf("wanted %v points, got %v", test.wantPoints, history.Points)
+			}
+			if first := history.Points[0]; !first.Time.Equal(epoch) || first.Docks != 24 ||
+				first.BicyclesAvailable != 4 || first.DocksAvailable != 20 || first.EBikesAvailable != 0 {
+				t.Errorf("unexpected first point %+v", first)
+			}
+		})
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	t.Parallel()
+
+	def := time.Unix(1, 0)
+	tests := []struct {
+		input   string
+		want    time.Time
+		wantErr bool
+	}{
+		{"", def, false},
+		{"1709510400", epoch, false},
+		{"1709510400.5", epoch.Add(500 * time.Millisecond), false},
+		{"2024-03-04T00:00:00Z", epoch, false},
+		{"2024-03-04", time.Time{}, true},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.input, func(t *testing.T) {
+			t.Parallel()
+			got, err := parseTime(test.input, def)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("wanted error %v, got %v", test.wantErr, err)
+			}
+			if !got.Equal(test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
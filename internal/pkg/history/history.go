@@ -0,0 +1,707 @@
+// Package history implements an embedded, on-disk store of station
+// availability snapshots, so availability over time can be queried without
+// running Prometheus.
+//
+// Snapshots are appended to an open segment file, which is sealed once it
+// spans the segment duration. Sealed segments from the same day are
+// periodically compacted into one, and segments older than the retention
+// period are deleted. Every write is fsynced, and files are replaced by
+// renaming, so a crash loses at most the snapshot being written.
+package history
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// openExt is the extension of the segment being appended to, which is
+	// named after its first snapshot.
+	openExt = ".open"
+
+	// sealedExt is the extension of segments that will not be appended to,
+	// which are named after their first and last snapshots.
+	sealedExt = ".seg"
+
+	// tmpExt is the extension of compacted segments being written.
+	tmpExt = ".tmp"
+
+	// blockDuration is the period compacted into a single segment.
+	blockDuration = 24 * time.Hour
+
+	// lookback is the maximum age of a snapshot used as the value of a
+	// step, matching Prometheus's default.
+	lookback = 5 * time.Minute
+
+	// maxPoints bounds the number of points a query can return, matching
+	// Prometheus's limit.
+	maxPoints = 11000
+)
+
+var (
+	// ErrNotFound is returned by Query() if there are no snapshots of the
+	// station in the range.
+	ErrNotFound = errors.New("no history for station in range")
+
+	// ErrTooManyPoints is returned by Query() if the range divided by the
+	// step, or without a step, the number of snapshots in the range, exceeds
+	// maxPoints.
+	ErrTooManyPoints = fmt.Errorf("query would return more than %v points", maxPoints)
+)
+
+// errDone stops reading a segment early.
+var errDone = errors.New("done")
+
+var (
+	appendFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tflcycles_exporter_history_append_failures_total",
+		Help: "The number of snapshots that could not be written to the history store.",
+	})
+	compactions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tflcycles_exporter_history_compactions_total",
+		Help: "The number of times history segments were merged.",
+	})
+	sizeBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tflcycles_exporter_history_size_bytes",
+		Help: "The total size of history segments on disk.",
+	})
+)
+
+// Point is the availability of a station at a point in time.
+type Point struct {
+	Time time.Time
+	bikepoint.StationAvailability
+}
+
+// segment is a sealed segment on disk.
+type segment struct {
+	path     string
+	min, max int64
+	size     int64
+}
+
+// head is the segment being appended to.
+type head struct {
+	f        *os.File
+	encoder  *encoder
+	min, max int64
+	size     int64
+}
+
+// Store is an on-disk time series of snapshots. It is safe for concurrent
+// use. Create instances with Open().
+type Store struct {
+	Logger *slog.Logger
+	Dir    string
+
+	// Retention is how long snapshots are kept. This can be configured using
+	// WithRetention().
+	Retention time.Duration
+
+	// SegmentDuration is the period after which the open segment is sealed.
+	// This can be configured using WithSegmentDuration().
+	SegmentDuration time.Duration
+
+	// maxPoints is the most points Query() returns, overridden by tests.
+	maxPoints int
+
+	mu     sync.Mutex
+	sealed []segment // sorted by min
+	head   *head     // nil if no segment is open
+	latest int64
+}
+
+// Option allows customising the store's behaviour during construction with
+// Open().
+type Option func(*Store)
+
+// WithRetention overrides the default retention period of 7 days. Snapshots
+// are deleted a segment at a time, so may be kept for up to a day longer.
+func WithRetention(retention time.Duration) Option {
+	return func(s *Store) {
+		s.Retention = retention
+	}
+}
+
+// WithSegmentDuration overrides the default of sealing the open segment
+// every hour. Shorter durations lose less to corruption, but compress worse
+// until compacted.
+func WithSegmentDuration(duration time.Duration) Option {
+	return func(s *Store) {
+		s.SegmentDuration = duration
+	}
+}
+
+// Open loads the store in dir, creating the directory if necessary. A
+// segment left open by a crash is truncated to its last complete snapshot
+// and sealed.
+func Open(logger *slog.Logger, dir string, opts ...Option) (*Store, error) {
+	s := &Store{
+		Logger:          logger,
+		Dir:             dir,
+		Retention:       7 * 24 * time.Hour,
+		SegmentDuration: time.Hour,
+		maxPoints:       maxPoints,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		switch filepath.Ext(entry.Name()) {
+		case tmpExt:
+			// An interrupted compaction, whose inputs are intact.
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+		case openExt:
+			if err := s.recover(path); err != nil {
+				return nil, fmt.Errorf("failed to recover %v: %w", path, err)
+			}
+		case sealedExt:
+			seg, err := parseSegment(path)
+			if err != nil {
+				return nil, err
+			}
+			s.sealed = append(s.sealed, seg)
+		}
+	}
+	slices.SortFunc(s.sealed, func(a, b segment) int {
+		return cmp.Or(cmp.Compare(a.min, b.min), cmp.Compare(b.max, a.max))
+	})
+	if err := s.removeSuperseded(); err != nil {
+		return nil, err
+	}
+	for _, seg := range s.sealed {
+		s.latest = max(s.latest, seg.max)
+	}
+	s.updateSize()
+	return s, nil
+}
+
+// recover truncates a segment that was open when the process stopped to its
+// valid prefix, then seals it.
+func (s *Store) recover(path string) error {
+	d := decoder{}
+	h := &head{
+		min: -1,
+	}
+	valid, corrupt, err := readFrames(path, func(payload []byte) error {
+		t, err := d.decodePayload(payload, func(int64, *stationKey, counts) {})
+		if err != nil {
+			return err
+		}
+		if h.min == -1 {
+			h.min = t
+		}
+		h.max = t
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if h.min == -1 {
+		return os.Remove(path)
+	}
+	if corrupt {
+		s.Logger.Warn("truncating partially written history segment",
+			slog.String("path", path),
+			slog.Int64("offset", valid))
+	}
+	h.f, err = os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := h.f.Truncate(valid); err != nil {
+		h.f.Close()
+		return err
+	}
+	h.size = valid
+	return s.seal(h)
+}
+
+// parseSegment returns the sealed segment at path, whose name contains its
+// range.
+func parseSegment(path string) (segment, error) {
+	name := strings.TrimSuffix(filepath.Base(path), sealedExt)
+	first, last, ok := strings.Cut(name, "-")
+	if !ok {
+		return segment{}, fmt.Errorf("invalid segment name %v", path)
+	}
+	minTime, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return segment{}, fmt.Errorf("invalid segment name %v: %w", path, err)
+	}
+	maxTime, err := strconv.ParseInt(last, 10, 64)
+	if err != nil {
+		return segment{}, fmt.Errorf("invalid segment name %v: %w", path, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return segment{}, err
+	}
+	return segment{
+		path: path,
+		min:  minTime,
+		max:  maxTime,
+		size: info.Size(),
+	}, nil
+}
+
+// removeSuperseded deletes segments whose range is within another's. These
+// are the inputs of a compaction interrupted after its output was renamed
+// into place. s.sealed must be sorted.
+func (s *Store) removeSuperseded() error {
+	kept := s.sealed[:0]
+	for _, seg := range s.sealed {
+		if len(kept) > 0 && seg.max <= kept[len(kept)-1].max {
+			if err := os.Remove(seg.path); err != nil {
+				return err
+			}
+			continue
+		}
+		kept = append(kept, seg)
+	}
+	s.sealed = kept
+	return nil
+}
+
+// Append adds a snapshot taken at t. Snapshots must be appended in order.
+func (s *Store) Append(t time.Time, stationAvailabilities []bikepoint.StationAvailability) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.append(t.UnixMilli(), stationAvailabilities); err != nil {
+		appendFailures.Inc()
+		return err
+	}
+	s.updateSize()
+	return nil
+}
+
+func (s *Store) append(ms int64, stationAvailabilities []bikepoint.StationAvailability) error {
+	if ms <= s.latest {
+		return fmt.Errorf("snapshot at %v is not after the latest, at %v",
+			time.UnixMilli(ms).UTC(), time.UnixMilli(s.latest).UTC())
+	}
+	if s.head != nil && ms-s.head.min >= s.SegmentDuration.Milliseconds() {
+		h := s.head
+		s.head = nil
+		if err := s.seal(h); err != nil {
+			return err
+		}
+		if err := s.compact(); err != nil {
+			return fmt.Errorf("failed to compact: %w", err)
+		}
+	}
+	if s.head == nil {
+		h, err := s.create(ms)
+		if err != nil {
+			return err
+		}
+		s.head = h
+	}
+
+	frame := s.head.encoder.appendFrame(nil, ms, stationAvailabilities)
+	_, err := s.head.f.Write(frame)
+	if err == nil {
+		err = s.head.f.Sync()
+	}
+	if err != nil {
+		// The encoder has already advanced, so the segment cannot be
+		// appended to again. Remove anything partially written, and
+		// start a new one next time.
+		h := s.head
+		s.head = nil
+		if truncErr := h.f.Truncate(h.size); truncErr != nil {
+			h.f.Close()
+		} else if sealErr := s.seal(h); sealErr != nil {
+			s.Logger.Error("failed to seal history segment after failed write",
+				slog.String("path", h.f.Name()),
+				slog.String("error", sealErr.Error()))
+		}
+		return err
+	}
+	s.head.size += int64(len(frame))
+	s.head.max = ms
+	s.latest = ms
+	return s.expire()
+}
+
+// create opens a new segment for a snapshot at ms.
+func (s *Store) create(ms int64) (*head, error) {
+	path := filepath.Join(s.Dir, strconv.FormatInt(ms, 10)+openExt)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(header()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := syncDir(s.Dir); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &head{
+		f:       f,
+		encoder: newEncoder(),
+		min:     ms,
+		max:     ms,
+		size:    int64(headerSize),
+	}, nil
+}
+
+// seal closes the segment and renames it to include its range. If the
+// segment is empty, it is removed instead.
+func (s *Store) seal(h *head) error {
+	path := h.f.Name()
+	if err := h.f.Sync(); err != nil {
+		h.f.Close()
+		return err
+	}
+	if err := h.f.Close(); err != nil {
+		return err
+	}
+	if h.size <= int64(headerSize) {
+		return os.Remove(path)
+	}
+	seg := segment{
+		path: filepath.Join(s.Dir, fmt.Sprintf("%v-%v%v", h.min, h.max, sealedExt)),
+		min:  h.min,
+		max:  h.max,
+		size: h.size,
+	}
+	if err := os.Rename(path, seg.path); err != nil {
+		return err
+	}
+	if err := syncDir(s.Dir); err != nil {
+		return err
+	}
+	s.sealed = append(s.sealed, seg)
+	return nil
+}
+
+// compact merges sealed segments starting in the same block.
+func (s *Store) compact() error {
+	block := func(seg segment) int64 {
+		return seg.min / blockDuration.Milliseconds()
+	}
+	var compacted []segment
+	for i := 0; i < len(s.sealed); {
+		j := i + 1
+		for j < len(s.sealed) && block(s.sealed[j]) == block(s.sealed[i]) {
+			j++
+		}
+		if j-i == 1 {
+			compacted = append(compacted, s.sealed[i])
+			i = j
+			continue
+		}
+		merged, err := s.merge(s.sealed[i:j])
+		switch {
+		case errors.Is(err, errCorrupt):
+			// Merging would lose the rest of the corrupt segment, so
+			// the block is left as it is for investigation.
+			s.Logger.Error("not compacting history block containing corrupt segment",
+				slog.String("error", err.Error()))
+			compacted = append(compacted, s.sealed[i:j]...)
+		case err != nil:
+			return err
+		default:
+			compacted = append(compacted, merged)
+		}
+		i = j
+	}
+	s.sealed = compacted
+	return nil
+}
+
+// merge writes the snapshots of consecutive segments to a new segment, then
+// removes the inputs. If interrupted, either the inputs remain, or the
+// output is complete and removeSuperseded() will delete them.
+func (s *Store) merge(inputs []segment) (segment, error) {
+	first, last := inputs[0], inputs[len(inputs)-1]
+	merged := segment{
+		path: filepath.Join(s.Dir, fmt.Sprintf("%v-%v%v", first.min, last.max, sealedExt)),
+		min:  first.min,
+		max:  last.max,
+	}
+	enc := newEncoder()
+	b := header()
+	for _, input := range inputs {
+		err := readSnapshots(input.path, func(t int64, stationAvailabilities []bikepoint.StationAvailability) error {
+			b = enc.appendFrame(b, t, stationAvailabilities)
+			return nil
+		})
+		if err != nil {
+			return segment{}, fmt.Errorf("failed to read %v: %w", input.path, err)
+		}
+	}
+	if err := writeFileSync(merged.path+tmpExt, b); err != nil {
+		return segment{}, err
+	}
+	if err := os.Rename(merged.path+tmpExt, merged.path); err != nil {
+		return segment{}, err
+	}
+	if err := syncDir(s.Dir); err != nil {
+		return segment{}, err
+	}
+	for _, input := range inputs {
+		if err := os.Remove(input.path); err != nil {
+			return segment{}, err
+		}
+	}
+	merged.size = int64(len(b))
+	compactions.Inc()
+	return merged, nil
+}
+
+// expire removes sealed segments whose snapshots are all older than the
+// retention period, relative to the latest snapshot.
+func (s *Store) expire() error {
+	cutoff := s.latest - s.Retention.Milliseconds()
+	for len(s.sealed) > 0 && s.sealed[0].max < cutoff {
+		if err := os.Remove(s.sealed[0].path); err != nil {
+			return err
+		}
+		s.sealed = s.sealed[1:]
+	}
+	return nil
+}
+
+func (s *Store) updateSize() {
+	var size int64
+	for _, seg := range s.sealed {
+		size += seg.size
+	}
+	if s.head != nil {
+		size += s.head.size
+	}
+	sizeBytes.Set(float64(size))
+}
+
+// Observe appends a snapshot, logging any failure. This allows the store to
+// be passed to watch.Poll().
+func (s *Store) Observe(ctx context.Context, t time.Time, stationAvailabilities []bikepoint.StationAvailability) {
+	if err := s.Append(t, stationAvailabilities); err != nil {
+		s.Logger.ErrorContext(ctx, "failed to append snapshot to history",
+			slog.String("error", err.Error()))
+	}
+}
+
+// Query returns the snapshots of a station between from and to inclusive. If
+// step is 0, every snapshot is returned. Otherwise, a point is returned at
+// from and every step until to, with the values of the latest snapshot at
+// most 5 minutes before, if there is one. ErrNotFound is returned if there
+// are no points, and ErrTooManyPoints if there would be more than 11,000.
+func (s *Store) Query(id string, from, to time.Time, step time.Duration) ([]Point, error) {
+	if step < 0 {
+		return nil, errors.New("step must not be negative")
+	}
+	if step > 0 && to.Sub(from)/step >= time.Duration(s.maxPoints) {
+		return nil, ErrTooManyPoints
+	}
+	lo := from.UnixMilli()
+	if step > 0 {
+		lo -= lookback.Milliseconds()
+	}
+	hi := to.UnixMilli()
+
+	var raw []Point
+	collect := func(f *os.File, size int64) error {
+		d := decoder{}
+		valid, corrupt, err := readFramesAt(f, size, func(payload []byte) error {
+			t, err := d.decodePayload(payload, func(t int64, key *stationKey, c counts) {
+				if key.ID != id || t < lo || t > hi {
+					return
+				}
+				raw = append(raw, Point{
+					Time: time.UnixMilli(t),
+					StationAvailability: bikepoint.StationAvailability{
+						Station: bikepoint.Station{
+							ID:    key.ID,
+							Name:  key.Name,
+							Docks: c[0],
+							Lat:   key.Lat,
+							Lon:   key.Lon,
+						},
+						Availability: bikepoint.Availability{
+							Docks:    c[1],
+							Bicycles: c[2],
+							EBikes:   c[3],
+						},
+					},
+				})
+			})
+			if err == nil && t > hi {
+				return errDone
+			}
+			if err == nil && step == 0 && len(raw) > s.maxPoints {
+				return ErrTooManyPoints
+			}
+			return err
+		})
+		if errors.Is(err, errDone) {
+			return nil
+		}
+		if err == nil && corrupt {
+			s.Logger.Warn("ignoring corrupt end of history segment",
+				slog.String("path", f.Name()),
+				slog.Int64("offset", valid))
+		}
+		return err
+	}
+
+	files, err := s.openRange(lo, hi)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, file := range files {
+			file.f.Close()
+		}
+	}()
+	for _, file := range files {
+		if err := collect(file.f, file.size); errors.Is(err, ErrTooManyPoints) {
+			return nil, err
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read %v: %w", file.f.Name(), err)
+		}
+	}
+
+	if step > 0 {
+		raw = resample(raw, from, to, step)
+	}
+	if len(raw) == 0 {
+		return nil, ErrNotFound
+	}
+	return raw, nil
+}
+
+// openFile is a segment opened for reading, and the size to read, or -1 to
+// read it all.
+type openFile struct {
+	f    *os.File
+	size int64
+}
+
+// openRange opens the segments overlapping lo and hi, in order. This is done
+// under the lock, but they are read after releasing it, so queries do not
+// block appends. Compaction and expiry only unlink segments, so they remain
+// readable, and only frames complete when the lock was held are read from
+// the open segment.
+func (s *Store) openRange(lo, hi int64) ([]openFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var files []openFile
+	add := func(path string, size int64) error {
+		f, err := os.Open(path)
+		if err != nil {
+			for _, file := range files {
+				file.f.Close()
+			}
+			return err
+		}
+		files = append(files, openFile{f: f, size: size})
+		return nil
+	}
+	for _, seg := range s.sealed {
+		if seg.max >= lo && seg.min <= hi {
+			if err := add(seg.path, -1); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if s.head != nil && s.head.max >= lo && s.head.min <= hi {
+		if err := add(s.head.f.Name(), s.head.size); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// resample returns a point at each step, with the values of the latest raw
+// point within the lookback period.
+func resample(raw []Point, from, to time.Time, step time.Duration) []Point {
+	var points []Point
+	i := 0
+	for t := from; !t.After(to); t = t.Add(step) {
+		for i < len(raw) && !raw[i].Time.After(t) {
+			i++
+		}
+		if i == 0 || t.Sub(raw[i-1].Time) > lookback {
+			continue
+		}
+		point := raw[i-1]
+		point.Time = t
+		points = append(points, point)
+	}
+	return points
+}
+
+// Close seals the open segment, if any.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.head == nil {
+		return nil
+	}
+	h := s.head
+	s.head = nil
+	return s.seal(h)
+}
+
+func writeFileSync(path string, b []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir makes renames and file creations within dir durable.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
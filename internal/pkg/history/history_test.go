@@ -0,0 +1,362 @@
+package history
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+)
+
+var epoch = time.Date(2024, time.March, 4, 0, 0, 0, 0, time.UTC)
+
+// snapshot returns n stations whose availability changes with i.
+func snapshot(i, n int) []bikepoint.StationAvailability {
+	stationAvailabilities := make([]bikepoint.StationAvailability, 0, n)
+	for j := 0; j < n; j++ {
+		docks := 20 + j
+		bicycles := (i + j) % docks
+		stationAvailabilities = append(stationAvailabilities, bikepoint.StationAvailability{
+			Station: bikepoint.Station{
+				ID:    "BikePoints_" + strconv.Itoa(j),
+				Name:  "Station " + strconv.Itoa(j),
+				Docks: docks,
+				Lat:   51.5 + float64(j)/1000,
+				Lon:   -0.1,
+			},
+			Availability: bikepoint.Availability{
+				Docks:    docks - bicycles,
+				Bicycles: bicycles,
+				EBikes:   j % 2,
+			},
+		})
+	}
+	return stationAvailabilities
+}
+
+// appendMinutely appends count snapshots a minute apart, starting at start.
+func appendMinutely(t *testing.T, s *Store, start time.Time, count int) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		if err := s.Append(start.Add(time.Duration(i)*time.Minute), snapshot(i, 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// wantPoints returns the raw points of station j, for snapshots appended by
+// appendMinutely().
+func wantPoints(start time.Time, count, j int) []Point {
+	points := make([]Point, 0, count)
+	for i := 0; i < count; i++ {
+		points = append(points, Point{
+			Time:                start.Add(time.Duration(i) * time.Minute),
+			StationAvailability: snapshot(i, 10)[j],
+		})
+	}
+	return points
+}
+
+func open(t *testing.T, dir string, opts ...Option) *Store {
+	t.Helper()
+	s, err := Open(slog.Default(), dir, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// query returns the raw points of a station, with times in UTC for
+// comparison.
+func query(t *testing.T, s *Store, id string, from, to time.Time) []Point {
+	t.Helper()
+	points, err := s.Query(id, from, to, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range points {
+		points[i].Time = points[i].Time.UTC()
+	}
+	return points
+}
+
+func segments(t *testing.T, dir, ext string) []string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+ext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func TestStore_AppendQuery(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	s := open(t, dir)
+	appendMinutely(t, s, epoch, 150)
+
+	want := wantPoints(epoch, 150, 3)
+	if got := query(t, s, "BikePoints_3", epoch, epoch.Add(3*time.Hour)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := query(t, s, "BikePoints_3", epoch.Add(time.Hour), epoch.Add(time.Hour+time.Minute)); !reflect.DeepEqual(got, want[60:62]) {
+		t.Errorf("got %v, want %v", got, want[60:62])
+	}
+	if _, err := s.Query("BikePoints_404", epoch, epoch.Add(time.Hour), 0); !errors.Is(err, ErrNotFound) {
+		t.Errorf("wanted %v, got %v", ErrNotFound, err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s = open(t, dir)
+	if got := query(t, s, "BikePoints_3", epoch, epoch.Add(3*time.Hour)); !reflect.DeepEqual(got, want) {
+		t.Errorf("after reopening, got %v, want %v", got, want)
+	}
+	if err := s.Append(epoch.Add(time.Minute), snapshot(0, 10)); err == nil {
+		t.Error("wanted error appending out of order after reopening")
+	}
+}
+
+func TestStore_Compaction(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	s := open(t, dir, WithSegmentDuration(10*time.Minute))
+	// 22:00 to 02:10 the next day.
+	start := epoch.Add(22 * time.Hour)
+	appendMinutely(t, s, start, 250)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Segments are compacted when one is sealed, so both days have been
+	// merged, except for the segment sealed by Close().
+	if got := segments(t, dir, sealedExt); len(got) != 3 {
+		t.Errorf("wanted 3 segments, got %v", got)
+	}
+	want := wantPoints(start, 250, 7)
+	if got := query(t, s, "BikePoints_7", start, start.Add(5*time.Hour)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestStore_Retention(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	s := open(t, dir, WithRetention(time.Hour), WithSegmentDuration(10*time.Minute))
+	appendMinutely(t, s, epoch, 180)
+
+	points := query(t, s, "BikePoints_0", epoch, epoch.Add(3*time.Hour))
+	// The day's snapshots are compacted into one segment, which cannot be
+	// partially expired.
+	if len(points) != 180 {
+		t.Errorf("wanted all 180 points within a compacted segment, got %v", len(points))
+	}
+
+	// The next day's snapshot makes the previous day's segment expire.
+	appendMinutely(t, s, epoch.Add(24*time.Hour), 11)
+	points = query(t, s, "BikePoints_0", epoch, epoch.Add(25*time.Hour))
+	if len(points) != 11 || !points[0].Time.Equal(epoch.Add(24*time.Hour)) {
+		t.Errorf("wanted 11 points from the second day, got %v", points)
+	}
+}
+
+func TestStore_RecoverTruncated(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	s := open(t, dir)
+	appendMinutely(t, s, epoch, 5)
+	// Simulate a crash part way through writing the next snapshot.
+	frame := s.head.encoder.appendFrame(nil, epoch.Add(5*time.Minute).UnixMilli(), snapshot(5, 10))
+	if _, err := s.head.f.Write(frame[:len(frame)/2]); err != nil {
+		t.Fatal(err)
+	}
+	s.head.f.Close()
+
+	s = open(t, dir)
+	if got := segments(t, dir, openExt); len(got) != 0 {
+		t.Errorf("wanted open segment to be sealed, got %v", got)
+	}
+	want := wantPoints(epoch, 5, 2)
+	if got := query(t, s, "BikePoints_2", epoch, epoch.Add(time.Hour)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The snapshot can be written again.
+	if err := s.Append(epoch.Add(5*time.Minute), snapshot(5, 10)); err != nil {
+		t.Fatal(err)
+	}
+	want = wantPoints(epoch, 6, 2)
+	if got := query(t, s, "BikePoints_2", epoch, epoch.Add(time.Hour)); !reflect.DeepEqual(got, want) {
+		t.Errorf("after appending, got %v, want %v", got, want)
+	}
+}
+
+func TestStore_RecoverEmpty(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	// A crash before the header was fully written.
+	if err := os.WriteFile(filepath.Join(dir, "1"+openExt), []byte(magic[:2]), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	open(t, dir)
+	if got := segments(t, dir, ""); len(got) != 0 {
+		t.Errorf("wanted empty segment to be removed, got %v", got)
+	}
+}
+
+func TestStore_InterruptedCompaction(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	s := open(t, dir, WithSegmentDuration(30*time.Minute))
+	appendMinutely(t, s, epoch, 59)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	inputs := map[string][]byte{}
+	for _, path := range segments(t, dir, sealedExt) {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inputs[path] = b
+	}
+	if len(inputs) != 2 {
+		t.Fatalf("wanted 2 segments to compact, got %v", len(inputs))
+	}
+	if err := s.compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash after the output was renamed into place, but before
+	// the inputs were removed, and one while writing another output.
+	for path, b := range inputs {
+		if err := os.WriteFile(path, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "1-2"+sealedExt+tmpExt), []byte(magic), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s = open(t, dir)
+	if got := segments(t, dir, ""); len(got) != 1 {
+		t.Errorf("wanted only the compacted segment, got %v", got)
+	}
+	want := wantPoints(epoch, 59, 0)
+	if got := query(t, s, "BikePoints_0", epoch, epoch.Add(time.Hour)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestStore_CorruptSegment(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	s := open(t, dir, WithSegmentDuration(10*time.Minute))
+	appendMinutely(t, s, epoch, 15)
+	corrupted := s.sealed[0].path
+	b, err := os.ReadFile(corrupted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-1]++
+	if err := os.WriteFile(corrupted, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sealing the second segment attempts to compact it with the first.
+	for i := 15; i < 21; i++ {
+		if err := s.Append(epoch.Add(time.Duration(i)*time.Minute), snapshot(i, 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := segments(t, dir, sealedExt); len(got) != 2 {
+		t.Fatalf("wanted segments to be left uncompacted, got %v", got)
+	}
+	if _, err := os.Stat(corrupted); err != nil {
+		t.Errorf("wanted corrupt segment to be kept: %v", err)
+	}
+
+	// The last snapshot of the first segment is lost.
+	want := append(wantPoints(epoch, 9, 3), wantPoints(epoch, 21, 3)[10:]...)
+	if got := query(t, s, "BikePoints_3", epoch, epoch.Add(time.Hour)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestStore_QueryStep(t *testing.T) {
+	t.Parallel()
+
+	s := open(t, t.TempDir())
+	appendMinutely(t, s, epoch, 10)
+	// A gap longer than the lookback period.
+	appendMinutely(t, s, epoch.Add(time.Hour), 1)
+
+	points, err := s.Query("BikePoints_1", epoch.Add(30*time.Second), epoch.Add(time.Hour), 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []time.Duration
+	for _, point := range points {
+		got = append(got, point.Time.Sub(epoch))
+	}
+	// The snapshot at 9m is used until 14m, then there are no points until
+	// the snapshot at 60m.
+	want := []time.Duration{
+		30 * time.Second,
+		5*time.Minute + 30*time.Second,
+		10*time.Minute + 30*time.Second,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got points at %v, want %v", got, want)
+	}
+	if points[2].Availability != snapshot(9, 10)[1].Availability {
+		t.Errorf("got %v, want values of the snapshot at 9m", points[2])
+	}
+
+	if _, err := s.Query("BikePoints_1", epoch, epoch.Add(24*time.Hour), time.Second); !errors.Is(err, ErrTooManyPoints) {
+		t.Errorf("wanted %v, got %v", ErrTooManyPoints, err)
+	}
+}
+
+func TestStore_QueryTooManySnapshots(t *testing.T) {
+	t.Parallel()
+
+	s := open(t, t.TempDir())
+	s.maxPoints = 5
+	appendMinutely(t, s, epoch, 10)
+
+	if _, err := s.Query("BikePoints_1", epoch, epoch.Add(4*time.Minute), 0); err != nil {
+		t.Errorf("wanted the limit to be inclusive, got %v", err)
+	}
+	if _, err := s.Query("BikePoints_1", epoch, epoch.Add(time.Hour), 0); !errors.Is(err, ErrTooManyPoints) {
+		t.Errorf("wanted %v, got %v", ErrTooManyPoints, err)
+	}
+}
+
+func TestEncoder_Size(t *testing.T) {
+	t.Parallel()
+
+	e := newEncoder()
+	stations := snapshot(0, 800)
+	first := len(e.appendFrame(nil, 1, stations))
+	second := len(e.appendFrame(nil, 2, stations))
+	// Unchanged stations take an index and four zero deltas.
+	if perStation := float64(second) / 800; perStation > 7 {
+		t.Errorf("unchanged snapshot took %v bytes per station", perStation)
+	}
+	if first <= second {
+		t.Errorf("first snapshot of %v bytes should include definitions, second was %v bytes", first, second)
+	}
+}
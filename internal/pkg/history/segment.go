@@ -0,0 +1,336 @@
+package history
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+)
+
+// Segment files start with a magic string and format version. The rest of
+// the file is a sequence of frames, each containing one snapshot:
+//
+//	frame   = uvarint(len(payload)) crc32c(payload) payload
+//	payload = varint(time delta) uvarint(#defs) def* uvarint(#stations) station*
+//	def     = string(id) string(name) float64(lat) float64(lon)
+//	station = uvarint(index) varint(docks delta) varint(empty docks delta)
+//	          varint(bicycles delta) varint(e-bikes delta)
+//
+// Times are Unix milliseconds, and strings are prefixed with their uvarint
+// length. Stations are referred to by their index in the order they were
+// defined in the segment, and their counts are encoded relative to those in
+// the last snapshot of the segment containing them. As most counts do not
+// change between snapshots, a typical station takes 5 bytes.
+const (
+	magic         = "TFLH"
+	formatVersion = 1
+	headerSize    = len(magic) + 1
+
+	// crcSize is the length of the checksum following each frame's length.
+	crcSize = 4
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errCorrupt indicates a segment contains a frame that could not be decoded.
+var errCorrupt = errors.New("corrupt segment")
+
+// stationKey identifies a station's definition within a segment. A station
+// whose name or location changes is defined again.
+type stationKey struct {
+	ID       string
+	Name     string
+	Lat, Lon float64
+}
+
+// counts are the values of a station that change over time.
+type counts [4]int
+
+func countsOf(sa bikepoint.StationAvailability) counts {
+	return counts{
+		sa.Station.Docks,
+		sa.Availability.Docks,
+		sa.Availability.Bicycles,
+		sa.Availability.EBikes,
+	}
+}
+
+// encoder encodes snapshots into payloads, tracking the state of a segment.
+type encoder struct {
+	indexes  map[stationKey]int
+	previous []counts
+	time     int64
+}
+
+func newEncoder() *encoder {
+	return &encoder{
+		indexes: make(map[stationKey]int),
+	}
+}
+
+// appendFrame encodes a snapshot taken at t in Unix milliseconds, appending
+// the frame to b. The encoder's state is updated, so the frame must be
+// written for the segment to remain decodable.
+func (e *encoder) appendFrame(b []byte, t int64, stationAvailabilities []bikepoint.StationAvailability) []byte {
+	payload := binary.AppendVarint(nil, t-e.time)
+	e.time = t
+
+	var defs []stationKey
+	indexes := make([]int, len(stationAvailabilities))
+	for i, sa := range stationAvailabilities {
+		key := stationKey{
+			ID:   sa.Station.ID,
+			Name: sa.Station.Name,
+			Lat:  sa.Station.Lat,
+			Lon:  sa.Station.Lon,
+		}
+		index, ok := e.indexes[key]
+		if !ok {
+			index = len(e.previous)
+			e.indexes[key] = index
+			e.previous = append(e.previous, counts{})
+			defs = append(defs, key)
+		}
+		indexes[i] = index
+	}
+	payload = binary.AppendUvarint(payload, uint64(len(defs)))
+	for _, def := range defs {
+		payload = appendString(payload, def.ID)
+		payload = appendString(payload, def.Name)
+		payload = binary.LittleEndian.AppendUint64(payload, math.Float64bits(def.Lat))
+		payload = binary.LittleEndian.AppendUint64(payload, math.Float64bits(def.Lon))
+	}
+
+	payload = binary.AppendUvarint(payload, uint64(len(stationAvailabilities)))
+	for i, sa := range stationAvailabilities {
+		index := indexes[i]
+		payload = binary.AppendUvarint(payload, uint64(index))
+		current := countsOf(sa)
+		for j := range current {
+			payload = binary.AppendVarint(payload, int64(current[j]-e.previous[index][j]))
+		}
+		e.previous[index] = current
+	}
+
+	b = binary.AppendUvarint(b, uint64(len(payload)))
+	b = binary.LittleEndian.AppendUint32(b, crc32.Checksum(payload, crcTable))
+	return append(b, payload...)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// decoder decodes payloads, tracking the state of a segment.
+type decoder struct {
+	keys     []stationKey
+	previous []counts
+	time     int64
+}
+
+// decodePayload decodes a snapshot, calling fn for each station. The key must
+// not be modified. The snapshot's time in Unix milliseconds is returned.
+func (d *decoder) decodePayload(payload []byte, fn func(t int64, key *stationKey, c counts)) (int64, error) {
+	r := reader{b: payload}
+	d.time += r.varint()
+	defs := r.uvarint()
+	for i := uint64(0); i < defs && r.err == nil; i++ {
+		key := stationKey{
+			ID:   r.string(),
+			Name: r.string(),
+			Lat:  r.float64(),
+			Lon:  r.float64(),
+		}
+		d.keys = append(d.keys, key)
+		d.previous = append(d.previous, counts{})
+	}
+	stations := r.uvarint()
+	for i := uint64(0); i < stations && r.err == nil; i++ {
+		index := r.uvarint()
+		var delta counts
+		for j := range delta {
+			delta[j] = int(r.varint())
+		}
+		if r.err != nil {
+			break
+		}
+		if index >= uint64(len(d.keys)) {
+			return 0, fmt.Errorf("%w: undefined station index %v", errCorrupt, index)
+		}
+		for j := range delta {
+			d.previous[index][j] += delta[j]
+		}
+		fn(d.time, &d.keys[index], d.previous[index])
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	if len(r.b) != 0 {
+		return 0, fmt.Errorf("%w: %v trailing bytes in payload", errCorrupt, len(r.b))
+	}
+	return d.time, nil
+}
+
+// reader consumes values from a payload. After the first error, every method
+// returns the zero value.
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) fail() {
+	if r.err == nil {
+		r.err = fmt.Errorf("%w: truncated payload", errCorrupt)
+	}
+	r.b = nil
+}
+
+func (r *reader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *reader) varint() int64 {
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *reader) string() string {
+	n := r.uvarint()
+	if n > uint64(len(r.b)) {
+		r.fail()
+		return ""
+	}
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+	return s
+}
+
+func (r *reader) float64() float64 {
+	if len(r.b) < 8 {
+		r.fail()
+		return 0
+	}
+	v := math.Float64frombits(binary.LittleEndian.Uint64(r.b))
+	r.b = r.b[8:]
+	return v
+}
+
+// header returns the bytes every segment starts with.
+func header() []byte {
+	return append([]byte(magic), formatVersion)
+}
+
+// readFrames calls fn with the payload of each valid frame in the segment at
+// path, in order. It stops at the first incomplete or corrupt frame, which
+// is expected at the end of a segment that was being written when the
+// process crashed. The length of the valid prefix of the file is returned,
+// and whether anything followed it.
+func readFrames(path string, fn func(payload []byte) error) (valid int64, corrupt bool, err error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false, err
+	}
+	return decodeFrames(path, b, fn)
+}
+
+// readFramesAt is like readFrames(), for an open segment. If size is not -1,
+// only the first size bytes are read.
+func readFramesAt(f *os.File, size int64, fn func(payload []byte) error) (valid int64, corrupt bool, err error) {
+	var b []byte
+	if size == -1 {
+		b, err = io.ReadAll(f)
+	} else {
+		b = make([]byte, size)
+		_, err = f.ReadAt(b, 0)
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return decodeFrames(f.Name(), b, fn)
+}
+
+// decodeFrames calls fn with the payload of each valid frame in b, the
+// contents of the segment at path. See readFrames().
+func decodeFrames(path string, b []byte, fn func(payload []byte) error) (valid int64, corrupt bool, err error) {
+	if len(b) < headerSize {
+		// The process crashed before the header was written.
+		return 0, len(b) > 0, nil
+	}
+	if string(b[:len(magic)]) != magic {
+		return 0, false, fmt.Errorf("%v is not a history segment", path)
+	}
+	if version := b[len(magic)]; version != formatVersion {
+		return 0, false, fmt.Errorf("%v has unsupported format version %v", path, version)
+	}
+
+	offset := headerSize
+	for offset < len(b) {
+		length, n := binary.Uvarint(b[offset:])
+		if n <= 0 || length > uint64(len(b)) || uint64(len(b)-offset-n) < crcSize+length {
+			return int64(offset), true, nil
+		}
+		start := offset + n + crcSize
+		payload := b[start : start+int(length)]
+		if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(b[offset+n:]) {
+			return int64(offset), true, nil
+		}
+		if err := fn(payload); err != nil {
+			return int64(offset), false, err
+		}
+		offset = start + int(length)
+	}
+	return int64(offset), false, nil
+}
+
+// readSnapshots calls fn with each snapshot in the sealed segment at path. The
+// slice is reused between calls. Unlike readFrames(), an error wrapping
+// errCorrupt is returned if the segment does not end with a complete frame,
+// as sealed segments are never partially written.
+func readSnapshots(path string, fn func(t int64, stationAvailabilities []bikepoint.StationAvailability) error) error {
+	d := decoder{}
+	var snapshot []bikepoint.StationAvailability
+	valid, corrupt, err := readFrames(path, func(payload []byte) error {
+		snapshot = snapshot[:0]
+		t, err := d.decodePayload(payload, func(_ int64, key *stationKey, c counts) {
+			snapshot = append(snapshot, bikepoint.StationAvailability{
+				Station: bikepoint.Station{
+					ID:    key.ID,
+					Name:  key.Name,
+					Docks: c[0],
+					Lat:   key.Lat,
+					Lon:   key.Lon,
+				},
+				Availability: bikepoint.Availability{
+					Docks:    c[1],
+					Bicycles: c[2],
+					EBikes:   c[3],
+				},
+			})
+		})
+		if err != nil {
+			return err
+		}
+		return fn(t, snapshot)
+	})
+	if err == nil && corrupt {
+		return fmt.Errorf("%w: invalid frame at offset %v", errCorrupt, valid)
+	}
+	return err
+}
@@ -0,0 +1,132 @@
+// Package influx renders station availability in InfluxDB line protocol, for
+// collection by Telegraf.
+package influx
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+)
+
+// Measurement is the name of the measurement containing each station's
+// availability.
+const Measurement = "tflcycles"
+
+var (
+	// measurementEscaper escapes measurement names, in which commas and
+	// spaces would otherwise end the name. Backslashes are escaped so they
+	// cannot combine with an escape we add. Newlines cannot be represented,
+	// so are replaced with an escaped space, as in tags.
+	measurementEscaper = strings.NewReplacer(
+		`\`, `\\`,
+		",", `\,`,
+		" ", `\ `,
+		"\n", `\ `,
+	)
+
+	// tagEscaper escapes tag keys, tag values and field keys, in which
+	// commas, equals signs and spaces are significant. Newlines cannot be
+	// represented, so are replaced.
+	tagEscaper = strings.NewReplacer(
+		`\`, `\\`,
+		",", `\,`,
+		"=", `\=`,
+		" ", `\ `,
+		"\n", `\ `,
+	)
+)
+
+// AppendLines appends a line for each station in the system to b, with the
+// system, station name and ID as tags, and availability as integer fields.
+func AppendLines(b []byte, system string, stationAvailabilities []bikepoint.StationAvailability, t time.Time) []byte {
+	for _, sa := range stationAvailabilities {
+		b = append(b, measurementEscaper.Replace(Measurement)...)
+		b = appendTag(b, "system", system)
+		b = appendTag(b, "station", sa.Station.Name)
+		b = appendTag(b, "id", sa.Station.ID)
+		b = append(b, ' ')
+		b = appendField(b, "docks", sa.Station.Docks, false)
+		b = appendField(b, "docks_available", sa.Availability.Docks, true)
+		b = appendField(b, "bicycles_available", sa.Availability.Bicycles, true)
+		b = appendField(b, "ebikes_available", sa.Availability.EBikes, true)
+		b = append(b, ' ')
+		b = strconv.AppendInt(b, t.UnixNano(), 10)
+		b = append(b, '\n')
+	}
+	return b
+}
+
+// appendTag appends ",key=value" to b. Tags with empty values are not
+// permitted, so are omitted.
+func appendTag(b []byte, key, value string) []byte {
+	if value == "" {
+		return b
+	}
+	b = append(b, ',')
+	b = append(b, tagEscaper.Replace(key)...)
+	b = append(b, '=')
+	return append(b, tagEscaper.Replace(value)...)
+}
+
+// appendField appends "key=valuei" to b, preceded by a comma unless it is the
+// first field.
+func appendField(b []byte, key string, value int, comma bool) []byte {
+	if comma {
+		b = append(b, ',')
+	}
+	b = append(b, tagEscaper.Replace(key)...)
+	b = append(b, '=')
+	b = strconv.AppendInt(b, int64(value), 10)
+	return append(b, 'i')
+}
+
+// FetchFunc returns the stations of each system, keyed by name, omitting
+// those that could not be fetched. exporter.Exporter.Fetch() is an
+// implementation.
+type FetchFunc func(context.Context) map[string][]bikepoint.StationAvailability
+
+// Handler serves every system's stations in line protocol, suitable for
+// Telegraf's http input. Create instances with NewHandler().
+type Handler struct {
+	Logger *slog.Logger
+	Fetch  FetchFunc
+}
+
+// NewHandler creates a handler rendering the result of fetch.
+func NewHandler(logger *slog.Logger, fetch FetchFunc) *Handler {
+	return &Handler{
+		Logger: logger,
+		Fetch:  fetch,
+	}
+}
+
+// ServeHTTP fetches every system, responding with the stations of those that
+// succeeded, or 503 if none did.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	systems := h.Fetch(r.Context())
+	if len(systems) == 0 {
+		http.Error(w, "failed to fetch station availabilities", http.StatusServiceUnavailable)
+		return
+	}
+	now := time.Now()
+	var b []byte
+	names := make([]string, 0, len(systems))
+	for name := range systems {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		b = AppendLines(b, name, systems[name], now)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if _, err := w.Write(b); err != nil {
+		h.Logger.DebugContext(r.Context(), "failed to write response",
+			slog.String("error", err.Error()))
+	}
+}
@@ -0,0 +1,166 @@
+package influx
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+)
+
+func TestAppendTag(t *testing.T) {
+	tests := []struct {
+		name  string
+		key   string
+		value string
+		want  string
+	}{
+		{
+			name:  "plain",
+			key:   "id",
+			value: "BikePoints_1",
+			want:  ",id=BikePoints_1",
+		},
+		{
+			name:  "comma and space",
+			key:   "station",
+			value: "Stonecutter Street, Holborn",
+			want:  `,station=Stonecutter\ Street\,\ Holborn`,
+		},
+		{
+			name:  "equals",
+			key:   "a=b",
+			value: "c=d",
+			want:  `,a\=b=c\=d`,
+		},
+		{
+			name:  "newline",
+			key:   "station",
+			value: "Foo\nBar",
+			want:  `,station=Foo\ Bar`,
+		},
+		{
+			name:  "backslashes",
+			key:   "station",
+			value: `St. "John's" \ Wood\`,
+			want:  `,station=St.\ "John's"\ \\\ Wood\\`,
+		},
+		{
+			name:  "empty value omitted",
+			key:   "id",
+			value: "",
+			want:  "",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			if got := string(appendTag(nil, test.key, test.value)); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMeasurementEscaper(t *testing.T) {
+	t.Parallel()
+
+	// Line protocol has no way to escape a newline, so it must not reach the
+	// output, nor become an unescaped space, which would end the measurement.
+	if got, want := measurementEscaper.Replace("a b,c\nd"), `a\ b\,c\ d`; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+var stationAvailabilities = []bikepoint.StationAvailability{
+	{
+		Station: bikepoint.Station{
+			ID:    "BikePoints_1",
+			Name:  "River Street, Clerkenwell",
+			Docks: 19,
+		},
+		Availability: bikepoint.Availability{
+			Docks:    5,
+			Bicycles: 10,
+			EBikes:   2,
+		},
+	},
+	{
+		Station: bikepoint.Station{
+			ID:    "BikePoints_2",
+			Name:  "Phillimore Gardens, Kensington",
+			Docks: 37,
+		},
+		Availability: bikepoint.Availability{
+			Docks:    30,
+			Bicycles: 7,
+		},
+	},
+}
+
+func TestAppendLines(t *testing.T) {
+	t.Parallel()
+
+	got := string(AppendLines(nil, "tfl", stationAvailabilities, time.Unix(1700000000, 5)))
+	want := `tflcycles,system=tfl,station=River\ Street\,\ Clerkenwell,id=BikePoints_1 docks=19i,docks_available=5i,bicycles_available=10i,ebikes_available=2i 1700000000000000005
+tflcycles,system=tfl,station=Phillimore\ Gardens\,\ Kensington,id=BikePoints_2 docks=37i,docks_available=30i,bicycles_available=7i,ebikes_available=0i 1700000000000000005
+`
+	if got != want {
+		t.Errorf("got:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		systems    map[string][]bikepoint.StationAvailability
+		wantStatus int
+		wantLines  int
+	}{
+		{
+			name: "success",
+			systems: map[string][]bikepoint.StationAvailability{
+				"tfl":   stationAvailabilities,
+				"other": stationAvailabilities[:1],
+			},
+			wantStatus: http.StatusOK,
+			wantLines:  3,
+		},
+		{
+			name:       "all failed",
+			wantStatus: http.StatusServiceUnavailable,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			h := NewHandler(slog.Default(), func(context.Context) map[string][]bikepoint.StationAvailability {
+				return test.systems
+			})
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/stations.influx", nil))
+			if rr.Code != test.wantStatus {
+				t.Errorf("wanted HTTP %v, got %v", test.wantStatus, rr.Code)
+			}
+			if test.wantStatus != http.StatusOK {
+				return
+			}
+			lines := 0
+			for _, c := range rr.Body.String() {
+				if c == '\n' {
+					lines++
+				}
+			}
+			if lines != test.wantLines {
+				t.Errorf("wanted %v lines, got %v:\n%v", test.wantLines, lines, rr.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+)
+
+// Condition is a state of a station that can trigger a notification.
+type Condition string
+
+const (
+	// ConditionEmpty is met when a station has no bikes or e-bikes.
+	ConditionEmpty Condition = "empty"
+
+	// ConditionFull is met when a station has no docks available.
+	ConditionFull Condition = "full"
+
+	// ConditionEBikesBelow is met when a station has fewer than
+	// Rule.Threshold e-bikes.
+	ConditionEBikesBelow Condition = "ebikes_below"
+
+	// ConditionLocked is met when a station is locked.
+	ConditionLocked Condition = "locked"
+)
+
+const (
+	defaultCooldown = 15 * time.Minute
+	defaultTimeout  = 5 * time.Second
+	defaultRetries  = 3
+)
+
+// Config defines the rules to evaluate against each snapshot, and where to
+// send notifications.
+type Config struct {
+	Webhooks []Webhook `yaml:"webhooks"`
+	Rules    []Rule    `yaml:"rules"`
+}
+
+// Webhook is a URL to which notifications are POSTed as JSON.
+type Webhook struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+
+	// Secret is the key used to sign requests with HMAC-SHA256. Requests are
+	// unsigned if empty.
+	Secret string `yaml:"secret"`
+
+	// Timeout bounds each attempt at delivery. It defaults to 5s.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Retries is the number of times to retry a failed delivery. It defaults
+	// to 3.
+	Retries *int `yaml:"retries"`
+}
+
+// Rule triggers a notification when a station starts meeting a condition.
+type Rule struct {
+	Name string `yaml:"name"`
+
+	// Stations lists the stations the rule applies to, by ID or name. If
+	// empty, it applies to every station.
+	Stations []string `yaml:"stations"`
+
+	Condition Condition `yaml:"condition"`
+
+	// Threshold is the number of e-bikes for ConditionEBikesBelow.
+	Threshold int `yaml:"threshold"`
+
+	// Cooldown is the minimum time between notifications for a station. It
+	// defaults to 15m.
+	Cooldown time.Duration `yaml:"cooldown"`
+
+	// Webhooks are the names of the webhooks to notify. If empty, every
+	// webhook is notified.
+	Webhooks []string `yaml:"webhooks"`
+}
+
+// Validate returns an error if the configuration is invalid.
+func (c Config) Validate() error {
+	webhooks := make(map[string]struct{}, len(c.Webhooks))
+	for _, webhook := range c.Webhooks {
+		if webhook.Name == "" {
+			return errors.New("webhook name is required")
+		}
+		if _, ok := webhooks[webhook.Name]; ok {
+			return fmt.Errorf("duplicate webhook %q", webhook.Name)
+		}
+		webhooks[webhook.Name] = struct{}{}
+		if u, err := url.Parse(webhook.URL); err != nil {
+			return fmt.Errorf("webhook %q: invalid url: %w", webhook.Name, err)
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("webhook %q: url %q must be http or https", webhook.Name, webhook.URL)
+		}
+		if webhook.Timeout < 0 {
+			return fmt.Errorf("webhook %q: timeout must be positive", webhook.Name)
+		}
+		if webhook.Retries != nil && *webhook.Retries < 0 {
+			return fmt.Errorf("webhook %q: retries must not be negative", webhook.Name)
+		}
+	}
+
+	rules := make(map[string]struct{}, len(c.Rules))
+	for _, rule := range c.Rules {
+		if rule.Name == "" {
+			return errors.New("rule name is required")
+		}
+		if _, ok := rules[rule.Name]; ok {
+			return fmt.Errorf("duplicate rule %q", rule.Name)
+		}
+		rules[rule.Name] = struct{}{}
+		switch rule.Condition {
+		case ConditionEmpty, ConditionFull, ConditionLocked:
+		case ConditionEBikesBelow:
+			if rule.Threshold < 1 {
+				return fmt.Errorf("rule %q: threshold must be at least 1", rule.Name)
+			}
+		default:
+			return fmt.Errorf("rule %q: unknown condition %q", rule.Name, rule.Condition)
+		}
+		if rule.Cooldown < 0 {
+			return fmt.Errorf("rule %q: cooldown must be positive", rule.Name)
+		}
+		if len(c.Webhooks) == 0 {
+			return fmt.Errorf("rule %q: no webhooks are defined", rule.Name)
+		}
+		for _, name := range rule.Webhooks {
+			if _, ok := webhooks[name]; !ok {
+				return fmt.Errorf("rule %q: unknown webhook %q", rule.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+// met returns whether a station meets the rule's condition.
+func (r Rule) met(sa *bikepoint.StationAvailability) bool {
+	switch r.Condition {
+	case ConditionEmpty:
+		return sa.Availability.Bicycles+sa.Availability.EBikes == 0
+	case ConditionFull:
+		return sa.Availability.Docks == 0
+	case ConditionEBikesBelow:
+		return sa.Availability.EBikes < r.Threshold
+	case ConditionLocked:
+		return sa.Availability.Locked
+	}
+	return false
+}
+
+// applies returns whether the rule should be evaluated for a station.
+func (r Rule) applies(sa *bikepoint.StationAvailability) bool {
+	if len(r.Stations) == 0 {
+		return true
+	}
+	for _, station := range r.Stations {
+		if station == sa.Station.ID || station == sa.Station.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Rule) cooldown() time.Duration {
+	if r.Cooldown == 0 {
+		return defaultCooldown
+	}
+	return r.Cooldown
+}
+
+func (w Webhook) timeout() time.Duration {
+	if w.Timeout == 0 {
+		return defaultTimeout
+	}
+	return w.Timeout
+}
+
+func (w Webhook) retries() int {
+	if w.Retries == nil {
+		return defaultRetries
+	}
+	return *w.Retries
+}
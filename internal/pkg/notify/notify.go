@@ -0,0 +1,385 @@
+// Package notify sends webhook notifications when stations start meeting a
+// condition, such as a station near the office becoming empty.
+//
+// Rules are evaluated against the changes between consecutive snapshots. A
+// rule fires when a station starts meeting its condition, so a station that
+// remains empty is notified about once, and a station flapping between states
+// at most once per cooldown. The first snapshot establishes the initial state
+// without notifying.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/backoffutil"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+	"github.com/gebn/tflcycles_exporter/internal/pkg/watch"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/gebn/go-stamp/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// DeliveryHeader contains the ID of the notification, which is the same
+	// for every attempt to deliver it, so receivers can deduplicate retries.
+	DeliveryHeader = "X-Tflcycles-Delivery"
+
+	// SignatureHeader contains "sha256=" followed by the hex-encoded
+	// HMAC-SHA256 of the body, keyed by the webhook's secret.
+	SignatureHeader = "X-Tflcycles-Signature-256"
+)
+
+var (
+	notifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tflcycles_exporter_notifications_total",
+		Help: "The number of times a rule fired, by whether the notification was sent or suppressed by its cooldown.",
+	}, []string{"rule", "result"})
+	deliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tflcycles_exporter_webhook_deliveries_total",
+		Help: "The number of notifications sent to each webhook, by whether they were accepted, after any retries, or dropped as too many were waiting.",
+	}, []string{"webhook", "result"})
+)
+
+// Station is the state of a station in a notification.
+type Station struct {
+	ID                string  `json:"id"`
+	Name              string  `json:"name"`
+	Docks             int     `json:"docks"`
+	DocksAvailable    int     `json:"docks_available"`
+	BicyclesAvailable int     `json:"bicycles_available"`
+	EBikesAvailable   int     `json:"ebikes_available"`
+	Locked            bool    `json:"locked"`
+	Lat               float64 `json:"lat"`
+	Lon               float64 `json:"lon"`
+}
+
+// Notification is the body POSTed to webhooks.
+type Notification struct {
+	ID        string    `json:"id"`
+	Rule      string    `json:"rule"`
+	Condition Condition `json:"condition"`
+	Threshold int       `json:"threshold,omitempty"`
+	Time      time.Time `json:"time"`
+	Station   Station   `json:"station"`
+}
+
+// ruleStation identifies the state of a rule for a station.
+type ruleStation struct {
+	rule    string
+	station string
+}
+
+// delivery is a notification waiting to be sent to a webhook.
+type delivery struct {
+	webhook      Webhook
+	notification Notification
+	body         []byte
+}
+
+// Option customises a Notifier.
+type Option func(*Notifier)
+
+// WithWorkers sets how many deliveries may be in progress at once. It
+// defaults to 4.
+func WithWorkers(workers int) Option {
+	return func(n *Notifier) {
+		n.Workers = workers
+	}
+}
+
+// WithQueueSize sets how many deliveries may wait for a worker before further
+// notifications are dropped. It defaults to 100.
+func WithQueueSize(size int) Option {
+	return func(n *Notifier) {
+		n.QueueSize = size
+	}
+}
+
+// Notifier evaluates rules against snapshots, and delivers notifications. It
+// implements watch.Observer. Create instances with New(), and stop them with
+// Shutdown().
+type Notifier struct {
+	Logger     *slog.Logger
+	HTTPClient *http.Client
+	Config     Config
+
+	Workers   int
+	QueueSize int
+
+	// backOff returns the policy for retrying a delivery. It is overridden
+	// in tests.
+	backOff func() backoff.BackOff
+
+	mu       sync.Mutex
+	closed   bool
+	differ   watch.Differ
+	met      map[ruleStation]bool
+	lastSent map[ruleStation]time.Time
+
+	queue chan delivery
+
+	// ctx is cancelled to abandon deliveries if Shutdown() times out.
+	// Deliveries do not use the context passed to Observe(), so they can
+	// outlive the poller.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	workers  sync.WaitGroup
+	inFlight sync.WaitGroup // queued or in progress
+}
+
+// New creates a notifier, and starts its workers. The config must be valid.
+func New(logger *slog.Logger, httpClient *http.Client, config Config, opts ...Option) *Notifier {
+	for _, rule := range config.Rules {
+		for _, result := range []string{"sent", "suppressed"} {
+			notifications.WithLabelValues(rule.Name, result)
+		}
+	}
+	for _, webhook := range config.Webhooks {
+		for _, result := range []string{"success", "failure", "dropped"} {
+			deliveries.WithLabelValues(webhook.Name, result)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &Notifier{
+		Logger:     logger,
+		HTTPClient: httpClient,
+		Config:     config,
+		Workers:    4,
+		QueueSize:  100,
+		backOff: func() backoff.BackOff {
+			return backoff.NewExponentialBackOff()
+		},
+		met:      make(map[ruleStation]bool),
+		lastSent: make(map[ruleStation]time.Time),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	for _, opt := range opts {
+		opt(n)
+	}
+	n.queue = make(chan delivery, n.QueueSize)
+	for range n.Workers {
+		n.workers.Add(1)
+		go n.work()
+	}
+	return n
+}
+
+// Observe evaluates the rules against the changes since the last snapshot.
+// Notifications are delivered in the background; use Wait() to wait for them
+// to finish. It does nothing after Shutdown().
+func (n *Notifier) Observe(ctx context.Context, t time.Time, stationAvailabilities []bikepoint.StationAvailability) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return
+	}
+
+	initial := n.differ.Snapshot() == nil
+	for _, change := range n.differ.Next(stationAvailabilities) {
+		for _, rule := range n.Config.Rules {
+			key := ruleStation{
+				rule:    rule.Name,
+				station: change.ID(),
+			}
+			if change.Current == nil || !rule.applies(change.Current) {
+				delete(n.met, key)
+				continue
+			}
+			met := rule.met(change.Current)
+			wasMet := n.met[key]
+			n.met[key] = met
+			if !met || wasMet || initial {
+				continue
+			}
+			if lastSent, ok := n.lastSent[key]; ok && t.Sub(lastSent) < rule.cooldown() {
+				notifications.WithLabelValues(rule.Name, "suppressed").Inc()
+				n.Logger.DebugContext(ctx, "notification suppressed by cooldown",
+					slog.String("rule", rule.Name),
+					slog.String("station", key.station))
+				continue
+			}
+			n.lastSent[key] = t
+			notifications.WithLabelValues(rule.Name, "sent").Inc()
+			n.notify(ctx, rule, newNotification(rule, t, change.Current))
+		}
+	}
+}
+
+func newNotification(rule Rule, t time.Time, sa *bikepoint.StationAvailability) Notification {
+	notification := Notification{
+		Rule:      rule.Name,
+		Condition: rule.Condition,
+		Time:      t.UTC(),
+		Station: Station{
+			ID:                sa.Station.ID,
+			Name:              sa.Station.Name,
+			Docks:             sa.Station.Docks,
+			DocksAvailable:    sa.Availability.Docks,
+			BicyclesAvailable: sa.Availability.Bicycles,
+			EBikesAvailable:   sa.Availability.EBikes,
+			Locked:            sa.Availability.Locked,
+			Lat:               sa.Station.Lat,
+			Lon:               sa.Station.Lon,
+		},
+	}
+	if rule.Condition == ConditionEBikesBelow {
+		notification.Threshold = rule.Threshold
+	}
+	// Identical for retries, and unique per firing given the cooldown.
+	sum := sha256.Sum256(fmt.Appendf(nil, "%v\x00%v\x00%v", rule.Name, sa.Station.ID, t.UnixNano()))
+	notification.ID = hex.EncodeToString(sum[:16])
+	return notification
+}
+
+// notify queues a notification for delivery to the rule's webhooks. It must
+// be called with mu held. If the queue is full, the notification is dropped
+// rather than blocking the poller.
+func (n *Notifier) notify(ctx context.Context, rule Rule, notification Notification) {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		// Notifications contain only marshallable types.
+		panic(err)
+	}
+	for _, webhook := range n.Config.Webhooks {
+		if len(rule.Webhooks) > 0 && !slices.Contains(rule.Webhooks, webhook.Name) {
+			continue
+		}
+		n.inFlight.Add(1)
+		select {
+		case n.queue <- delivery{
+			webhook:      webhook,
+			notification: notification,
+			body:         body,
+		}:
+		default:
+			n.inFlight.Done()
+			deliveries.WithLabelValues(webhook.Name, "dropped").Inc()
+			n.Logger.WarnContext(ctx, "dropped notification, as too many are waiting to be delivered",
+				slog.String("webhook", webhook.Name),
+				slog.String("rule", notification.Rule),
+				slog.String("station", notification.Station.ID))
+		}
+	}
+}
+
+// work delivers queued notifications until the queue is closed.
+func (n *Notifier) work() {
+	defer n.workers.Done()
+	for d := range n.queue {
+		if err := n.deliver(n.ctx, d.webhook, d.notification.ID, d.body); err != nil {
+			deliveries.WithLabelValues(d.webhook.Name, "failure").Inc()
+			n.Logger.ErrorContext(n.ctx, "failed to deliver notification",
+				slog.String("webhook", d.webhook.Name),
+				slog.String("rule", d.notification.Rule),
+				slog.String("station", d.notification.Station.ID),
+				slog.String("error", err.Error()))
+		} else {
+			deliveries.WithLabelValues(d.webhook.Name, "success").Inc()
+		}
+		n.inFlight.Done()
+	}
+}
+
+// deliver POSTs the body to the webhook, retrying on network errors, 429s and
+// 5xx responses.
+func (n *Notifier) deliver(ctx context.Context, webhook Webhook, id string, body []byte) error {
+	return backoff.RetryNotify(
+		func() error {
+			ctx, cancel := context.WithTimeout(ctx, webhook.timeout())
+			defer cancel()
+
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+			if err != nil {
+				return backoff.Permanent(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("User-Agent", "tflcycles_exporter/"+stamp.Version)
+			req.Header.Set(DeliveryHeader, id)
+			if webhook.Secret != "" {
+				req.Header.Set(SignatureHeader, Sign(webhook.Secret, body))
+			}
+
+			resp, err := n.HTTPClient.Do(req)
+			if err != nil {
+				return err
+			}
+			// Drain the body so the connection can be reused.
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+			resp.Body.Close()
+
+			switch {
+			case resp.StatusCode >= 200 && resp.StatusCode < 300:
+				return nil
+			case resp.StatusCode == http.StatusTooManyRequests,
+				resp.StatusCode >= http.StatusInternalServerError:
+				return fmt.Errorf("got HTTP %v", resp.StatusCode)
+			}
+			return backoff.Permanent(fmt.Errorf("got HTTP %v", resp.StatusCode))
+		},
+		backoffutil.WithContext(backoff.WithMaxRetries(n.backOff(), uint64(webhook.retries())), ctx),
+		func(err error, wait time.Duration) {
+			n.Logger.WarnContext(ctx, "failed to deliver notification, retrying",
+				slog.String("webhook", webhook.Name),
+				slog.String("error", err.Error()),
+				slog.Duration("wait", wait))
+		},
+	)
+}
+
+// Wait blocks until every notification being delivered has succeeded or
+// failed.
+func (n *Notifier) Wait() {
+	n.inFlight.Wait()
+}
+
+// Shutdown stops accepting snapshots, and waits for queued and in-progress
+// deliveries to finish, including retries. If the context expires first, the
+// remaining deliveries are abandoned, and its error returned.
+func (n *Notifier) Shutdown(ctx context.Context) error {
+	n.mu.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.queue)
+	}
+	n.mu.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		n.workers.Wait()
+		close(stopped)
+	}()
+	defer n.cancel()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		n.cancel()
+		<-stopped
+		return ctx.Err()
+	}
+}
+
+// Sign returns the value of SignatureHeader for a body. Receivers should
+// compute this themselves, and compare it to the header using
+// hmac.Equal().
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,402 @@
+package notify
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var epoch = time.Date(2024, time.March, 4, 8, 0, 0, 0, time.UTC)
+
+func station(id string, bicycles, eBikes int) bikepoint.StationAvailability {
+	return bikepoint.StationAvailability{
+		Station: bikepoint.Station{
+			ID:    id,
+			Name:  "Station " + id,
+			Docks: 10,
+		},
+		Availability: bikepoint.Availability{
+			Docks:    10 - bicycles - eBikes,
+			Bicycles: bicycles,
+			EBikes:   eBikes,
+		},
+	}
+}
+
+// receiver is a webhook recording the notifications it accepts. Responses
+// are taken from statuses in turn, followed by 200s.
+type receiver struct {
+	*httptest.Server
+	t      *testing.T
+	secret string
+
+	mu            sync.Mutex
+	statuses      []int
+	attempts      int
+	deliveryIDs   []string
+	notifications []Notification
+}
+
+func newReceiver(t *testing.T, secret string, statuses ...int) *receiver {
+	r := &receiver{
+		t:        t,
+		secret:   secret,
+		statuses: statuses,
+	}
+	r.Server = httptest.NewServer(r)
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		r.t.Error(err)
+		return
+	}
+	if r.secret != "" && !hmac.Equal([]byte(req.Header.Get(SignatureHeader)), []byte(Sign(r.secret, body))) {
+		r.t.Errorf("invalid signature %q", req.Header.Get(SignatureHeader))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.attempts++
+	r.deliveryIDs = append(r.deliveryIDs, req.Header.Get(DeliveryHeader))
+	if len(r.statuses) > 0 {
+		status := r.statuses[0]
+		r.statuses = r.statuses[1:]
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+	}
+	notification := Notification{}
+	if err := json.Unmarshal(body, &notification); err != nil {
+		r.t.Error(err)
+	}
+	r.notifications = append(r.notifications, notification)
+}
+
+// fired returns the rule and station of each notification received.
+func (r *receiver) fired() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var fired []string
+	for _, n := range r.notifications {
+		fired = append(fired, n.Rule+" "+n.Station.ID)
+	}
+	return fired
+}
+
+func newNotifier(t *testing.T, config Config, opts ...Option) *Notifier {
+	n := New(slog.Default(), http.DefaultClient, config, opts...)
+	n.backOff = func() backoff.BackOff {
+		return &backoff.ZeroBackOff{}
+	}
+	t.Cleanup(func() {
+		if err := n.Shutdown(context.Background()); err != nil {
+			t.Error(err)
+		}
+	})
+	return n
+}
+
+func TestNotifier(t *testing.T) {
+	t.Parallel()
+
+	office := newReceiver(t, "s3cret")
+	home := newReceiver(t, "")
+	n := newNotifier(t, Config{
+		Webhooks: []Webhook{
+			{Name: "office", URL: office.URL, Secret: "s3cret"},
+			{Name: "home", URL: home.URL},
+		},
+		Rules: []Rule{
+			{
+				Name:      "office-empty",
+				Stations:  []string{"1", "Station 2"},
+				Condition: ConditionEmpty,
+				Webhooks:  []string{"office"},
+			},
+			{
+				Name:      "few-ebikes",
+				Condition: ConditionEBikesBelow,
+				Threshold: 2,
+				Cooldown:  time.Minute,
+			},
+		},
+	})
+
+	steps := []struct {
+		offset   time.Duration
+		snapshot []bikepoint.StationAvailability
+	}{
+		// Station 1 is already empty, which establishes state only.
+		{0, []bikepoint.StationAvailability{station("1", 0, 0), station("2", 3, 3), station("3", 0, 5)}},
+		// Station 2 empties and drops below 2 e-bikes; 3 drops below 2.
+		{time.Minute, []bikepoint.StationAvailability{station("1", 0, 0), station("2", 0, 0), station("3", 0, 1)}},
+		// Remaining empty does not notify again.
+		{2 * time.Minute, []bikepoint.StationAvailability{station("1", 0, 0), station("2", 0, 0), station("3", 0, 1)}},
+		// 2 and 3 recover.
+		{3 * time.Minute, []bikepoint.StationAvailability{station("1", 0, 0), station("2", 1, 2), station("3", 0, 3)}},
+		// 2 empties again, within the cooldown of office-empty but not of
+		// few-ebikes.
+		{4 * time.Minute, []bikepoint.StationAvailability{station("1", 0, 0), station("2", 0, 0), station("3", 0, 3)}},
+		// 3 drops again after its cooldown.
+		{5 * time.Minute, []bikepoint.StationAvailability{station("1", 0, 0), station("2", 0, 0), station("3", 0, 0)}},
+		// 3 is removed, then reappears below the threshold.
+		{6 * time.Minute, []bikepoint.StationAvailability{station("1", 0, 0), station("2", 0, 0)}},
+		{7 * time.Minute, []bikepoint.StationAvailability{station("1", 0, 0), station("2", 0, 0), station("3", 0, 0)}},
+	}
+	for _, step := range steps {
+		n.Observe(context.Background(), epoch.Add(step.offset), step.snapshot)
+		n.Wait()
+	}
+
+	wantHome := []string{"few-ebikes 2", "few-ebikes 3", "few-ebikes 2", "few-ebikes 3", "few-ebikes 3"}
+	wantOffice := append([]string{"office-empty 2"}, wantHome...)
+	if got := office.fired(); !equalUnordered(got, wantOffice) {
+		t.Errorf("office got %v, want %v", got, wantOffice)
+	}
+	if got := home.fired(); !equalUnordered(got, wantHome) {
+		t.Errorf("home got %v, want %v", got, wantHome)
+	}
+
+	for _, notification := range home.notifications {
+		if notification.Station.ID != "2" {
+			continue
+		}
+		if notification.Condition != ConditionEBikesBelow || notification.Threshold != 2 ||
+			!notification.Time.Equal(epoch.Add(time.Minute)) || notification.Station.Name != "Station 2" ||
+			notification.ID == "" {
+			t.Errorf("unexpected notification %+v", notification)
+		}
+		break
+	}
+}
+
+// equalUnordered returns whether a and b contain the same elements, as
+// notifications to a webhook are delivered concurrently.
+func equalUnordered(a, b []string) bool {
+	counts := map[string]int{}
+	for _, s := range a {
+		counts[s]++
+	}
+	for _, s := range b {
+		counts[s]--
+	}
+	for _, count := range counts {
+		if count != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestNotifier_Retries(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name             string
+		statuses         []int
+		wantAttempts     int
+		wantNotification bool
+	}{
+		{
+			name:             "server errors",
+			statuses:         []int{http.StatusServiceUnavailable, http.StatusTooManyRequests},
+			wantAttempts:     3,
+			wantNotification: true,
+		},
+		{
+			name:         "exhausted",
+			statuses:     []int{500, 500, 500, 500, 500},
+			wantAttempts: 4,
+		},
+		{
+			name:         "rejected",
+			statuses:     []int{http.StatusBadRequest},
+			wantAttempts: 1,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			r := newReceiver(t, "", test.statuses...)
+			n := newNotifier(t, Config{
+				Webhooks: []Webhook{{Name: "test", URL: r.URL}},
+				Rules:    []Rule{{Name: "locked", Condition: ConditionLocked}},
+			})
+			n.Observe(context.Background(), epoch, []bikepoint.StationAvailability{station("1", 1, 1)})
+			locked := station("1", 1, 1)
+			locked.Availability.Locked = true
+			n.Observe(context.Background(), epoch.Add(time.Minute), []bikepoint.StationAvailability{locked})
+			n.Wait()
+
+			if r.attempts != test.wantAttempts {
+				t.Errorf("wanted %v attempts, got %v", test.wantAttempts, r.attempts)
+			}
+			for _, id := range r.deliveryIDs {
+				if id != r.deliveryIDs[0] {
+					t.Errorf("delivery ID changed between attempts: %v", r.deliveryIDs)
+				}
+			}
+			if got := len(r.notifications) == 1; got != test.wantNotification {
+				t.Errorf("wanted notification %v, got %v", test.wantNotification, r.notifications)
+			}
+		})
+	}
+}
+
+func TestNotifier_Shutdown(t *testing.T) {
+	t.Parallel()
+
+	r := newReceiver(t, "")
+	n := newNotifier(t, Config{
+		Webhooks: []Webhook{{Name: "test", URL: r.URL}},
+		Rules:    []Rule{{Name: "locked", Condition: ConditionLocked}},
+	})
+	// Deliveries outlive the context of the poll that triggered them.
+	ctx, cancel := context.WithCancel(context.Background())
+	n.Observe(ctx, epoch, []bikepoint.StationAvailability{station("1", 1, 1)})
+	locked := station("1", 1, 1)
+	locked.Availability.Locked = true
+	n.Observe(ctx, epoch.Add(time.Minute), []bikepoint.StationAvailability{locked})
+	cancel()
+	if err := n.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := r.fired(); len(got) != 1 {
+		t.Errorf("wanted the queued notification to be delivered, got %v", got)
+	}
+	// Snapshots after shutdown are ignored.
+	n.Observe(context.Background(), epoch.Add(2*time.Minute), nil)
+}
+
+func TestNotifier_QueueFull(t *testing.T) {
+	t.Parallel()
+
+	r := newReceiver(t, "")
+	// Without workers, nothing can leave the queue.
+	n := newNotifier(t, Config{
+		Webhooks: []Webhook{{Name: "queue-full", URL: r.URL}},
+		Rules:    []Rule{{Name: "locked", Condition: ConditionLocked}},
+	}, WithWorkers(0), WithQueueSize(0))
+	dropped := deliveries.WithLabelValues("queue-full", "dropped")
+	before := testutil.ToFloat64(dropped)
+	n.Observe(context.Background(), epoch, []bikepoint.StationAvailability{station("1", 1, 1)})
+	locked := station("1", 1, 1)
+	locked.Availability.Locked = true
+	n.Observe(context.Background(), epoch.Add(time.Minute), []bikepoint.StationAvailability{locked})
+	n.Wait()
+
+	if got := testutil.ToFloat64(dropped) - before; got != 1 {
+		t.Errorf("wanted 1 dropped delivery, got %v", got)
+	}
+	if got := r.fired(); len(got) != 0 {
+		t.Errorf("wanted no deliveries, got %v", got)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	webhooks := []Webhook{{Name: "office", URL: "https://example.com/hook"}}
+	negative := -1
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "valid",
+			config: Config{
+				Webhooks: webhooks,
+				Rules: []Rule{
+					{Name: "a", Condition: ConditionFull, Webhooks: []string{"office"}},
+					{Name: "b", Condition: ConditionEBikesBelow, Threshold: 3},
+				},
+			},
+		},
+		{
+			name: "no webhooks",
+			config: Config{
+				Rules: []Rule{{Name: "a", Condition: ConditionEmpty}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown webhook",
+			config: Config{
+				Webhooks: webhooks,
+				Rules:    []Rule{{Name: "a", Condition: ConditionEmpty, Webhooks: []string{"home"}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown condition",
+			config: Config{
+				Webhooks: webhooks,
+				Rules:    []Rule{{Name: "a", Condition: "busy"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing threshold",
+			config: Config{
+				Webhooks: webhooks,
+				Rules:    []Rule{{Name: "a", Condition: ConditionEBikesBelow}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "duplicate rule",
+			config: Config{
+				Webhooks: webhooks,
+				Rules: []Rule{
+					{Name: "a", Condition: ConditionEmpty},
+					{Name: "a", Condition: ConditionFull},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid url",
+			config: Config{
+				Webhooks: []Webhook{{Name: "office", URL: "ftp://example.com"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative retries",
+			config: Config{
+				Webhooks: []Webhook{{Name: "office", URL: "https://example.com", Retries: &negative}},
+			},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			if err := test.config.Validate(); (err != nil) != test.wantErr {
+				t.Errorf("wanted error %v, got %v", test.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+// Package otlp periodically pushes the exporter's metrics to an OpenTelemetry
+// collector over OTLP, for environments that do not scrape Prometheus
+// endpoints. The same metrics continue to be served for pulling. It also
+// creates exporters for sending traces to the same collector.
+package otlp
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"time"
+
+	"github.com/gebn/go-stamp/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
+	prombridge "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+)
+
+// Supported values of Pusher.Protocol.
+const (
+	ProtocolHTTP = "http/protobuf"
+	ProtocolGRPC = "grpc"
+)
+
+// serviceName is the service.name resource attribute, unless overridden by
+// OTEL_SERVICE_NAME.
+const serviceName = "tflcycles_exporter"
+
+// Paths of the OTLP/HTTP endpoints for each signal, used if the endpoint URL
+// does not have one.
+const (
+	metricsHTTPPath = "/v1/metrics"
+	tracesHTTPPath  = "/v1/traces"
+)
+
+var (
+	exports = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tflcycles_exporter_otlp_exports_total",
+		Help: "The number of pushes of metrics to the OTLP endpoint, by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	for _, result := range []string{"success", "failure"} {
+		exports.WithLabelValues(result)
+	}
+}
+
+// GathererFunc returns the metrics to push. It is called before every push,
+// with a context that expires when the push times out, so should return
+// promptly, e.g. the metrics of the latest background poll rather than
+// fetching afresh.
+type GathererFunc func(context.Context) prometheus.Gatherer
+
+// PusherOption customises a Pusher.
+type PusherOption func(*Pusher)
+
+// WithProtocol sets the OTLP transport: ProtocolHTTP (the default) or
+// ProtocolGRPC.
+func WithProtocol(protocol string) PusherOption {
+	return func(p *Pusher) {
+		p.Protocol = protocol
+	}
+}
+
+// WithInterval sets how often metrics are pushed. It defaults to 1m. Each
+// push, including gathering, is limited to this duration.
+func WithInterval(interval time.Duration) PusherOption {
+	return func(p *Pusher) {
+		p.Interval = interval
+	}
+}
+
+// Pusher sends metrics to an OTLP endpoint in the background. Create
+// instances with NewPusher().
+type Pusher struct {
+	Logger *slog.Logger
+
+	// Endpoint is the URL of the collector, e.g. http://localhost:4318 for
+	// OTLP/HTTP, or http://localhost:4317 for gRPC. An https scheme enables
+	// TLS.
+	Endpoint string
+
+	Protocol string
+	Interval time.Duration
+	Gather   GathererFunc
+
+	provider *sdkmetric.MeterProvider
+}
+
+// NewPusher starts pushing metrics returned by gather to endpoint. Headers
+// and TLS settings can additionally be configured with the standard
+// OTEL_EXPORTER_OTLP_* environment variables. Call Shutdown() to send a final
+// push and stop.
+func NewPusher(ctx context.Context, logger *slog.Logger, endpoint string, gather GathererFunc, opts ...PusherOption) (*Pusher, error) {
+	p := &Pusher{
+		Logger:   logger,
+		Endpoint: endpoint,
+		Protocol: ProtocolHTTP,
+		Interval: time.Minute,
+		Gather:   gather,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	exporter, err := p.newExporter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := NewResource(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reader := sdkmetric.NewPeriodicReader(countingExporter{exporter, p.Logger},
+		sdkmetric.WithInterval(p.Interval),
+		sdkmetric.WithTimeout(p.Interval),
+		sdkmetric.WithProducer(producer{gather: p.Gather}))
+	p.provider = sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(reader),
+		sdkmetric.WithResource(res))
+	return p, nil
+}
+
+// NewResource describes the exporter to collectors. The service name and
+// version can be overridden, and attributes added, with OTEL_SERVICE_NAME and
+// OTEL_RESOURCE_ATTRIBUTES.
+func NewResource(ctx context.Context) (*resource.Resource, error) {
+	res, err := resource.New(ctx,
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(
+			semconv.ServiceName(serviceName),
+			semconv.ServiceVersion(stamp.Version),
+		),
+		// Applied last, so the environment takes precedence.
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build resource: %w", err)
+	}
+	return res, nil
+}
+
+// newExporter creates an exporter for the configured protocol.
+func (p *Pusher) newExporter(ctx context.Context) (sdkmetric.Exporter, error) {
+	u, err := endpointURL(p.Endpoint, p.Protocol, metricsHTTPPath)
+	if err != nil {
+		return nil, err
+	}
+	if p.Protocol == ProtocolGRPC {
+		return otlpmetricgrpc.New(ctx, otlpmetricgrpc.WithEndpointURL(u))
+	}
+	return otlpmetrichttp.New(ctx, otlpmetrichttp.WithEndpointURL(u))
+}
+
+// NewTraceExporter creates an exporter sending spans to endpoint, which is
+// interpreted as by Pusher.Endpoint.
+func NewTraceExporter(ctx context.Context, endpoint, protocol string) (sdktrace.SpanExporter, error) {
+	u, err := endpointURL(endpoint, protocol, tracesHTTPPath)
+	if err != nil {
+		return nil, err
+	}
+	if protocol == ProtocolGRPC {
+		return otlptracegrpc.New(ctx, otlptracegrpc.WithEndpointURL(u))
+	}
+	return otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(u))
+}
+
+// endpointURL validates a collector URL, adding httpPath if the protocol is
+// ProtocolHTTP and the URL has no path.
+func endpointURL(endpoint, protocol, httpPath string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid endpoint: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("endpoint %q must be http or https", endpoint)
+	}
+	switch protocol {
+	case ProtocolHTTP:
+		if u.Path == "" || u.Path == "/" {
+			u.Path = httpPath
+		}
+	case ProtocolGRPC:
+	default:
+		return "", fmt.Errorf("unknown protocol %q", protocol)
+	}
+	return u.String(), nil
+}
+
+// Shutdown pushes any metrics not yet sent, and stops pushing.
+func (p *Pusher) Shutdown(ctx context.Context) error {
+	return p.provider.Shutdown(ctx)
+}
+
+// producer gathers metrics at the time of each push, converting them to
+// OpenTelemetry's data model.
+type producer struct {
+	gather GathererFunc
+}
+
+func (p producer) Produce(ctx context.Context) ([]metricdata.ScopeMetrics, error) {
+	return prombridge.NewMetricProducer(
+		prombridge.WithGatherer(gaugeGatherer{p.gather(ctx)}),
+	).Produce(ctx)
+}
+
+// gaugeGatherer reports untyped metrics, such as tflcycles_up, as gauges,
+// which is what they are in practice. The bridge otherwise drops them.
+type gaugeGatherer struct {
+	prometheus.Gatherer
+}
+
+func (g gaugeGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+	for _, family := range families {
+		if family.GetType() != dto.MetricType_UNTYPED {
+			continue
+		}
+		family.Type = dto.MetricType_GAUGE.Enum()
+		for _, metric := range family.Metric {
+			value := metric.GetUntyped().GetValue()
+			metric.Gauge = &dto.Gauge{Value: &value}
+			metric.Untyped = nil
+		}
+	}
+	return families, err
+}
+
+// countingExporter records the result of each push.
+type countingExporter struct {
+	sdkmetric.Exporter
+	logger *slog.Logger
+}
+
+func (e countingExporter) Export(ctx context.Context, rm *metricdata.ResourceMetrics) error {
+	if err := e.Exporter.Export(ctx, rm); err != nil {
+		exports.WithLabelValues("failure").Inc()
+		e.logger.WarnContext(ctx, "failed to push metrics",
+			slog.String("error", err.Error()))
+		return err
+	}
+	exports.WithLabelValues("success").Inc()
+	return nil
+}
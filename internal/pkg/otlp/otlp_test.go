@@ -0,0 +1,243 @@
+package otlp
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	collectormetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// receiver is an in-process OTLP collector, recording the requests it
+// receives over HTTP and gRPC.
+type receiver struct {
+	collectormetrics.UnimplementedMetricsServiceServer
+
+	mu       sync.Mutex
+	requests []*collectormetrics.ExportMetricsServiceRequest
+}
+
+func (r *receiver) Export(_ context.Context, req *collectormetrics.ExportMetricsServiceRequest) (*collectormetrics.ExportMetricsServiceResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req)
+	return &collectormetrics.ExportMetricsServiceResponse{}, nil
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != metricsHTTPPath {
+		http.NotFound(w, req)
+		return
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	exportReq := &collectormetrics.ExportMetricsServiceRequest{}
+	if err := proto.Unmarshal(body, exportReq); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, _ := r.Export(req.Context(), exportReq)
+	b, _ := proto.Marshal(resp)
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(b)
+}
+
+// listenHTTP serves the receiver over OTLP/HTTP, returning its base URL.
+func (r *receiver) listenHTTP(t *testing.T) string {
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// listenGRPC serves the receiver over gRPC, returning its URL.
+func (r *receiver) listenGRPC(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	collectormetrics.RegisterMetricsServiceServer(server, r)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return "http://" + listener.Addr().String()
+}
+
+// metrics returns the metrics received, keyed by name.
+func (r *receiver) metrics() map[string]*metricspb.Metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	metrics := make(map[string]*metricspb.Metric)
+	for _, req := range r.requests {
+		for _, rm := range req.ResourceMetrics {
+			for _, sm := range rm.ScopeMetrics {
+				for _, m := range sm.Metrics {
+					metrics[m.Name] = m
+				}
+			}
+		}
+	}
+	return metrics
+}
+
+// resourceAttributes returns the string attributes of the first resource
+// received.
+func (r *receiver) resourceAttributes() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	attributes := make(map[string]string)
+	if len(r.requests) == 0 || len(r.requests[0].ResourceMetrics) == 0 {
+		return attributes
+	}
+	for _, kv := range r.requests[0].ResourceMetrics[0].Resource.Attributes {
+		attributes[kv.Key] = kv.Value.GetStringValue()
+	}
+	return attributes
+}
+
+func TestPusher(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		protocol string
+		listen   func(*receiver, *testing.T) string
+	}{
+		{ProtocolHTTP, (*receiver).listenHTTP},
+		{ProtocolGRPC, (*receiver).listenGRPC},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.protocol, func(t *testing.T) {
+			t.Parallel()
+
+			r := &receiver{}
+			endpoint := test.listen(r, t)
+			gathered := 0
+			gather := func(context.Context) prometheus.Gatherer {
+				gathered++
+				reg := prometheus.NewRegistry()
+				bicycles := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+					Name: "tflcycles_bicycles_available",
+					Help: "Test gauge.",
+				}, []string{"station", "system"})
+				bicycles.WithLabelValues("Foo", "tfl").Set(3)
+				up := prometheus.NewUntypedFunc(prometheus.UntypedOpts{
+					Name: "tflcycles_up",
+					Help: "Test untyped.",
+				}, func() float64 {
+					return 1
+				})
+				failures := prometheus.NewCounter(prometheus.CounterOpts{
+					Name: "tflcycles_exporter_fetch_failures_total",
+					Help: "Test counter.",
+				})
+				failures.Add(2)
+				reg.MustRegister(bicycles, up, failures)
+				return reg
+			}
+
+			pusher, err := NewPusher(context.Background(), slog.Default(), endpoint, gather,
+				WithProtocol(test.protocol))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Pushes once before stopping.
+			if err := pusher.Shutdown(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if gathered != 1 {
+				t.Errorf("wanted 1 gather, got %v", gathered)
+			}
+
+			attributes := r.resourceAttributes()
+			if attributes["service.name"] != serviceName {
+				t.Errorf("unexpected service.name %q", attributes["service.name"])
+			}
+			if _, ok := attributes["service.version"]; !ok {
+				t.Error("missing service.version")
+			}
+
+			metrics := r.metrics()
+			bicycles := metrics["tflcycles_bicycles_available"].GetGauge().GetDataPoints()
+			if len(bicycles) != 1 || bicycles[0].GetAsDouble() != 3 || len(bicycles[0].Attributes) != 2 {
+				t.Errorf("unexpected bicycles %v", bicycles)
+			}
+			up := metrics["tflcycles_up"].GetGauge().GetDataPoints()
+			if len(up) != 1 || up[0].GetAsDouble() != 1 {
+				t.Errorf("unexpected up %v", up)
+			}
+			failures := metrics["tflcycles_exporter_fetch_failures_total"].GetSum()
+			if !failures.GetIsMonotonic() || len(failures.GetDataPoints()) != 1 || failures.GetDataPoints()[0].GetAsDouble() != 2 {
+				t.Errorf("unexpected failures %v", failures)
+			}
+		})
+	}
+}
+
+func TestNewPusher_Invalid(t *testing.T) {
+	t.Parallel()
+
+	gather := func(context.Context) prometheus.Gatherer {
+		return prometheus.NewRegistry()
+	}
+	tests := []struct {
+		name     string
+		endpoint string
+		protocol string
+	}{
+		{"no scheme", "localhost:4317", ProtocolGRPC},
+		{"unknown protocol", "http://localhost:4318", "http/json"},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			if _, err := NewPusher(context.Background(), slog.Default(), test.endpoint, gather,
+				WithProtocol(test.protocol)); err == nil {
+				t.Error("wanted error")
+			}
+		})
+	}
+}
+
+func TestEndpointURL(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		endpoint string
+		protocol string
+		want     string
+		wantErr  bool
+	}{
+		{"http://localhost:4318", ProtocolHTTP, "http://localhost:4318/v1/traces", false},
+		{"https://collector/", ProtocolHTTP, "https://collector/v1/traces", false},
+		{"http://localhost:4318/custom", ProtocolHTTP, "http://localhost:4318/custom", false},
+		{"http://localhost:4317", ProtocolGRPC, "http://localhost:4317", false},
+		{"localhost:4317", ProtocolGRPC, "", true},
+		{"http://localhost:4318", "http/json", "", true},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.endpoint+" "+test.protocol, func(t *testing.T) {
+			t.Parallel()
+			got, err := endpointURL(test.endpoint, test.protocol, tracesHTTPPath)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("wanted error %v, got %v", test.wantErr, err)
+			}
+			if got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
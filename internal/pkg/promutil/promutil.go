@@ -1,9 +1,14 @@
 package promutil
 
 import (
+	"context"
 	"log/slog"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // HandlerOptsWithLogger returns an OpenMetrics-enabled set of handler options,
@@ -14,3 +19,74 @@ func HandlerOptsWithLogger(logger *slog.Logger) promhttp.HandlerOpts {
 		EnableOpenMetrics: true,
 	}
 }
+
+// WithNativeHistogram configures a histogram to additionally maintain a native
+// histogram, with buckets around 10% wide. The classic buckets are still
+// exposed, and Prometheus only ingests the native histogram instead if
+// scraping native histograms is enabled. Use WithoutNativeHistograms() to
+// expose only the classic buckets.
+func WithNativeHistogram(opts prometheus.HistogramOpts) prometheus.HistogramOpts {
+	opts.NativeHistogramBucketFactor = 1.1
+	opts.NativeHistogramMaxBucketNumber = 100
+	opts.NativeHistogramMinResetDuration = time.Hour
+	return opts
+}
+
+// WithoutNativeHistograms returns a gatherer which removes the native
+// histograms from those maintained with WithNativeHistogram(), leaving the
+// classic buckets. Histograms are created when packages are initialised, so
+// this allows native histograms to be disabled by a flag.
+func WithoutNativeHistograms(g prometheus.Gatherer) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := g.Gather()
+		for _, family := range families {
+			for _, metric := range family.GetMetric() {
+				if h := metric.GetHistogram(); h != nil {
+					stripNative(h)
+				}
+			}
+		}
+		return families, err
+	})
+}
+
+// stripNative removes every field of h particular to native histograms.
+func stripNative(h *dto.Histogram) {
+	h.Schema = nil
+	h.ZeroThreshold = nil
+	h.ZeroCount = nil
+	h.ZeroCountFloat = nil
+	h.NegativeSpan = nil
+	h.NegativeDelta = nil
+	h.NegativeCount = nil
+	h.PositiveSpan = nil
+	h.PositiveDelta = nil
+	h.PositiveCount = nil
+	h.Exemplars = nil
+}
+
+// TraceExemplar returns exemplar labels identifying the span in ctx, so a
+// latency observation can be linked to its trace. It returns nil if the span
+// is not sampled, as the trace will not exist; Timer and ObserveWithTrace()
+// then record the observation without an exemplar.
+func TraceExemplar(ctx context.Context) prometheus.Labels {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.IsSampled() {
+		return nil
+	}
+	return prometheus.Labels{
+		"trace_id": spanContext.TraceID().String(),
+		"span_id":  spanContext.SpanID().String(),
+	}
+}
+
+// ObserveWithTrace records v, with an exemplar identifying the span in ctx if
+// it is sampled.
+func ObserveWithTrace(ctx context.Context, observer prometheus.Observer, v float64) {
+	exemplarObserver, ok := observer.(prometheus.ExemplarObserver)
+	if exemplar := TraceExemplar(ctx); ok && exemplar != nil {
+		exemplarObserver.ObserveWithExemplar(v, exemplar)
+		return
+	}
+	observer.Observe(v)
+}
@@ -0,0 +1,104 @@
+package promutil
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestObserveWithTrace(t *testing.T) {
+	t.Parallel()
+
+	sampled := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{2},
+		TraceFlags: trace.FlagsSampled,
+	})
+	tests := []struct {
+		name         string
+		ctx          context.Context
+		wantExemplar bool
+	}{
+		{
+			name: "no span",
+			ctx:  context.Background(),
+		},
+		{
+			name: "unsampled",
+			ctx:  trace.ContextWithSpanContext(context.Background(), sampled.WithTraceFlags(0)),
+		},
+		{
+			name:         "sampled",
+			ctx:          trace.ContextWithSpanContext(context.Background(), sampled),
+			wantExemplar: true,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			histogram := prometheus.NewHistogram(WithNativeHistogram(prometheus.HistogramOpts{
+				Name:    "test_duration_seconds",
+				Help:    "Test.",
+				Buckets: []float64{1},
+			}))
+			ObserveWithTrace(test.ctx, histogram, .5)
+
+			metric := &dto.Metric{}
+			if err := histogram.Write(metric); err != nil {
+				t.Fatal(err)
+			}
+			h := metric.GetHistogram()
+			if h.GetSampleCount() != 1 {
+				t.Fatalf("wanted 1 observation, got %v", h.GetSampleCount())
+			}
+			if h.GetSchema() == 0 && len(h.PositiveSpan) == 0 {
+				t.Error("no native histogram")
+			}
+			// OpenMetrics exposes the exemplar of the classic bucket.
+			exemplar := h.Bucket[0].GetExemplar()
+			if !test.wantExemplar {
+				if exemplar != nil {
+					t.Errorf("wanted no exemplar, got %v", exemplar)
+				}
+				return
+			}
+			labels := map[string]string{}
+			for _, pair := range exemplar.GetLabel() {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+			if labels["trace_id"] != sampled.TraceID().String() || labels["span_id"] != sampled.SpanID().String() {
+				t.Errorf("wanted exemplar of %v, got %v", sampled, labels)
+			}
+		})
+	}
+}
+
+func TestWithoutNativeHistograms(t *testing.T) {
+	t.Parallel()
+
+	reg := prometheus.NewPedanticRegistry()
+	histogram := prometheus.NewHistogram(WithNativeHistogram(prometheus.HistogramOpts{
+		Name:    "test_duration_seconds",
+		Help:    "Test.",
+		Buckets: []float64{1},
+	}))
+	reg.MustRegister(histogram)
+	histogram.Observe(.5)
+
+	families, err := WithoutNativeHistograms(reg).Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := families[0].GetMetric()[0].GetHistogram()
+	if h.Schema != nil || h.ZeroThreshold != nil || len(h.PositiveSpan) != 0 || len(h.PositiveDelta) != 0 {
+		t.Errorf("native histogram not removed: %v", h)
+	}
+	if len(h.Bucket) != 1 || h.Bucket[0].GetCumulativeCount() != 1 {
+		t.Errorf("wanted classic bucket with 1 observation, got %v", h.Bucket)
+	}
+}
@@ -0,0 +1,381 @@
+// Package recording implements http.RoundTrippers that save upstream responses
+// to a directory, and serve them back. This allows reproducing bad responses
+// after the fact, turning incidents into regression tests, and running the
+// exporter offline.
+//
+// Each exchange is stored as two files sharing a name: <name>.json contains
+// the request URL, response status, headers and timing, and <name>.body the
+// raw response body. Names sort in the order responses were recorded.
+package recording
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	metadataExt = ".json"
+	bodyExt     = ".body"
+)
+
+// Exchange is the metadata of a recorded response.
+type Exchange struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+
+	// Recorded is when the request was made.
+	Recorded time.Time `json:"recorded"`
+
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+
+	// Duration is the time from sending the request to finishing reading
+	// the body.
+	Duration time.Duration `json:"duration"`
+
+	// BodyError is the error encountered reading the body, if any. The body
+	// file contains what was read before it occurred.
+	BodyError string `json:"body_error,omitempty"`
+}
+
+// RecorderOption allows customising the recorder's behaviour during
+// construction with NewRecorder().
+type RecorderOption func(*Recorder)
+
+// WithMaxExchanges sets the number of exchanges to keep, beyond which the
+// oldest are deleted. It defaults to 0, meaning no limit.
+func WithMaxExchanges(n int) RecorderOption {
+	return func(r *Recorder) {
+		r.MaxExchanges = n
+	}
+}
+
+// WithMaxBytes sets the total size of the exchanges to keep, beyond which the
+// oldest are deleted. The latest exchange is always kept. It defaults to 0,
+// meaning no limit.
+func WithMaxBytes(n int64) RecorderOption {
+	return func(r *Recorder) {
+		r.MaxBytes = n
+	}
+}
+
+// Recorder is an http.RoundTripper saving every response it receives to a
+// directory. Responses are read in full before being returned. Requests
+// failing before a response is received are not recorded. Create instances
+// with NewRecorder().
+type Recorder struct {
+	Logger    *slog.Logger
+	Transport http.RoundTripper
+	Dir       string
+
+	MaxExchanges int
+	MaxBytes     int64
+
+	seq atomic.Uint64
+
+	// pruneMu prevents concurrent saves deleting the same exchanges.
+	pruneMu sync.Mutex
+}
+
+// NewRecorder creates a recorder writing to dir, which must exist. Requests
+// are made using transport, or http.DefaultTransport if nil. Exchanges already
+// in dir count towards the limits.
+func NewRecorder(logger *slog.Logger, transport http.RoundTripper, dir string, opts ...RecorderOption) *Recorder {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	r := &Recorder{
+		Logger:    logger,
+		Transport: transport,
+		Dir:       dir,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := r.Transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, bodyErr := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	exchange := Exchange{
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		Recorded:   start.UTC(),
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Duration:   time.Since(start),
+	}
+	if bodyErr != nil {
+		exchange.BodyError = bodyErr.Error()
+	}
+	name := fmt.Sprintf("%v-%06d", start.UTC().Format("20060102T150405.000000000Z"), r.seq.Add(1))
+	if err := r.save(name, exchange, body); err != nil {
+		// Recording is best-effort; the caller still gets its response.
+		r.Logger.ErrorContext(req.Context(), "failed to record response",
+			slog.String("url", exchange.URL),
+			slog.String("error", err.Error()))
+	} else if err := r.prune(); err != nil {
+		r.Logger.ErrorContext(req.Context(), "failed to delete old recordings",
+			slog.String("error", err.Error()))
+	}
+
+	resp.Body = newBody(body, bodyErr)
+	return resp, nil
+}
+
+func (r *Recorder) save(name string, exchange Exchange, body []byte) error {
+	metadata, err := json.MarshalIndent(exchange, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(r.Dir, name+bodyExt), body, 0o644); err != nil {
+		return err
+	}
+	// Written last, so a replayer never sees metadata without a body.
+	return os.WriteFile(filepath.Join(r.Dir, name+metadataExt), metadata, 0o644)
+}
+
+// prune deletes the oldest exchanges until the directory is within the
+// limits, always keeping the latest.
+func (r *Recorder) prune() error {
+	if r.MaxExchanges <= 0 && r.MaxBytes <= 0 {
+		return nil
+	}
+	r.pruneMu.Lock()
+	defer r.pruneMu.Unlock()
+
+	entries, err := os.ReadDir(r.Dir)
+	if err != nil {
+		return err
+	}
+	// Entries are sorted by name, so exchanges are in the order recorded.
+	var names []string
+	sizes := map[string]int64{}
+	var total int64
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if ext != metadataExt && ext != bodyExt {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(entry.Name(), ext)
+		if ext == metadataExt {
+			names = append(names, name)
+		}
+		sizes[name] += info.Size()
+		total += info.Size()
+	}
+	for i, name := range names[:max(len(names)-1, 0)] {
+		if (r.MaxExchanges <= 0 || len(names)-i <= r.MaxExchanges) &&
+			(r.MaxBytes <= 0 || total <= r.MaxBytes) {
+			break
+		}
+		// Metadata first, so a replayer never sees metadata without a body.
+		for _, ext := range []string{metadataExt, bodyExt} {
+			if err := os.Remove(filepath.Join(r.Dir, name+ext)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+		total -= sizes[name]
+	}
+	return nil
+}
+
+// recordedExchange is an Exchange loaded with its body.
+type recordedExchange struct {
+	Exchange
+	body []byte
+}
+
+// route identifies the requests an exchange can be replayed for. The host and
+// query are ignored, so recordings can be replayed against another endpoint,
+// and with another app key.
+type route struct {
+	method string
+	path   string
+}
+
+// Replayer is an http.RoundTripper serving previously recorded responses to
+// requests with the same method and path. Responses for each are returned in
+// the order they were recorded, starting again from the first after the last.
+// Create instances with NewReplayer().
+type Replayer struct {
+
+	// Delay causes each response to be delayed by its recorded duration, or
+	// until the request's context expires. This can be configured using
+	// WithDelay().
+	Delay bool
+
+	exchanges map[route][]recordedExchange
+
+	mu   sync.Mutex
+	next map[route]int
+}
+
+// ReplayerOption allows customising the replayer's behaviour during
+// construction with NewReplayer().
+type ReplayerOption func(*Replayer)
+
+// WithDelay reproduces the recorded latency of each response.
+func WithDelay() ReplayerOption {
+	return func(r *Replayer) {
+		r.Delay = true
+	}
+}
+
+// NewReplayer loads the recordings in dir. It returns an error if there are
+// none.
+func NewReplayer(dir string, opts ...ReplayerOption) (*Replayer, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+metadataExt))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no recordings found in %v", dir)
+	}
+	sort.Strings(paths)
+
+	r := &Replayer{
+		exchanges: make(map[route][]recordedExchange),
+		next:      make(map[route]int),
+	}
+	for _, path := range paths {
+		exchange, err := load(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %v: %w", path, err)
+		}
+		u, err := url.Parse(exchange.URL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse URL of %v: %w", path, err)
+		}
+		key := route{
+			method: exchange.Method,
+			path:   u.Path,
+		}
+		r.exchanges[key] = append(r.exchanges[key], exchange)
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r, nil
+}
+
+func load(path string) (recordedExchange, error) {
+	metadata, err := os.ReadFile(path)
+	if err != nil {
+		return recordedExchange{}, err
+	}
+	exchange := recordedExchange{}
+	if err := json.Unmarshal(metadata, &exchange.Exchange); err != nil {
+		return recordedExchange{}, err
+	}
+	exchange.body, err = os.ReadFile(strings.TrimSuffix(path, metadataExt) + bodyExt)
+	if err != nil {
+		return recordedExchange{}, err
+	}
+	return exchange, nil
+}
+
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := route{
+		method: req.Method,
+		path:   req.URL.Path,
+	}
+	exchanges := r.exchanges[key]
+	if len(exchanges) == 0 {
+		return nil, fmt.Errorf("no recorded responses to %v %v", req.Method, req.URL.Path)
+	}
+	r.mu.Lock()
+	exchange := exchanges[r.next[key]]
+	r.next[key] = (r.next[key] + 1) % len(exchanges)
+	r.mu.Unlock()
+
+	if r.Delay {
+		if err := sleep(req.Context(), exchange.Duration); err != nil {
+			return nil, err
+		}
+	}
+
+	var bodyErr error
+	switch exchange.BodyError {
+	case "":
+	case io.ErrUnexpectedEOF.Error():
+		// Preserve identity, as callers may check for it.
+		bodyErr = io.ErrUnexpectedEOF
+	default:
+		bodyErr = errors.New(exchange.BodyError)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", exchange.StatusCode, http.StatusText(exchange.StatusCode)),
+		StatusCode:    exchange.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        exchange.Header.Clone(),
+		Body:          newBody(exchange.body, bodyErr),
+		ContentLength: -1,
+		Request:       req,
+	}, nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// body is an io.ReadCloser returning b, followed by err if non-nil. This
+// reproduces responses truncated by a connection reset.
+type body struct {
+	r   *bytes.Reader
+	err error
+}
+
+func newBody(b []byte, err error) io.ReadCloser {
+	return body{
+		r:   bytes.NewReader(b),
+		err: err,
+	}
+}
+
+func (b body) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if errors.Is(err, io.EOF) && b.err != nil {
+		return n, b.err
+	}
+	return n, err
+}
+
+func (body) Close() error {
+	return nil
+}
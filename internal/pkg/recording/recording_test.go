@@ -0,0 +1,269 @@
+package recording
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRecordReplay(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte("slow down"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	recorder := NewRecorder(slog.Default(), nil, dir)
+	client := &http.Client{Transport: recorder}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(server.URL + "/BikePoint")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The recorder must not consume the body.
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) == 0 {
+			t.Fatalf("request %v: empty body", i)
+		}
+	}
+
+	replayer, err := NewReplayer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = &http.Client{Transport: replayer}
+	want := []struct {
+		status int
+		header string
+		body   string
+	}{
+		{http.StatusTooManyRequests, "1", "slow down"},
+		{http.StatusOK, "", `[]`},
+		// Replays loop.
+		{http.StatusTooManyRequests, "1", "slow down"},
+	}
+	for i, want := range want {
+		resp, err := client.Get("http://example.com/BikePoint")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != want.status || resp.Header.Get("Retry-After") != want.header ||
+			string(b) != want.body {
+			t.Errorf("response %v: got %v %q %q, want %v %q %q", i, resp.StatusCode,
+				resp.Header.Get("Retry-After"), b, want.status, want.header, want.body)
+		}
+	}
+}
+
+func TestRecordReplayTruncated(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Promise more than we send.
+		w.Header().Set("Content-Length", strconv.Itoa(100))
+		w.Write([]byte(`[{"id": "BikePoints_1"`))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: NewRecorder(slog.Default(), nil, dir)}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(resp.Body); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("wanted %v recording, got %v", io.ErrUnexpectedEOF, err)
+	}
+
+	replayer, err := NewReplayer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = (&http.Client{Transport: replayer}).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("wanted %v replaying, got %v", io.ErrUnexpectedEOF, err)
+	}
+	if string(b) != `[{"id": "BikePoints_1"` {
+		t.Errorf("got partial body %q", b)
+	}
+}
+
+func TestReplayer_Delay(t *testing.T) {
+	t.Parallel()
+
+	replayer := &Replayer{
+		Delay: true,
+		exchanges: map[route][]recordedExchange{
+			{http.MethodGet, "/BikePoint"}: {
+				{
+					Exchange: Exchange{
+						StatusCode: http.StatusOK,
+						Duration:   time.Minute,
+					},
+				},
+			},
+		},
+		next: map[route]int{},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com/BikePoint", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := replayer.RoundTrip(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wanted %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestNewReplayer_Empty(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewReplayer(t.TempDir()); err == nil {
+		t.Error("wanted error for directory without recordings")
+	}
+}
+
+func TestReplayer_Route(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Method + " " + r.URL.Path))
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: NewRecorder(slog.Default(), nil, dir)}
+	for _, path := range []string{"/gbfs.json", "/station_status.json"} {
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	replayer, err := NewReplayer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = &http.Client{Transport: replayer}
+	// The query and host are ignored.
+	resp, err := client.Get("http://example.com/station_status.json?app_key=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "GET /station_status.json"; string(b) != want {
+		t.Errorf("got %q, want %q", b, want)
+	}
+	if _, err := client.Post("http://example.com/gbfs.json", "text/plain", nil); err == nil {
+		t.Error("wanted error for unrecorded method")
+	}
+	if _, err := client.Get("http://example.com/BikePoint"); err == nil {
+		t.Error("wanted error for unrecorded path")
+	}
+}
+
+func TestRecorder_Limits(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	// Closed after the parallel subtests finish.
+	t.Cleanup(server.Close)
+
+	tests := []struct {
+		name string
+		opts []RecorderOption
+		want []string
+	}{
+		{
+			name: "unlimited",
+			want: []string{"/1", "/2", "/3"},
+		},
+		{
+			name: "exchanges",
+			opts: []RecorderOption{WithMaxExchanges(2)},
+			want: []string{"/2", "/3"},
+		},
+		{
+			name: "bytes",
+			// Too small for any exchange, but the latest is kept.
+			opts: []RecorderOption{WithMaxBytes(1)},
+			want: []string{"/3"},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+			client := &http.Client{Transport: NewRecorder(slog.Default(), nil, dir, test.opts...)}
+			for _, path := range []string{"/1", "/2", "/3"} {
+				resp, err := client.Get(server.URL + path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+			}
+
+			replayer, err := NewReplayer(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for key := range replayer.exchanges {
+				got = append(got, key.path)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+			bodies, err := filepath.Glob(filepath.Join(dir, "*"+bodyExt))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(bodies) != len(test.want) {
+				t.Errorf("got %v bodies, want %v", len(bodies), len(test.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,269 @@
+// Package remotewrite pushes metrics to a Prometheus remote-write endpoint,
+// for exporters that Prometheus cannot reach to scrape, such as those behind
+// NAT.
+//
+// Callers enqueue the metrics to send, typically after each background poll,
+// and a separate sender delivers them, retrying failed requests with backoff.
+// The queue is bounded: if it fills while the endpoint is unavailable, the
+// oldest samples are dropped, so memory use does not grow however long an
+// outage lasts.
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/backoffutil"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/gebn/go-stamp/v2"
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	samples = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tflcycles_exporter_remote_write_samples_total",
+		Help: "The number of samples gathered for remote-write, by whether they were sent, rejected by the endpoint, or dropped from a full queue.",
+	}, []string{"result"})
+	queuedSamples = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tflcycles_exporter_remote_write_queued_samples",
+		Help: "The number of samples waiting to be sent, excluding any being sent.",
+	})
+	requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tflcycles_exporter_remote_write_requests_total",
+		Help: "The number of remote-write requests, by result. Retries are counted separately.",
+	}, []string{"result"})
+)
+
+func init() {
+	for _, result := range []string{"sent", "rejected", "dropped"} {
+		samples.WithLabelValues(result)
+	}
+	for _, result := range []string{"success", "retry", "failure"} {
+		requests.WithLabelValues(result)
+	}
+}
+
+// WriterOption customises a Writer.
+type WriterOption func(*Writer)
+
+// WithTimeout bounds each attempt to send a request. It defaults to 1m.
+func WithTimeout(timeout time.Duration) WriterOption {
+	return func(w *Writer) {
+		w.Timeout = timeout
+	}
+}
+
+// WithExternalLabels adds labels to every series, such as to identify the
+// exporter in place of the job and instance labels Prometheus would add when
+// scraping. Labels already on a series take precedence.
+func WithExternalLabels(labels map[string]string) WriterOption {
+	return func(w *Writer) {
+		w.ExternalLabels = labels
+	}
+}
+
+// WithMaxQueuedSamples sets the number of samples that can wait to be sent
+// before the oldest are dropped. It defaults to 100,000, which is half an
+// hour of TfL's stations at a 1m interval.
+func WithMaxQueuedSamples(n int) WriterOption {
+	return func(w *Writer) {
+		w.MaxQueuedSamples = n
+	}
+}
+
+// Writer writes enqueued metrics to a remote-write endpoint. Create instances
+// with NewWriter().
+type Writer struct {
+	Logger     *slog.Logger
+	HTTPClient *http.Client
+
+	// URL is the remote-write endpoint. Basic auth credentials can be
+	// included in the URL.
+	URL string
+
+	Timeout          time.Duration
+	ExternalLabels   map[string]string
+	MaxQueuedSamples int
+
+	// backOff returns the policy for retrying a request. It is overridden
+	// in tests.
+	backOff func() backoff.BackOff
+
+	mu     sync.Mutex
+	queue  [][]series // batches, oldest first
+	queued int        // samples in queue
+	wake   chan struct{}
+}
+
+// NewWriter creates a writer sending to url. Call Run() to start writing, and
+// Enqueue() to add metrics.
+func NewWriter(logger *slog.Logger, httpClient *http.Client, url string, opts ...WriterOption) *Writer {
+	w := &Writer{
+		Logger:           logger,
+		HTTPClient:       httpClient,
+		URL:              url,
+		Timeout:          time.Minute,
+		MaxQueuedSamples: 100_000,
+		backOff: func() backoff.BackOff {
+			b := backoff.NewExponentialBackOff()
+			b.MaxInterval = 30 * time.Second
+			// Recoverable errors are retried until the context ends, as by
+			// Prometheus; the queue bounds what builds up behind them.
+			b.MaxElapsedTime = 0
+			return b
+		},
+		wake: make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+// Run sends enqueued metrics until the context is cancelled. Samples still
+// queued are then discarded.
+func (w *Writer) Run(ctx context.Context) {
+	w.send(ctx)
+}
+
+// Enqueue gathers metrics to be sent, stamping every sample with t. It does
+// not block on sending.
+func (w *Writer) Enqueue(ctx context.Context, g prometheus.Gatherer, t time.Time) {
+	families, err := g.Gather()
+	if err != nil {
+		// Partial results are still worth writing.
+		w.Logger.WarnContext(ctx, "failed to gather metrics for remote-write",
+			slog.String("error", err.Error()))
+	}
+	w.enqueue(toSeries(families, t.UnixMilli(), w.ExternalLabels))
+}
+
+// enqueue adds a batch to the queue, dropping the oldest batches if it would
+// exceed the maximum size.
+func (w *Writer) enqueue(batch []series) {
+	if len(batch) == 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.queue = append(w.queue, batch)
+	w.queued += len(batch)
+	dropped := 0
+	// Always keep the newest batch, even if it alone exceeds the limit.
+	for w.queued > w.MaxQueuedSamples && len(w.queue) > 1 {
+		dropped += len(w.queue[0])
+		w.queued -= len(w.queue[0])
+		w.queue[0] = nil
+		w.queue = w.queue[1:]
+	}
+	if dropped > 0 {
+		samples.WithLabelValues("dropped").Add(float64(dropped))
+		w.Logger.Warn("remote-write queue full, dropped oldest samples",
+			slog.Int("samples", dropped))
+	}
+	queuedSamples.Set(float64(w.queued))
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dequeue removes and returns the oldest batch, or nil if the queue is empty.
+func (w *Writer) dequeue() []series {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.queue) == 0 {
+		return nil
+	}
+	batch := w.queue[0]
+	w.queue[0] = nil
+	w.queue = w.queue[1:]
+	w.queued -= len(batch)
+	queuedSamples.Set(float64(w.queued))
+	return batch
+}
+
+// send writes batches as they are queued, until the context is cancelled.
+func (w *Writer) send(ctx context.Context) {
+	for {
+		for batch := w.dequeue(); batch != nil; batch = w.dequeue() {
+			if err := w.write(ctx, batch); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				samples.WithLabelValues("rejected").Add(float64(len(batch)))
+				w.Logger.ErrorContext(ctx, "remote-write endpoint rejected samples",
+					slog.Int("samples", len(batch)),
+					slog.String("error", err.Error()))
+				continue
+			}
+			samples.WithLabelValues("sent").Add(float64(len(batch)))
+		}
+		select {
+		case <-w.wake:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// write sends a batch, retrying on network errors, 429s and 5xx responses.
+// It returns an error if the endpoint rejected the batch, or the context was
+// cancelled.
+func (w *Writer) write(ctx context.Context, batch []series) error {
+	body := snappy.Encode(nil, appendWriteRequest(nil, batch))
+	err := backoff.RetryNotify(
+		func() error {
+			ctx, cancel := context.WithTimeout(ctx, w.Timeout)
+			defer cancel()
+
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+			if err != nil {
+				return backoff.Permanent(err)
+			}
+			req.Header.Set("Content-Encoding", "snappy")
+			req.Header.Set("Content-Type", "application/x-protobuf")
+			req.Header.Set("User-Agent", "tflcycles_exporter/"+stamp.Version)
+			req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+			resp, err := w.HTTPClient.Do(req)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			// Receivers explain rejections in the body.
+			message, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+
+			switch {
+			case resp.StatusCode >= 200 && resp.StatusCode < 300:
+				return nil
+			case resp.StatusCode == http.StatusTooManyRequests,
+				resp.StatusCode >= http.StatusInternalServerError:
+				return fmt.Errorf("got HTTP %v: %s", resp.StatusCode, bytes.TrimSpace(message))
+			}
+			return backoff.Permanent(fmt.Errorf("got HTTP %v: %s", resp.StatusCode, bytes.TrimSpace(message)))
+		},
+		backoffutil.WithContext(w.backOff(), ctx),
+		func(err error, wait time.Duration) {
+			requests.WithLabelValues("retry").Inc()
+			w.Logger.WarnContext(ctx, "remote-write failed, retrying",
+				slog.String("error", err.Error()),
+				slog.Duration("wait", wait))
+		},
+	)
+	if err != nil {
+		requests.WithLabelValues("failure").Inc()
+		return err
+	}
+	requests.WithLabelValues("success").Inc()
+	return nil
+}
@@ -0,0 +1,416 @@
+package remotewrite
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// receiver is a fake remote-write endpoint. Responses are taken from
+// statuses in turn, followed by 204s. Accepted samples are recorded in
+// text form, e.g. `up{job="a"} 1 @1000`.
+type receiver struct {
+	*httptest.Server
+	t *testing.T
+
+	mu       sync.Mutex
+	statuses []int
+	attempts int
+	samples  []string
+	received chan struct{}
+}
+
+func newReceiver(t *testing.T, statuses ...int) *receiver {
+	r := &receiver{
+		t:        t,
+		statuses: statuses,
+		received: make(chan struct{}, 100),
+	}
+	r.Server = httptest.NewServer(r)
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	for header, want := range map[string]string{
+		"Content-Encoding":                  "snappy",
+		"Content-Type":                      "application/x-protobuf",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+	} {
+		if got := req.Header.Get(header); got != want {
+			r.t.Errorf("wanted %v %q, got %q", header, want, got)
+		}
+	}
+	compressed, err := io.ReadAll(req.Body)
+	if err != nil {
+		r.t.Error(err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.attempts++
+	if len(r.statuses) > 0 {
+		status := r.statuses[0]
+		r.statuses = r.statuses[1:]
+		if status >= 300 {
+			http.Error(w, "unavailable", status)
+			return
+		}
+	}
+	body, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		r.t.Error(err)
+		return
+	}
+	samples, err := decodeWriteRequest(body)
+	if err != nil {
+		r.t.Error(err)
+		return
+	}
+	r.samples = append(r.samples, samples...)
+	w.WriteHeader(http.StatusNoContent)
+	r.received <- struct{}{}
+}
+
+// decodeWriteRequest parses a WriteRequest into text samples.
+func decodeWriteRequest(b []byte) ([]string, error) {
+	var samples []string
+	err := consumeFields(b, func(num protowire.Number, v []byte) error {
+		if num != writeRequestTimeseries {
+			return fmt.Errorf("unexpected WriteRequest field %v", num)
+		}
+		var name string
+		var labels []string
+		var sample string
+		err := consumeFields(v, func(num protowire.Number, v []byte) error {
+			switch num {
+			case timeSeriesLabels:
+				var l label
+				if err := consumeFields(v, func(num protowire.Number, v []byte) error {
+					if num == labelName {
+						l.name = string(v)
+					} else {
+						l.value = string(v)
+					}
+					return nil
+				}); err != nil {
+					return err
+				}
+				if l.name == "__name__" {
+					name = l.value
+				} else {
+					labels = append(labels, fmt.Sprintf("%v=%q", l.name, l.value))
+				}
+			case timeSeriesSamples:
+				value, timestamp, err := decodeSample(v)
+				if err != nil {
+					return err
+				}
+				sample = fmt.Sprintf("%v @%v", value, timestamp)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		samples = append(samples, fmt.Sprintf("%v{%v} %v", name, strings.Join(labels, ","), sample))
+		return nil
+	})
+	return samples, err
+}
+
+// decodeSample parses a Sample into its value and timestamp.
+func decodeSample(b []byte) (float64, int64, error) {
+	var value float64
+	var timestamp int64
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return 0, 0, protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == sampleValue && typ == protowire.Fixed64Type:
+			bits, n := protowire.ConsumeFixed64(b)
+			if n < 0 {
+				return 0, 0, protowire.ParseError(n)
+			}
+			value = math.Float64frombits(bits)
+			b = b[n:]
+		case num == sampleTimestamp && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return 0, 0, protowire.ParseError(n)
+			}
+			timestamp = int64(v)
+			b = b[n:]
+		default:
+			return 0, 0, fmt.Errorf("unexpected Sample field %v", num)
+		}
+	}
+	return value, timestamp, nil
+}
+
+// consumeFields calls fn with the number and value of each length-delimited
+// field in b.
+func consumeFields(b []byte, fn func(protowire.Number, []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 || typ != protowire.BytesType {
+			return fmt.Errorf("unexpected tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if err := fn(num, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// accepted returns the samples received.
+func (r *receiver) accepted() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.samples...)
+}
+
+func newWriter(url string, opts ...WriterOption) *Writer {
+	w := NewWriter(slog.Default(), http.DefaultClient, url, opts...)
+	w.backOff = func() backoff.BackOff {
+		return &backoff.ZeroBackOff{}
+	}
+	return w
+}
+
+func TestWriter_Run(t *testing.T) {
+	t.Parallel()
+
+	r := newReceiver(t)
+	reg := prometheus.NewRegistry()
+	bicycles := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tflcycles_bicycles_available",
+		Help: "Test gauge.",
+	}, []string{"station", "system"})
+	bicycles.WithLabelValues("Foo", "tfl").Set(3)
+	up := prometheus.NewUntypedFunc(prometheus.UntypedOpts{
+		Name:        "tflcycles_up",
+		Help:        "Test untyped.",
+		ConstLabels: prometheus.Labels{"system": "tfl"},
+	}, func() float64 {
+		return 1
+	})
+	reg.MustRegister(bicycles, up)
+	w := newWriter(r.URL,
+		WithExternalLabels(map[string]string{"instance": "pi", "system": "ignored"}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.Run(ctx)
+	}()
+	w.Enqueue(ctx, reg, time.UnixMilli(1709510400000))
+	<-r.received
+	cancel()
+	<-done
+
+	want := []string{
+		`tflcycles_bicycles_available{instance="pi",station="Foo",system="tfl"} 3 @1709510400000`,
+		`tflcycles_up{instance="pi",system="tfl"} 1 @1709510400000`,
+	}
+	if got := r.accepted(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestWriter_write(t *testing.T) {
+	t.Parallel()
+
+	batch := []series{
+		{labels: []label{{"__name__", "tflcycles_up"}}, value: 1, timestamp: 1000},
+	}
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantAttempts int
+		wantErr      bool
+	}{
+		{
+			name:         "success",
+			wantAttempts: 1,
+		},
+		{
+			name:         "retried",
+			statuses:     []int{http.StatusServiceUnavailable, http.StatusTooManyRequests},
+			wantAttempts: 3,
+		},
+		{
+			name:         "rejected",
+			statuses:     []int{http.StatusBadRequest},
+			wantAttempts: 1,
+			wantErr:      true,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			r := newReceiver(t, test.statuses...)
+			w := newWriter(r.URL)
+			err := w.write(context.Background(), batch)
+			if (err != nil) != test.wantErr {
+				t.Errorf("wanted error %v, got %v", test.wantErr, err)
+			}
+			if r.attempts != test.wantAttempts {
+				t.Errorf("wanted %v attempts, got %v", test.wantAttempts, r.attempts)
+			}
+			if !test.wantErr && !reflect.DeepEqual(r.accepted(), []string{"tflcycles_up{} 1 @1000"}) {
+				t.Errorf("unexpected samples %v", r.accepted())
+			}
+		})
+	}
+}
+
+func TestWriter_write_Cancelled(t *testing.T) {
+	t.Parallel()
+
+	// Fails forever, so only cancellation stops retries.
+	r := newReceiver(t, 500, 500, 500, 500, 500, 500, 500, 500, 500, 500,
+		500, 500, 500, 500, 500, 500, 500, 500, 500, 500)
+	w := newWriter(r.URL)
+	w.backOff = func() backoff.BackOff {
+		return backoff.NewConstantBackOff(10 * time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := w.write(ctx, []series{{labels: []label{{"__name__", "x"}}}}); err == nil {
+		t.Error("wanted error")
+	}
+}
+
+func TestWriter_enqueue(t *testing.T) {
+	t.Parallel()
+
+	w := newWriter("", WithMaxQueuedSamples(5))
+	batch := func(name string, n int) []series {
+		var b []series
+		for range n {
+			b = append(b, series{labels: []label{{"__name__", name}}})
+		}
+		return b
+	}
+	names := func() []string {
+		var names []string
+		for _, batch := range w.queue {
+			names = append(names, batch[0].labels[0].value)
+		}
+		return names
+	}
+
+	w.enqueue(batch("a", 2))
+	w.enqueue(batch("b", 2))
+	w.enqueue(batch("c", 2))
+	if got, want := names(), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The newest batch is kept even if it alone is too large.
+	w.enqueue(batch("d", 6))
+	if got, want := names(), []string{"d"}; !reflect.DeepEqual(got, want) || w.queued != 6 {
+		t.Errorf("got %v (%v samples), want %v", got, w.queued, want)
+	}
+	if b := w.dequeue(); len(b) != 6 || w.queued != 0 {
+		t.Errorf("unexpected dequeue of %v samples, %v remaining", len(b), w.queued)
+	}
+	if b := w.dequeue(); b != nil {
+		t.Errorf("wanted empty queue, got %v", b)
+	}
+}
+
+func TestToSeries(t *testing.T) {
+	t.Parallel()
+
+	families := []*dto.MetricFamily{
+		{
+			Name: proto.String("fetch_duration_seconds"),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label: []*dto.LabelPair{
+						{Name: proto.String("system"), Value: proto.String("tfl")},
+					},
+					Histogram: &dto.Histogram{
+						SampleCount: proto.Uint64(3),
+						SampleSum:   proto.Float64(2.5),
+						Bucket: []*dto.Bucket{
+							{UpperBound: proto.Float64(0.5), CumulativeCount: proto.Uint64(1)},
+							{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(2)},
+						},
+					},
+				},
+			},
+		},
+		{
+			Name: proto.String("tflcycles_docks"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label: []*dto.LabelPair{
+						{Name: proto.String("station"), Value: proto.String("Foo")},
+					},
+					Gauge:       &dto.Gauge{Value: proto.Float64(5)},
+					TimestampMs: proto.Int64(500),
+				},
+			},
+		},
+	}
+	var got []string
+	for _, s := range toSeries(families, 1000, map[string]string{"instance": "pi"}) {
+		var labels []string
+		for _, l := range s.labels {
+			labels = append(labels, l.name+"="+l.value)
+		}
+		got = append(got, fmt.Sprintf("%v %v @%v", strings.Join(labels, ","), s.value, s.timestamp))
+	}
+	want := []string{
+		"__name__=fetch_duration_seconds_bucket,instance=pi,le=0.5,system=tfl 1 @1000",
+		"__name__=fetch_duration_seconds_bucket,instance=pi,le=1,system=tfl 2 @1000",
+		"__name__=fetch_duration_seconds_bucket,instance=pi,le=+Inf,system=tfl 3 @1000",
+		"__name__=fetch_duration_seconds_sum,instance=pi,system=tfl 2.5 @1000",
+		"__name__=fetch_duration_seconds_count,instance=pi,system=tfl 3 @1000",
+		// Its own timestamp is ignored.
+		"__name__=tflcycles_docks,instance=pi,station=Foo 5 @1000",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got:\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	for _, s := range toSeries(families, 1000, nil) {
+		if !sort.SliceIsSorted(s.labels, func(i, j int) bool {
+			return s.labels[i].name < s.labels[j].name
+		}) {
+			t.Errorf("labels not sorted: %v", s.labels)
+		}
+	}
+}
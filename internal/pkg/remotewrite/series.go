@@ -0,0 +1,141 @@
+package remotewrite
+
+import (
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// label is a name-value pair identifying a series.
+type label struct {
+	name  string
+	value string
+}
+
+// series is a sample of a time series, in remote-write's data model. Labels
+// are sorted by name, and include __name__.
+type series struct {
+	labels    []label
+	value     float64
+	timestamp int64 // milliseconds
+}
+
+// toSeries flattens metric families into series, as Prometheus would on
+// scraping their exposition. Every sample is given timestampMs, even if it has
+// its own: receivers permanently reject samples older than their head block,
+// as upstream modification times can be. externalLabels are added to every
+// series, unless it already has the label.
+func toSeries(families []*dto.MetricFamily, timestampMs int64, externalLabels map[string]string) []series {
+	var out []series
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			add := func(suffix string, value float64, extra ...label) {
+				labels := make([]label, 0, len(metric.Label)+len(extra)+len(externalLabels)+1)
+				labels = append(labels, label{"__name__", family.GetName() + suffix})
+				for _, pair := range metric.Label {
+					labels = append(labels, label{pair.GetName(), pair.GetValue()})
+				}
+				labels = append(labels, extra...)
+				for name, value := range externalLabels {
+					if !slices.ContainsFunc(labels, func(l label) bool { return l.name == name }) {
+						labels = append(labels, label{name, value})
+					}
+				}
+				slices.SortFunc(labels, func(a, b label) int {
+					return strings.Compare(a.name, b.name)
+				})
+				out = append(out, series{
+					labels:    labels,
+					value:     value,
+					timestamp: timestampMs,
+				})
+			}
+
+			switch family.GetType() {
+			case dto.MetricType_GAUGE:
+				add("", metric.GetGauge().GetValue())
+			case dto.MetricType_COUNTER:
+				add("", metric.GetCounter().GetValue())
+			case dto.MetricType_UNTYPED:
+				add("", metric.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				summary := metric.GetSummary()
+				for _, quantile := range summary.Quantile {
+					add("", quantile.GetValue(), label{"quantile", formatFloat(quantile.GetQuantile())})
+				}
+				add("_sum", summary.GetSampleSum())
+				add("_count", float64(summary.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				histogram := metric.GetHistogram()
+				for _, bucket := range histogram.Bucket {
+					add("_bucket", float64(bucket.GetCumulativeCount()), label{"le", formatFloat(bucket.GetUpperBound())})
+				}
+				add("_bucket", float64(histogram.GetSampleCount()), label{"le", "+Inf"})
+				add("_sum", histogram.GetSampleSum())
+				add("_count", float64(histogram.GetSampleCount()))
+			}
+		}
+	}
+	return out
+}
+
+// formatFloat formats a quantile or bucket bound as Prometheus does.
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Field numbers of the remote-write protobuf messages, which are small
+// enough that we encode them directly, rather than importing Prometheus.
+const (
+	writeRequestTimeseries = 1
+
+	timeSeriesLabels  = 1
+	timeSeriesSamples = 2
+
+	labelName  = 1
+	labelValue = 2
+
+	sampleValue     = 1
+	sampleTimestamp = 2
+)
+
+// appendWriteRequest appends a prometheus.WriteRequest containing the series
+// to b.
+func appendWriteRequest(b []byte, ss []series) []byte {
+	var scratch []byte
+	for _, s := range ss {
+		scratch = appendTimeSeries(scratch[:0], s)
+		b = protowire.AppendTag(b, writeRequestTimeseries, protowire.BytesType)
+		b = protowire.AppendBytes(b, scratch)
+	}
+	return b
+}
+
+func appendTimeSeries(b []byte, s series) []byte {
+	for _, l := range s.labels {
+		b = protowire.AppendTag(b, timeSeriesLabels, protowire.BytesType)
+		b = protowire.AppendVarint(b, uint64(
+			protowire.SizeTag(labelName)+protowire.SizeBytes(len(l.name))+
+				protowire.SizeTag(labelValue)+protowire.SizeBytes(len(l.value))))
+		b = protowire.AppendTag(b, labelName, protowire.BytesType)
+		b = protowire.AppendString(b, l.name)
+		b = protowire.AppendTag(b, labelValue, protowire.BytesType)
+		b = protowire.AppendString(b, l.value)
+	}
+	b = protowire.AppendTag(b, timeSeriesSamples, protowire.BytesType)
+	b = protowire.AppendVarint(b, uint64(
+		protowire.SizeTag(sampleValue)+protowire.SizeFixed64()+
+			protowire.SizeTag(sampleTimestamp)+protowire.SizeVarint(uint64(s.timestamp))))
+	b = protowire.AppendTag(b, sampleValue, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, math.Float64bits(s.value))
+	b = protowire.AppendTag(b, sampleTimestamp, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(s.timestamp))
+	return b
+}
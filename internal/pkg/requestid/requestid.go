@@ -0,0 +1,102 @@
+// Package requestid assigns each HTTP request an ID, which is added to every
+// log line written with the request's context. This allows the warnings of
+// individual fetch attempts to be correlated with the scrape that caused
+// them.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+)
+
+// Header is the request header from which an ID is adopted, e.g. if set by a
+// reverse proxy, and the response header the ID is returned in.
+const Header = "X-Request-Id"
+
+// maxLength is the longest ID adopted from a request. Longer IDs are replaced,
+// so clients cannot bloat every log line.
+const maxLength = 64
+
+// LogKey is the key of the attribute added to log records.
+const LogKey = "request_id"
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying id.
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the ID carried by ctx, if any.
+func FromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(contextKey{}).(string)
+	return id, ok
+}
+
+// Wrap assigns every request passed to h an ID. The ID in the request's
+// X-Request-Id header is used if it is valid, otherwise a random one is
+// generated. The ID is returned in the response's X-Request-Id header.
+func Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(Header)
+		if !valid(id) {
+			id = generate()
+		}
+		w.Header().Set(Header, id)
+		h.ServeHTTP(w, r.WithContext(NewContext(r.Context(), id)))
+	})
+}
+
+// valid returns whether id is short, and consists only of printable ASCII
+// other than spaces, so is safe to log and echo.
+func valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// generate returns a random 16-character hex ID.
+func generate() string {
+	b := make([]byte, 8)
+	// This never returns an error.
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// LogHandler adds the ID in each record's context to the record, as
+// request_id. Create instances with NewLogHandler().
+type LogHandler struct {
+	slog.Handler
+}
+
+// NewLogHandler wraps h, so records logged with a context carrying an ID
+// include it.
+func NewLogHandler(h slog.Handler) *LogHandler {
+	return &LogHandler{
+		Handler: h,
+	}
+}
+
+func (h *LogHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id, ok := FromContext(ctx); ok {
+		r.AddAttrs(slog.String(LogKey, id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *LogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return NewLogHandler(h.Handler.WithAttrs(attrs))
+}
+
+func (h *LogHandler) WithGroup(name string) slog.Handler {
+	return NewLogHandler(h.Handler.WithGroup(name))
+}
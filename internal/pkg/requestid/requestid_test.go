@@ -0,0 +1,97 @@
+package requestid
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWrap(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		header string
+		want   string // empty if a new ID should be generated
+	}{
+		{
+			name: "generated",
+		},
+		{
+			name:   "adopted",
+			header: "abc-123",
+			want:   "abc-123",
+		},
+		{
+			name:   "too long",
+			header: strings.Repeat("a", maxLength+1),
+		},
+		{
+			name:   "space",
+			header: "abc 123",
+		},
+		{
+			name:   "non-ascii",
+			header: "abcé",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			var got string
+			h := Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got, _ = FromContext(r.Context())
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/stations", nil)
+			if test.header != "" {
+				req.Header.Set(Header, test.header)
+			}
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			if test.want != "" && got != test.want {
+				t.Errorf("got ID %v, want %v", got, test.want)
+			}
+			if test.want == "" && (len(got) != 16 || got == test.header) {
+				t.Errorf("wanted generated ID, got %v", got)
+			}
+			if header := rr.Header().Get(Header); header != got {
+				t.Errorf("wanted %v response header %v, got %v", Header, got, header)
+			}
+		})
+	}
+}
+
+func TestLogHandler(t *testing.T) {
+	t.Parallel()
+
+	buf := bytes.Buffer{}
+	logger := slog.New(NewLogHandler(slog.NewJSONHandler(&buf, nil))).
+		With(slog.String("component", "test"))
+
+	logger.InfoContext(NewContext(context.Background(), "abc"), "with")
+	logger.InfoContext(context.Background(), "without")
+	logger.Info("no context")
+
+	want := []string{"abc", "", ""}
+	for i, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		record := map[string]any{}
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatal(err)
+		}
+		id, _ := record[LogKey].(string)
+		if id != want[i] {
+			t.Errorf("record %v: wanted %v %q, got %q", i, LogKey, want[i], id)
+		}
+		if record["component"] != "test" {
+			t.Errorf("record %v: lost attributes: %s", i, line)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+// Package validate implements sanity checks on station availabilities before
+// they are exported, so a truncated or corrupt upstream response does not
+// masquerade as real data.
+package validate
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Rule identifies a check.
+type Rule string
+
+const (
+	// RuleMinStations requires a snapshot to contain at least
+	// Config.MinStations stations, after any have been dropped.
+	RuleMinStations Rule = "min_stations"
+
+	// RuleNonNegative requires every count of a station to be at least 0.
+	RuleNonNegative Rule = "non_negative"
+
+	// RuleConsistent requires a station's available docks and bikes not to
+	// exceed its total docks.
+	RuleConsistent Rule = "consistent"
+
+	// RuleDuplicateID requires station IDs to be unique. The first station
+	// with a given ID is not considered a violation.
+	RuleDuplicateID Rule = "duplicate_id"
+)
+
+// Policy is the action to take when a rule is violated.
+type Policy string
+
+const (
+	// PolicyIgnore disables the rule, as if it had no policy.
+	PolicyIgnore Policy = "ignore"
+
+	// PolicyDrop removes the offending station. It cannot be used with
+	// RuleMinStations.
+	PolicyDrop Policy = "drop"
+
+	// PolicyFail fails the fetch.
+	PolicyFail Policy = "fail"
+
+	// PolicyLastGood replaces the snapshot with the last one to pass
+	// validation. If there is none, or it is older than
+	// Config.LastGoodMaxAge, the fetch fails.
+	PolicyLastGood Policy = "last_good"
+)
+
+var (
+	violations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tflcycles_exporter_validation_violations_total",
+		Help: "The number of times a snapshot or station failed a validation rule.",
+	}, []string{"system", "rule"})
+	servingLastGood = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tflcycles_exporter_validation_serving_last_good",
+		Help: "1 if the latest snapshot of the system failed validation and the last good one was served instead, 0 otherwise.",
+	}, []string{"system"})
+)
+
+// Config determines which rules are applied, and how violations are handled.
+type Config struct {
+
+	// MinStations is the minimum number of stations a snapshot must contain.
+	// RuleMinStations is not applied if this is 0.
+	MinStations int `yaml:"min_stations"`
+
+	// Policies contains the policy for each rule. Rules without a policy, or
+	// with PolicyIgnore, are not applied.
+	Policies map[Rule]Policy `yaml:"policies"`
+
+	// LastGoodMaxAge is the age beyond which the last good snapshot is no
+	// longer served by PolicyLastGood, and the fetch fails instead.
+	LastGoodMaxAge time.Duration `yaml:"last_good_max_age"`
+}
+
+// DefaultConfig returns a configuration that applies no rules, so snapshots
+// are exported as received. The last good snapshot is served for up to 10
+// minutes if a rule is configured with PolicyLastGood.
+func DefaultConfig() Config {
+	return Config{
+		LastGoodMaxAge: 10 * time.Minute,
+	}
+}
+
+// Validate returns an error if the configuration is invalid.
+func (c Config) Validate() error {
+	if c.MinStations < 0 {
+		return fmt.Errorf("min_stations must not be negative, got %v", c.MinStations)
+	}
+	if c.LastGoodMaxAge <= 0 {
+		return fmt.Errorf("last_good_max_age must be positive, got %v", c.LastGoodMaxAge)
+	}
+	for rule, policy := range c.Policies {
+		switch rule {
+		case RuleDuplicateID, RuleNonNegative, RuleConsistent, RuleMinStations:
+		default:
+			return fmt.Errorf("unknown rule %q", rule)
+		}
+		switch policy {
+		case PolicyDrop:
+			if rule == RuleMinStations {
+				return fmt.Errorf("policy %q cannot be used with rule %q", policy, rule)
+			}
+		case PolicyIgnore, PolicyFail, PolicyLastGood:
+		default:
+			return fmt.Errorf("unknown policy %q for rule %q", policy, rule)
+		}
+	}
+	return nil
+}
+
+// Validator applies rules to snapshots, remembering the last good snapshot of
+// each system. It is safe for concurrent use. Create instances with New().
+type Validator struct {
+	Config
+
+	now func() time.Time
+
+	mu       sync.Mutex
+	lastGood map[string]lastGood
+}
+
+// lastGood is the last snapshot of a system to pass validation.
+type lastGood struct {
+	stationAvailabilities []bikepoint.StationAvailability
+	time                  time.Time
+}
+
+// New creates a validator. The config must be valid.
+func New(config Config) *Validator {
+	return &Validator{
+		Config:   config,
+		now:      time.Now,
+		lastGood: make(map[string]lastGood),
+	}
+}
+
+// Validate checks a system's snapshot, returning the stations to export. The
+// input is not modified, and the result must not be, as it may be returned
+// again as the last good snapshot. If that happens, stale is true. Errors are
+// classed as bikepoint.ClassValidation. The snapshot must be of the whole
+// system, as the last good snapshot and minimum number of stations are
+// tracked per system.
+func (v *Validator) Validate(system string, stationAvailabilities []bikepoint.StationAvailability) (result []bikepoint.StationAvailability, stale bool, err error) {
+	// The most severe policy triggered, and the violation that triggered it.
+	var action Policy
+	var reason string
+	violated := func(rule Rule, detail string) (dropped bool) {
+		violations.WithLabelValues(system, string(rule)).Inc()
+		policy := v.Policies[rule]
+		if severity(policy) > severity(action) {
+			action = policy
+			reason = fmt.Sprintf("%v: %v", rule, detail)
+		}
+		return policy == PolicyDrop
+	}
+
+	result = v.apply(stationAvailabilities, violated)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := v.now()
+	switch action {
+	case PolicyFail:
+		servingLastGood.WithLabelValues(system).Set(0)
+		return nil, false, newError(reason)
+	case PolicyLastGood:
+		previous, ok := v.lastGood[system]
+		if !ok {
+			servingLastGood.WithLabelValues(system).Set(0)
+			return nil, false, newError(reason + " (no previous snapshot)")
+		}
+		if age := now.Sub(previous.time); age > v.LastGoodMaxAge {
+			servingLastGood.WithLabelValues(system).Set(0)
+			return nil, false, newError(fmt.Sprintf("%v (previous snapshot is %v old)",
+				reason, age.Round(time.Second)))
+		}
+		servingLastGood.WithLabelValues(system).Set(1)
+		return previous.stationAvailabilities, true, nil
+	}
+	servingLastGood.WithLabelValues(system).Set(0)
+	v.lastGood[system] = lastGood{
+		stationAvailabilities: result,
+		time:                  now,
+	}
+	return result, false, nil
+}
+
+// Violation is a failure of a rule, found by Check().
+type Violation struct {
+	Rule Rule
+
+	// Policy is the action Validate() would take.
+	Policy Policy
+
+	// Detail identifies the station, or explains the failure for
+	// RuleMinStations.
+	Detail string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%v (%v): %v", v.Rule, v.Policy, v.Detail)
+}
+
+// Check returns every violation Validate() would find in a snapshot, without
+// acting on them or updating metrics. This allows reporting problems with a
+// snapshot, rather than only the most severe.
+func (c Config) Check(stationAvailabilities []bikepoint.StationAvailability) []Violation {
+	var found []Violation
+	c.apply(stationAvailabilities, func(rule Rule, detail string) bool {
+		found = append(found, Violation{
+			Rule:   rule,
+			Policy: c.Policies[rule],
+			Detail: detail,
+		})
+		return c.Policies[rule] == PolicyDrop
+	})
+	return found
+}
+
+// apply checks each rule, calling violated for every failure. Stations for
+// which violated returns true are dropped from the result.
+func (c Config) apply(stationAvailabilities []bikepoint.StationAvailability, violated func(rule Rule, detail string) (dropped bool)) []bikepoint.StationAvailability {
+	result := make([]bikepoint.StationAvailability, 0, len(stationAvailabilities))
+	ids := make(map[string]struct{}, len(stationAvailabilities))
+	for _, sa := range stationAvailabilities {
+		if c.applies(RuleDuplicateID) {
+			if _, ok := ids[sa.Station.ID]; ok {
+				if violated(RuleDuplicateID, sa.Station.ID) {
+					continue
+				}
+			}
+			ids[sa.Station.ID] = struct{}{}
+		}
+		if c.applies(RuleNonNegative) && isNegative(sa) {
+			if violated(RuleNonNegative, sa.Station.ID) {
+				continue
+			}
+		}
+		if c.applies(RuleConsistent) && !isConsistent(sa) {
+			if violated(RuleConsistent, sa.Station.ID) {
+				continue
+			}
+		}
+		result = append(result, sa)
+	}
+	if c.applies(RuleMinStations) && len(result) < c.MinStations {
+		violated(RuleMinStations, fmt.Sprintf("got %v stations, wanted at least %v",
+			len(result), c.MinStations))
+	}
+	return result
+}
+
+// applies returns whether the rule should be checked.
+func (c Config) applies(rule Rule) bool {
+	policy := c.Policies[rule]
+	return policy != "" && policy != PolicyIgnore
+}
+
+func isNegative(sa bikepoint.StationAvailability) bool {
+	return sa.Station.Docks < 0 ||
+		sa.Availability.Docks < 0 ||
+		sa.Availability.Bicycles < 0 ||
+		sa.Availability.EBikes < 0
+}
+
+// isConsistent returns whether the station's available resources fit within
+// its docks. The converse does not hold, as docks may be out of service. A
+// station with 0 docks is assumed to have an unknown capacity, as GBFS's
+// `capacity` field is optional, so is consistent.
+func isConsistent(sa bikepoint.StationAvailability) bool {
+	return sa.Station.Docks == 0 ||
+		sa.Availability.Docks+sa.Availability.Bicycles+sa.Availability.EBikes <= sa.Station.Docks
+}
+
+// severity orders policies, so the strictest triggered is applied.
+func severity(policy Policy) int {
+	switch policy {
+	case PolicyDrop:
+		return 1
+	case PolicyLastGood:
+		return 2
+	case PolicyFail:
+		return 3
+	}
+	return 0
+}
+
+func newError(reason string) error {
+	return &bikepoint.Error{
+		Class: bikepoint.ClassValidation,
+		Err:   fmt.Errorf("validation failed: %v", reason),
+	}
+}
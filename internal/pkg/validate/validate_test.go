@@ -0,0 +1,396 @@
+package validate
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func station(id string, docks, emptyDocks, bicycles, eBikes int) bikepoint.StationAvailability {
+	return bikepoint.StationAvailability{
+		Station: bikepoint.Station{
+			ID:    id,
+			Name:  id,
+			Docks: docks,
+		},
+		Availability: bikepoint.Availability{
+			Docks:    emptyDocks,
+			Bicycles: bicycles,
+			EBikes:   eBikes,
+		},
+	}
+}
+
+// strictConfig drops invalid stations, and serves the last good snapshot if
+// there are too few.
+func strictConfig(minStations int) Config {
+	config := DefaultConfig()
+	config.MinStations = minStations
+	config.Policies = map[Rule]Policy{
+		RuleDuplicateID: PolicyDrop,
+		RuleNonNegative: PolicyDrop,
+		RuleConsistent:  PolicyDrop,
+		RuleMinStations: PolicyLastGood,
+	}
+	return config
+}
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{
+			name:   "default",
+			config: DefaultConfig(),
+		},
+		{
+			name:   "strict",
+			config: strictConfig(700),
+		},
+		{
+			name: "negative min stations",
+			config: Config{
+				MinStations:    -1,
+				LastGoodMaxAge: time.Minute,
+			},
+			wantErr: true,
+		},
+		{
+			name:    "no last good max age",
+			config:  Config{},
+			wantErr: true,
+		},
+		{
+			name: "unknown rule",
+			config: Config{
+				LastGoodMaxAge: time.Minute,
+				Policies: map[Rule]Policy{
+					"positive": PolicyDrop,
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown policy",
+			config: Config{
+				LastGoodMaxAge: time.Minute,
+				Policies: map[Rule]Policy{
+					RuleConsistent: "warn",
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "drop min stations",
+			config: Config{
+				LastGoodMaxAge: time.Minute,
+				Policies: map[Rule]Policy{
+					RuleMinStations: PolicyDrop,
+				},
+			},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			if err := test.config.Validate(); (err != nil) != test.wantErr {
+				t.Errorf("wanted error %v, got %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestValidator_Validate(t *testing.T) {
+	good := []bikepoint.StationAvailability{
+		station("1", 10, 5, 4, 1),
+		station("2", 20, 20, 0, 0),
+	}
+	tests := []struct {
+		name     string
+		config   Config
+		previous []bikepoint.StationAvailability
+		input    []bikepoint.StationAvailability
+		want     []bikepoint.StationAvailability
+		wantErr  bool
+	}{
+		{
+			name:   "valid",
+			config: DefaultConfig(),
+			input:  good,
+			want:   good,
+		},
+		{
+			name:   "drop negative",
+			config: strictConfig(0),
+			input: []bikepoint.StationAvailability{
+				station("1", 10, 5, 4, 1),
+				station("2", 20, -1, 0, 0),
+			},
+			want: []bikepoint.StationAvailability{
+				station("1", 10, 5, 4, 1),
+			},
+		},
+		{
+			name:   "drop inconsistent",
+			config: strictConfig(0),
+			input: []bikepoint.StationAvailability{
+				station("1", 10, 6, 4, 1),
+				station("2", 20, 20, 0, 0),
+			},
+			want: []bikepoint.StationAvailability{
+				station("2", 20, 20, 0, 0),
+			},
+		},
+		{
+			name:   "out of service docks are consistent",
+			config: strictConfig(0),
+			input: []bikepoint.StationAvailability{
+				station("1", 10, 2, 2, 0),
+			},
+			want: []bikepoint.StationAvailability{
+				station("1", 10, 2, 2, 0),
+			},
+		},
+		{
+			name:   "unknown capacity is consistent",
+			config: strictConfig(0),
+			input: []bikepoint.StationAvailability{
+				station("1", 0, 5, 4, 1),
+			},
+			want: []bikepoint.StationAvailability{
+				station("1", 0, 5, 4, 1),
+			},
+		},
+		{
+			name:   "default applies no rules",
+			config: DefaultConfig(),
+			input: []bikepoint.StationAvailability{
+				station("1", 10, 6, 4, 1),
+				station("1", 20, -1, 0, 0),
+			},
+			want: []bikepoint.StationAvailability{
+				station("1", 10, 6, 4, 1),
+				station("1", 20, -1, 0, 0),
+			},
+		},
+		{
+			name:   "drop duplicate",
+			config: strictConfig(0),
+			input: []bikepoint.StationAvailability{
+				station("1", 10, 5, 4, 1),
+				station("1", 20, 20, 0, 0),
+			},
+			want: []bikepoint.StationAvailability{
+				station("1", 10, 5, 4, 1),
+			},
+		},
+		{
+			name: "ignore",
+			config: Config{
+				Policies: map[Rule]Policy{
+					RuleConsistent: PolicyIgnore,
+				},
+			},
+			input: []bikepoint.StationAvailability{
+				station("1", 10, 6, 4, 1),
+			},
+			want: []bikepoint.StationAvailability{
+				station("1", 10, 6, 4, 1),
+			},
+		},
+		{
+			name: "fail",
+			config: Config{
+				Policies: map[Rule]Policy{
+					RuleNonNegative: PolicyFail,
+				},
+			},
+			input: []bikepoint.StationAvailability{
+				station("1", 10, 5, 4, 1),
+				station("2", -20, 0, 0, 0),
+			},
+			wantErr: true,
+		},
+		{
+			name: "too few stations",
+			config: Config{
+				MinStations: 3,
+				Policies: map[Rule]Policy{
+					RuleMinStations: PolicyFail,
+				},
+			},
+			input:   good,
+			wantErr: true,
+		},
+		{
+			name: "too few stations after drop",
+			config: Config{
+				MinStations:    2,
+				LastGoodMaxAge: time.Minute,
+				Policies: map[Rule]Policy{
+					RuleNonNegative: PolicyDrop,
+					RuleMinStations: PolicyFail,
+				},
+			},
+			input: []bikepoint.StationAvailability{
+				station("1", 10, 5, 4, 1),
+				station("2", 20, -1, 0, 0),
+			},
+			wantErr: true,
+		},
+		{
+			name: "last good",
+			config: Config{
+				MinStations:    2,
+				LastGoodMaxAge: time.Minute,
+				Policies: map[Rule]Policy{
+					RuleMinStations: PolicyLastGood,
+				},
+			},
+			previous: good,
+			input:    good[:1],
+			want:     good,
+		},
+		{
+			name: "last good unavailable",
+			config: Config{
+				MinStations:    2,
+				LastGoodMaxAge: time.Minute,
+				Policies: map[Rule]Policy{
+					RuleMinStations: PolicyLastGood,
+				},
+			},
+			input:   good[:1],
+			wantErr: true,
+		},
+		{
+			name: "fail takes precedence over last good",
+			config: Config{
+				MinStations:    2,
+				LastGoodMaxAge: time.Minute,
+				Policies: map[Rule]Policy{
+					RuleNonNegative: PolicyFail,
+					RuleMinStations: PolicyLastGood,
+				},
+			},
+			previous: good,
+			input: []bikepoint.StationAvailability{
+				station("1", -10, 5, 4, 1),
+			},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			v := New(test.config)
+			if test.previous != nil {
+				if _, _, err := v.Validate("tfl", test.previous); err != nil {
+					t.Fatalf("previous snapshot failed validation: %v", err)
+				}
+			}
+			got, stale, err := v.Validate("tfl", test.input)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("wanted error, got %v", got)
+				}
+				if class := bikepoint.ClassOf(err); class != bikepoint.ClassValidation {
+					t.Errorf("wanted %v error, got %v", bikepoint.ClassValidation, class)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+			if wantStale := test.previous != nil; stale != wantStale {
+				t.Errorf("wanted stale %v, got %v", wantStale, stale)
+			}
+		})
+	}
+}
+
+func TestValidator_ValidateSystemsIndependent(t *testing.T) {
+	t.Parallel()
+
+	v := New(Config{
+		MinStations:    1,
+		LastGoodMaxAge: time.Minute,
+		Policies: map[Rule]Policy{
+			RuleMinStations: PolicyLastGood,
+		},
+	})
+	if _, _, err := v.Validate("tfl", []bikepoint.StationAvailability{
+		station("1", 10, 5, 4, 1),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _, err := v.Validate("other", nil); err == nil {
+		t.Errorf("wanted error, got last good snapshot of another system: %v", got)
+	}
+}
+
+func TestConfig_Check(t *testing.T) {
+	t.Parallel()
+
+	got := strictConfig(3).Check([]bikepoint.StationAvailability{
+		station("1", 10, 5, 4, 1),
+		station("1", 10, 5, 4, 1),
+		station("2", 10, 6, 4, 1),
+		station("3", 10, -1, 0, 0),
+	})
+	want := []Violation{
+		{RuleDuplicateID, PolicyDrop, "1"},
+		{RuleConsistent, PolicyDrop, "2"},
+		{RuleNonNegative, PolicyDrop, "3"},
+		{RuleMinStations, PolicyLastGood, "got 1 stations, wanted at least 3"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestValidator_ValidateLastGoodMaxAge(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1709510400, 0)
+	v := New(strictConfig(2))
+	v.now = func() time.Time {
+		return now
+	}
+	good := []bikepoint.StationAvailability{
+		station("1", 10, 5, 4, 1),
+		station("2", 20, 20, 0, 0),
+	}
+	if _, _, err := v.Validate("last-good-max-age", good); err != nil {
+		t.Fatal(err)
+	}
+	servingLastGood := servingLastGood.WithLabelValues("last-good-max-age")
+
+	now = now.Add(v.LastGoodMaxAge)
+	if _, stale, err := v.Validate("last-good-max-age", good[:1]); err != nil || !stale {
+		t.Fatalf("wanted last good snapshot, got stale %v, error %v", stale, err)
+	}
+	if got := testutil.ToFloat64(servingLastGood); got != 1 {
+		t.Errorf("wanted serving last good gauge 1, got %v", got)
+	}
+
+	now = now.Add(time.Second)
+	if got, _, err := v.Validate("last-good-max-age", good[:1]); err == nil {
+		t.Errorf("wanted error, got expired last good snapshot: %v", got)
+	}
+	if got := testutil.ToFloat64(servingLastGood); got != 0 {
+		t.Errorf("wanted serving last good gauge 0, got %v", got)
+	}
+}
@@ -0,0 +1,191 @@
+// Package watch polls systems for snapshots in the background, passing each
+// to observers such as the history store, notifier and push outputs. This
+// allows features that act on snapshots to share one stream of requests to
+// the upstream APIs.
+package watch
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	polls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tflcycles_exporter_watch_polls_total",
+		Help: "The number of background polls of station availability, by whether any system was fetched.",
+	}, []string{"result"})
+)
+
+func init() {
+	for _, result := range []string{"success", "failure"} {
+		polls.WithLabelValues(result)
+	}
+}
+
+// FetchFunc returns the stations of each system, keyed by name, omitting
+// those that could not be fetched. exporter.Exporter.Fetch() is an
+// implementation, which validates and audits fetches as scrapes do.
+type FetchFunc func(context.Context) map[string][]bikepoint.StationAvailability
+
+// SystemsObserver receives the snapshots of every system from Poll().
+// Observers are called in turn, so should not block for longer than the poll
+// interval.
+type SystemsObserver interface {
+
+	// ObserveSystems is called with each poll's snapshots, keyed by system
+	// name, and the time they were fetched. Systems that failed to fetch are
+	// omitted. Implementations must not modify or retain the map or slices.
+	ObserveSystems(ctx context.Context, t time.Time, systems map[string][]bikepoint.StationAvailability)
+}
+
+// SystemsObserverFunc adapts a function to the SystemsObserver interface.
+type SystemsObserverFunc func(ctx context.Context, t time.Time, systems map[string][]bikepoint.StationAvailability)
+
+func (f SystemsObserverFunc) ObserveSystems(ctx context.Context, t time.Time, systems map[string][]bikepoint.StationAvailability) {
+	f(ctx, t, systems)
+}
+
+// Observer receives the snapshots of a single system, such as the history
+// store and notifier. Use ForSystem() to pass it to Poll().
+type Observer interface {
+
+	// Observe is called with each snapshot, and the time it was fetched.
+	// Implementations must not modify or retain the slice.
+	Observe(ctx context.Context, t time.Time, stationAvailabilities []bikepoint.StationAvailability)
+}
+
+// ObserverFunc adapts a function to the Observer interface.
+type ObserverFunc func(ctx context.Context, t time.Time, stationAvailabilities []bikepoint.StationAvailability)
+
+func (f ObserverFunc) Observe(ctx context.Context, t time.Time, stationAvailabilities []bikepoint.StationAvailability) {
+	f(ctx, t, stationAvailabilities)
+}
+
+// ForSystem passes the named system's snapshots to observer. Polls in which
+// the system failed to fetch are skipped.
+func ForSystem(system string, observer Observer) SystemsObserver {
+	return SystemsObserverFunc(func(ctx context.Context, t time.Time, systems map[string][]bikepoint.StationAvailability) {
+		if stationAvailabilities, ok := systems[system]; ok {
+			observer.Observe(ctx, t, stationAvailabilities)
+		}
+	})
+}
+
+// Poll fetches every system every interval until the context is cancelled,
+// passing the snapshots to the observers. Each fetch may take up to the
+// interval. Failures are logged by fetch, and the systems omitted from the
+// snapshots passed to observers, which may be empty.
+func Poll(ctx context.Context, logger *slog.Logger, fetch FetchFunc, interval time.Duration, observers ...SystemsObserver) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		poll(ctx, logger, fetch, interval, observers)
+		select {
+		case <-ticker.C:
+			// Both may be ready, in which case either can be chosen.
+			if ctx.Err() != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func poll(ctx context.Context, logger *slog.Logger, fetch FetchFunc, timeout time.Duration, observers []SystemsObserver) {
+	fetchCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	systems := fetch(fetchCtx)
+	if len(systems) == 0 {
+		polls.WithLabelValues("failure").Inc()
+		logger.WarnContext(ctx, "failed to fetch any system in background")
+	} else {
+		polls.WithLabelValues("success").Inc()
+	}
+	now := time.Now()
+	for _, observer := range observers {
+		observer.ObserveSystems(ctx, now, systems)
+	}
+}
+
+// Change is a station that was added, removed or modified between two
+// snapshots. Changes to Modified alone are ignored.
+type Change struct {
+
+	// Previous is nil if the station was added.
+	Previous *bikepoint.StationAvailability
+
+	// Current is nil if the station was removed.
+	Current *bikepoint.StationAvailability
+}
+
+// ID returns the ID of the changed station.
+func (c Change) ID() string {
+	if c.Current != nil {
+		return c.Current.Station.ID
+	}
+	return c.Previous.Station.ID
+}
+
+// Diff returns the changes from previous to current, in the order of current,
+// followed by removed stations in the order of previous. The returned
+// pointers refer to elements of the inputs.
+func Diff(previous, current []bikepoint.StationAvailability) []Change {
+	byID := make(map[string]*bikepoint.StationAvailability, len(previous))
+	for i := range previous {
+		byID[previous[i].Station.ID] = &previous[i]
+	}
+	var changes []Change
+	seen := make(map[string]struct{}, len(current))
+	for i := range current {
+		sa := &current[i]
+		seen[sa.Station.ID] = struct{}{}
+		before, ok := byID[sa.Station.ID]
+		switch {
+		case !ok:
+			changes = append(changes, Change{Current: sa})
+		case before.Station != sa.Station || before.Availability != sa.Availability:
+			changes = append(changes, Change{Previous: before, Current: sa})
+		}
+	}
+	for i := range previous {
+		if _, ok := seen[previous[i].Station.ID]; !ok {
+			changes = append(changes, Change{Previous: &previous[i]})
+		}
+	}
+	return changes
+}
+
+// Differ diffs each snapshot of a system against the one before it. The zero
+// value has seen no snapshots, and is ready to use. It is not safe for
+// concurrent use.
+type Differ struct {
+	previous []bikepoint.StationAvailability // nil before the first snapshot
+}
+
+// Next returns the changes from the previous snapshot to current, as Diff()
+// does, and retains a copy of current to diff the next snapshot against.
+// Every station in current is added if there was no previous snapshot. The
+// copy is never modified, so pointers into previous snapshots remain valid.
+func (d *Differ) Next(current []bikepoint.StationAvailability) []Change {
+	changes := Diff(d.previous, current)
+	d.previous = slices.Clone(current)
+	if d.previous == nil {
+		d.previous = []bikepoint.StationAvailability{}
+	}
+	return changes
+}
+
+// Snapshot returns the snapshot last passed to Next(), or nil if there has
+// not been one. It must not be modified.
+func (d *Differ) Snapshot() []bikepoint.StationAvailability {
+	return d.previous
+}
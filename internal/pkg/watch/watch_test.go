@@ -0,0 +1,165 @@
+package watch
+
+import (
+	"context"
+	"log/slog"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gebn/tflcycles_exporter/internal/pkg/bikepoint"
+)
+
+func station(id string, bicycles int) bikepoint.StationAvailability {
+	return bikepoint.StationAvailability{
+		Station: bikepoint.Station{
+			ID:    id,
+			Name:  id,
+			Docks: 10,
+		},
+		Availability: bikepoint.Availability{
+			Docks:    10 - bicycles,
+			Bicycles: bicycles,
+		},
+	}
+}
+
+func TestDiff(t *testing.T) {
+	t.Parallel()
+
+	previous := []bikepoint.StationAvailability{
+		station("1", 1),
+		station("2", 2),
+		station("3", 3),
+	}
+	touched := station("1", 1)
+	touched.Modified = time.Unix(1, 0)
+	current := []bikepoint.StationAvailability{
+		station("4", 4),
+		touched,
+		station("2", 5),
+	}
+	type change struct {
+		id       string
+		previous int
+		current  int
+	}
+	var got []change
+	for _, c := range Diff(previous, current) {
+		got = append(got, change{
+			id:       c.ID(),
+			previous: bicycles(c.Previous),
+			current:  bicycles(c.Current),
+		})
+	}
+	want := []change{
+		{"4", -1, 4},
+		{"2", 2, 5},
+		{"3", 3, -1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// bicycles returns the number of bicycles at the station, or -1 if nil.
+func bicycles(sa *bikepoint.StationAvailability) int {
+	if sa == nil {
+		return -1
+	}
+	return sa.Availability.Bicycles
+}
+
+func TestDiffer(t *testing.T) {
+	t.Parallel()
+
+	var d Differ
+	if d.Snapshot() != nil {
+		t.Fatal("wanted no snapshot before the first")
+	}
+	if changes := d.Next(nil); len(changes) != 0 {
+		t.Errorf("got %v changes to an empty first snapshot, want 0", len(changes))
+	}
+	if d.Snapshot() == nil {
+		t.Error("wanted an empty snapshot to be retained")
+	}
+
+	current := []bikepoint.StationAvailability{station("1", 1)}
+	d.Next(current)
+	// Reusing the caller's slice must not affect the retained copy.
+	current[0] = station("1", 2)
+	changes := d.Next(current)
+	if len(changes) != 1 {
+		t.Fatalf("got %v changes, want 1", len(changes))
+	}
+	if got := bicycles(changes[0].Previous); got != 1 {
+		t.Errorf("got %v previous bicycles, want 1", got)
+	}
+	if got := d.Snapshot()[0].Availability.Bicycles; got != 2 {
+		t.Errorf("got %v retained bicycles, want 2", got)
+	}
+}
+
+func TestPoll(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	observed := make(chan int, 10)
+	calls := atomic.Int32{}
+	fetch := func(context.Context) map[string][]bikepoint.StationAvailability {
+		if calls.Add(1) == 2 {
+			return map[string][]bikepoint.StationAvailability{}
+		}
+		return map[string][]bikepoint.StationAvailability{
+			"tfl":   {station("1", 1)},
+			"other": {station("2", 2), station("3", 3)},
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Poll(ctx, slog.Default(), fetch, time.Millisecond, ForSystem("tfl", ObserverFunc(
+			func(_ context.Context, _ time.Time, stationAvailabilities []bikepoint.StationAvailability) {
+				observed <- len(stationAvailabilities)
+				if len(observed) == 2 {
+					cancel()
+				}
+			})))
+	}()
+	<-done
+	// The failed fetch in between is skipped.
+	if calls := calls.Load(); calls != 3 {
+		t.Errorf("wanted 3 fetches, got %v", calls)
+	}
+	if len(observed) != 2 {
+		t.Errorf("wanted 2 snapshots, got %v", len(observed))
+	}
+	for len(observed) > 0 {
+		if n := <-observed; n != 1 {
+			t.Errorf("wanted only the tfl system's station, got %v stations", n)
+		}
+	}
+}
+
+func TestForSystem(t *testing.T) {
+	t.Parallel()
+
+	observed := 0
+	observer := ForSystem("tfl", ObserverFunc(
+		func(context.Context, time.Time, []bikepoint.StationAvailability) {
+			observed++
+		}))
+	observer.ObserveSystems(context.Background(), time.Now(), map[string][]bikepoint.StationAvailability{
+		"other": {station("1", 1)},
+	})
+	if observed != 0 {
+		t.Error("observed a snapshot of another system")
+	}
+	observer.ObserveSystems(context.Background(), time.Now(), map[string][]bikepoint.StationAvailability{
+		"tfl": {station("1", 1)},
+	})
+	if observed != 1 {
+		t.Errorf("wanted 1 snapshot, got %v", observed)
+	}
+}